@@ -0,0 +1,46 @@
+package file
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+)
+
+// NewDeadLetterSink returns a run.DeadLetterSink appending the dead letters to the file as JSON lines.
+// The file is created when missing, and synced after every write.
+func NewDeadLetterSink(path string) (*DeadLetterSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeadLetterSink{file: f}, nil
+}
+
+type DeadLetterSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (s *DeadLetterSink) Send(deadLetter run.DeadLetter) error {
+	line, err := json.Marshal(deadLetter)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	return s.file.Sync()
+}
+
+func (s *DeadLetterSink) Close() error {
+	return s.file.Close()
+}
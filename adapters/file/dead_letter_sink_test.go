@@ -0,0 +1,66 @@
+package file_test
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lorenzoranucci/tor/adapters/file"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetterSink_Send(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead_letters.jsonl")
+
+	s, err := file.NewDeadLetterSink(path)
+	require.NoError(t, err)
+
+	for _, pos := range []uint32{400, 800} {
+		err = s.Send(run.DeadLetter{
+			Schema:   "my_schema",
+			Table:    "outbox",
+			Position: run.Position{File: "mysql-bin.000001", Offset: pos},
+			Columns:  []run.Column{{Name: []byte("payload"), Value: nil}},
+			Err:      errors.New("payload Column not found"),
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	// reopening appends to the existing file
+	s, err = file.NewDeadLetterSink(path)
+	require.NoError(t, err)
+	require.NoError(t, s.Send(run.DeadLetter{Position: run.Position{File: "mysql-bin.000002", Offset: 4}}))
+	require.NoError(t, s.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.NoError(t, scanner.Err())
+
+	require.Len(t, lines, 3)
+	assert.JSONEq(
+		t,
+		`{
+			"schema": "my_schema",
+			"table": "outbox",
+			"binlog_file": "mysql-bin.000001",
+			"binlog_pos": 800,
+			"timestamp": 0,
+			"error": "payload Column not found",
+			"attempts": 0,
+			"columns": {"payload": null}
+		}`,
+		lines[1],
+	)
+}
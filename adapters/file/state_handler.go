@@ -0,0 +1,84 @@
+package file
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+)
+
+// NewStateHandler returns a run.StateHandler storing the checkpoint in the file at path.
+// The file is replaced atomically: the checkpoint is written and synced to a temporary file in the same directory,
+// which is then renamed to path.
+func NewStateHandler(path string) *StateHandler {
+	return &StateHandler{path: path}
+}
+
+type StateHandler struct {
+	path string
+}
+
+func (s *StateHandler) GetLastCheckpoint() (run.Checkpoint, error) {
+	c, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (s *StateHandler) SetLastCheckpoint(c run.Checkpoint) error {
+	dir, name := filepath.Split(s.path)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	err = writeAndSync(f, c)
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	err = os.Rename(f.Name(), s.path)
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func writeAndSync(f *os.File, b []byte) error {
+	_, err := f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+// syncDir makes the rename durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
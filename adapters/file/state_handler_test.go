@@ -0,0 +1,56 @@
+package file_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lorenzoranucci/tor/adapters/file"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/lorenzoranucci/tor/router/pkg/run/runtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateHandler(t *testing.T) {
+	runtest.StateHandlerSuite(t, func(t *testing.T) run.StateHandler {
+		return file.NewStateHandler(filepath.Join(t.TempDir(), "checkpoint"))
+	})
+}
+
+func TestStateHandler_SetLastCheckpointReplacesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "checkpoint")
+
+	s := file.NewStateHandler(path)
+
+	c, err := s.GetLastCheckpoint()
+	require.NoError(t, err)
+	assert.Empty(t, c)
+
+	c1, err := run.EncodeCheckpoint(run.Position{File: "mysql-bin.000001", Offset: 200})
+	require.NoError(t, err)
+	c2, err := run.EncodeCheckpoint(run.Position{File: "mysql-bin.000002", Offset: 4})
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetLastCheckpoint(c1))
+	require.NoError(t, s.SetLastCheckpoint(c2))
+
+	// a new handler reads the checkpoint persisted by the former one
+	c, err = file.NewStateHandler(path).GetLastCheckpoint()
+	require.NoError(t, err)
+	assert.Equal(t, c2, c)
+
+	// no temporary file is left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "checkpoint", entries[0].Name())
+}
+
+func TestStateHandler_SetLastCheckpointMissingDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "checkpoint")
+
+	err := file.NewStateHandler(path).SetLastCheckpoint(run.NewCheckpoint(run.CheckpointV1, []byte("{}")))
+	assert.Error(t, err)
+}
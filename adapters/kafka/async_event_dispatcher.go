@@ -0,0 +1,142 @@
+package kafka
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/Shopify/sarama"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+)
+
+// NewAsyncEventDispatcher returns an EventDispatcher that pipelines messages through a sarama.AsyncProducer,
+// which batches them according to its Producer.Flush configuration.
+// The producer must return both successes and errors. To preserve the order of messages with the same key
+// it must be idempotent, which implies Net.MaxOpenRequests=1 (see NewAsyncProducerConfig).
+func NewAsyncEventDispatcher(
+	asyncProducer sarama.AsyncProducer,
+	admin sarama.ClusterAdmin,
+	routing Routing,
+	headerMappings []HeaderMapping,
+	envelope Envelope,
+	serializer *SchemaRegistrySerializer,
+	transactionMetadata TransactionMetadata,
+) (*AsyncEventDispatcher, error) {
+	mm, err := newMessageMapper(admin, routing, headerMappings, envelope, serializer, transactionMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &AsyncEventDispatcher{
+		asyncProducer: asyncProducer,
+		admin:         admin,
+		messageMapper: mm,
+	}
+
+	d.wg.Add(2)
+	go d.readSuccesses()
+	go d.readErrors()
+
+	return d, nil
+}
+
+// NewAsyncProducerConfig returns a configuration for the producer of an AsyncEventDispatcher
+// preserving the order of messages with the same key.
+func NewAsyncProducerConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_11_0_0
+	config.Producer.Idempotent = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Retry.Max = 10
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Net.MaxOpenRequests = 1
+	config.Metadata.AllowAutoTopicCreation = false
+
+	return config
+}
+
+type AsyncEventDispatcher struct {
+	messageMapper
+
+	asyncProducer sarama.AsyncProducer
+	admin         sarama.ClusterAdmin
+	wg            sync.WaitGroup
+}
+
+// delivery tracks the messages produced for a single event, which is acknowledged once all of them are.
+type delivery struct {
+	remaining int32
+	failed    int32
+	ack       func(error)
+}
+
+func (d *delivery) done(err error) {
+	if err != nil {
+		if atomic.CompareAndSwapInt32(&d.failed, 0, 1) {
+			d.ack(err)
+		}
+		atomic.AddInt32(&d.remaining, -1)
+		return
+	}
+
+	if atomic.AddInt32(&d.remaining, -1) == 0 && atomic.LoadInt32(&d.failed) == 0 {
+		d.ack(nil)
+	}
+}
+
+func (k *AsyncEventDispatcher) DispatchAsync(event run.OutboxEvent, ack func(error)) error {
+	messages, err := k.mapMessages(event)
+	if err != nil {
+		return err
+	}
+
+	if len(messages) == 0 {
+		ack(nil)
+		return nil
+	}
+
+	d := &delivery{remaining: int32(len(messages)), ack: ack}
+	for _, m := range messages {
+		m.Metadata = d
+		k.asyncProducer.Input() <- m
+	}
+
+	return nil
+}
+
+// Dispatch writes the event and waits for its delivery.
+func (k *AsyncEventDispatcher) Dispatch(event run.OutboxEvent) error {
+	errCh := make(chan error, 1)
+	err := k.DispatchAsync(event, func(err error) {
+		errCh <- err
+	})
+	if err != nil {
+		return err
+	}
+
+	return <-errCh
+}
+
+// Close flushes the buffered messages, waits for their acknowledgements and closes the producer.
+func (k *AsyncEventDispatcher) Close() error {
+	k.asyncProducer.AsyncClose()
+	k.wg.Wait()
+
+	return k.admin.Close()
+}
+
+func (k *AsyncEventDispatcher) readSuccesses() {
+	defer k.wg.Done()
+
+	for m := range k.asyncProducer.Successes() {
+		m.Metadata.(*delivery).done(nil)
+	}
+}
+
+func (k *AsyncEventDispatcher) readErrors() {
+	defer k.wg.Done()
+
+	for pe := range k.asyncProducer.Errors() {
+		pe.Msg.Metadata.(*delivery).done(pe.Err)
+	}
+}
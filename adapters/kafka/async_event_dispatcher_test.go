@@ -0,0 +1,99 @@
+package kafka_test
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/lorenzoranucci/tor/adapters/kafka"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsyncEventDispatcher_DispatchAsync(t *testing.T) {
+	expectedErr := errors.New("a")
+
+	tests := []struct {
+		name          string
+		aggregateType string
+		expect        func(p *mocks.AsyncProducer)
+		wantAckErr    error
+	}{
+		{
+			name:          "when every message is delivered then event is acknowledged",
+			aggregateType: "order",
+			expect: func(p *mocks.AsyncProducer) {
+				p.ExpectInputAndSucceed().ExpectInputAndSucceed()
+			},
+		},
+		{
+			name:          "when a message is not delivered then event is acknowledged with error",
+			aggregateType: "order",
+			expect: func(p *mocks.AsyncProducer) {
+				p.ExpectInputAndSucceed().ExpectInputAndFail(expectedErr)
+			},
+			wantAckErr: expectedErr,
+		},
+		{
+			name:          "when no topic matches then event is acknowledged",
+			aggregateType: "invoice",
+			expect:        func(p *mocks.AsyncProducer) {},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := mocks.NewAsyncProducer(t, kafka.NewAsyncProducerConfig())
+			tt.expect(p)
+
+			d, err := kafka.NewAsyncEventDispatcher(
+				p,
+				&clusterAdminMock{},
+				kafka.Routing{Topics: []kafka.Topic{
+					{Name: "order", AggregateType: regexp.MustCompile("^order$")},
+					{Name: "all", AggregateType: regexp.MustCompile("(?i)^order")},
+				}},
+				nil,
+				nil,
+				nil,
+				kafka.TransactionMetadata{},
+			)
+			require.NoError(t, err)
+
+			ackCh := make(chan error, 2)
+			err = d.DispatchAsync(
+				run.OutboxEvent{AggregateType: []byte(tt.aggregateType)},
+				func(err error) {
+					ackCh <- err
+				},
+			)
+			require.NoError(t, err)
+
+			select {
+			case err := <-ackCh:
+				assert.Equal(t, tt.wantAckErr, err)
+			case <-time.After(time.Second):
+				t.Fatal("event not acknowledged")
+			}
+
+			require.NoError(t, d.Close())
+			assert.Empty(t, ackCh, "event acknowledged more than once")
+		})
+	}
+}
+
+type clusterAdminMock struct {
+	sarama.ClusterAdmin
+}
+
+func (c *clusterAdminMock) DescribeTopics([]string) ([]*sarama.TopicMetadata, error) {
+	return nil, nil
+}
+
+func (c *clusterAdminMock) Close() error {
+	return nil
+}
@@ -0,0 +1,373 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// avroEncoder encodes JSON values with an Avro schema. Values are plain JSON, unions are not wrapped in an object
+// naming the branch as in the Avro JSON encoding: the first branch matching the value is used.
+type avroEncoder struct {
+	header []byte
+	codec  *goavro.Codec
+	schema interface{}
+	// names are the named types of the schema by full name.
+	names map[string]map[string]interface{}
+}
+
+func newAvroEncoder(schemaID uint32, schema string) (*avroEncoder, error) {
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &avroEncoder{
+		header: wireFormatHeader(schemaID),
+		codec:  codec,
+		names:  map[string]map[string]interface{}{},
+	}
+
+	err = json.Unmarshal([]byte(schema), &e.schema)
+	if err != nil {
+		return nil, err
+	}
+	e.registerNames(e.schema, "")
+
+	return e, nil
+}
+
+func (e *avroEncoder) encode(value []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(value))
+	d.UseNumber()
+
+	var v interface{}
+	err := d.Decode(&v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrIncompatibleValue, err)
+	}
+
+	native, err := e.native(e.schema, "", v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrIncompatibleValue, err)
+	}
+
+	b, err := e.codec.BinaryFromNative(append([]byte(nil), e.header...), native)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrIncompatibleValue, err)
+	}
+
+	return b, nil
+}
+
+func (e *avroEncoder) registerNames(schema interface{}, namespace string) {
+	switch s := schema.(type) {
+	case []interface{}:
+		for _, b := range s {
+			e.registerNames(b, namespace)
+		}
+	case map[string]interface{}:
+		switch s["type"] {
+		case "record", "error", "enum", "fixed":
+			name := avroFullName(s, namespace)
+			e.names[name] = s
+			namespace = avroNamespace(name)
+		}
+
+		if fields, ok := s["fields"].([]interface{}); ok {
+			for _, f := range fields {
+				if fm, ok := f.(map[string]interface{}); ok {
+					e.registerNames(fm["type"], namespace)
+				}
+			}
+		}
+		for _, k := range []string{"type", "items", "values"} {
+			if t, ok := s[k].(map[string]interface{}); ok {
+				e.registerNames(t, namespace)
+			}
+			if t, ok := s[k].([]interface{}); ok {
+				e.registerNames(t, namespace)
+			}
+		}
+	}
+}
+
+// native converts the JSON value to the native form of goavro for the schema.
+func (e *avroEncoder) native(schema interface{}, namespace string, v interface{}) (interface{}, error) {
+	switch s := schema.(type) {
+	case string:
+		if named, ok := e.lookup(s, namespace); ok {
+			return e.native(named, namespace, v)
+		}
+
+		return avroPrimitive(s, "", v)
+	case []interface{}:
+		return e.union(s, namespace, v)
+	case map[string]interface{}:
+		t, _ := s["type"].(string)
+		switch t {
+		case "record", "error":
+			name := avroFullName(s, namespace)
+			return e.record(s, avroNamespace(name), v)
+		case "enum":
+			if _, ok := v.(string); !ok {
+				return nil, fmt.Errorf("expected enum symbol, got %v", v)
+			}
+			return v, nil
+		case "fixed":
+			return avroPrimitive("bytes", "", v)
+		case "array":
+			a, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected array, got %v", v)
+			}
+			r := make([]interface{}, 0, len(a))
+			for _, item := range a {
+				n, err := e.native(s["items"], namespace, item)
+				if err != nil {
+					return nil, err
+				}
+				r = append(r, n)
+			}
+			return r, nil
+		case "map":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected map, got %v", v)
+			}
+			r := make(map[string]interface{}, len(m))
+			for k, item := range m {
+				n, err := e.native(s["values"], namespace, item)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", k, err)
+				}
+				r[k] = n
+			}
+			return r, nil
+		default:
+			logicalType, _ := s["logicalType"].(string)
+			if _, ok := s["type"].(string); !ok {
+				return e.native(s["type"], namespace, v)
+			}
+			return avroPrimitive(t, logicalType, v)
+		}
+	default:
+		return nil, fmt.Errorf("invalid schema: %v", schema)
+	}
+}
+
+func (e *avroEncoder) record(s map[string]interface{}, namespace string, v interface{}) (interface{}, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected object, got %v", v)
+	}
+
+	fields, _ := s["fields"].([]interface{})
+	known := make(map[string]struct{}, len(fields))
+	r := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		fm, _ := f.(map[string]interface{})
+		name, _ := fm["name"].(string)
+		known[name] = struct{}{}
+
+		fv, ok := m[name]
+		if !ok {
+			// goavro uses the default of the field, if any
+			continue
+		}
+
+		n, err := e.native(fm["type"], namespace, fv)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		r[name] = n
+	}
+
+	for name := range m {
+		if _, ok := known[name]; !ok {
+			return nil, fmt.Errorf("unknown field: %s", name)
+		}
+	}
+
+	return r, nil
+}
+
+func (e *avroEncoder) union(branches []interface{}, namespace string, v interface{}) (interface{}, error) {
+	for _, b := range branches {
+		if v == nil {
+			if b == "null" {
+				return nil, nil
+			}
+			continue
+		}
+
+		if b == "null" {
+			continue
+		}
+
+		n, err := e.native(b, namespace, v)
+		if err != nil {
+			continue
+		}
+
+		return goavro.Union(e.branchName(b, namespace), n), nil
+	}
+
+	return nil, fmt.Errorf("no union branch matches %v", v)
+}
+
+// branchName returns the name identifying the branch of a union in goavro.
+func (e *avroEncoder) branchName(schema interface{}, namespace string) string {
+	switch s := schema.(type) {
+	case string:
+		if _, ok := e.lookup(s, namespace); ok {
+			if strings.Contains(s, ".") || namespace == "" {
+				return s
+			}
+			return namespace + "." + s
+		}
+		return s
+	case map[string]interface{}:
+		t, _ := s["type"].(string)
+		switch t {
+		case "record", "error", "enum", "fixed":
+			return avroFullName(s, namespace)
+		}
+		if logicalType, ok := s["logicalType"].(string); ok {
+			return t + "." + logicalType
+		}
+		return t
+	default:
+		return ""
+	}
+}
+
+func (e *avroEncoder) lookup(name string, namespace string) (map[string]interface{}, bool) {
+	if s, ok := e.names[name]; ok {
+		return s, true
+	}
+
+	if namespace != "" {
+		s, ok := e.names[namespace+"."+name]
+		return s, ok
+	}
+
+	return nil, false
+}
+
+func avroPrimitive(t string, logicalType string, v interface{}) (interface{}, error) {
+	switch t {
+	case "null":
+		if v != nil {
+			return nil, fmt.Errorf("expected null, got %v", v)
+		}
+		return nil, nil
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return nil, fmt.Errorf("expected boolean, got %v", v)
+		}
+		return v, nil
+	case "int", "long":
+		if s, ok := v.(string); ok && (logicalType == "date" || strings.HasPrefix(logicalType, "timestamp-")) {
+			layout := time.RFC3339Nano
+			if logicalType == "date" {
+				layout = "2006-01-02"
+			}
+			tv, err := time.Parse(layout, s)
+			if err != nil {
+				return nil, err
+			}
+			return tv, nil
+		}
+
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("expected %s, got %v", t, v)
+		}
+		i, err := n.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("expected %s, got %v", t, v)
+		}
+		if t == "int" {
+			if i < math.MinInt32 || i > math.MaxInt32 {
+				return nil, fmt.Errorf("int out of range: %v", v)
+			}
+			return int32(i), nil
+		}
+		return i, nil
+	case "float", "double":
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("expected %s, got %v", t, v)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, err
+		}
+		if t == "float" {
+			return float32(f), nil
+		}
+		return f, nil
+	case "bytes":
+		if logicalType == "decimal" {
+			var s string
+			switch d := v.(type) {
+			case json.Number:
+				s = d.String()
+			case string:
+				s = d
+			default:
+				return nil, fmt.Errorf("expected decimal, got %v", v)
+			}
+			r, ok := new(big.Rat).SetString(s)
+			if !ok {
+				return nil, fmt.Errorf("expected decimal, got %v", v)
+			}
+			return r, nil
+		}
+
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected bytes, got %v", v)
+		}
+		return []byte(s), nil
+	case "string":
+		if _, ok := v.(string); !ok {
+			return nil, fmt.Errorf("expected string, got %v", v)
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unknown type: %s", t)
+	}
+}
+
+func avroFullName(s map[string]interface{}, namespace string) string {
+	name, _ := s["name"].(string)
+	if strings.Contains(name, ".") {
+		return name
+	}
+
+	if ns, ok := s["namespace"].(string); ok {
+		namespace = ns
+	}
+	if namespace == "" {
+		return name
+	}
+
+	return namespace + "." + name
+}
+
+func avroNamespace(fullName string) string {
+	i := strings.LastIndex(fullName, ".")
+	if i < 0 {
+		return ""
+	}
+
+	return fullName[:i]
+}
@@ -0,0 +1,70 @@
+package kafka
+
+import (
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+)
+
+const deadLetterErrorHeader = "tor_dead_letter_error"
+
+// NewDeadLetterSink returns a run.DeadLetterSink writing the dead letters as JSON on the topic, which is created
+// when missing. Messages are keyed by aggregate ID when the row could be mapped, and carry the failure in headers.
+func NewDeadLetterSink(
+	syncProducer sarama.SyncProducer,
+	admin sarama.ClusterAdmin,
+	topic Topic,
+) (*DeadLetterSink, error) {
+	err := createTopics([]Topic{topic}, admin)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeadLetterSink{syncProducer: syncProducer, topic: topic.Name}, nil
+}
+
+type DeadLetterSink struct {
+	syncProducer sarama.SyncProducer
+	topic        string
+}
+
+func (s *DeadLetterSink) Send(deadLetter run.DeadLetter) error {
+	value, err := json.Marshal(deadLetter)
+	if err != nil {
+		return err
+	}
+
+	reason := "unmapped"
+	if deadLetter.Event != nil {
+		reason = "undispatched"
+	}
+
+	m := &sarama.ProducerMessage{
+		Topic: s.topic,
+		Value: sarama.ByteEncoder(value),
+		Headers: []sarama.RecordHeader{
+			deadLetterHeader(reason),
+		},
+	}
+
+	if deadLetter.Event != nil {
+		m.Key = sarama.ByteEncoder(deadLetter.Event.AggregateID)
+	}
+
+	if deadLetter.Err != nil {
+		m.Headers = append(m.Headers, sarama.RecordHeader{
+			Key:   []byte(deadLetterErrorHeader),
+			Value: []byte(deadLetter.Err.Error()),
+		})
+	}
+
+	_, _, err = s.syncProducer.SendMessage(m)
+
+	return err
+}
+
+// Close closes the producer. The admin is left open since it is usually shared with a dispatcher.
+func (s *DeadLetterSink) Close() error {
+	return s.syncProducer.Close()
+}
@@ -0,0 +1,71 @@
+package kafka_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/lorenzoranucci/tor/adapters/kafka"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetterSink_Send(t *testing.T) {
+	tests := []struct {
+		name        string
+		deadLetter  run.DeadLetter
+		wantKey     sarama.Encoder
+		wantHeaders []sarama.RecordHeader
+	}{
+		{
+			name: "when row could not be mapped then message has no key",
+			deadLetter: run.DeadLetter{
+				Schema:   "my_schema",
+				Table:    "outbox",
+				Position: run.Position{File: "mysql-bin.000001", Offset: 400},
+				Err:      errors.New("payload Column not found"),
+			},
+			wantHeaders: []sarama.RecordHeader{
+				{Key: []byte("tor_dead_letter_reason"), Value: []byte("unmapped")},
+				{Key: []byte("tor_dead_letter_error"), Value: []byte("payload Column not found")},
+			},
+		},
+		{
+			name: "when event could not be dispatched then message is keyed by aggregate id",
+			deadLetter: run.DeadLetter{
+				Schema:   "my_schema",
+				Table:    "outbox",
+				Position: run.Position{File: "mysql-bin.000001", Offset: 400},
+				Event:    &run.OutboxEvent{AggregateID: []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c")},
+				Err:      errors.New("message too large"),
+				Attempts: 3,
+			},
+			wantKey: sarama.ByteEncoder("c44ade3e-9394-4e6e-8d2d-20707d61061c"),
+			wantHeaders: []sarama.RecordHeader{
+				{Key: []byte("tor_dead_letter_reason"), Value: []byte("undispatched")},
+				{Key: []byte("tor_dead_letter_error"), Value: []byte("message too large")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := mocks.NewSyncProducer(t, nil)
+			p.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+				assert.Equal(t, "tor_dead_letter", msg.Topic)
+				assert.Equal(t, tt.wantKey, msg.Key)
+				assert.Equal(t, tt.wantHeaders, msg.Headers)
+
+				return nil
+			})
+
+			s, err := kafka.NewDeadLetterSink(p, &clusterAdminMock{}, kafka.Topic{Name: "tor_dead_letter"})
+			require.NoError(t, err)
+
+			require.NoError(t, s.Send(tt.deadLetter))
+			require.NoError(t, s.Close())
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+)
+
+// Envelope builds the value of the message of an event, with the headers to add to it.
+// Without an Envelope, the value is the event payload.
+type Envelope interface {
+	Wrap(event run.OutboxEvent) (value []byte, headers []sarama.RecordHeader, err error)
+}
+
+const (
+	defaultDebeziumEventIDField          = "id"
+	defaultDebeziumRouteByField          = "aggregatetype"
+	defaultDebeziumRouteTopicReplacement = "outbox.event.${routedByValue}"
+
+	debeziumIDHeader     = "id"
+	debeziumPayloadField = "payload"
+)
+
+type FieldPlacement string
+
+const (
+	PlaceInHeader   FieldPlacement = "header"
+	PlaceInEnvelope FieldPlacement = "envelope"
+)
+
+// AdditionalField is a column added to the message, as in the table.fields.additional.placement option of
+// the Debezium outbox event router.
+type AdditionalField struct {
+	ColumnName string
+	Placement  FieldPlacement
+	// Alias is the name of the header or of the envelope field, the column name by default.
+	Alias string
+}
+
+func (f AdditionalField) name() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+
+	return f.ColumnName
+}
+
+// ParseAdditionalFields parses a comma separated list of column:placement[:alias], e.g. type:header:eventType.
+func ParseAdditionalFields(s string) ([]AdditionalField, error) {
+	var r []AdditionalField
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+
+		parts := strings.Split(f, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid additional field, column:placement[:alias] expected: %s", f)
+		}
+
+		af := AdditionalField{ColumnName: parts[0], Placement: FieldPlacement(parts[1])}
+		if len(parts) == 3 {
+			af.Alias = parts[2]
+		}
+		r = append(r, af)
+	}
+
+	return r, nil
+}
+
+// DebeziumEnvelope builds messages like the Debezium outbox event router does: the event ID is sent in the id
+// header and additional fields are placed in headers or in the envelope.
+// The key is the aggregate ID and, with DebeziumRouting, the topic is named after the aggregate type.
+type DebeziumEnvelope struct {
+	eventIDField      string
+	additionalFields  []AdditionalField
+	jsonEnvelope      bool
+	expandJSONPayload bool
+}
+
+// NewDebeziumEnvelope returns a DebeziumEnvelope reading the event ID from eventIDField, "id" by default.
+// With jsonEnvelope, the value is a JSON object with the payload in the payload field, next to the additional
+// fields placed in the envelope, which require it. With expandJSONPayload, a JSON payload is embedded as is
+// instead of as a string.
+func NewDebeziumEnvelope(
+	eventIDField string,
+	additionalFields []AdditionalField,
+	jsonEnvelope bool,
+	expandJSONPayload bool,
+) (*DebeziumEnvelope, error) {
+	actualEventIDField := defaultDebeziumEventIDField
+	if eventIDField != "" {
+		actualEventIDField = eventIDField
+	}
+
+	for _, f := range additionalFields {
+		switch f.Placement {
+		case PlaceInHeader:
+		case PlaceInEnvelope:
+			if !jsonEnvelope {
+				return nil, fmt.Errorf("envelope placement requires the JSON envelope. Column: %s", f.ColumnName)
+			}
+			if f.name() == debeziumPayloadField {
+				return nil, errors.New("additional field cannot be named payload")
+			}
+		default:
+			return nil, fmt.Errorf("unknown placement: %s. Column: %s", f.Placement, f.ColumnName)
+		}
+	}
+
+	return &DebeziumEnvelope{
+		eventIDField:      actualEventIDField,
+		additionalFields:  additionalFields,
+		jsonEnvelope:      jsonEnvelope,
+		expandJSONPayload: expandJSONPayload,
+	}, nil
+}
+
+func (d *DebeziumEnvelope) Wrap(event run.OutboxEvent) ([]byte, []sarama.RecordHeader, error) {
+	id, ok := columnValue(event.Columns, d.eventIDField)
+	if !ok || id == nil {
+		return nil, nil, fmt.Errorf("column not found for event id. Column: %s", d.eventIDField)
+	}
+
+	headers := []sarama.RecordHeader{{Key: []byte(debeziumIDHeader), Value: id}}
+	envelope := map[string]interface{}{debeziumPayloadField: d.payload(event.Payload)}
+	for _, f := range d.additionalFields {
+		v, ok := columnValue(event.Columns, f.ColumnName)
+		if !ok {
+			return nil, nil, fmt.Errorf("column not found for additional field. Column: %s", f.ColumnName)
+		}
+
+		if f.Placement == PlaceInHeader {
+			headers = append(headers, sarama.RecordHeader{Key: []byte(f.name()), Value: v})
+			continue
+		}
+
+		if v == nil {
+			envelope[f.name()] = nil
+		} else {
+			envelope[f.name()] = string(v)
+		}
+	}
+
+	if !d.jsonEnvelope {
+		return event.Payload, headers, nil
+	}
+
+	value, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return value, headers, nil
+}
+
+func (d *DebeziumEnvelope) payload(p []byte) interface{} {
+	if p == nil {
+		return nil
+	}
+
+	if d.expandJSONPayload && json.Valid(p) {
+		return json.RawMessage(p)
+	}
+
+	return string(p)
+}
+
+// DebeziumRouting returns the routing of the Debezium outbox event router: each event is written on the topic
+// named after the value of the routeByField column, "aggregatetype" by default, replacing ${routedByValue} in
+// topicReplacement, "outbox.event.${routedByValue}" by default. Topics are created on first use with topicDetail.
+func DebeziumRouting(routeByField string, topicReplacement string, topicDetail *sarama.TopicDetail) Routing {
+	actualRouteByField := defaultDebeziumRouteByField
+	if routeByField != "" {
+		actualRouteByField = routeByField
+	}
+
+	actualTopicReplacement := defaultDebeziumRouteTopicReplacement
+	if topicReplacement != "" {
+		actualTopicReplacement = topicReplacement
+	}
+
+	return Routing{
+		Topics: []Topic{{
+			Name:        strings.ReplaceAll(actualTopicReplacement, "${routedByValue}", "{{"+actualRouteByField+"}}"),
+			TopicDetail: topicDetail,
+		}},
+		UnmatchedPolicy: FailUnmatched,
+	}
+}
+
+const (
+	cloudEventsHeaderPrefix = "ce_"
+	contentTypeHeader       = "content-type"
+)
+
+// CloudEventsEnvelope builds messages with the CloudEvents Kafka protocol binding: in binary mode the context
+// attributes are sent in ce_* headers and the value is the payload, in structured mode the value is the whole event.
+type CloudEventsEnvelope struct {
+	encoder *run.CloudEventsEncoder
+}
+
+func NewCloudEventsEnvelope(encoder *run.CloudEventsEncoder) *CloudEventsEnvelope {
+	return &CloudEventsEnvelope{encoder: encoder}
+}
+
+func (c *CloudEventsEnvelope) Wrap(event run.OutboxEvent) ([]byte, []sarama.RecordHeader, error) {
+	ce, err := c.encoder.Encode(event)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	headers := make([]sarama.RecordHeader, 0, len(ce.Attributes)+1)
+	for _, a := range ce.Attributes {
+		headers = append(headers, sarama.RecordHeader{
+			Key:   []byte(cloudEventsHeaderPrefix + a.Name),
+			Value: []byte(a.Value),
+		})
+	}
+	headers = append(headers, sarama.RecordHeader{
+		Key:   []byte(contentTypeHeader),
+		Value: []byte(ce.ContentType),
+	})
+
+	return ce.Data, headers, nil
+}
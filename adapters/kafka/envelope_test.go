@@ -0,0 +1,261 @@
+package kafka_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/lorenzoranucci/tor/adapters/kafka"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventDispatcher_Dispatch_DebeziumEnvelope(t *testing.T) {
+	event := run.OutboxEvent{
+		AggregateID:   []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c"),
+		AggregateType: []byte("Order"),
+		Payload:       []byte(`{"name": "new order"}`),
+		Columns: []run.Column{
+			{Name: []byte("id"), Value: []byte("5c0e9be6-ea69-452d-9824-7f55b544f2e3")},
+			{Name: []byte("aggregatetype"), Value: []byte("Order")},
+			{Name: []byte("type"), Value: []byte("OrderCreated")},
+			{Name: []byte("tenant"), Value: []byte("acme")},
+			{Name: []byte("deleted_at"), Value: nil},
+		},
+	}
+
+	tests := []struct {
+		name              string
+		eventIDField      string
+		additionalFields  []kafka.AdditionalField
+		jsonEnvelope      bool
+		expandJSONPayload bool
+		wantValue         string
+		wantHeaders       []sarama.RecordHeader
+		wantErr           error
+	}{
+		{
+			name:      "when there are no additional fields then value is the payload and event id is in the id header",
+			wantValue: `{"name": "new order"}`,
+			wantHeaders: []sarama.RecordHeader{
+				{Key: []byte("id"), Value: []byte("5c0e9be6-ea69-452d-9824-7f55b544f2e3")},
+			},
+		},
+		{
+			name: "when additional fields are placed in headers then they are added with their alias",
+			additionalFields: []kafka.AdditionalField{
+				{ColumnName: "type", Placement: kafka.PlaceInHeader, Alias: "eventType"},
+				{ColumnName: "tenant", Placement: kafka.PlaceInHeader},
+			},
+			wantValue: `{"name": "new order"}`,
+			wantHeaders: []sarama.RecordHeader{
+				{Key: []byte("id"), Value: []byte("5c0e9be6-ea69-452d-9824-7f55b544f2e3")},
+				{Key: []byte("eventType"), Value: []byte("OrderCreated")},
+				{Key: []byte("tenant"), Value: []byte("acme")},
+			},
+		},
+		{
+			name: "when additional fields are placed in the JSON envelope then they are next to the payload",
+			additionalFields: []kafka.AdditionalField{
+				{ColumnName: "type", Placement: kafka.PlaceInEnvelope, Alias: "eventType"},
+				{ColumnName: "deleted_at", Placement: kafka.PlaceInEnvelope},
+			},
+			jsonEnvelope: true,
+			wantValue:    `{"deleted_at":null,"eventType":"OrderCreated","payload":"{\"name\": \"new order\"}"}`,
+			wantHeaders: []sarama.RecordHeader{
+				{Key: []byte("id"), Value: []byte("5c0e9be6-ea69-452d-9824-7f55b544f2e3")},
+			},
+		},
+		{
+			name:              "when JSON payload is expanded then it is embedded in the envelope",
+			jsonEnvelope:      true,
+			expandJSONPayload: true,
+			wantValue:         `{"payload":{"name":"new order"}}`,
+			wantHeaders: []sarama.RecordHeader{
+				{Key: []byte("id"), Value: []byte("5c0e9be6-ea69-452d-9824-7f55b544f2e3")},
+			},
+		},
+		{
+			name:         "when event id column is missing then error",
+			eventIDField: "event_id",
+			wantErr:      errors.New("column not found for event id. Column: event_id"),
+		},
+		{
+			name: "when additional field column is missing then error",
+			additionalFields: []kafka.AdditionalField{
+				{ColumnName: "other", Placement: kafka.PlaceInHeader},
+			},
+			wantErr: errors.New("column not found for additional field. Column: other"),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := kafka.NewDebeziumEnvelope(tt.eventIDField, tt.additionalFields, tt.jsonEnvelope, tt.expandJSONPayload)
+			require.NoError(t, err)
+
+			p := mocks.NewSyncProducer(t, nil)
+			if tt.wantErr == nil {
+				p.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+					assert.Equal(t, "outbox.event.Order", msg.Topic)
+					assert.Equal(t, sarama.ByteEncoder(event.AggregateID), msg.Key)
+					assert.Equal(t, sarama.ByteEncoder(tt.wantValue), msg.Value)
+					assert.Equal(t, tt.wantHeaders, msg.Headers)
+					return nil
+				})
+			}
+
+			d, err := kafka.NewEventDispatcher(
+				p,
+				&clusterAdminMock{},
+				kafka.DebeziumRouting("", "", nil),
+				nil,
+				e,
+				nil,
+				kafka.TransactionMetadata{},
+			)
+			require.NoError(t, err)
+
+			err = d.Dispatch(event)
+			if tt.wantErr != nil {
+				assert.EqualError(t, err, tt.wantErr.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+			require.NoError(t, p.Close())
+		})
+	}
+}
+
+func TestNewDebeziumEnvelope(t *testing.T) {
+	tests := []struct {
+		name             string
+		additionalFields []kafka.AdditionalField
+		jsonEnvelope     bool
+		wantErr          bool
+	}{
+		{
+			name:             "when a field is placed in the envelope without JSON envelope then error",
+			additionalFields: []kafka.AdditionalField{{ColumnName: "type", Placement: kafka.PlaceInEnvelope}},
+			wantErr:          true,
+		},
+		{
+			name:             "when a field has an unknown placement then error",
+			additionalFields: []kafka.AdditionalField{{ColumnName: "type", Placement: "partition"}},
+			jsonEnvelope:     true,
+			wantErr:          true,
+		},
+		{
+			name: "when a field is named payload then error",
+			additionalFields: []kafka.AdditionalField{
+				{ColumnName: "type", Placement: kafka.PlaceInEnvelope, Alias: "payload"},
+			},
+			jsonEnvelope: true,
+			wantErr:      true,
+		},
+		{
+			name: "when fields are valid then no error",
+			additionalFields: []kafka.AdditionalField{
+				{ColumnName: "type", Placement: kafka.PlaceInEnvelope},
+				{ColumnName: "tenant", Placement: kafka.PlaceInHeader},
+			},
+			jsonEnvelope: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := kafka.NewDebeziumEnvelope("", tt.additionalFields, tt.jsonEnvelope, false)
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func TestParseAdditionalFields(t *testing.T) {
+	got, err := kafka.ParseAdditionalFields("type:header:eventType, tenant:envelope")
+	require.NoError(t, err)
+	assert.Equal(t, []kafka.AdditionalField{
+		{ColumnName: "type", Placement: kafka.PlaceInHeader, Alias: "eventType"},
+		{ColumnName: "tenant", Placement: kafka.PlaceInEnvelope},
+	}, got)
+
+	_, err = kafka.ParseAdditionalFields("type")
+	assert.Error(t, err)
+}
+
+func TestEventDispatcher_Dispatch_CloudEventsEnvelope(t *testing.T) {
+	event := run.OutboxEvent{
+		Schema:        "sales",
+		Table:         "outbox",
+		AggregateID:   []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c"),
+		AggregateType: []byte("order"),
+		Payload:       []byte(`{"name": "new order"}`),
+		Columns: []run.Column{
+			{Name: []byte("id"), Value: []byte("5c0e9be6-ea69-452d-9824-7f55b544f2e3")},
+		},
+		EventTimestampFromDatabase: 1668940200,
+	}
+
+	tests := []struct {
+		name        string
+		mode        run.CloudEventsMode
+		wantValue   string
+		wantHeaders []sarama.RecordHeader
+	}{
+		{
+			name:      "when mode is binary then attributes are in ce headers",
+			mode:      run.CloudEventsBinary,
+			wantValue: `{"name": "new order"}`,
+			wantHeaders: []sarama.RecordHeader{
+				{Key: []byte("ce_specversion"), Value: []byte("1.0")},
+				{Key: []byte("ce_id"), Value: []byte("5c0e9be6-ea69-452d-9824-7f55b544f2e3")},
+				{Key: []byte("ce_source"), Value: []byte("/sales/outbox")},
+				{Key: []byte("ce_type"), Value: []byte("order")},
+				{Key: []byte("ce_subject"), Value: []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c")},
+				{Key: []byte("ce_time"), Value: []byte("2022-11-20T10:30:00Z")},
+				{Key: []byte("content-type"), Value: []byte("application/json")},
+			},
+		},
+		{
+			name: "when mode is structured then value is the event",
+			mode: run.CloudEventsStructured,
+			wantValue: `{"specversion":"1.0","id":"5c0e9be6-ea69-452d-9824-7f55b544f2e3","source":"/sales/outbox",` +
+				`"type":"order","subject":"c44ade3e-9394-4e6e-8d2d-20707d61061c","time":"2022-11-20T10:30:00Z",` +
+				`"datacontenttype":"application/json","data":{"name":"new order"}}`,
+			wantHeaders: []sarama.RecordHeader{
+				{Key: []byte("content-type"), Value: []byte("application/cloudevents+json")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			encoder, err := run.NewCloudEventsEncoder(run.CloudEvents{Mode: tt.mode})
+			require.NoError(t, err)
+
+			p := mocks.NewSyncProducer(t, nil)
+			p.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+				assert.Equal(t, "orders", msg.Topic)
+				assert.Equal(t, sarama.ByteEncoder(tt.wantValue), msg.Value)
+				assert.Equal(t, tt.wantHeaders, msg.Headers)
+				return nil
+			})
+
+			d, err := kafka.NewEventDispatcher(
+				p,
+				&clusterAdminMock{},
+				kafka.Routing{Topics: []kafka.Topic{{Name: "orders"}}},
+				nil,
+				kafka.NewCloudEventsEnvelope(encoder),
+				nil,
+				kafka.TransactionMetadata{},
+			)
+			require.NoError(t, err)
+
+			assert.NoError(t, d.Dispatch(event))
+			require.NoError(t, p.Close())
+		})
+	}
+}
@@ -1,8 +1,8 @@
 package kafka
 
 import (
+	"errors"
 	"fmt"
-	"regexp"
 
 	"github.com/Shopify/sarama"
 	"github.com/lorenzoranucci/tor/router/pkg/run"
@@ -11,33 +11,29 @@ import (
 func NewEventDispatcher(
 	syncProducer sarama.SyncProducer,
 	admin sarama.ClusterAdmin,
-	topics []Topic,
+	routing Routing,
 	headerMappings []HeaderMapping,
+	envelope Envelope,
+	serializer *SchemaRegistrySerializer,
+	transactionMetadata TransactionMetadata,
 ) (*EventDispatcher, error) {
-	err := createTopics(topics, admin)
+	mm, err := newMessageMapper(admin, routing, headerMappings, envelope, serializer, transactionMetadata)
 	if err != nil {
 		return nil, err
 	}
 
 	return &EventDispatcher{
-		syncProducer:   syncProducer,
-		admin:          admin,
-		topics:         topics,
-		headerMappings: headerMappings,
+		syncProducer:  syncProducer,
+		admin:         admin,
+		messageMapper: mm,
 	}, nil
 }
 
 type EventDispatcher struct {
-	syncProducer   sarama.SyncProducer
-	admin          sarama.ClusterAdmin
-	topics         []Topic
-	headerMappings []HeaderMapping
-}
+	messageMapper
 
-type Topic struct {
-	Name          string
-	TopicDetail   *sarama.TopicDetail
-	AggregateType *regexp.Regexp
+	syncProducer sarama.SyncProducer
+	admin        sarama.ClusterAdmin
 }
 
 type HeaderMapping struct {
@@ -46,31 +42,28 @@ type HeaderMapping struct {
 }
 
 func (k *EventDispatcher) Dispatch(event run.OutboxEvent) error {
-	for _, topic := range k.topics {
-		if !topic.AggregateType.MatchString(string(event.AggregateType)) {
-			continue
-		}
+	messages, err := k.mapMessages(event)
+	if err != nil {
+		return err
+	}
 
-		headers, err := k.mapHeaders(event.Columns)
+	for _, m := range messages {
+		_, _, err = k.syncProducer.SendMessage(m)
 		if err != nil {
 			return err
 		}
+	}
 
-		_, _, err = k.syncProducer.SendMessage(
-			&sarama.ProducerMessage{
-				Key:     sarama.ByteEncoder(event.AggregateID),
-				Topic:   topic.Name,
-				Value:   sarama.ByteEncoder(event.Payload),
-				Headers: headers,
-			},
-		)
+	return nil
+}
 
-		if err != nil {
-			return err
-		}
+func (k *EventDispatcher) Close() error {
+	err := k.syncProducer.Close()
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return k.admin.Close()
 }
 
 func createTopics(topics []Topic, admin sarama.ClusterAdmin) error {
@@ -103,11 +96,156 @@ func createTopics(topics []Topic, admin sarama.ClusterAdmin) error {
 	return nil
 }
 
-func (k *EventDispatcher) mapHeaders(columns []run.Column) ([]sarama.RecordHeader, error) {
+type messageMapper struct {
+	routing             Routing
+	headerMappings      []HeaderMapping
+	envelope            Envelope
+	serializer          *SchemaRegistrySerializer
+	transactionMetadata TransactionMetadata
+	topicCreator        *topicCreator
+}
+
+func newMessageMapper(
+	admin sarama.ClusterAdmin,
+	routing Routing,
+	headerMappings []HeaderMapping,
+	envelope Envelope,
+	serializer *SchemaRegistrySerializer,
+	transactionMetadata TransactionMetadata,
+) (messageMapper, error) {
+	err := routing.validate()
+	if err != nil {
+		return messageMapper{}, err
+	}
+
+	if serializer != nil && serializer.incompatiblePolicy == DeadLetterIncompatible && routing.DeadLetterTopic == nil {
+		return messageMapper{}, errors.New("dead-letter incompatible policy requires a dead-letter topic")
+	}
+
+	err = createTopics(routing.staticTopics(), admin)
+	if err != nil {
+		return messageMapper{}, err
+	}
+
+	return messageMapper{
+		routing:             routing,
+		headerMappings:      headerMappings,
+		envelope:            envelope,
+		serializer:          serializer,
+		transactionMetadata: transactionMetadata,
+		topicCreator:        newTopicCreator(admin),
+	}, nil
+}
+
+// mapMessages returns a message for each topic the event has to be written on.
+func (m *messageMapper) mapMessages(event run.OutboxEvent) ([]*sarama.ProducerMessage, error) {
+	topics, deadLetterReason, err := m.routing.route(event)
+	if err != nil || len(topics) == 0 {
+		return nil, err
+	}
+
+	headers, err := m.mapHeaders(event.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	value := event.Payload
+	if m.envelope != nil {
+		var envelopeHeaders []sarama.RecordHeader
+		value, envelopeHeaders, err = m.envelope.Wrap(event)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, envelopeHeaders...)
+	}
+	headers = append(headers, m.transactionMetadata.headers(event)...)
+
+	if deadLetterReason != "" {
+		headers = append(headers, deadLetterHeader(deadLetterReason))
+	}
+	headers = injectTraceContext(event, headers)
+
+	r := make([]*sarama.ProducerMessage, 0, len(topics))
+	for _, topic := range topics {
+		name := topic.Name
+		if topic.isTemplate() {
+			name, err = topic.name(event)
+			if err != nil {
+				return nil, err
+			}
+
+			err = m.topicCreator.ensure(name, topic.TopicDetail)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		msg := &sarama.ProducerMessage{
+			Key:       sarama.ByteEncoder(event.AggregateID),
+			Topic:     name,
+			Value:     sarama.ByteEncoder(value),
+			Headers:   headers,
+			Timestamp: m.transactionMetadata.timestamp(event),
+		}
+		if m.serializer != nil && deadLetterReason == "" {
+			err = m.serialize(event, msg, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		r = append(r, msg)
+	}
+
+	return r, nil
+}
+
+// serialize encodes the value of the message with the schema of its topic. With the DeadLetterIncompatible policy,
+// incompatible values are written as they are on the dead-letter topic.
+func (m *messageMapper) serialize(event run.OutboxEvent, msg *sarama.ProducerMessage, value []byte) error {
+	v, err := m.serializer.serialize(msg.Topic, value)
+	if err == nil {
+		msg.Value = sarama.ByteEncoder(v)
+		return nil
+	}
+
+	if !errors.Is(err, ErrIncompatibleValue) || m.serializer.incompatiblePolicy != DeadLetterIncompatible {
+		return fmt.Errorf("%w. Topic: %s", err, msg.Topic)
+	}
+
+	deadLetterTopic := m.routing.forEvent(event).DeadLetterTopic
+	if deadLetterTopic == nil {
+		deadLetterTopic = m.routing.DeadLetterTopic
+	}
+
+	headers := make([]sarama.RecordHeader, 0, len(msg.Headers)+2)
+	headers = append(headers, msg.Headers...)
+	headers = append(headers,
+		deadLetterHeader("incompatible"),
+		sarama.RecordHeader{Key: []byte(deadLetterErrorHeader), Value: []byte(err.Error())},
+	)
+
+	msg.Topic = deadLetterTopic.Name
+	msg.Headers = headers
+
+	return nil
+}
+
+// RequiredColumns returns the columns mapped to headers, validated by the router when an outbox table is altered.
+func (m *messageMapper) RequiredColumns() []string {
+	r := make([]string, 0, len(m.headerMappings))
+	for _, h := range m.headerMappings {
+		r = append(r, h.ColumnName)
+	}
+
+	return r
+}
+
+func (m *messageMapper) mapHeaders(columns []run.Column) ([]sarama.RecordHeader, error) {
 	r := make([]sarama.RecordHeader, 0, len(columns))
 
 outerLoop:
-	for _, h := range k.headerMappings {
+	for _, h := range m.headerMappings {
 		for _, c := range columns {
 			if h.ColumnName == string(c.Name) {
 				r = append(r, sarama.RecordHeader{
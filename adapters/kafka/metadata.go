@@ -0,0 +1,80 @@
+package kafka
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+)
+
+const (
+	commitTimestampHeader = "tor_commit_timestamp"
+	binlogFileHeader      = "tor_binlog_file"
+	binlogPosHeader       = "tor_binlog_pos"
+	binlogRowHeader       = "tor_binlog_row"
+	lsnHeader             = "tor_lsn"
+	gtidHeader            = "tor_gtid"
+	serverIDHeader        = "tor_server_id"
+	sourceTableHeader     = "tor_source_table"
+)
+
+// TransactionMetadata defines the metadata of the binlog transaction added to the messages, so that consumers can
+// measure the end-to-end latency and deduplicate the events.
+type TransactionMetadata struct {
+	// Headers adds the commit timestamp, in milliseconds since the epoch, the binlog file, position and row,
+	// the GTID, the server ID and the source table as tor_* headers. Missing values are omitted.
+	// The changes read from PostgreSQL have the LSN of the change, e.g. 16/B374D848, and the row instead of the
+	// binlog file and position.
+	Headers bool
+	// Timestamp sets the timestamp of the records to the commit time of the transaction.
+	// It requires a producer with Kafka version 0.10.0.0 or later.
+	Timestamp bool
+}
+
+func (t TransactionMetadata) headers(event run.OutboxEvent) []sarama.RecordHeader {
+	if !t.Headers {
+		return nil
+	}
+
+	var r []sarama.RecordHeader
+	add := func(key, value string) {
+		r = append(r, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+	}
+
+	if event.EventTimestampFromDatabase != 0 {
+		add(commitTimestampHeader, strconv.FormatInt(commitTime(event).UnixMilli(), 10))
+	}
+	switch p := event.Binlog.Position; {
+	case p.File != "":
+		add(binlogFileHeader, p.File)
+		add(binlogPosHeader, strconv.FormatUint(uint64(p.Offset), 10))
+		add(binlogRowHeader, strconv.Itoa(event.Binlog.Row))
+	case p.LSN != 0:
+		add(lsnHeader, p.String())
+		add(binlogRowHeader, strconv.Itoa(event.Binlog.Row))
+	}
+	if event.Binlog.GTID != "" {
+		add(gtidHeader, event.Binlog.GTID)
+	}
+	if event.Binlog.ServerID != 0 {
+		add(serverIDHeader, strconv.FormatUint(uint64(event.Binlog.ServerID), 10))
+	}
+	if event.Schema != "" {
+		add(sourceTableHeader, event.Schema+"."+event.Table)
+	}
+
+	return r
+}
+
+func (t TransactionMetadata) timestamp(event run.OutboxEvent) time.Time {
+	if !t.Timestamp || event.EventTimestampFromDatabase == 0 {
+		return time.Time{}
+	}
+
+	return commitTime(event)
+}
+
+func commitTime(event run.OutboxEvent) time.Time {
+	return time.Unix(int64(event.EventTimestampFromDatabase), 0)
+}
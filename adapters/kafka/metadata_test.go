@@ -0,0 +1,113 @@
+package kafka_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/lorenzoranucci/tor/adapters/kafka"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventDispatcher_Dispatch_TransactionMetadata(t *testing.T) {
+	event := run.OutboxEvent{
+		Schema:                     "sales",
+		Table:                      "outbox",
+		AggregateID:                []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c"),
+		AggregateType:              []byte("order"),
+		Payload:                    []byte(`{"name": "new order"}`),
+		EventTimestampFromDatabase: 1668940200,
+		Binlog: run.BinlogMetadata{
+			Position: run.Position{File: "mysql-bin.000002", Offset: 400},
+			Row:      1,
+			GTID:     "3e11fa47-71ca-11e1-9e33-c80aa9429562:23",
+			ServerID: 7,
+		},
+	}
+
+	tests := []struct {
+		name                string
+		transactionMetadata kafka.TransactionMetadata
+		event               run.OutboxEvent
+		wantHeaders         []sarama.RecordHeader
+		wantTimestamp       time.Time
+	}{
+		{
+			name:        "when metadata is disabled then there are no headers and no timestamp",
+			event:       event,
+			wantHeaders: []sarama.RecordHeader{},
+		},
+		{
+			name:                "when metadata is enabled then headers and timestamp are set",
+			transactionMetadata: kafka.TransactionMetadata{Headers: true, Timestamp: true},
+			event:               event,
+			wantHeaders: []sarama.RecordHeader{
+				{Key: []byte("tor_commit_timestamp"), Value: []byte("1668940200000")},
+				{Key: []byte("tor_binlog_file"), Value: []byte("mysql-bin.000002")},
+				{Key: []byte("tor_binlog_pos"), Value: []byte("400")},
+				{Key: []byte("tor_binlog_row"), Value: []byte("1")},
+				{Key: []byte("tor_gtid"), Value: []byte("3e11fa47-71ca-11e1-9e33-c80aa9429562:23")},
+				{Key: []byte("tor_server_id"), Value: []byte("7")},
+				{Key: []byte("tor_source_table"), Value: []byte("sales.outbox")},
+			},
+			wantTimestamp: time.Unix(1668940200, 0),
+		},
+		{
+			name:                "when the event is read from PostgreSQL then the LSN is set instead of the binlog position",
+			transactionMetadata: kafka.TransactionMetadata{Headers: true},
+			event: run.OutboxEvent{
+				Schema:                     "public",
+				Table:                      "outbox",
+				AggregateID:                []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c"),
+				AggregateType:              []byte("order"),
+				Payload:                    []byte(`{"name": "new order"}`),
+				EventTimestampFromDatabase: 1668940200,
+				Binlog:                     run.BinlogMetadata{Position: run.Position{LSN: 0x16B374D848}},
+			},
+			wantHeaders: []sarama.RecordHeader{
+				{Key: []byte("tor_commit_timestamp"), Value: []byte("1668940200000")},
+				{Key: []byte("tor_lsn"), Value: []byte("16/B374D848")},
+				{Key: []byte("tor_binlog_row"), Value: []byte("0")},
+				{Key: []byte("tor_source_table"), Value: []byte("public.outbox")},
+			},
+		},
+		{
+			name:                "when binlog metadata is missing then headers are omitted",
+			transactionMetadata: kafka.TransactionMetadata{Headers: true, Timestamp: true},
+			event: run.OutboxEvent{
+				AggregateID:   []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c"),
+				AggregateType: []byte("order"),
+				Payload:       []byte(`{"name": "new order"}`),
+			},
+			wantHeaders: []sarama.RecordHeader{},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := mocks.NewSyncProducer(t, nil)
+			p.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+				assert.Equal(t, tt.wantHeaders, msg.Headers)
+				assert.Equal(t, tt.wantTimestamp, msg.Timestamp)
+				return nil
+			})
+
+			d, err := kafka.NewEventDispatcher(
+				p,
+				&clusterAdminMock{},
+				kafka.Routing{Topics: []kafka.Topic{{Name: "order"}}},
+				nil,
+				nil,
+				nil,
+				tt.transactionMetadata,
+			)
+			require.NoError(t, err)
+
+			assert.NoError(t, d.Dispatch(tt.event))
+			require.NoError(t, p.Close())
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+const protobufSchemaFileName = "schema.proto"
+
+// protobufEncoder encodes JSON values, in the proto3 JSON mapping, with the first message of a Protobuf schema.
+type protobufEncoder struct {
+	header  []byte
+	message *desc.MessageDescriptor
+}
+
+func newProtobufEncoder(schemaID uint32, schema string) (*protobufEncoder, error) {
+	fds, err := protoparse.Parser{
+		Accessor: protoparse.FileContentsFromMap(map[string]string{protobufSchemaFileName: schema}),
+	}.ParseFiles(protobufSchemaFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := fds[0].GetMessageTypes()
+	if len(messages) == 0 {
+		return nil, errors.New("protobuf schema has no message")
+	}
+
+	return &protobufEncoder{
+		// the message indexes of the first message are encoded as a single zero byte
+		header:  append(wireFormatHeader(schemaID), 0),
+		message: messages[0],
+	}, nil
+}
+
+func (e *protobufEncoder) encode(value []byte) ([]byte, error) {
+	m := dynamic.NewMessage(e.message)
+	err := m.UnmarshalJSON(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrIncompatibleValue, err)
+	}
+
+	b, err := m.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrIncompatibleValue, err)
+	}
+
+	r := make([]byte, 0, len(e.header)+len(b))
+	r = append(r, e.header...)
+
+	return append(r, b...), nil
+}
@@ -0,0 +1,260 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+)
+
+// ErrUnroutableEvent is returned by dispatchers when an event matches no topic and the FailUnmatched policy applies.
+var ErrUnroutableEvent = errors.New("no topic matches the event")
+
+const deadLetterReasonHeader = "tor_dead_letter_reason"
+
+type UnmatchedPolicy string
+
+const (
+	// DropUnmatched discards the events matching no topic.
+	DropUnmatched UnmatchedPolicy = "drop"
+	// FailUnmatched makes the dispatch fail, which stops the router.
+	FailUnmatched UnmatchedPolicy = "fail"
+	// DeadLetterUnmatched writes the events matching no topic on the dead-letter topic.
+	DeadLetterUnmatched UnmatchedPolicy = "dead-letter"
+)
+
+func ParseUnmatchedPolicy(s string) (UnmatchedPolicy, error) {
+	switch p := UnmatchedPolicy(s); p {
+	case "":
+		return DropUnmatched, nil
+	case DropUnmatched, FailUnmatched, DeadLetterUnmatched:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown unmatched policy: %s", s)
+	}
+}
+
+// Routing defines the topics each event is written on.
+type Routing struct {
+	Topics []Topic
+	// FirstMatchOnly makes an event be written on the first matching topic only, instead of all of them.
+	FirstMatchOnly bool
+	// DefaultTopic, when set, receives the events matching no topic.
+	DefaultTopic *Topic
+	// UnmatchedPolicy applies to the events matching no topic when there is no default topic.
+	UnmatchedPolicy UnmatchedPolicy
+	// DeadLetterTopic receives the events matching no topic with the DeadLetterUnmatched policy.
+	DeadLetterTopic *Topic
+	// Tables, when set, defines the routing of the events read from specific outbox tables.
+	// The events of the other tables are routed by this routing.
+	Tables []TableRouting
+}
+
+// TableRouting is the routing of the events read from an outbox table.
+type TableRouting struct {
+	Schema string
+	Table  string
+	Routing
+}
+
+// Topic is a destination of events, matching them by aggregate type and column values.
+type Topic struct {
+	// Name of the topic. It may contain {{column_name}} placeholders, which are replaced with the event
+	// column values, e.g. {{aggregate_type}}.events. Such topics are created on first use.
+	Name        string
+	TopicDetail *sarama.TopicDetail
+	// AggregateType, when set, must match the event aggregate type.
+	AggregateType *regexp.Regexp
+	// Columns, when set, must match the values of the event columns.
+	Columns []ColumnMatcher
+}
+
+type ColumnMatcher struct {
+	ColumnName string
+	Regexp     *regexp.Regexp
+}
+
+var topicNamePlaceholder = regexp.MustCompile(`\{\{\s*([^{}\s]+)\s*\}\}`)
+
+func (t *Topic) isTemplate() bool {
+	return topicNamePlaceholder.MatchString(t.Name)
+}
+
+func (t *Topic) matches(event run.OutboxEvent) bool {
+	if t.AggregateType != nil && !t.AggregateType.MatchString(string(event.AggregateType)) {
+		return false
+	}
+
+	for _, cm := range t.Columns {
+		v, ok := columnValue(event.Columns, cm.ColumnName)
+		if !ok || v == nil || !cm.Regexp.Match(v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (t *Topic) name(event run.OutboxEvent) (string, error) {
+	var err error
+	name := topicNamePlaceholder.ReplaceAllStringFunc(t.Name, func(placeholder string) string {
+		columnName := topicNamePlaceholder.FindStringSubmatch(placeholder)[1]
+
+		v, ok := columnValue(event.Columns, columnName)
+		if !ok || v == nil {
+			err = fmt.Errorf("column not found for topic name. Column: %s, Topic: %s", columnName, t.Name)
+			return ""
+		}
+
+		return string(v)
+	})
+
+	return name, err
+}
+
+// staticTopics returns the topics whose name is not a template, which can be created upfront.
+func (r *Routing) staticTopics() []Topic {
+	var topics []Topic
+	for _, t := range r.allTopics() {
+		if !t.isTemplate() {
+			topics = append(topics, t)
+		}
+	}
+
+	return topics
+}
+
+func (r *Routing) allTopics() []Topic {
+	topics := make([]Topic, 0, len(r.Topics)+2)
+	topics = append(topics, r.Topics...)
+	if r.DefaultTopic != nil {
+		topics = append(topics, *r.DefaultTopic)
+	}
+	if r.DeadLetterTopic != nil {
+		topics = append(topics, *r.DeadLetterTopic)
+	}
+	for i := range r.Tables {
+		topics = append(topics, r.Tables[i].allTopics()...)
+	}
+
+	return topics
+}
+
+func (r *Routing) validate() error {
+	if _, err := ParseUnmatchedPolicy(string(r.UnmatchedPolicy)); err != nil {
+		return err
+	}
+
+	if r.UnmatchedPolicy == DeadLetterUnmatched && r.DeadLetterTopic == nil {
+		return errors.New("dead-letter unmatched policy requires a dead-letter topic")
+	}
+
+	for i := range r.Tables {
+		t := &r.Tables[i]
+		if len(t.Tables) > 0 {
+			return fmt.Errorf("table routing cannot be nested. Table: %s.%s", t.Schema, t.Table)
+		}
+
+		err := t.validate()
+		if err != nil {
+			return fmt.Errorf("%w. Table: %s.%s", err, t.Schema, t.Table)
+		}
+	}
+
+	return nil
+}
+
+// forEvent returns the routing of the outbox table the event was read from.
+func (r *Routing) forEvent(event run.OutboxEvent) *Routing {
+	for i := range r.Tables {
+		if r.Tables[i].Schema == event.Schema && r.Tables[i].Table == event.Table {
+			return &r.Tables[i].Routing
+		}
+	}
+
+	return r
+}
+
+// route returns the topics the event has to be written on. deadLetterReason is set when the event
+// must be written on the dead-letter topic.
+func (r *Routing) route(event run.OutboxEvent) (topics []*Topic, deadLetterReason string, err error) {
+	r = r.forEvent(event)
+
+	for i := range r.Topics {
+		if !r.Topics[i].matches(event) {
+			continue
+		}
+
+		topics = append(topics, &r.Topics[i])
+		if r.FirstMatchOnly {
+			break
+		}
+	}
+
+	if len(topics) > 0 {
+		return topics, "", nil
+	}
+
+	if r.DefaultTopic != nil {
+		return []*Topic{r.DefaultTopic}, "", nil
+	}
+
+	switch r.UnmatchedPolicy {
+	case FailUnmatched:
+		return nil, "", fmt.Errorf("%w: aggregate type %s", ErrUnroutableEvent, event.AggregateType)
+	case DeadLetterUnmatched:
+		return []*Topic{r.DeadLetterTopic}, "unmatched", nil
+	default:
+		return nil, "", nil
+	}
+}
+
+// topicCreator creates the missing topics, remembering the ones already known to exist.
+type topicCreator struct {
+	admin sarama.ClusterAdmin
+
+	mu    sync.Mutex
+	known map[string]struct{}
+}
+
+func newTopicCreator(admin sarama.ClusterAdmin) *topicCreator {
+	return &topicCreator{admin: admin, known: map[string]struct{}{}}
+}
+
+func (c *topicCreator) ensure(name string, detail *sarama.TopicDetail) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.known[name]; ok {
+		return nil
+	}
+
+	err := createTopics([]Topic{{Name: name, TopicDetail: detail}}, c.admin)
+	if err != nil {
+		return err
+	}
+
+	c.known[name] = struct{}{}
+
+	return nil
+}
+
+func columnValue(columns []run.Column, name string) ([]byte, bool) {
+	for _, c := range columns {
+		if string(c.Name) == name {
+			return c.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+func deadLetterHeader(reason string) sarama.RecordHeader {
+	return sarama.RecordHeader{
+		Key:   []byte(deadLetterReasonHeader),
+		Value: []byte(reason),
+	}
+}
@@ -0,0 +1,254 @@
+package kafka_test
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/lorenzoranucci/tor/adapters/kafka"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventDispatcher_Dispatch_Routing(t *testing.T) {
+	event := run.OutboxEvent{
+		Schema:        "sales",
+		Table:         "outbox",
+		AggregateID:   []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c"),
+		AggregateType: []byte("order"),
+		Payload:       []byte(`{"name": "new order"}`),
+		Columns: []run.Column{
+			{Name: []byte("aggregate_type"), Value: []byte("order")},
+			{Name: []byte("event_type"), Value: []byte("created")},
+			{Name: []byte("tenant"), Value: []byte("acme")},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		routing    kafka.Routing
+		wantTopics []string
+		wantErr    error
+		wantHeader *sarama.RecordHeader
+	}{
+		{
+			name: "when several topics match then event is written on all of them",
+			routing: kafka.Routing{Topics: []kafka.Topic{
+				{Name: "orders", AggregateType: regexp.MustCompile("^order$")},
+				{Name: "all"},
+			}},
+			wantTopics: []string{"orders", "all"},
+		},
+		{
+			name: "when several topics match and first match only then event is written on the first one",
+			routing: kafka.Routing{
+				Topics: []kafka.Topic{
+					{Name: "orders", AggregateType: regexp.MustCompile("^order$")},
+					{Name: "all"},
+				},
+				FirstMatchOnly: true,
+			},
+			wantTopics: []string{"orders"},
+		},
+		{
+			name: "when topics match on columns then event is written on matching ones",
+			routing: kafka.Routing{Topics: []kafka.Topic{
+				{
+					Name: "acme_deleted",
+					Columns: []kafka.ColumnMatcher{
+						{ColumnName: "tenant", Regexp: regexp.MustCompile("^acme$")},
+						{ColumnName: "event_type", Regexp: regexp.MustCompile("^deleted$")},
+					},
+				},
+				{
+					Name: "acme_created",
+					Columns: []kafka.ColumnMatcher{
+						{ColumnName: "tenant", Regexp: regexp.MustCompile("^acme$")},
+						{ColumnName: "event_type", Regexp: regexp.MustCompile("^created$")},
+					},
+				},
+				{
+					Name: "missing_column",
+					Columns: []kafka.ColumnMatcher{
+						{ColumnName: "other", Regexp: regexp.MustCompile(".*")},
+					},
+				},
+			}},
+			wantTopics: []string{"acme_created"},
+		},
+		{
+			name: "when topic name is a template then it is computed from columns",
+			routing: kafka.Routing{Topics: []kafka.Topic{
+				{Name: "{{tenant}}.{{ aggregate_type }}.events"},
+			}},
+			wantTopics: []string{"acme.order.events"},
+		},
+		{
+			name: "when topic name template refers to a missing column then error",
+			routing: kafka.Routing{Topics: []kafka.Topic{
+				{Name: "{{other}}.events"},
+			}},
+			wantErr: errors.New("column not found for topic name. Column: other, Topic: {{other}}.events"),
+		},
+		{
+			name: "when no topic matches and there is a default topic then event is written on it",
+			routing: kafka.Routing{
+				Topics: []kafka.Topic{
+					{Name: "invoices", AggregateType: regexp.MustCompile("^invoice$")},
+				},
+				DefaultTopic:    &kafka.Topic{Name: "default"},
+				UnmatchedPolicy: kafka.FailUnmatched,
+			},
+			wantTopics: []string{"default"},
+		},
+		{
+			name: "when no topic matches and drop policy then event is dropped",
+			routing: kafka.Routing{
+				Topics: []kafka.Topic{
+					{Name: "invoices", AggregateType: regexp.MustCompile("^invoice$")},
+				},
+				UnmatchedPolicy: kafka.DropUnmatched,
+			},
+		},
+		{
+			name: "when no topic matches and fail policy then error",
+			routing: kafka.Routing{
+				Topics: []kafka.Topic{
+					{Name: "invoices", AggregateType: regexp.MustCompile("^invoice$")},
+				},
+				UnmatchedPolicy: kafka.FailUnmatched,
+			},
+			wantErr: kafka.ErrUnroutableEvent,
+		},
+		{
+			name: "when no topic matches and dead-letter policy then event is written on dead-letter topic",
+			routing: kafka.Routing{
+				Topics: []kafka.Topic{
+					{Name: "invoices", AggregateType: regexp.MustCompile("^invoice$")},
+				},
+				UnmatchedPolicy: kafka.DeadLetterUnmatched,
+				DeadLetterTopic: &kafka.Topic{Name: "dead_letter"},
+			},
+			wantTopics: []string{"dead_letter"},
+			wantHeader: &sarama.RecordHeader{Key: []byte("tor_dead_letter_reason"), Value: []byte("unmatched")},
+		},
+		{
+			name: "when event table has its own routing then event is routed by it",
+			routing: kafka.Routing{
+				Topics: []kafka.Topic{{Name: "all"}},
+				Tables: []kafka.TableRouting{
+					{
+						Schema:  "billing",
+						Table:   "outbox",
+						Routing: kafka.Routing{Topics: []kafka.Topic{{Name: "billing"}}},
+					},
+					{
+						Schema: "sales",
+						Table:  "outbox",
+						Routing: kafka.Routing{Topics: []kafka.Topic{
+							{Name: "sales_orders", AggregateType: regexp.MustCompile("^order$")},
+						}},
+					},
+				},
+			},
+			wantTopics: []string{"sales_orders"},
+		},
+		{
+			name: "when event table has its own routing then its unmatched policy applies",
+			routing: kafka.Routing{
+				Topics: []kafka.Topic{{Name: "all"}},
+				Tables: []kafka.TableRouting{
+					{
+						Schema: "sales",
+						Table:  "outbox",
+						Routing: kafka.Routing{
+							Topics: []kafka.Topic{
+								{Name: "sales_invoices", AggregateType: regexp.MustCompile("^invoice$")},
+							},
+							UnmatchedPolicy: kafka.FailUnmatched,
+						},
+					},
+				},
+			},
+			wantErr: kafka.ErrUnroutableEvent,
+		},
+		{
+			name: "when event table has no routing then event is routed by the top-level one",
+			routing: kafka.Routing{
+				Topics: []kafka.Topic{{Name: "all"}},
+				Tables: []kafka.TableRouting{
+					{
+						Schema:  "billing",
+						Table:   "outbox",
+						Routing: kafka.Routing{Topics: []kafka.Topic{{Name: "billing"}}},
+					},
+				},
+			},
+			wantTopics: []string{"all"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var gotTopics []string
+			p := mocks.NewSyncProducer(t, nil)
+			for range tt.wantTopics {
+				p.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+					gotTopics = append(gotTopics, msg.Topic)
+					if tt.wantHeader != nil {
+						assert.Contains(t, msg.Headers, *tt.wantHeader)
+					}
+
+					return nil
+				})
+			}
+
+			d, err := kafka.NewEventDispatcher(p, &clusterAdminMock{}, tt.routing, nil, nil, nil, kafka.TransactionMetadata{})
+			require.NoError(t, err)
+
+			err = d.Dispatch(event)
+			if tt.wantErr != nil {
+				require.Error(t, err)
+				if errors.Is(tt.wantErr, kafka.ErrUnroutableEvent) {
+					assert.ErrorIs(t, err, tt.wantErr)
+				} else {
+					assert.EqualError(t, err, tt.wantErr.Error())
+				}
+			} else {
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, tt.wantTopics, gotTopics)
+			require.NoError(t, p.Close())
+		})
+	}
+}
+
+func TestNewEventDispatcher_WhenDeadLetterPolicyWithoutTopic(t *testing.T) {
+	_, err := kafka.NewEventDispatcher(
+		mocks.NewSyncProducer(t, nil),
+		&clusterAdminMock{},
+		kafka.Routing{UnmatchedPolicy: kafka.DeadLetterUnmatched},
+		nil,
+		nil,
+		nil,
+		kafka.TransactionMetadata{},
+	)
+	assert.Error(t, err)
+
+	_, err = kafka.NewEventDispatcher(
+		mocks.NewSyncProducer(t, nil),
+		&clusterAdminMock{},
+		kafka.Routing{Tables: []kafka.TableRouting{
+			{Schema: "sales", Table: "outbox", Routing: kafka.Routing{UnmatchedPolicy: kafka.DeadLetterUnmatched}},
+		}},
+		nil,
+		nil,
+		nil,
+		kafka.TransactionMetadata{},
+	)
+	assert.Error(t, err)
+}
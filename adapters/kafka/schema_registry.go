@@ -0,0 +1,225 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ErrIncompatibleValue is returned when the value of a message does not match the schema of its topic.
+var ErrIncompatibleValue = errors.New("value is incompatible with the schema")
+
+const (
+	schemaRegistryMagicByte   = 0
+	schemaRegistryContentType = "application/vnd.schemaregistry.v1+json"
+
+	schemaTypeAvro     = "AVRO"
+	schemaTypeProtobuf = "PROTOBUF"
+)
+
+type IncompatiblePolicy string
+
+const (
+	// FailIncompatible makes the dispatch fail, the run.PoisonEventPolicy of the router applies.
+	FailIncompatible IncompatiblePolicy = "fail"
+	// DeadLetterIncompatible writes the incompatible events as they are on the dead-letter topic of the routing.
+	DeadLetterIncompatible IncompatiblePolicy = "dead-letter"
+)
+
+func ParseIncompatiblePolicy(s string) (IncompatiblePolicy, error) {
+	switch p := IncompatiblePolicy(s); p {
+	case "":
+		return FailIncompatible, nil
+	case FailIncompatible, DeadLetterIncompatible:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown incompatible policy: %s", s)
+	}
+}
+
+// SchemaRegistryClient reads schemas from a Confluent Schema Registry.
+type SchemaRegistryClient struct {
+	baseURL    string
+	httpClient *http.Client
+	username   string
+	password   string
+}
+
+// NewSchemaRegistryClient returns a client of the registry at baseURL, using http.DefaultClient when httpClient is
+// nil. Requests are authenticated with basic auth when username is set.
+func NewSchemaRegistryClient(baseURL string, httpClient *http.Client, username, password string) *SchemaRegistryClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &SchemaRegistryClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: httpClient,
+		username:   username,
+		password:   password,
+	}
+}
+
+type registeredSchema struct {
+	Subject    string `json:"subject"`
+	Version    int    `json:"version"`
+	ID         uint32 `json:"id"`
+	SchemaType string `json:"schemaType"`
+	Schema     string `json:"schema"`
+}
+
+type schemaRegistryError struct {
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+// latestSchema returns the latest version of the schema of the subject.
+func (c *SchemaRegistryClient) latestSchema(subject string) (registeredSchema, error) {
+	req, err := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("%s/subjects/%s/versions/latest", c.baseURL, url.PathEscape(subject)),
+		nil,
+	)
+	if err != nil {
+		return registeredSchema{}, err
+	}
+	req.Header.Set("Accept", schemaRegistryContentType)
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return registeredSchema{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return registeredSchema{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var e schemaRegistryError
+		if json.Unmarshal(body, &e) != nil || e.Message == "" {
+			e.Message = http.StatusText(resp.StatusCode)
+		}
+
+		return registeredSchema{}, fmt.Errorf("schema registry error reading subject %s: %d %s",
+			subject, resp.StatusCode, e.Message)
+	}
+
+	var s registeredSchema
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		return registeredSchema{}, err
+	}
+
+	if s.SchemaType == "" {
+		s.SchemaType = schemaTypeAvro
+	}
+
+	return s, nil
+}
+
+// SchemaRegistrySerializer encodes the JSON values of the messages with the latest schema of the subject of their
+// topic, in the Confluent wire format: a zero magic byte, the schema ID as a 4 bytes big-endian integer and the
+// Avro or Protobuf encoded value. Protobuf values are encoded with the first message of the schema.
+// Schemas are read once per subject.
+type SchemaRegistrySerializer struct {
+	client             *SchemaRegistryClient
+	subjects           map[string]string
+	incompatiblePolicy IncompatiblePolicy
+
+	mu       sync.Mutex
+	encoders map[string]valueEncoder
+}
+
+type valueEncoder interface {
+	encode(value []byte) ([]byte, error)
+}
+
+// NewSchemaRegistrySerializer returns a SchemaRegistrySerializer reading the subject of each topic from subjects,
+// falling back to the topic name strategy of Confluent serializers, i.e. <topic>-value.
+func NewSchemaRegistrySerializer(
+	client *SchemaRegistryClient,
+	subjects map[string]string,
+	incompatiblePolicy IncompatiblePolicy,
+) (*SchemaRegistrySerializer, error) {
+	p, err := ParseIncompatiblePolicy(string(incompatiblePolicy))
+	if err != nil {
+		return nil, err
+	}
+
+	return &SchemaRegistrySerializer{
+		client:             client,
+		subjects:           subjects,
+		incompatiblePolicy: p,
+		encoders:           map[string]valueEncoder{},
+	}, nil
+}
+
+func (s *SchemaRegistrySerializer) subject(topic string) string {
+	if subject, ok := s.subjects[topic]; ok {
+		return subject
+	}
+
+	return topic + "-value"
+}
+
+// serialize returns the value encoded for the topic, or an error wrapping ErrIncompatibleValue when the value
+// does not match the schema.
+func (s *SchemaRegistrySerializer) serialize(topic string, value []byte) ([]byte, error) {
+	e, err := s.encoder(s.subject(topic))
+	if err != nil {
+		return nil, err
+	}
+
+	return e.encode(value)
+}
+
+func (s *SchemaRegistrySerializer) encoder(subject string) (valueEncoder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.encoders[subject]; ok {
+		return e, nil
+	}
+
+	rs, err := s.client.latestSchema(subject)
+	if err != nil {
+		return nil, err
+	}
+
+	var e valueEncoder
+	switch rs.SchemaType {
+	case schemaTypeAvro:
+		e, err = newAvroEncoder(rs.ID, rs.Schema)
+	case schemaTypeProtobuf:
+		e, err = newProtobufEncoder(rs.ID, rs.Schema)
+	default:
+		err = fmt.Errorf("unsupported schema type: %s", rs.SchemaType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w. Subject: %s", err, subject)
+	}
+
+	s.encoders[subject] = e
+
+	return e, nil
+}
+
+// wireFormatHeader returns the prefix of the values encoded with the schema.
+func wireFormatHeader(schemaID uint32) []byte {
+	b := make([]byte, 5)
+	b[0] = schemaRegistryMagicByte
+	binary.BigEndian.PutUint32(b[1:], schemaID)
+
+	return b
+}
@@ -0,0 +1,344 @@
+package kafka_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/linkedin/goavro/v2"
+	"github.com/lorenzoranucci/tor/adapters/kafka"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const orderAvroSchema = `{
+	"type": "record",
+	"name": "Order",
+	"namespace": "com.example",
+	"fields": [
+		{"name": "id", "type": "string"},
+		{"name": "quantity", "type": "int"},
+		{"name": "note", "type": ["null", "string"], "default": null},
+		{"name": "customer", "type": ["null", {
+			"type": "record",
+			"name": "Customer",
+			"fields": [{"name": "name", "type": "string"}]
+		}], "default": null},
+		{"name": "tags", "type": {"type": "array", "items": "string"}, "default": []}
+	]
+}`
+
+const orderProtobufSchema = `syntax = "proto3";
+package com.example;
+
+message Order {
+  string id = 1;
+  int32 quantity = 2;
+  repeated string tags = 3;
+}
+
+message Invoice {
+  string id = 1;
+}
+`
+
+func TestEventDispatcher_Dispatch_SchemaRegistry(t *testing.T) {
+	registry := newFakeSchemaRegistry(t)
+	registry.register("order-value", 7, "", orderAvroSchema)
+	registry.register("order-proto", 8, "PROTOBUF", orderProtobufSchema)
+
+	tests := []struct {
+		name               string
+		subjects           map[string]string
+		incompatiblePolicy kafka.IncompatiblePolicy
+		payload            string
+		wantTopic          string
+		wantSchemaID       uint32
+		wantAvro           map[string]interface{}
+		wantProtobuf       map[string]interface{}
+		wantRawValue       bool
+		wantErr            error
+		wantErrContains    string
+	}{
+		{
+			name:         "when schema is avro then value is encoded with the latest schema of the topic subject",
+			payload:      `{"id": "o-1", "quantity": 2, "note": "fragile", "customer": {"name": "acme"}}`,
+			wantTopic:    "order",
+			wantSchemaID: 7,
+			wantAvro: map[string]interface{}{
+				"id":       "o-1",
+				"quantity": int32(2),
+				"note":     map[string]interface{}{"string": "fragile"},
+				"customer": map[string]interface{}{"com.example.Customer": map[string]interface{}{"name": "acme"}},
+				"tags":     []interface{}{},
+			},
+		},
+		{
+			name:         "when optional avro fields are null or missing then defaults are used",
+			payload:      `{"id": "o-1", "quantity": 2, "customer": null, "tags": ["a"]}`,
+			wantTopic:    "order",
+			wantSchemaID: 7,
+			wantAvro: map[string]interface{}{
+				"id":       "o-1",
+				"quantity": int32(2),
+				"note":     nil,
+				"customer": nil,
+				"tags":     []interface{}{"a"},
+			},
+		},
+		{
+			name:         "when schema is protobuf then value is encoded with the first message",
+			subjects:     map[string]string{"order": "order-proto"},
+			payload:      `{"id": "o-1", "quantity": 2, "tags": ["a", "b"]}`,
+			wantTopic:    "order",
+			wantSchemaID: 8,
+			wantProtobuf: map[string]interface{}{"id": "o-1", "quantity": int32(2), "tags": []interface{}{"a", "b"}},
+		},
+		{
+			name:            "when avro value is incompatible then error",
+			payload:         `{"id": "o-1", "quantity": "two"}`,
+			wantErr:         kafka.ErrIncompatibleValue,
+			wantErrContains: "quantity: expected int, got two",
+		},
+		{
+			name:            "when avro value has unknown fields then error",
+			payload:         `{"id": "o-1", "quantity": 2, "price": 10}`,
+			wantErr:         kafka.ErrIncompatibleValue,
+			wantErrContains: "unknown field: price",
+		},
+		{
+			name:     "when protobuf value is incompatible then error",
+			subjects: map[string]string{"order": "order-proto"},
+			payload:  `{"id": "o-1", "price": 10}`,
+			wantErr:  kafka.ErrIncompatibleValue,
+		},
+		{
+			name:               "when value is incompatible and policy is dead-letter then raw value is dead-lettered",
+			incompatiblePolicy: kafka.DeadLetterIncompatible,
+			payload:            `{"id": "o-1"}`,
+			wantTopic:          "tor_dead_letter",
+			wantRawValue:       true,
+		},
+		{
+			name:            "when subject is missing then error",
+			subjects:        map[string]string{"order": "missing"},
+			payload:         `{"id": "o-1", "quantity": 2}`,
+			wantErrContains: "schema registry error reading subject missing: 404 Subject 'missing' not found.",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := kafka.NewSchemaRegistrySerializer(
+				kafka.NewSchemaRegistryClient(registry.server.URL, nil, "user", "secret"),
+				tt.subjects,
+				tt.incompatiblePolicy,
+			)
+			require.NoError(t, err)
+
+			p := mocks.NewSyncProducer(t, nil)
+			if tt.wantTopic != "" {
+				p.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+					assert.Equal(t, tt.wantTopic, msg.Topic)
+
+					value, err := msg.Value.Encode()
+					require.NoError(t, err)
+
+					if tt.wantRawValue {
+						assert.Equal(t, tt.payload, string(value))
+						assert.Equal(t, "incompatible", headerValue(msg.Headers, "tor_dead_letter_reason"))
+						assert.Contains(t, headerValue(msg.Headers, "tor_dead_letter_error"), "quantity")
+						return nil
+					}
+
+					require.Greater(t, len(value), 5)
+					assert.Equal(t, byte(0), value[0])
+					assert.Equal(t, tt.wantSchemaID, binary.BigEndian.Uint32(value[1:5]))
+
+					if tt.wantAvro != nil {
+						codec, err := goavro.NewCodec(orderAvroSchema)
+						require.NoError(t, err)
+						native, _, err := codec.NativeFromBinary(value[5:])
+						require.NoError(t, err)
+						assert.Equal(t, tt.wantAvro, native)
+					}
+
+					if tt.wantProtobuf != nil {
+						// message indexes of the first message
+						assert.Equal(t, byte(0), value[5])
+						m := decodeProtobuf(t, value[6:])
+						for k, v := range tt.wantProtobuf {
+							assert.Equal(t, v, m.GetFieldByName(k))
+						}
+					}
+
+					return nil
+				})
+			}
+
+			d, err := kafka.NewEventDispatcher(
+				p,
+				&clusterAdminMock{},
+				kafka.Routing{
+					Topics:          []kafka.Topic{{Name: "order"}},
+					DeadLetterTopic: &kafka.Topic{Name: "tor_dead_letter"},
+				},
+				nil,
+				nil,
+				s,
+				kafka.TransactionMetadata{},
+			)
+			require.NoError(t, err)
+
+			err = d.Dispatch(run.OutboxEvent{
+				AggregateID:   []byte("o-1"),
+				AggregateType: []byte("order"),
+				Payload:       []byte(tt.payload),
+			})
+			if tt.wantErr != nil || tt.wantErrContains != "" {
+				require.Error(t, err)
+				if tt.wantErr != nil {
+					assert.ErrorIs(t, err, tt.wantErr)
+				}
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+			} else {
+				assert.NoError(t, err)
+			}
+			require.NoError(t, p.Close())
+		})
+	}
+
+	assert.Equal(t, []string{"order-value", "order-proto", "missing"}, registry.requestedSubjects())
+	assert.True(t, registry.authenticated())
+}
+
+func TestNewSchemaRegistrySerializer(t *testing.T) {
+	_, err := kafka.NewSchemaRegistrySerializer(kafka.NewSchemaRegistryClient("", nil, "", ""), nil, "ignore")
+	assert.Error(t, err)
+
+	s, err := kafka.NewSchemaRegistrySerializer(
+		kafka.NewSchemaRegistryClient("", nil, "", ""),
+		nil,
+		kafka.DeadLetterIncompatible,
+	)
+	require.NoError(t, err)
+
+	_, err = kafka.NewEventDispatcher(
+		mocks.NewSyncProducer(t, nil),
+		&clusterAdminMock{},
+		kafka.Routing{Topics: []kafka.Topic{{Name: "order"}}},
+		nil,
+		nil,
+		s,
+		kafka.TransactionMetadata{},
+	)
+	assert.EqualError(t, err, "dead-letter incompatible policy requires a dead-letter topic")
+}
+
+func decodeProtobuf(t *testing.T, b []byte) *dynamic.Message {
+	fds, err := protoparse.Parser{
+		Accessor: protoparse.FileContentsFromMap(map[string]string{"order.proto": orderProtobufSchema}),
+	}.ParseFiles("order.proto")
+	require.NoError(t, err)
+
+	m := dynamic.NewMessage(fds[0].FindMessage("com.example.Order"))
+	require.NoError(t, m.Unmarshal(b))
+
+	return m
+}
+
+func headerValue(headers []sarama.RecordHeader, key string) string {
+	for _, h := range headers {
+		if string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+
+	return ""
+}
+
+// fakeSchemaRegistry serves the latest version of the registered subjects, as a Confluent Schema Registry does.
+type fakeSchemaRegistry struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	schemas  map[string]map[string]interface{}
+	subjects []string
+	auth     bool
+}
+
+func newFakeSchemaRegistry(t *testing.T) *fakeSchemaRegistry {
+	r := &fakeSchemaRegistry{schemas: map[string]map[string]interface{}{}}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	t.Cleanup(r.server.Close)
+
+	return r
+}
+
+func (r *fakeSchemaRegistry) register(subject string, id int, schemaType string, schema string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := map[string]interface{}{"subject": subject, "version": 1, "id": id, "schema": schema}
+	if schemaType != "" {
+		s["schemaType"] = schemaType
+	}
+	r.schemas[subject] = s
+}
+
+func (r *fakeSchemaRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	username, password, ok := req.BasicAuth()
+	r.auth = ok && username == "user" && password == "secret"
+
+	subject := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/subjects/"), "/versions/latest")
+	r.subjects = append(r.subjects, subject)
+
+	w.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	s, ok := r.schemas[subject]
+	if req.Method != http.MethodGet || !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"error_code": 40401,
+			"message":    "Subject '" + subject + "' not found.",
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(s)
+}
+
+func (r *fakeSchemaRegistry) requestedSubjects() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var subjects []string
+	seen := map[string]struct{}{}
+	for _, s := range r.subjects {
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		subjects = append(subjects, s)
+	}
+
+	return subjects
+}
+
+func (r *fakeSchemaRegistry) authenticated() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.auth
+}
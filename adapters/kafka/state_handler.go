@@ -0,0 +1,181 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+)
+
+const defaultStateReadTimeout = 5 * time.Second
+
+// NewStateHandler returns a StateHandler reading the last checkpoint from the state topic of the dispatcher,
+// and writing it through the dispatcher.
+// The state topic is read with read_committed fetch requests up to its last stable offset: the control records
+// closing the transactions, never returned to consumers, are accounted for by offset.
+// readTimeout bounds the whole read, when exceeded GetLastCheckpoint fails.
+func NewStateHandler(
+	client sarama.Client,
+	dispatcher *TransactionalEventDispatcher,
+	readTimeout time.Duration,
+) *StateHandler {
+	actualReadTimeout := defaultStateReadTimeout
+	if readTimeout != 0 {
+		actualReadTimeout = readTimeout
+	}
+
+	return &StateHandler{client: client, dispatcher: dispatcher, readTimeout: actualReadTimeout}
+}
+
+type StateHandler struct {
+	client      sarama.Client
+	dispatcher  *TransactionalEventDispatcher
+	readTimeout time.Duration
+}
+
+// GetLastCheckpoint returns the last committed checkpoint of the state topic. The JSON positions written by the
+// previous versions are migrated to version 1 checkpoints, whose data they are.
+func (s *StateHandler) GetLastCheckpoint() (run.Checkpoint, error) {
+	topic := s.dispatcher.stateTopic
+
+	oldest, err := s.client.GetOffset(topic, 0, sarama.OffsetOldest)
+	if err != nil {
+		return nil, err
+	}
+
+	newest, err := s.client.GetOffset(topic, 0, sarama.OffsetNewest)
+	if err != nil {
+		return nil, err
+	}
+
+	if oldest == newest {
+		return nil, nil
+	}
+
+	broker, err := s.client.Leader(topic, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &stateReader{key: s.dispatcher.stateKey, abortedProducerIDs: map[int64]struct{}{}}
+	deadline := time.Now().Add(s.readTimeout)
+	for offset := oldest; offset < newest; {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("reading state topic %s timed out at offset %d of %d", topic, offset, newest)
+		}
+
+		req := &sarama.FetchRequest{
+			Version:     4,
+			MaxWaitTime: int32(s.readTimeout / time.Millisecond),
+			MinBytes:    1,
+			MaxBytes:    sarama.MaxResponseSize,
+			Isolation:   sarama.ReadCommitted,
+		}
+		req.AddBlock(topic, 0, offset, stateFetchSize)
+
+		res, err := broker.Fetch(req)
+		if err != nil {
+			return nil, err
+		}
+
+		block := res.GetBlock(topic, 0)
+		if block == nil {
+			return nil, fmt.Errorf("state topic %s missing from the fetch response", topic)
+		}
+		if !errors.Is(block.Err, sarama.ErrNoError) {
+			return nil, block.Err
+		}
+
+		// the records of the open transactions are not returned until they are committed or aborted
+		if block.LastStableOffset >= 0 && block.LastStableOffset < newest {
+			newest = block.LastStableOffset
+		}
+
+		offset = r.read(block, offset)
+	}
+
+	if len(r.value) == 0 {
+		return nil, nil
+	}
+
+	if r.value[0] == '{' {
+		return run.NewCheckpoint(run.CheckpointV1, r.value), nil
+	}
+
+	return r.value, nil
+}
+
+// SetLastCheckpoint writes the checkpoint through the dispatcher, that skips the one of the last committed
+// transaction and the ones preceding it.
+func (s *StateHandler) SetLastCheckpoint(c run.Checkpoint) error {
+	p, err := run.DecodeCheckpoint(c)
+	if err != nil {
+		return err
+	}
+
+	return s.dispatcher.SetLastPosition(p)
+}
+
+// stateFetchSize is the maximum size of the records of the state topic returned by each fetch request.
+const stateFetchSize = 1 << 20
+
+// stateReader reads the last value of the state key from the record batches of read_committed fetch responses,
+// skipping the control records and the records of the aborted transactions as consumers do.
+type stateReader struct {
+	key                string
+	abortedProducerIDs map[int64]struct{}
+	value              []byte
+}
+
+// read reads the record batches of the block from offset, and returns the offset following them.
+func (r *stateReader) read(block *sarama.FetchResponseBlock, offset int64) int64 {
+	aborted := make([]*sarama.AbortedTransaction, len(block.AbortedTransactions))
+	copy(aborted, block.AbortedTransactions)
+	sort.Slice(aborted, func(i, j int) bool {
+		return aborted[i].FirstOffset < aborted[j].FirstOffset
+	})
+
+	next := offset
+	for _, records := range block.RecordsSet {
+		batch := records.RecordBatch
+		if batch == nil || batch.LastOffset() < offset {
+			continue
+		}
+		if batch.LastOffset() >= next {
+			next = batch.LastOffset() + 1
+		}
+
+		for len(aborted) > 0 && aborted[0].FirstOffset <= batch.LastOffset() {
+			r.abortedProducerIDs[aborted[0].ProducerID] = struct{}{}
+			aborted = aborted[1:]
+		}
+
+		if batch.Control {
+			if len(batch.Records) > 0 && isAbortMarker(batch.Records[0].Key) {
+				delete(r.abortedProducerIDs, batch.ProducerID)
+			}
+			continue
+		}
+
+		if _, ok := r.abortedProducerIDs[batch.ProducerID]; ok && batch.IsTransactional {
+			continue
+		}
+
+		for _, rec := range batch.Records {
+			if batch.FirstOffset+rec.OffsetDelta >= offset && string(rec.Key) == r.key {
+				r.value = rec.Value
+			}
+		}
+	}
+
+	return next
+}
+
+// isAbortMarker reports whether the key of a control record, its version and type, is the one of an abort marker.
+func isAbortMarker(key []byte) bool {
+	return len(key) >= 4 && binary.BigEndian.Uint16(key[2:4]) == uint16(sarama.ControlRecordAbort)
+}
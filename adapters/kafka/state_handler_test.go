@@ -0,0 +1,126 @@
+package kafka_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/lorenzoranucci/tor/adapters/kafka"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateHandler_GetLastCheckpoint(t *testing.T) {
+	c1 := run.NewCheckpoint(run.CheckpointV1, []byte(`{"name":"mysql-bin.000001","pos":200}`))
+	c2 := run.NewCheckpoint(run.CheckpointV1, []byte(`{"name":"mysql-bin.000001","pos":400}`))
+
+	tests := []struct {
+		name string
+		// records adds the records of the state topic to the fetch response, and returns the newest offset
+		records func(res *sarama.FetchResponse) int64
+		want    run.Checkpoint
+	}{
+		{
+			name: "empty topic",
+			records: func(res *sarama.FetchResponse) int64 {
+				return 0
+			},
+		},
+		{
+			name: "committed transactions",
+			records: func(res *sarama.FetchResponse) int64 {
+				res.AddRecordBatch("tor_state", 0, sarama.StringEncoder("last_position"), sarama.ByteEncoder(c1), 0, 1, true)
+				res.AddControlRecord("tor_state", 0, 1, 1, sarama.ControlRecordCommit)
+				res.AddRecordBatch("tor_state", 0, sarama.StringEncoder("last_position"), sarama.ByteEncoder(c2), 2, 1, true)
+				res.AddControlRecord("tor_state", 0, 3, 1, sarama.ControlRecordCommit)
+				return 4
+			},
+			want: c2,
+		},
+		{
+			name: "aborted last transaction",
+			records: func(res *sarama.FetchResponse) int64 {
+				res.AddRecordBatch("tor_state", 0, sarama.StringEncoder("last_position"), sarama.ByteEncoder(c1), 0, 1, true)
+				res.AddControlRecord("tor_state", 0, 1, 1, sarama.ControlRecordCommit)
+				res.AddRecordBatch("tor_state", 0, sarama.StringEncoder("last_position"), sarama.ByteEncoder(c2), 2, 2, true)
+				res.AddControlRecord("tor_state", 0, 3, 2, sarama.ControlRecordAbort)
+				res.GetBlock("tor_state", 0).AbortedTransactions = []*sarama.AbortedTransaction{
+					{ProducerID: 2, FirstOffset: 2},
+				}
+				return 4
+			},
+			want: c1,
+		},
+		{
+			name: "other keys",
+			records: func(res *sarama.FetchResponse) int64 {
+				res.AddRecordBatch("tor_state", 0, sarama.StringEncoder("last_position"), sarama.ByteEncoder(c1), 0, 1, true)
+				res.AddRecordBatch("tor_state", 0, sarama.StringEncoder("other"), sarama.ByteEncoder(c2), 1, 1, true)
+				res.AddControlRecord("tor_state", 0, 2, 1, sarama.ControlRecordCommit)
+				return 3
+			},
+			want: c1,
+		},
+		{
+			name: "JSON position",
+			records: func(res *sarama.FetchResponse) int64 {
+				res.AddRecordBatch(
+					"tor_state", 0,
+					sarama.StringEncoder("last_position"), sarama.StringEncoder(`{"name":"mysql-bin.000001","pos":200}`),
+					0, 1, true,
+				)
+				res.AddControlRecord("tor_state", 0, 1, 1, sarama.ControlRecordCommit)
+				return 2
+			},
+			want: c1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &sarama.FetchResponse{Version: 4}
+			newest := tt.records(res)
+			res.SetLastStableOffset("tor_state", 0, newest)
+
+			b := sarama.NewMockBroker(t, 1)
+			defer b.Close()
+			b.SetHandlerByMap(map[string]sarama.MockResponse{
+				"MetadataRequest": sarama.NewMockMetadataResponse(t).
+					SetBroker(b.Addr(), b.BrokerID()).
+					SetLeader("tor_state", 0, b.BrokerID()),
+				"OffsetRequest": sarama.NewMockOffsetResponse(t).
+					SetOffset("tor_state", 0, sarama.OffsetOldest, 0).
+					SetOffset("tor_state", 0, sarama.OffsetNewest, newest),
+				"FetchRequest": sarama.NewMockWrapper(res),
+			})
+
+			config := sarama.NewConfig()
+			config.Version = sarama.V2_0_0_0
+			client, err := sarama.NewClient([]string{b.Addr()}, config)
+			require.NoError(t, err)
+			defer client.Close()
+
+			d, err := kafka.NewTransactionalEventDispatcher(
+				mocks.NewAsyncProducer(t, kafka.NewTransactionalProducerConfig("tor")),
+				&clusterAdminMock{},
+				kafka.Routing{},
+				nil,
+				nil,
+				nil,
+				kafka.TransactionMetadata{},
+				kafka.Topic{Name: "tor_state"},
+				"last_position",
+			)
+			require.NoError(t, err)
+
+			// the control records closing the transactions are never returned, they must not be waited for
+			readTimeout := 10 * time.Second
+			start := time.Now()
+			c, err := kafka.NewStateHandler(client, d, readTimeout).GetLastCheckpoint()
+			require.NoError(t, err)
+			assert.Less(t, time.Since(start), readTimeout/2)
+			assert.Equal(t, tt.want, c)
+		})
+	}
+}
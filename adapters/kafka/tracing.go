@@ -0,0 +1,56 @@
+package kafka
+
+import (
+	"context"
+
+	"github.com/Shopify/sarama"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// injectTraceContext sets the W3C trace context of the event in the headers, replacing any header with the same key,
+// so that consumers continue the trace of the event.
+func injectTraceContext(event run.OutboxEvent, headers []sarama.RecordHeader) []sarama.RecordHeader {
+	if !event.SpanContext.IsValid() {
+		return headers
+	}
+
+	c := headersCarrier(headers)
+	propagation.TraceContext{}.Inject(trace.ContextWithSpanContext(context.Background(), event.SpanContext), &c)
+
+	return c
+}
+
+// headersCarrier adapts the record headers to propagation.TextMapCarrier.
+type headersCarrier []sarama.RecordHeader
+
+func (c *headersCarrier) Get(key string) string {
+	for _, h := range *c {
+		if string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+
+	return ""
+}
+
+func (c *headersCarrier) Set(key, value string) {
+	for i, h := range *c {
+		if string(h.Key) == key {
+			(*c)[i].Value = []byte(value)
+			return
+		}
+	}
+
+	*c = append(*c, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+}
+
+func (c *headersCarrier) Keys() []string {
+	keys := make([]string, 0, len(*c))
+	for _, h := range *c {
+		keys = append(keys, string(h.Key))
+	}
+
+	return keys
+}
@@ -0,0 +1,85 @@
+package kafka_test
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/lorenzoranucci/tor/adapters/kafka"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestEventDispatcher_Dispatch_TraceContext(t *testing.T) {
+	traceID, err := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	require.NoError(t, err)
+	spanID, err := trace.SpanIDFromHex("00f067aa0ba902b7")
+	require.NoError(t, err)
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	})
+
+	tests := []struct {
+		name           string
+		spanContext    trace.SpanContext
+		headerMappings []kafka.HeaderMapping
+		wantHeaders    []sarama.RecordHeader
+	}{
+		{
+			name:        "when event has a span context then it is injected in headers",
+			spanContext: spanContext,
+			wantHeaders: []sarama.RecordHeader{
+				{Key: []byte("traceparent"), Value: []byte("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")},
+			},
+		},
+		{
+			name:           "when a header mapping has the same key then it is replaced",
+			spanContext:    spanContext,
+			headerMappings: []kafka.HeaderMapping{{ColumnName: "traceparent", HeaderName: "traceparent"}},
+			wantHeaders: []sarama.RecordHeader{
+				{Key: []byte("traceparent"), Value: []byte("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")},
+			},
+		},
+		{
+			name:        "when event has no span context then no header is added",
+			wantHeaders: []sarama.RecordHeader{},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := mocks.NewSyncProducer(t, nil)
+			p.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+				assert.Equal(t, tt.wantHeaders, msg.Headers)
+				return nil
+			})
+
+			d, err := kafka.NewEventDispatcher(
+				p,
+				&clusterAdminMock{},
+				kafka.Routing{Topics: []kafka.Topic{{Name: "order"}}},
+				tt.headerMappings,
+				nil,
+				nil,
+				kafka.TransactionMetadata{},
+			)
+			require.NoError(t, err)
+
+			err = d.Dispatch(run.OutboxEvent{
+				AggregateID:   []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c"),
+				AggregateType: []byte("order"),
+				Payload:       []byte(`{"name": "new order"}`),
+				Columns: []run.Column{
+					{Name: []byte("traceparent"), Value: []byte("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")},
+				},
+				SpanContext: tt.spanContext,
+			})
+			require.NoError(t, err)
+			require.NoError(t, p.Close())
+		})
+	}
+}
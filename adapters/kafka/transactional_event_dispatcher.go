@@ -0,0 +1,286 @@
+package kafka
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+)
+
+// NewTransactionalEventDispatcher returns an EventDispatcher writing the events of each binlog transaction in a
+// Kafka transaction, together with the binlog position following them, which is written on the compacted
+// state topic. Consumers reading with read_committed isolation level see each event exactly once.
+// The producer must be transactional and return both successes and errors (see NewTransactionalProducerConfig).
+// The position written on the state topic is read by the StateHandler.
+func NewTransactionalEventDispatcher(
+	asyncProducer sarama.AsyncProducer,
+	admin sarama.ClusterAdmin,
+	routing Routing,
+	headerMappings []HeaderMapping,
+	envelope Envelope,
+	serializer *SchemaRegistrySerializer,
+	transactionMetadata TransactionMetadata,
+	stateTopic Topic,
+	stateKey string,
+) (*TransactionalEventDispatcher, error) {
+	if !asyncProducer.IsTransactional() {
+		return nil, errors.New("producer is not transactional")
+	}
+
+	stateTopic.TopicDetail = compactedTopicDetail(stateTopic.TopicDetail)
+
+	err := createTopics([]Topic{stateTopic}, admin)
+	if err != nil {
+		return nil, err
+	}
+
+	mm, err := newMessageMapper(admin, routing, headerMappings, envelope, serializer, transactionMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &TransactionalEventDispatcher{
+		asyncProducer: asyncProducer,
+		admin:         admin,
+		stateTopic:    stateTopic.Name,
+		stateKey:      stateKey,
+		messageMapper: mm,
+	}
+
+	d.readersWg.Add(2)
+	go d.readSuccesses()
+	go d.readErrors()
+
+	return d, nil
+}
+
+// NewTransactionalProducerConfig returns a configuration for the producer of a TransactionalEventDispatcher,
+// which is suitable for the client of the StateHandler too.
+func NewTransactionalProducerConfig(transactionalID string) *sarama.Config {
+	config := NewAsyncProducerConfig()
+	config.Producer.Transaction.ID = transactionalID
+	config.Consumer.IsolationLevel = sarama.ReadCommitted
+
+	return config
+}
+
+type TransactionalEventDispatcher struct {
+	messageMapper
+
+	asyncProducer sarama.AsyncProducer
+	admin         sarama.ClusterAdmin
+	stateTopic    string
+	stateKey      string
+	readersWg     sync.WaitGroup
+
+	// mu guards the current transaction.
+	mu sync.Mutex
+	tx *transaction
+	// lastCommitted is the last position written on the state topic.
+	lastCommitted *run.Position
+}
+
+// transaction holds the events dispatched in the current Kafka transaction.
+type transaction struct {
+	acks []func(error)
+	// produced is done when every message of the transaction has been either delivered or failed.
+	produced sync.WaitGroup
+	errMu    sync.Mutex
+	err      error
+}
+
+func (t *transaction) done(err error) {
+	if err != nil {
+		t.errMu.Lock()
+		if t.err == nil {
+			t.err = err
+		}
+		t.errMu.Unlock()
+	}
+
+	t.produced.Done()
+}
+
+// DispatchAsync writes the event in the current transaction, which is begun if needed.
+// The event is acknowledged when the transaction is committed or aborted.
+func (k *TransactionalEventDispatcher) DispatchAsync(event run.OutboxEvent, ack func(error)) error {
+	messages, err := k.mapMessages(event)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	tx, err := k.beginTx()
+	if err != nil {
+		return err
+	}
+
+	tx.acks = append(tx.acks, ack)
+	k.produce(tx, messages...)
+
+	return nil
+}
+
+// Dispatch writes the event in the current transaction, it does not wait for the event delivery, which happens
+// on commit.
+func (k *TransactionalEventDispatcher) Dispatch(event run.OutboxEvent) error {
+	return k.DispatchAsync(event, func(error) {})
+}
+
+// Commit writes the position on the state topic and commits the current transaction, if any.
+// When a message of the transaction was not delivered, the transaction is aborted and its events are
+// acknowledged with the error.
+func (k *TransactionalEventDispatcher) Commit(position run.Position) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.tx == nil {
+		return nil
+	}
+
+	return k.commitTx(position)
+}
+
+// SetLastPosition writes the position on the state topic in a dedicated transaction, unless a transaction
+// is in progress or the position, or a following one, has already been written.
+func (k *TransactionalEventDispatcher) SetLastPosition(position run.Position) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.tx != nil || (k.lastCommitted != nil && (position == *k.lastCommitted || position.Before(*k.lastCommitted))) {
+		return nil
+	}
+
+	_, err := k.beginTx()
+	if err != nil {
+		return err
+	}
+
+	return k.commitTx(position)
+}
+
+// Close aborts the current transaction, if any, and closes the producer.
+func (k *TransactionalEventDispatcher) Close() error {
+	k.mu.Lock()
+	if k.tx != nil {
+		k.abortTx(errors.New("event dispatcher closed"))
+	}
+	k.mu.Unlock()
+
+	k.asyncProducer.AsyncClose()
+	k.readersWg.Wait()
+
+	return k.admin.Close()
+}
+
+func (k *TransactionalEventDispatcher) beginTx() (*transaction, error) {
+	if k.tx != nil {
+		return k.tx, nil
+	}
+
+	err := k.asyncProducer.BeginTxn()
+	if err != nil {
+		return nil, err
+	}
+
+	k.tx = &transaction{}
+
+	return k.tx, nil
+}
+
+func (k *TransactionalEventDispatcher) commitTx(position run.Position) error {
+	tx := k.tx
+
+	value, err := run.EncodeCheckpoint(position)
+	if err != nil {
+		k.abortTx(err)
+		return err
+	}
+
+	k.produce(tx, &sarama.ProducerMessage{
+		Topic: k.stateTopic,
+		Key:   sarama.StringEncoder(k.stateKey),
+		Value: sarama.ByteEncoder(value),
+	})
+
+	tx.produced.Wait()
+	if tx.err != nil {
+		k.abortTx(tx.err)
+		return tx.err
+	}
+
+	err = k.asyncProducer.CommitTxn()
+	if err != nil {
+		k.abortTx(err)
+		return err
+	}
+
+	k.tx = nil
+	k.lastCommitted = &position
+	for _, ack := range tx.acks {
+		ack(nil)
+	}
+
+	return nil
+}
+
+// abortTx aborts the current transaction and acknowledges its events with err.
+func (k *TransactionalEventDispatcher) abortTx(err error) {
+	tx := k.tx
+	k.tx = nil
+
+	tx.produced.Wait()
+	_ = k.asyncProducer.AbortTxn()
+
+	for _, ack := range tx.acks {
+		ack(err)
+	}
+}
+
+func (k *TransactionalEventDispatcher) produce(tx *transaction, messages ...*sarama.ProducerMessage) {
+	for _, m := range messages {
+		tx.produced.Add(1)
+		m.Metadata = tx
+		k.asyncProducer.Input() <- m
+	}
+}
+
+func (k *TransactionalEventDispatcher) readSuccesses() {
+	defer k.readersWg.Done()
+
+	for m := range k.asyncProducer.Successes() {
+		m.Metadata.(*transaction).done(nil)
+	}
+}
+
+func (k *TransactionalEventDispatcher) readErrors() {
+	defer k.readersWg.Done()
+
+	for pe := range k.asyncProducer.Errors() {
+		pe.Msg.Metadata.(*transaction).done(pe.Err)
+	}
+}
+
+// compactedTopicDetail returns the detail of a single-partition compacted topic, based on d.
+func compactedTopicDetail(d *sarama.TopicDetail) *sarama.TopicDetail {
+	r := &sarama.TopicDetail{ReplicationFactor: 1}
+	if d != nil {
+		*r = *d
+	}
+
+	compact := "compact"
+	r.NumPartitions = 1
+	r.ConfigEntries = map[string]*string{"cleanup.policy": &compact}
+	if d != nil {
+		for k, v := range d.ConfigEntries {
+			if k != "cleanup.policy" {
+				r.ConfigEntries[k] = v
+			}
+		}
+	}
+
+	return r
+}
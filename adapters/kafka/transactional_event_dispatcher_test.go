@@ -0,0 +1,144 @@
+package kafka_test
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/lorenzoranucci/tor/adapters/kafka"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionalEventDispatcher_Commit(t *testing.T) {
+	expectedErr := errors.New("a")
+	position := run.Position{File: "mysql-bin.000001", Offset: 200}
+
+	isStateMessage := func(msg *sarama.ProducerMessage) error {
+		if msg.Topic != "tor_state" {
+			return errors.New("not a state message")
+		}
+
+		v, err := msg.Value.Encode()
+		if err != nil {
+			return err
+		}
+
+		if string(v) != "\x01"+`{"name":"mysql-bin.000001","pos":200}` {
+			return errors.New("unexpected state message value: " + string(v))
+		}
+
+		return nil
+	}
+
+	tests := []struct {
+		name       string
+		expect     func(p *mocks.AsyncProducer)
+		wantErr    error
+		wantAckErr error
+	}{
+		{
+			name: "when every message is delivered then events and position are committed",
+			expect: func(p *mocks.AsyncProducer) {
+				p.ExpectInputAndSucceed().
+					ExpectInputAndSucceed().
+					ExpectInputWithMessageCheckerFunctionAndSucceed(isStateMessage)
+			},
+		},
+		{
+			name: "when a message is not delivered then transaction is aborted",
+			expect: func(p *mocks.AsyncProducer) {
+				p.ExpectInputAndSucceed().
+					ExpectInputAndFail(expectedErr).
+					ExpectInputWithMessageCheckerFunctionAndSucceed(isStateMessage)
+			},
+			wantErr:    expectedErr,
+			wantAckErr: expectedErr,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := mocks.NewAsyncProducer(t, kafka.NewTransactionalProducerConfig("tor"))
+			tt.expect(p)
+
+			d := buildTransactionalEventDispatcher(t, p)
+
+			var acks []error
+			for i := 0; i < 2; i++ {
+				err := d.DispatchAsync(
+					run.OutboxEvent{AggregateType: []byte("order")},
+					func(err error) {
+						acks = append(acks, err)
+					},
+				)
+				require.NoError(t, err)
+			}
+			assert.Empty(t, acks)
+
+			err := d.Commit(position)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, []error{tt.wantAckErr, tt.wantAckErr}, acks)
+			assert.Equal(t, sarama.ProducerTxnFlagReady, p.TxnStatus())
+
+			require.NoError(t, d.Close())
+		})
+	}
+}
+
+func TestTransactionalEventDispatcher_CommitWithoutEvents(t *testing.T) {
+	p := mocks.NewAsyncProducer(t, kafka.NewTransactionalProducerConfig("tor"))
+
+	d := buildTransactionalEventDispatcher(t, p)
+
+	err := d.Commit(run.Position{File: "mysql-bin.000001", Offset: 200})
+	require.NoError(t, err)
+
+	require.NoError(t, d.Close())
+}
+
+func TestTransactionalEventDispatcher_SetLastPosition(t *testing.T) {
+	p := mocks.NewAsyncProducer(t, kafka.NewTransactionalProducerConfig("tor"))
+	p.ExpectInputAndSucceed().
+		ExpectInputAndSucceed()
+
+	d := buildTransactionalEventDispatcher(t, p)
+
+	err := d.SetLastPosition(run.Position{File: "mysql-bin.000001", Offset: 200})
+	require.NoError(t, err)
+
+	err = d.SetLastPosition(run.Position{File: "mysql-bin.000002", Offset: 4})
+	require.NoError(t, err)
+
+	// the last written position is not written again
+	err = d.SetLastPosition(run.Position{File: "mysql-bin.000002", Offset: 4})
+	require.NoError(t, err)
+
+	// older positions are not written
+	err = d.SetLastPosition(run.Position{File: "mysql-bin.000001", Offset: 300})
+	require.NoError(t, err)
+
+	require.NoError(t, d.Close())
+}
+
+func buildTransactionalEventDispatcher(t *testing.T, p sarama.AsyncProducer) *kafka.TransactionalEventDispatcher {
+	d, err := kafka.NewTransactionalEventDispatcher(
+		p,
+		&clusterAdminMock{},
+		kafka.Routing{Topics: []kafka.Topic{
+			{Name: "order", AggregateType: regexp.MustCompile("^order$")},
+		}},
+		nil,
+		nil,
+		nil,
+		kafka.TransactionMetadata{},
+		kafka.Topic{Name: "tor_state"},
+		"last_position",
+	)
+	require.NoError(t, err)
+
+	return d
+}
@@ -0,0 +1,117 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+)
+
+const defaultTableName = "tor_state"
+
+// ErrConcurrentUpdate is returned when setting a checkpoint that was updated by someone else since it was read.
+var ErrConcurrentUpdate = errors.New("checkpoint updated concurrently")
+
+// NewStateHandler returns a run.StateHandler storing the checkpoint in the row named name of the table tableName,
+// e.g. in the source database. The table, created by CreateTable, is not an outbox table so the router ignores
+// its changes.
+// The checkpoint is set with optimistic concurrency: it is updated only if its version is the one read by
+// GetLastCheckpoint or written by the last SetLastCheckpoint, otherwise ErrConcurrentUpdate is returned.
+func NewStateHandler(db *sql.DB, tableName string, name string) *StateHandler {
+	actualTableName := defaultTableName
+	if tableName != "" {
+		actualTableName = tableName
+	}
+
+	return &StateHandler{db: db, tableName: quoteIdentifier(actualTableName), name: name}
+}
+
+type StateHandler struct {
+	db        *sql.DB
+	tableName string
+	name      string
+
+	// version is the version of the checkpoint last read or written, zero when there was none.
+	version uint64
+}
+
+// CreateTable creates the table of the checkpoints when missing.
+func (s *StateHandler) CreateTable() error {
+	_, err := s.db.ExecContext(context.Background(), fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s ("+
+			"name VARCHAR(255) NOT NULL PRIMARY KEY, "+
+			"checkpoint BLOB NOT NULL, "+
+			"version BIGINT UNSIGNED NOT NULL"+
+			")",
+		s.tableName,
+	))
+
+	return err
+}
+
+func (s *StateHandler) GetLastCheckpoint() (run.Checkpoint, error) {
+	var c []byte
+	var version uint64
+	err := s.db.QueryRowContext(
+		context.Background(),
+		fmt.Sprintf("SELECT checkpoint, version FROM %s WHERE name = ?", s.tableName),
+		s.name,
+	).Scan(&c, &version)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.version = 0
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.version = version
+
+	return c, nil
+}
+
+func (s *StateHandler) SetLastCheckpoint(c run.Checkpoint) error {
+	var res sql.Result
+	var err error
+	if s.version == 0 {
+		res, err = s.db.ExecContext(
+			context.Background(),
+			fmt.Sprintf("INSERT IGNORE INTO %s (name, checkpoint, version) VALUES (?, ?, 1)", s.tableName),
+			s.name,
+			[]byte(c),
+		)
+	} else {
+		res, err = s.db.ExecContext(
+			context.Background(),
+			fmt.Sprintf(
+				"UPDATE %s SET checkpoint = ?, version = version + 1 WHERE name = ? AND version = ?",
+				s.tableName,
+			),
+			[]byte(c),
+			s.name,
+			s.version,
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrConcurrentUpdate
+	}
+
+	s.version++
+
+	return nil
+}
+
+func quoteIdentifier(s string) string {
+	return "`" + strings.ReplaceAll(s, "`", "``") + "`"
+}
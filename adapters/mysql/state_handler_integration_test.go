@@ -0,0 +1,167 @@
+//go:build integration
+
+package mysql_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+	mysql2 "github.com/lorenzoranucci/tor/adapters/mysql"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/lorenzoranucci/tor/router/pkg/run/runtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// defaultDSN is the database of the development environment, see .devenv/docker-compose.yaml.
+const defaultDSN = "guest:guest@tcp(127.0.0.1:3306)/my_schema"
+
+func TestStateHandler(t *testing.T) {
+	db := openDB(t)
+
+	runtest.StateHandlerSuite(t, func(t *testing.T) run.StateHandler {
+		s := mysql2.NewStateHandler(db, tableName(t, db), "orders")
+		require.NoError(t, s.CreateTable())
+
+		return s
+	})
+}
+
+func TestStateHandler_SharedTable(t *testing.T) {
+	db := openDB(t)
+	dropTable(t, db, "tor_state")
+
+	s := mysql2.NewStateHandler(db, "", "orders")
+	require.NoError(t, s.CreateTable())
+
+	var name string
+	require.NoError(t, db.QueryRowContext(context.Background(), "SHOW TABLES LIKE 'tor_state'").Scan(&name))
+	assert.Equal(t, "tor_state", name)
+
+	c, err := s.GetLastCheckpoint()
+	require.NoError(t, err)
+	assert.Empty(t, c)
+
+	c1, err := run.EncodeCheckpoint(run.Position{File: "mysql-bin.000001", Offset: 200})
+	require.NoError(t, err)
+	c2, err := run.EncodeCheckpoint(run.Position{File: "mysql-bin.000002", Offset: 4})
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetLastCheckpoint(c1))
+	require.NoError(t, s.SetLastCheckpoint(c2))
+
+	c, err = mysql2.NewStateHandler(db, "", "orders").GetLastCheckpoint()
+	require.NoError(t, err)
+	assert.Equal(t, c2, c)
+
+	// checkpoints with another name are independent
+	c, err = mysql2.NewStateHandler(db, "", "invoices").GetLastCheckpoint()
+	require.NoError(t, err)
+	assert.Empty(t, c)
+}
+
+func TestStateHandler_SetLastCheckpointConcurrentUpdate(t *testing.T) {
+	c1, err := run.EncodeCheckpoint(run.Position{File: "mysql-bin.000001", Offset: 200})
+	require.NoError(t, err)
+	c2, err := run.EncodeCheckpoint(run.Position{File: "mysql-bin.000001", Offset: 400})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		// read makes the handlers read the checkpoint before setting it
+		read bool
+	}{
+		{name: "first checkpoint"},
+		{name: "following checkpoint", read: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openDB(t)
+			table := tableName(t, db)
+			former := mysql2.NewStateHandler(db, table, "orders")
+			require.NoError(t, former.CreateTable())
+			current := mysql2.NewStateHandler(db, table, "orders")
+
+			if tt.read {
+				require.NoError(t, former.SetLastCheckpoint(c1))
+				_, err := former.GetLastCheckpoint()
+				require.NoError(t, err)
+				_, err = current.GetLastCheckpoint()
+				require.NoError(t, err)
+			}
+
+			require.NoError(t, current.SetLastCheckpoint(c2))
+
+			err := former.SetLastCheckpoint(c1)
+			assert.ErrorIs(t, err, mysql2.ErrConcurrentUpdate)
+
+			c, err := current.GetLastCheckpoint()
+			require.NoError(t, err)
+			assert.Equal(t, run.Checkpoint(c2), c)
+
+			// once read again, the checkpoint can be set
+			_, err = former.GetLastCheckpoint()
+			require.NoError(t, err)
+			assert.NoError(t, former.SetLastCheckpoint(c1))
+		})
+	}
+}
+
+func TestStateHandler_MissingTable(t *testing.T) {
+	db := openDB(t)
+	s := mysql2.NewStateHandler(db, tableName(t, db), "orders")
+
+	_, err := s.GetLastCheckpoint()
+	assert.Error(t, err)
+
+	err = s.SetLastCheckpoint(run.NewCheckpoint(run.CheckpointV1, []byte("{}")))
+	assert.Error(t, err)
+}
+
+// openDB opens the database of TOR_MYSQL_DSN, or of the development environment when unset.
+func openDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TOR_MYSQL_DSN")
+	if dsn == "" {
+		dsn = defaultDSN
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	require.NoError(t, db.PingContext(context.Background()))
+
+	return db
+}
+
+// tableName returns a table name unique to the test, dropping the table before and after it.
+func tableName(t *testing.T, db *sql.DB) string {
+	t.Helper()
+
+	name := "tor_state_" + strings.NewReplacer("/", "_", " ", "_").Replace(strings.ToLower(t.Name()))
+	if len(name) > 64 {
+		name = name[len(name)-64:]
+	}
+	dropTable(t, db, name)
+
+	return name
+}
+
+func dropTable(t *testing.T, db *sql.DB, name string) {
+	t.Helper()
+
+	query := fmt.Sprintf("DROP TABLE IF EXISTS `%s`", name)
+	_, err := db.ExecContext(context.Background(), query)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = db.ExecContext(context.Background(), query)
+	})
+}
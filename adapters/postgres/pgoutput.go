@@ -0,0 +1,153 @@
+package postgres
+
+import (
+	"fmt"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+)
+
+// keyColumnFlag marks the columns of the replica identity of a relation.
+const keyColumnFlag = 1
+
+// decoder decodes pgoutput messages to the changes of a run.SourceHandler.
+type decoder struct {
+	relations map[uint32]*relation
+	// timestamp is the commit time of the current transaction.
+	timestamp uint32
+}
+
+// relation is a table described by a relation message, with the type OIDs of its columns.
+type relation struct {
+	table *run.Table
+	oids  []uint32
+}
+
+func newDecoder() *decoder {
+	return &decoder{relations: map[uint32]*relation{}}
+}
+
+// decode decodes the message of the WAL data starting at walStart, the position of the rows it changes.
+func (d *decoder) decode(walStart pglogrepl.LSN, data []byte, handler run.SourceHandler) error {
+	msg, err := pglogrepl.Parse(data)
+	if err != nil {
+		return fmt.Errorf("parsing logical replication message: %w", err)
+	}
+
+	switch msg := msg.(type) {
+	case *pglogrepl.BeginMessage:
+		d.timestamp = uint32(msg.CommitTime.Unix())
+
+		return nil
+	case *pglogrepl.CommitMessage:
+		return handler.OnPosition(run.Position{LSN: uint64(msg.TransactionEndLSN)})
+	case *pglogrepl.RelationMessage:
+		d.decodeRelation(msg)
+
+		return nil
+	case *pglogrepl.InsertMessage:
+		return d.decodeRows(walStart, msg.RelationID, run.InsertAction, nil, msg.Tuple, handler)
+	case *pglogrepl.UpdateMessage:
+		return d.decodeRows(walStart, msg.RelationID, run.UpdateAction, msg.OldTuple, msg.NewTuple, handler)
+	case *pglogrepl.DeleteMessage:
+		return d.decodeRows(walStart, msg.RelationID, run.DeleteAction, msg.OldTuple, nil, handler)
+	default:
+		// types, origins, truncates and logical decoding messages are not relevant
+		return nil
+	}
+}
+
+func (d *decoder) decodeRelation(msg *pglogrepl.RelationMessage) {
+	rel := &relation{table: &run.Table{Schema: msg.Namespace, Name: msg.RelationName}}
+	for i, c := range msg.Columns {
+		rel.table.Columns = append(rel.table.Columns, run.TableColumn{
+			Name:    c.Name,
+			Type:    columnType(c.DataType),
+			RawType: typeNames[c.DataType],
+		})
+		rel.oids = append(rel.oids, c.DataType)
+		if c.Flags&keyColumnFlag != 0 {
+			rel.table.PKColumns = append(rel.table.PKColumns, i)
+		}
+	}
+	d.relations[msg.RelationID] = rel
+}
+
+// decodeRows decodes the tuples of an insert, update or delete message. Updates have the row before the update only
+// when the replica identity of the table is full or the key changed, otherwise it is a row of nulls, as are the
+// values of the unchanged TOASTed columns.
+func (d *decoder) decodeRows(
+	walStart pglogrepl.LSN,
+	relationID uint32,
+	action string,
+	before *pglogrepl.TupleData,
+	after *pglogrepl.TupleData,
+	handler run.SourceHandler,
+) error {
+	rel, ok := d.relations[relationID]
+	if !ok {
+		return fmt.Errorf("unknown relation: %d", relationID)
+	}
+
+	e := run.RowsEvent{
+		Table:     rel.table,
+		Action:    action,
+		Timestamp: d.timestamp,
+		Position:  run.Position{LSN: uint64(walStart)},
+	}
+
+	var beforeRow, afterRow []interface{}
+	var err error
+	if before != nil {
+		beforeRow, err = rel.decodeTuple(before)
+		if err != nil {
+			return err
+		}
+	}
+	if after != nil {
+		afterRow, err = rel.decodeTuple(after)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch action {
+	case run.InsertAction:
+		e.Rows = [][]interface{}{afterRow}
+	case run.UpdateAction:
+		if beforeRow == nil {
+			beforeRow = make([]interface{}, len(afterRow))
+		}
+		e.Rows = [][]interface{}{beforeRow, afterRow}
+	case run.DeleteAction:
+		e.Rows = [][]interface{}{beforeRow}
+	}
+
+	return handler.OnRows(e)
+}
+
+func (rel *relation) decodeTuple(t *pglogrepl.TupleData) ([]interface{}, error) {
+	if len(t.Columns) != len(rel.oids) {
+		return nil, fmt.Errorf(
+			"unexpected tuple length: %d columns in the tuple, %d in the relation %s.%s",
+			len(t.Columns), len(rel.oids), rel.table.Schema, rel.table.Name,
+		)
+	}
+
+	row := make([]interface{}, len(t.Columns))
+	for i, c := range t.Columns {
+		switch c.DataType {
+		case pglogrepl.TupleDataTypeNull, pglogrepl.TupleDataTypeToast:
+		case pglogrepl.TupleDataTypeText:
+			v, err := columnValue(rel.oids[i], c.Data)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", rel.table.Columns[i].Name, err)
+			}
+			row[i] = v
+		default:
+			return nil, fmt.Errorf("column %s: unsupported tuple data type: %c", rel.table.Columns[i].Name, c.DataType)
+		}
+	}
+
+	return row, nil
+}
@@ -0,0 +1,295 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSlotName        = "tor"
+	defaultPublicationName = "tor"
+	defaultStatusInterval  = 10 * time.Second
+
+	// duplicateObjectCode is the SQLSTATE of the creation of a replication slot that already exists.
+	duplicateObjectCode = "42710"
+)
+
+// NewSource returns a Source streaming the changes of the tables of a publication with pgoutput logical
+// replication. The replication slot is created when missing.
+// connString is the connection string of a user with the REPLICATION attribute, the replication parameter
+// is set by the Source.
+func NewSource(
+	connString string,
+	slotName string,
+	publicationName string,
+	statusInterval time.Duration,
+) *Source {
+	actualSlotName := defaultSlotName
+	if slotName != "" {
+		actualSlotName = slotName
+	}
+
+	actualPublicationName := defaultPublicationName
+	if publicationName != "" {
+		actualPublicationName = publicationName
+	}
+
+	actualStatusInterval := defaultStatusInterval
+	if statusInterval != 0 {
+		actualStatusInterval = statusInterval
+	}
+
+	return &Source{
+		connString:      connString,
+		slotName:        actualSlotName,
+		publicationName: actualPublicationName,
+		statusInterval:  actualStatusInterval,
+		closed:          make(chan struct{}),
+	}
+}
+
+// Source is a run.CheckpointedSource: the positions are the LSNs following the transactions, and the
+// checkpointed ones are confirmed to the replication slot, that can then discard the WAL before them.
+type Source struct {
+	connString      string
+	slotName        string
+	publicationName string
+	statusInterval  time.Duration
+
+	// received is the last LSN received from the server and flushed the last checkpointed one.
+	received uint64
+	flushed  uint64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ run.CheckpointedSource = (*Source)(nil)
+
+func (s *Source) Start(from run.Position, handler run.SourceHandler) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	conn, err := s.connect(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer func() {
+		_ = conn.Close(context.Background())
+	}()
+
+	atomic.StoreUint64(&s.flushed, from.LSN)
+	atomic.StoreUint64(&s.received, from.LSN)
+
+	err = s.startReplication(ctx, conn, from.LSN)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	err = s.stream(ctx, conn, handler)
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	return err
+}
+
+func (s *Source) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+}
+
+// Checkpointed confirms the LSN of the position to the replication slot with the next status update.
+func (s *Source) Checkpointed(p run.Position) error {
+	atomic.StoreUint64(&s.flushed, p.LSN)
+	return nil
+}
+
+func (s *Source) connect(ctx context.Context) (*pgconn.PgConn, error) {
+	config, err := pgconn.ParseConfig(s.connString)
+	if err != nil {
+		return nil, err
+	}
+	config.RuntimeParams["replication"] = "database"
+
+	conn, err := pgconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = pglogrepl.CreateReplicationSlot(
+		ctx,
+		conn,
+		quoteIdentifier(s.slotName),
+		"pgoutput",
+		pglogrepl.CreateReplicationSlotOptions{Mode: pglogrepl.LogicalReplication},
+	)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == duplicateObjectCode {
+		err = nil
+	}
+	if err != nil {
+		_ = conn.Close(context.Background())
+		return nil, fmt.Errorf("creating replication slot %s: %w", s.slotName, err)
+	}
+
+	return conn, nil
+}
+
+func (s *Source) startReplication(ctx context.Context, conn *pgconn.PgConn, lsn uint64) error {
+	logrus.WithField("slot", s.slotName).
+		WithField("lsn", pglogrepl.LSN(lsn).String()).
+		Info("starting logical replication")
+
+	return pglogrepl.StartReplication(
+		ctx,
+		conn,
+		quoteIdentifier(s.slotName),
+		pglogrepl.LSN(lsn),
+		pglogrepl.StartReplicationOptions{PluginArgs: []string{
+			"proto_version '1'",
+			fmt.Sprintf("publication_names '%s'", strings.ReplaceAll(s.publicationName, "'", "''")),
+		}},
+	)
+}
+
+// stream decodes the WAL data until ctx is done, sending the status of the replication every statusInterval and
+// when the server requests it.
+func (s *Source) stream(ctx context.Context, conn *pgconn.PgConn, handler run.SourceHandler) error {
+	d := newDecoder()
+	// the first status update confirms the position the replication starts from
+	var nextStatus time.Time
+
+	for {
+		if !time.Now().Before(nextStatus) {
+			err := s.sendStatus(ctx, conn)
+			if err != nil {
+				return err
+			}
+			nextStatus = time.Now().Add(s.statusInterval)
+		}
+
+		receiveCtx, cancel := context.WithDeadline(ctx, nextStatus)
+		msg, err := conn.ReceiveMessage(receiveCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if pgconn.Timeout(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			replyRequested, err := s.handleCopyData(d, msg.Data, handler)
+			if err != nil {
+				return err
+			}
+			if replyRequested {
+				nextStatus = time.Time{}
+			}
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.NoticeResponse:
+		default:
+			return fmt.Errorf("unexpected message while streaming: %T", msg)
+		}
+	}
+}
+
+// handleCopyData handles a keepalive or a WAL data message, returning whether the server requested a status
+// update.
+func (s *Source) handleCopyData(d *decoder, data []byte, handler run.SourceHandler) (bool, error) {
+	if len(data) == 0 {
+		return false, errors.New("empty replication message")
+	}
+
+	switch data[0] {
+	case pglogrepl.PrimaryKeepaliveMessageByteID:
+		k, err := pglogrepl.ParsePrimaryKeepaliveMessage(data[1:])
+		if err != nil {
+			return false, err
+		}
+		s.receivedLSN(uint64(k.ServerWALEnd))
+
+		return k.ReplyRequested, nil
+	case pglogrepl.XLogDataByteID:
+		x, err := pglogrepl.ParseXLogData(data[1:])
+		if err != nil {
+			return false, err
+		}
+
+		err = d.decode(x.WALStart, x.WALData, handler)
+		if err != nil {
+			return false, err
+		}
+		s.receivedLSN(uint64(x.WALStart) + uint64(len(x.WALData)))
+
+		return false, nil
+	default:
+		return false, fmt.Errorf("unknown replication message: %c", data[0])
+	}
+}
+
+func (s *Source) receivedLSN(lsn uint64) {
+	if lsn > atomic.LoadUint64(&s.received) {
+		atomic.StoreUint64(&s.received, lsn)
+	}
+}
+
+// sendStatus sends a standby status update: the received LSN is the written one, the checkpointed LSN is the
+// flushed and applied one.
+func (s *Source) sendStatus(ctx context.Context, conn *pgconn.PgConn) error {
+	flushed := atomic.LoadUint64(&s.flushed)
+	written := atomic.LoadUint64(&s.received)
+	// pglogrepl sends the written LSN as the flushed one when the latter is zero, nothing is confirmed then
+	if written < flushed || flushed == 0 {
+		written = flushed
+	}
+
+	err := pglogrepl.SendStandbyStatusUpdate(ctx, conn, pglogrepl.StandbyStatusUpdate{
+		WALWritePosition: pglogrepl.LSN(written),
+		WALFlushPosition: pglogrepl.LSN(flushed),
+		WALApplyPosition: pglogrepl.LSN(flushed),
+	})
+	if err != nil {
+		return err
+	}
+
+	logrus.WithField("flushed", pglogrepl.LSN(flushed).String()).
+		Debug("replication status sent")
+
+	return nil
+}
+
+func quoteIdentifier(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
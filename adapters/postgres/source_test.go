@@ -0,0 +1,371 @@
+package postgres_test
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/lorenzoranucci/tor/adapters/postgres"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSource_Start(t *testing.T) {
+	commitTime := time.Date(2023, time.January, 1, 10, 0, 0, 0, time.UTC)
+	server := newReplicationServer(t, [][]byte{
+		begin(commitTime),
+		relationMessage(16384, "public", "outbox",
+			relationColumn{name: "id", oid: 20, key: true},
+			relationColumn{name: "aggregate_id", oid: 2950},
+			relationColumn{name: "aggregate_type", oid: 1043},
+			relationColumn{name: "payload", oid: 3802},
+			relationColumn{name: "created_at", oid: 1184},
+		),
+		rowMessage('I', 16384, 0, nil, []*string{
+			ptr("1"),
+			ptr("c44ade3e-9394-4e6e-8d2d-20707d61061c"),
+			ptr("order"),
+			ptr(`{"name": "new order"}`),
+			ptr("2023-01-01 11:00:00.5+01"),
+		}),
+		rowMessage('U', 16384, 'K', []*string{ptr("1"), nil, nil, nil, nil}, []*string{
+			ptr("1"),
+			ptr("c44ade3e-9394-4e6e-8d2d-20707d61061c"),
+			ptr("order"),
+			ptr(`{"name": "paid order"}`),
+			nil,
+		}),
+		rowMessage('D', 16384, 'K', []*string{ptr("1"), nil, nil, nil, nil}, nil),
+		commit(0x16B374D848),
+	}, nil)
+
+	s := postgres.NewSource(server.connString(), "outbox_slot", "outbox_publication", 0)
+	h := &sourceHandlerMock{positions: make(chan run.Position, 1)}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Start(run.Position{LSN: 0x16B374D000}, h)
+	}()
+
+	select {
+	case p := <-h.positions:
+		assert.Equal(t, run.Position{LSN: 0x16B374D848}, p)
+	case err := <-errCh:
+		require.NoError(t, err)
+		t.Fatal("source stopped")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no position received")
+	}
+
+	require.NoError(t, s.Checkpointed(run.Position{LSN: 0x16B374D848}))
+	server.requestStatus()
+	assert.Eventually(t, func() bool {
+		return server.lastFlushed() == 0x16B374D848
+	}, 5*time.Second, 10*time.Millisecond)
+
+	s.Close()
+	require.NoError(t, <-errCh)
+
+	assert.Equal(t, []string{
+		`CREATE_REPLICATION_SLOT "outbox_slot"  LOGICAL pgoutput `,
+		`START_REPLICATION SLOT "outbox_slot" LOGICAL 16/B374D000 (proto_version '1', publication_names 'outbox_publication')`,
+	}, server.receivedQueries())
+	server.mu.Lock()
+	assert.Equal(t, "database", server.startupParameters["replication"])
+	// the first status update confirms the starting position
+	assert.Equal(t, uint64(0x16B374D000), server.flushed[0])
+	server.mu.Unlock()
+
+	require.Len(t, h.events, 3)
+	table := h.events[0].Table
+	assert.Equal(t, "public", table.Schema)
+	assert.Equal(t, "outbox", table.Name)
+	assert.Equal(t, []int{0}, table.PKColumns)
+	assert.Equal(t, []run.TableColumn{
+		{Name: "id", Type: run.TypeNumber, RawType: "bigint"},
+		{Name: "aggregate_id", Type: run.TypeString, RawType: "uuid"},
+		{Name: "aggregate_type", Type: run.TypeString, RawType: "character varying"},
+		{Name: "payload", Type: run.TypeJSON, RawType: "jsonb"},
+		{Name: "created_at", Type: run.TypeTimestamp, RawType: "timestamp with time zone"},
+	}, table.Columns)
+
+	assert.Equal(t, run.InsertAction, h.events[0].Action)
+	assert.Equal(t, uint32(commitTime.Unix()), h.events[0].Timestamp)
+	assert.Equal(t, run.Position{LSN: 0x16B374D820}, h.events[0].Position)
+	assert.Equal(t, [][]interface{}{{
+		int64(1),
+		"c44ade3e-9394-4e6e-8d2d-20707d61061c",
+		"order",
+		`{"name": "new order"}`,
+		time.Date(2023, time.January, 1, 10, 0, 0, 500000000, time.UTC),
+	}}, h.events[0].Rows)
+
+	assert.Equal(t, run.UpdateAction, h.events[1].Action)
+	assert.Equal(t, run.Position{LSN: 0x16B374D830}, h.events[1].Position)
+	assert.Equal(t, [][]interface{}{
+		{int64(1), nil, nil, nil, nil},
+		{int64(1), "c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"name": "paid order"}`, nil},
+	}, h.events[1].Rows)
+
+	assert.Equal(t, run.DeleteAction, h.events[2].Action)
+	assert.Equal(t, run.Position{LSN: 0x16B374D840}, h.events[2].Position)
+	assert.Equal(t, [][]interface{}{{int64(1), nil, nil, nil, nil}}, h.events[2].Rows)
+}
+
+func TestSource_Start_ReplicationError(t *testing.T) {
+	server := newReplicationServer(t, nil, &pgproto3.ErrorResponse{
+		Severity: "ERROR",
+		Code:     "42704",
+		Message:  `publication "tor" does not exist`,
+	})
+
+	s := postgres.NewSource(server.connString(), "", "", time.Second)
+	err := s.Start(run.Position{}, &sourceHandlerMock{})
+	assert.ErrorContains(t, err, `publication "tor" does not exist`)
+	assert.Equal(t, []string{
+		`CREATE_REPLICATION_SLOT "tor"  LOGICAL pgoutput `,
+		`START_REPLICATION SLOT "tor" LOGICAL 0/0 (proto_version '1', publication_names 'tor')`,
+	}, server.receivedQueries())
+}
+
+type relationColumn struct {
+	name string
+	oid  uint32
+	key  bool
+}
+
+func begin(commitTime time.Time) []byte {
+	b := []byte{'B'}
+	b = binary.BigEndian.AppendUint64(b, 0)
+	postgresEpoch := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	b = binary.BigEndian.AppendUint64(b, uint64(commitTime.Sub(postgresEpoch).Microseconds()))
+
+	return binary.BigEndian.AppendUint32(b, 42)
+}
+
+func commit(endLSN uint64) []byte {
+	b := []byte{'C', 0}
+	b = binary.BigEndian.AppendUint64(b, endLSN-8)
+	b = binary.BigEndian.AppendUint64(b, endLSN)
+
+	return binary.BigEndian.AppendUint64(b, 0)
+}
+
+func relationMessage(id uint32, namespace string, name string, columns ...relationColumn) []byte {
+	b := []byte{'R'}
+	b = binary.BigEndian.AppendUint32(b, id)
+	b = append(append(b, namespace...), 0)
+	b = append(append(b, name...), 0)
+	b = append(b, 'd')
+	b = binary.BigEndian.AppendUint16(b, uint16(len(columns)))
+	for _, c := range columns {
+		var flags byte
+		if c.key {
+			flags = 1
+		}
+		b = append(b, flags)
+		b = append(append(b, c.name...), 0)
+		b = binary.BigEndian.AppendUint32(b, c.oid)
+		b = binary.BigEndian.AppendUint32(b, 0xFFFFFFFF)
+	}
+
+	return b
+}
+
+// rowMessage returns an insert, update or delete message, nil values are nulls.
+func rowMessage(kind byte, relationID uint32, oldMarker byte, old []*string, new []*string) []byte {
+	b := []byte{kind}
+	b = binary.BigEndian.AppendUint32(b, relationID)
+	if old != nil {
+		b = appendTuple(append(b, oldMarker), old)
+	}
+	if new != nil {
+		b = appendTuple(append(b, 'N'), new)
+	}
+
+	return b
+}
+
+func appendTuple(b []byte, values []*string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(values)))
+	for _, v := range values {
+		if v == nil {
+			b = append(b, 'n')
+			continue
+		}
+		b = append(b, 't')
+		b = binary.BigEndian.AppendUint32(b, uint32(len(*v)))
+		b = append(b, *v...)
+	}
+
+	return b
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+type sourceHandlerMock struct {
+	events    []run.RowsEvent
+	positions chan run.Position
+}
+
+func (h *sourceHandlerMock) OnRows(e run.RowsEvent) error {
+	h.events = append(h.events, e)
+	return nil
+}
+
+func (h *sourceHandlerMock) OnPosition(p run.Position) error {
+	h.positions <- p
+	return nil
+}
+
+// replicationServer is a PostgreSQL server accepting a replication connection, that streams the given WAL data
+// after START_REPLICATION, every message 0x10 bytes after the former one from 16/B374D800, and records the status
+// updates.
+type replicationServer struct {
+	listener net.Listener
+	walData  [][]byte
+	startErr *pgproto3.ErrorResponse
+	status   chan struct{}
+
+	mu                sync.Mutex
+	startupParameters map[string]string
+	queries           []string
+	flushed           []uint64
+}
+
+func newReplicationServer(t *testing.T, walData [][]byte, startErr *pgproto3.ErrorResponse) *replicationServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	s := &replicationServer{listener: l, walData: walData, startErr: startErr, status: make(chan struct{}, 1)}
+	go s.serve()
+
+	return s
+}
+
+func (s *replicationServer) connString() string {
+	return "postgres://tor@" + s.listener.Addr().String() + "/outbox?sslmode=disable"
+}
+
+func (s *replicationServer) requestStatus() {
+	s.status <- struct{}{}
+}
+
+func (s *replicationServer) receivedQueries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.queries...)
+}
+
+func (s *replicationServer) lastFlushed() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.flushed) == 0 {
+		return 0
+	}
+
+	return s.flushed[len(s.flushed)-1]
+}
+
+func (s *replicationServer) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	b := pgproto3.NewBackend(conn, conn)
+	msg, err := b.ReceiveStartupMessage()
+	if err != nil {
+		return
+	}
+	if sm, ok := msg.(*pgproto3.StartupMessage); ok {
+		s.mu.Lock()
+		s.startupParameters = sm.Parameters
+		s.mu.Unlock()
+	}
+
+	b.Send(&pgproto3.AuthenticationOk{})
+	b.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if b.Flush() != nil {
+		return
+	}
+
+	for {
+		msg, err := b.Receive()
+		if err != nil {
+			return
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.Query:
+			s.mu.Lock()
+			s.queries = append(s.queries, msg.String)
+			s.mu.Unlock()
+
+			switch {
+			case strings.HasPrefix(msg.String, "CREATE_REPLICATION_SLOT"):
+				// the slot already exists
+				b.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42710", Message: "replication slot exists"})
+				b.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+			case strings.HasPrefix(msg.String, "START_REPLICATION"):
+				if s.startErr != nil {
+					b.Send(s.startErr)
+					b.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+					break
+				}
+				b.Send(&pgproto3.CopyBothResponse{})
+				for i, d := range s.walData {
+					b.Send(&pgproto3.CopyData{Data: xLogData(0x16B374D800+uint64(i)*0x10, d)})
+				}
+				if b.Flush() != nil {
+					return
+				}
+				go s.sendKeepalives(conn)
+			}
+			if b.Flush() != nil {
+				return
+			}
+		case *pgproto3.CopyData:
+			if len(msg.Data) == 34 && msg.Data[0] == 'r' {
+				s.mu.Lock()
+				s.flushed = append(s.flushed, binary.BigEndian.Uint64(msg.Data[9:17]))
+				s.mu.Unlock()
+			}
+		case *pgproto3.Terminate:
+			return
+		}
+	}
+}
+
+// sendKeepalives sends a keepalive requesting a reply on every requestStatus.
+func (s *replicationServer) sendKeepalives(conn net.Conn) {
+	for range s.status {
+		k := []byte{'k'}
+		k = binary.BigEndian.AppendUint64(k, 0)
+		k = binary.BigEndian.AppendUint64(k, 0)
+		k = append(k, 1)
+
+		_, _ = conn.Write((&pgproto3.CopyData{Data: k}).Encode(nil))
+	}
+}
+
+func xLogData(walStart uint64, walData []byte) []byte {
+	b := []byte{'w'}
+	b = binary.BigEndian.AppendUint64(b, walStart)
+	b = binary.BigEndian.AppendUint64(b, 0)
+	b = binary.BigEndian.AppendUint64(b, 0)
+
+	return append(b, walData...)
+}
@@ -0,0 +1,111 @@
+package postgres
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+)
+
+// OIDs of the built-in types.
+const (
+	boolOID        = 16
+	byteaOID       = 17
+	int8OID        = 20
+	int2OID        = 21
+	int4OID        = 23
+	textOID        = 25
+	jsonOID        = 114
+	float4OID      = 700
+	float8OID      = 701
+	varcharOID     = 1043
+	dateOID        = 1082
+	timeOID        = 1083
+	timestampOID   = 1114
+	timestamptzOID = 1184
+	numericOID     = 1700
+	uuidOID        = 2950
+	jsonbOID       = 3802
+)
+
+var typeNames = map[uint32]string{
+	boolOID:        "boolean",
+	byteaOID:       "bytea",
+	int8OID:        "bigint",
+	int2OID:        "smallint",
+	int4OID:        "integer",
+	textOID:        "text",
+	jsonOID:        "json",
+	float4OID:      "real",
+	float8OID:      "double precision",
+	varcharOID:     "character varying",
+	dateOID:        "date",
+	timeOID:        "time without time zone",
+	timestampOID:   "timestamp without time zone",
+	timestamptzOID: "timestamp with time zone",
+	numericOID:     "numeric",
+	uuidOID:        "uuid",
+	jsonbOID:       "jsonb",
+}
+
+// columnType returns the run.ColumnType closest to the type with the given OID.
+func columnType(oid uint32) run.ColumnType {
+	switch oid {
+	case int2OID, int4OID, int8OID:
+		return run.TypeNumber
+	case float4OID, float8OID:
+		return run.TypeFloat
+	case numericOID:
+		return run.TypeDecimal
+	case jsonOID, jsonbOID:
+		return run.TypeJSON
+	case dateOID:
+		return run.TypeDate
+	case timeOID:
+		return run.TypeTime
+	case timestampOID, timestamptzOID:
+		return run.TypeTimestamp
+	case byteaOID:
+		return run.TypeBinary
+	default:
+		return run.TypeString
+	}
+}
+
+// columnValue decodes the text representation of a value: integers, floats, booleans, timestamps and byte arrays
+// are decoded to the Go types canal uses, the other types are strings.
+// Timestamps without time zone are in UTC.
+func columnValue(oid uint32, text []byte) (interface{}, error) {
+	s := string(text)
+	switch oid {
+	case int2OID, int4OID, int8OID:
+		return strconv.ParseInt(s, 10, 64)
+	case float4OID, float8OID:
+		return strconv.ParseFloat(s, 64)
+	case boolOID:
+		return s == "t", nil
+	case timestampOID:
+		return time.ParseInLocation("2006-01-02 15:04:05.999999999", s, time.UTC)
+	case timestamptzOID:
+		// the offset has the minutes only when they are not zero, e.g. +00 or +05:30
+		layout := "2006-01-02 15:04:05.999999999Z07"
+		if strings.Count(s[strings.LastIndexAny(s, "+-"):], ":") > 0 {
+			layout = "2006-01-02 15:04:05.999999999Z07:00"
+		}
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			return nil, err
+		}
+		return t.UTC(), nil
+	case byteaOID:
+		if !strings.HasPrefix(s, `\x`) {
+			return nil, errors.New("bytea is not in hex format")
+		}
+		return hex.DecodeString(s[2:])
+	default:
+		return s, nil
+	}
+}
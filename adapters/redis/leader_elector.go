@@ -0,0 +1,201 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultLeaseTTL = 10 * time.Second
+
+// acquireScript sets the lock when free and increments the fencing token.
+var acquireScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return redis.call('INCR', KEYS[2])
+end
+return 0
+`)
+
+// renewScript extends the lock when still held.
+var renewScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseScript deletes the lock when still held.
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// NewLeaderElector returns a run.LeaderElector based on a Redis lock with a time to live, renewed every third
+// of it by the leader. The fencing token is a counter stored at keyName:fencing_token.
+// id identifies the replica, a random one is generated when empty.
+func NewLeaderElector(client *redis.Client, keyName string, ttl time.Duration, id string) (*LeaderElector, error) {
+	actualTTL := defaultLeaseTTL
+	if ttl != 0 {
+		actualTTL = ttl
+	}
+
+	actualID := id
+	if actualID == "" {
+		b := make([]byte, 16)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		actualID = hex.EncodeToString(b)
+	}
+
+	return &LeaderElector{
+		client:  client,
+		keyName: keyName,
+		ttl:     actualTTL,
+		id:      actualID,
+	}, nil
+}
+
+type LeaderElector struct {
+	client  *redis.Client
+	keyName string
+	ttl     time.Duration
+	id      string
+}
+
+func (e *LeaderElector) Campaign(ctx context.Context) (run.Lease, error) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		token, err := acquireScript.Run(
+			ctx,
+			e.client,
+			[]string{e.keyName, fencingTokenKey(e.keyName)},
+			e.id,
+			e.ttl.Milliseconds(),
+		).Int64()
+		if err != nil && ctx.Err() == nil {
+			logrus.WithError(err).Warn("acquiring leadership failed")
+		}
+		if err == nil && token > 0 {
+			return e.newLease(uint64(token)), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *LeaderElector) newLease(token uint64) *Lease {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Lease{
+		elector: e,
+		token:   token,
+		done:    make(chan struct{}),
+		cancel:  cancel,
+	}
+
+	l.wg.Add(1)
+	go l.renew(ctx)
+
+	return l
+}
+
+// Lease is the leadership held by a LeaderElector. It is lost when it cannot be renewed before its time to live
+// expires, or when the lock is found held by another replica.
+type Lease struct {
+	elector *LeaderElector
+	token   uint64
+
+	done     chan struct{}
+	doneOnce sync.Once
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func (l *Lease) Done() <-chan struct{} {
+	return l.done
+}
+
+func (l *Lease) FencingToken() uint64 {
+	return l.token
+}
+
+func (l *Lease) Release() error {
+	l.cancel()
+	l.wg.Wait()
+	l.lose()
+
+	return releaseScript.Run(
+		context.Background(),
+		l.elector.client,
+		[]string{l.elector.keyName},
+		l.elector.id,
+	).Err()
+}
+
+func (l *Lease) renew(ctx context.Context) {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.elector.ttl / 3)
+	defer ticker.Stop()
+
+	renewedAt := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		renewed, err := renewScript.Run(
+			ctx,
+			l.elector.client,
+			[]string{l.elector.keyName},
+			l.elector.id,
+			l.elector.ttl.Milliseconds(),
+		).Int64()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			logrus.WithError(err).Warn("renewing leadership failed")
+			// the lock may have expired in the meantime
+			if time.Since(renewedAt) >= l.elector.ttl {
+				l.lose()
+				return
+			}
+			continue
+		}
+
+		if renewed == 0 {
+			l.lose()
+			return
+		}
+		renewedAt = time.Now()
+	}
+}
+
+func (l *Lease) lose() {
+	l.doneOnce.Do(func() {
+		close(l.done)
+	})
+}
+
+func fencingTokenKey(keyName string) string {
+	return keyName + ":fencing_token"
+}
@@ -0,0 +1,73 @@
+package redis_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	redis2 "github.com/lorenzoranucci/tor/adapters/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaderElector_Campaign(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	leader, err := redis2.NewLeaderElector(client, "tor_leader", 300*time.Millisecond, "leader")
+	require.NoError(t, err)
+	standby, err := redis2.NewLeaderElector(client, "tor_leader", 300*time.Millisecond, "standby")
+	require.NoError(t, err)
+
+	lease, err := leader.Campaign(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), lease.FencingToken())
+
+	// the lease is renewed beyond its time to live
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = standby.Campaign(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	select {
+	case <-lease.Done():
+		t.Fatal("lease lost")
+	default:
+	}
+
+	require.NoError(t, lease.Release())
+
+	standbyLease, err := standby.Campaign(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), standbyLease.FencingToken())
+
+	require.NoError(t, standbyLease.Release())
+}
+
+func TestLeaderElector_LeaseLost(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	e, err := redis2.NewLeaderElector(client, "tor_leader", 300*time.Millisecond, "")
+	require.NoError(t, err)
+
+	lease, err := e.Campaign(context.Background())
+	require.NoError(t, err)
+
+	// another replica took the lock, e.g. after a long pause of this one
+	require.NoError(t, mr.Set("tor_leader", "other"))
+
+	select {
+	case <-lease.Done():
+	case <-time.After(time.Second):
+		t.Fatal("lease not lost")
+	}
+
+	require.NoError(t, lease.Release())
+
+	v, err := mr.Get("tor_leader")
+	require.NoError(t, err)
+	assert.Equal(t, "other", v)
+}
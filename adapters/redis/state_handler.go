@@ -2,57 +2,79 @@ package redis
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"strings"
 
-	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/go-redis/redis/v8"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
 )
 
+// ErrStaleFencingToken is returned when setting a checkpoint with a fencing token older than the last one used.
+var ErrStaleFencingToken = errors.New("stale fencing token")
+
+// fencedSetScript sets the checkpoint unless a newer fencing token was used, which is stored at
+// keyName:fencing_token.
+var fencedSetScript = redis.NewScript(`
+local last = tonumber(redis.call('GET', KEYS[2]) or '0')
+if last > tonumber(ARGV[2]) then
+	return redis.error_reply('stale fencing token')
+end
+redis.call('SET', KEYS[2], ARGV[2])
+return redis.call('SET', KEYS[1], ARGV[1])
+`)
+
 func NewStateHandler(client *redis.Client, keyName string) *StateHandler {
 	return &StateHandler{client: client, keyName: keyName}
 }
 
 type StateHandler struct {
-	client  *redis.Client
-	keyName string
+	client       *redis.Client
+	keyName      string
+	fencingToken uint64
+}
+
+// SetFencingToken makes the following checkpoints be set only if no newer fencing token was used.
+func (r *StateHandler) SetFencingToken(token uint64) {
+	r.fencingToken = token
 }
 
-func (r *StateHandler) GetLastPosition() (mysql.Position, error) {
-	val, err := r.client.Get(context.Background(), r.keyName).Result()
+// GetLastCheckpoint returns the checkpoint stored at keyName. The JSON MySQL positions stored by the previous
+// versions are migrated to version 1 checkpoints, whose data they are.
+func (r *StateHandler) GetLastCheckpoint() (run.Checkpoint, error) {
+	val, err := r.client.Get(context.Background(), r.keyName).Bytes()
 	if err != nil && err != redis.Nil {
-		return mysql.Position{}, err
+		return nil, err
 	}
 
 	if err != nil && err == redis.Nil {
-		return mysql.Position{}, nil
+		return nil, nil
 	}
 
-	var p mySQLPosition
-	err = json.Unmarshal([]byte(val), &p)
-	if err != nil {
-		return mysql.Position{}, err
+	if len(val) > 0 && val[0] == '{' {
+		return run.NewCheckpoint(run.CheckpointV1, val), nil
 	}
 
-	return mysql.Position{
-		Name: p.Name,
-		Pos:  p.Pos,
-	}, nil
+	return val, nil
 }
 
-func (r *StateHandler) SetLastPosition(p mysql.Position) error {
-	mp, err := json.Marshal(mySQLPosition{
-		Name: p.Name,
-		Pos:  p.Pos,
-	})
-	if err != nil {
-		return err
+func (r *StateHandler) SetLastCheckpoint(c run.Checkpoint) error {
+	v := []byte(c)
+	if r.fencingToken == 0 {
+		s := r.client.Set(context.Background(), r.keyName, v, 0)
+		return s.Err()
 	}
 
-	s := r.client.Set(context.Background(), r.keyName, mp, 0)
-	return s.Err()
-}
+	err := fencedSetScript.Run(
+		context.Background(),
+		r.client,
+		[]string{r.keyName, fencingTokenKey(r.keyName)},
+		v,
+		r.fencingToken,
+	).Err()
+	// depending on the server version, the error may be prefixed with ERR
+	if err != nil && strings.HasSuffix(err.Error(), ErrStaleFencingToken.Error()) {
+		return ErrStaleFencingToken
+	}
 
-type mySQLPosition struct {
-	Name string `json:"name,omitempty"`
-	Pos  uint32 `json:"pos,omitempty"`
+	return err
 }
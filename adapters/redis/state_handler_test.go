@@ -0,0 +1,71 @@
+package redis_test
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	redis2 "github.com/lorenzoranucci/tor/adapters/redis"
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/lorenzoranucci/tor/router/pkg/run/runtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateHandler(t *testing.T) {
+	runtest.StateHandlerSuite(t, func(t *testing.T) run.StateHandler {
+		mr := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+		return redis2.NewStateHandler(client, "last_position")
+	})
+}
+
+func TestStateHandler_SetLastCheckpointWithFencingToken(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	former := redis2.NewStateHandler(client, "last_position")
+	former.SetFencingToken(1)
+	current := redis2.NewStateHandler(client, "last_position")
+	current.SetFencingToken(2)
+
+	c1, err := run.EncodeCheckpoint(run.Position{File: "mysql-bin.000001", Offset: 200})
+	require.NoError(t, err)
+	c2, err := run.EncodeCheckpoint(run.Position{File: "mysql-bin.000001", Offset: 400})
+	require.NoError(t, err)
+
+	require.NoError(t, former.SetLastCheckpoint(c1))
+	require.NoError(t, current.SetLastCheckpoint(c2))
+
+	err = former.SetLastCheckpoint(c1)
+	assert.ErrorIs(t, err, redis2.ErrStaleFencingToken)
+
+	c, err := current.GetLastCheckpoint()
+	require.NoError(t, err)
+	assert.Equal(t, c2, c)
+}
+
+func TestStateHandler_GetLastCheckpointMigratesJSONPosition(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	// the value stored by the previous versions of the state handler
+	require.NoError(t, mr.Set(
+		"last_position",
+		`{"name":"mysql-bin.000003","pos":1234,"gtid_set":"0-1-100","gtid_flavor":"mariadb"}`,
+	))
+
+	c, err := redis2.NewStateHandler(client, "last_position").GetLastCheckpoint()
+	require.NoError(t, err)
+
+	p, err := run.DecodeCheckpoint(c)
+	require.NoError(t, err)
+	assert.Equal(t, run.Position{File: "mysql-bin.000003", Offset: 1234, GTIDSet: "0-1-100", GTIDFlavor: "mariadb"}, p)
+
+	// the checkpoint is stored with its version on the next update
+	require.NoError(t, redis2.NewStateHandler(client, "last_position").SetLastCheckpoint(c))
+	v, err := mr.Get("last_position")
+	require.NoError(t, err)
+	assert.Equal(t, string(c), v)
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+)
+
+// health tracks the state of the router to answer liveness and readiness probes.
+// The router is live until canal stops, so also while waiting for the leadership, and ready while canal is running,
+// the positions read are persisted within maxCheckpointAge and Kafka is reachable.
+type health struct {
+	maxCheckpointAge time.Duration
+	checkKafka       func() error
+
+	mu                sync.Mutex
+	canalState        string
+	canalErr          error
+	lastPosSynced     time.Time
+	lastCheckpoint    time.Time
+	lastCheckpointErr error
+	pending           pendingPositions
+}
+
+const (
+	canalNotStarted = "not_started"
+	canalRunning    = "running"
+	canalStopped    = "stopped"
+)
+
+func newHealth(maxCheckpointAge time.Duration, checkKafka func() error) *health {
+	return &health{
+		maxCheckpointAge: maxCheckpointAge,
+		checkKafka:       checkKafka,
+		canalState:       canalNotStarted,
+	}
+}
+
+type healthReport struct {
+	Canal                    string   `json:"canal"`
+	CanalError               string   `json:"canal_error,omitempty"`
+	SecondsSinceLastPosSync  *float64 `json:"seconds_since_last_pos_synced,omitempty"`
+	LastCheckpoint           string   `json:"last_checkpoint,omitempty"`
+	CheckpointAgeSeconds     float64  `json:"checkpoint_age_seconds"`
+	LastCheckpointError      string   `json:"last_checkpoint_error,omitempty"`
+	Kafka                    string   `json:"kafka,omitempty"`
+	MaxCheckpointAgeExceeded bool     `json:"max_checkpoint_age_exceeded,omitempty"`
+}
+
+// report returns the state of the router and whether it is live, or ready when readiness is true.
+// The checkpoint age is the time since the oldest position read and not persisted yet was read.
+func (h *health) report(readiness bool) (r healthReport, ok bool) {
+	r, ok = h.state(readiness)
+	if !readiness {
+		return r, ok
+	}
+
+	// Kafka is probed without holding the lock, so that a slow probe does not block the instrumentation
+	r.Kafka = "ok"
+	if err := h.checkKafka(); err != nil {
+		r.Kafka = err.Error()
+		ok = false
+	}
+
+	return r, ok
+}
+
+// state returns the state of the router, without the one of Kafka.
+func (h *health) state(readiness bool) (r healthReport, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	r = healthReport{Canal: h.canalState}
+	if !readiness {
+		ok = h.canalState != canalStopped
+	} else {
+		ok = h.canalState == canalRunning
+	}
+	if h.canalErr != nil {
+		r.CanalError = h.canalErr.Error()
+	}
+
+	if !h.lastPosSynced.IsZero() {
+		s := now.Sub(h.lastPosSynced).Seconds()
+		r.SecondsSinceLastPosSync = &s
+	}
+
+	if !h.lastCheckpoint.IsZero() {
+		r.LastCheckpoint = h.lastCheckpoint.Format(time.RFC3339)
+	}
+	age := h.pending.age(now)
+	r.CheckpointAgeSeconds = age.Seconds()
+	if h.lastCheckpointErr != nil {
+		r.LastCheckpointError = h.lastCheckpointErr.Error()
+	}
+
+	if readiness && h.maxCheckpointAge > 0 && age > h.maxCheckpointAge {
+		r.MaxCheckpointAgeExceeded = true
+		ok = false
+	}
+
+	return r, ok
+}
+
+func (h *health) liveness(w http.ResponseWriter, _ *http.Request) {
+	r, ok := h.report(false)
+	writeHealthReport(w, r, ok)
+}
+
+func (h *health) readiness(w http.ResponseWriter, _ *http.Request) {
+	r, ok := h.report(true)
+	writeHealthReport(w, r, ok)
+}
+
+func writeHealthReport(w http.ResponseWriter, r healthReport, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_ = json.NewEncoder(w).Encode(r)
+}
+
+func (h *health) PositionSynced(p run.Position) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if h.pending.positionSynced(p, now) {
+		h.lastPosSynced = now
+	}
+}
+
+func (h *health) PositionCheckpointed(p run.Position) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	h.lastCheckpoint = now
+	h.lastCheckpointErr = nil
+	h.pending.positionCheckpointed(p, now)
+}
+
+func (h *health) CheckpointFailed(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastCheckpointErr = err
+}
+
+func (h *health) CanalStarted() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.canalState = canalRunning
+	h.canalErr = nil
+}
+
+func (h *health) CanalStopped(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.canalState = canalStopped
+	h.canalErr = err
+}
+
+func (h *health) EventMapped(run.OutboxEvent)                    {}
+func (h *health) EventDispatched(run.OutboxEvent, time.Duration) {}
+func (h *health) EventSkipped(run.SkipReason)                    {}
+func (h *health) EventFailed(error)                              {}
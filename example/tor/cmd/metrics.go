@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// prometheusInstrumentation exposes the router instrumentation as Prometheus metrics.
+type prometheusInstrumentation struct {
+	mapped           prometheus.Counter
+	dispatched       prometheus.Counter
+	skipped          *prometheus.CounterVec
+	failed           prometheus.Counter
+	dispatchDuration prometheus.Histogram
+	binlogLag        prometheus.Gauge
+	lastCheckpoint   prometheus.Gauge
+	checkpointFailed prometheus.Counter
+	canalRunning     prometheus.Gauge
+
+	mu      sync.Mutex
+	pending pendingPositions
+}
+
+func newPrometheusInstrumentation(registerer prometheus.Registerer) *prometheusInstrumentation {
+	i := &prometheusInstrumentation{
+		mapped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tor_events_mapped_total",
+			Help: "Rows of the outbox table mapped to events.",
+		}),
+		dispatched: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tor_events_dispatched_total",
+			Help: "Events whose delivery is confirmed.",
+		}),
+		skipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tor_events_skipped_total",
+			Help: "Rows of the outbox table not routed, by reason.",
+		}, []string{"reason"}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tor_events_failed_total",
+			Help: "Failed mapping or dispatch attempts.",
+		}),
+		dispatchDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "tor_dispatch_duration_seconds",
+			Help:    "Time from the dispatch of an event to the confirmation of its delivery.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
+		binlogLag: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tor_binlog_lag_seconds",
+			Help: "Time between the database commit of the last dispatched event and its delivery.",
+		}),
+		lastCheckpoint: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tor_last_checkpoint_timestamp_seconds",
+			Help: "Unix time when the position persisted by the state handler last advanced.",
+		}),
+		checkpointFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tor_checkpoint_failures_total",
+			Help: "Failed attempts to persist a position.",
+		}),
+		canalRunning: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tor_canal_running",
+			Help: "Whether the binlog is being read.",
+		}),
+	}
+
+	registerer.MustRegister(
+		i.mapped,
+		i.dispatched,
+		i.skipped,
+		i.failed,
+		i.dispatchDuration,
+		i.binlogLag,
+		i.lastCheckpoint,
+		i.checkpointFailed,
+		i.canalRunning,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "tor_checkpoint_age_seconds",
+			Help: "Time since the oldest position read and not persisted yet was read.",
+		}, i.checkpointAge),
+	)
+
+	return i
+}
+
+func (i *prometheusInstrumentation) EventMapped(run.OutboxEvent) {
+	i.mapped.Inc()
+}
+
+func (i *prometheusInstrumentation) EventDispatched(event run.OutboxEvent, duration time.Duration) {
+	i.dispatched.Inc()
+	i.dispatchDuration.Observe(duration.Seconds())
+
+	if event.EventTimestampFromDatabase != 0 {
+		committedAt := time.Unix(int64(event.EventTimestampFromDatabase), 0)
+		i.binlogLag.Set(time.Since(committedAt).Seconds())
+	}
+}
+
+func (i *prometheusInstrumentation) EventSkipped(reason run.SkipReason) {
+	i.skipped.WithLabelValues(string(reason)).Inc()
+}
+
+func (i *prometheusInstrumentation) EventFailed(error) {
+	i.failed.Inc()
+}
+
+func (i *prometheusInstrumentation) PositionCheckpointed(p run.Position) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := time.Now()
+	if i.pending.positionCheckpointed(p, now) {
+		i.lastCheckpoint.Set(float64(now.Unix()))
+	}
+}
+
+func (i *prometheusInstrumentation) PositionSynced(p run.Position) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.pending.positionSynced(p, time.Now())
+}
+
+func (i *prometheusInstrumentation) CheckpointFailed(error) {
+	i.checkpointFailed.Inc()
+}
+
+func (i *prometheusInstrumentation) CanalStarted() {
+	i.canalRunning.Set(1)
+}
+
+func (i *prometheusInstrumentation) CanalStopped(error) {
+	i.canalRunning.Set(0)
+}
+
+// checkpointAge is zero while all the positions read are persisted, e.g. when the database is idle.
+func (i *prometheusInstrumentation) checkpointAge() float64 {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.pending.age(time.Now()).Seconds()
+}
+
+// instrumentations notifies all of its instrumentations.
+type instrumentations []run.Instrumentation
+
+func (is instrumentations) EventMapped(event run.OutboxEvent) {
+	for _, i := range is {
+		i.EventMapped(event)
+	}
+}
+
+func (is instrumentations) EventDispatched(event run.OutboxEvent, duration time.Duration) {
+	for _, i := range is {
+		i.EventDispatched(event, duration)
+	}
+}
+
+func (is instrumentations) EventSkipped(reason run.SkipReason) {
+	for _, i := range is {
+		i.EventSkipped(reason)
+	}
+}
+
+func (is instrumentations) EventFailed(err error) {
+	for _, i := range is {
+		i.EventFailed(err)
+	}
+}
+
+func (is instrumentations) PositionSynced(position run.Position) {
+	for _, i := range is {
+		i.PositionSynced(position)
+	}
+}
+
+func (is instrumentations) PositionCheckpointed(position run.Position) {
+	for _, i := range is {
+		i.PositionCheckpointed(position)
+	}
+}
+
+func (is instrumentations) CheckpointFailed(err error) {
+	for _, i := range is {
+		i.CheckpointFailed(err)
+	}
+}
+
+func (is instrumentations) CanalStarted() {
+	for _, i := range is {
+		i.CanalStarted()
+	}
+}
+
+func (is instrumentations) CanalStopped(err error) {
+	for _, i := range is {
+		i.CanalStopped(err)
+	}
+}
+
+// serveHTTP serves the handler on addr until ctx is done.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) {
+	server := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.WithError(err).Error("http server failed")
+		}
+	}()
+}
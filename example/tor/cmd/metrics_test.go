@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusInstrumentation_CheckpointAgeWithBlockedAck(t *testing.T) {
+	i := newPrometheusInstrumentation(prometheus.NewRegistry())
+	ed := &blockedEventDispatcher{dispatched: make(chan func(error), 1)}
+	eh, err := run.NewEventHandler(ed, "", "", "", run.EventHandlerOptions{Instrumentation: i})
+	require.NoError(t, err)
+
+	s := &sourceMock{closed: make(chan struct{})}
+	r := run.NewSourceRunner(s, eh, &stateHandlerMock{}, time.Millisecond, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- r.Run(ctx)
+	}()
+
+	ack := <-ed.dispatched
+
+	// the position following the event is not persisted while its ack is blocked, the former one is persisted again
+	time.Sleep(50 * time.Millisecond)
+	assert.Greater(t, i.checkpointAge(), (40 * time.Millisecond).Seconds())
+
+	ack(nil)
+	require.Eventually(t, func() bool {
+		return i.checkpointAge() == 0
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-runErr)
+}
+
+// blockedEventDispatcher sends the ack of every event to dispatched.
+type blockedEventDispatcher struct {
+	dispatched chan func(error)
+}
+
+func (e *blockedEventDispatcher) Dispatch(run.OutboxEvent) error {
+	return nil
+}
+
+func (e *blockedEventDispatcher) DispatchAsync(_ run.OutboxEvent, ack func(error)) error {
+	e.dispatched <- ack
+	return nil
+}
+
+// sourceMock streams a transaction with a row of the outbox table, then waits to be closed.
+type sourceMock struct {
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *sourceMock) Start(_ run.Position, h run.SourceHandler) error {
+	err := h.OnPosition(run.Position{LSN: 100})
+	if err != nil {
+		return err
+	}
+
+	err = h.OnRows(run.RowsEvent{
+		Table: &run.Table{
+			Schema:  "my_schema",
+			Name:    "outbox",
+			Columns: []run.TableColumn{{Name: "aggregate_id"}, {Name: "aggregate_type"}, {Name: "payload"}},
+		},
+		Action: run.InsertAction,
+		Rows:   [][]interface{}{{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{}`}},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = h.OnPosition(run.Position{LSN: 200})
+	if err != nil {
+		return err
+	}
+
+	<-s.closed
+	return nil
+}
+
+func (s *sourceMock) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+}
+
+type stateHandlerMock struct {
+	mu         sync.Mutex
+	checkpoint run.Checkpoint
+}
+
+func (s *stateHandlerMock) GetLastCheckpoint() (run.Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.checkpoint, nil
+}
+
+func (s *stateHandlerMock) SetLastCheckpoint(c run.Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoint = c
+
+	return nil
+}
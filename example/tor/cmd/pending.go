@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+)
+
+// pendingPositions tracks the last positions read and persisted, to measure for how long the positions read wait to
+// be persisted.
+type pendingPositions struct {
+	synced       run.Position
+	checkpointed run.Position
+	// since is when a position newer than the persisted one was read, zero when all of them are persisted.
+	// Persisting the same position again does not reset it, so that a stuck router keeps aging.
+	since time.Time
+}
+
+// positionSynced reports whether p is a new position.
+func (pp *pendingPositions) positionSynced(p run.Position, now time.Time) bool {
+	if p == pp.synced {
+		return false
+	}
+
+	pp.synced = p
+	if pp.since.IsZero() && p != pp.checkpointed {
+		pp.since = now
+	}
+
+	return true
+}
+
+// positionCheckpointed reports whether the persisted position advanced to p.
+func (pp *pendingPositions) positionCheckpointed(p run.Position, now time.Time) bool {
+	if p == pp.checkpointed {
+		return false
+	}
+
+	pp.checkpointed = p
+	pp.since = time.Time{}
+	if p != pp.synced {
+		pp.since = now
+	}
+
+	return true
+}
+
+// age is the time since the oldest position read and not persisted yet was read, zero when all of them are persisted.
+func (pp *pendingPositions) age(now time.Time) time.Duration {
+	if pp.since.IsZero() {
+		return 0
+	}
+
+	return now.Sub(pp.since)
+}
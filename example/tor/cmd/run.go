@@ -1,17 +1,27 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
+	"syscall"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/client"
 	"github.com/go-redis/redis/v8"
+	"github.com/lorenzoranucci/tor/adapters/file"
 	"github.com/lorenzoranucci/tor/adapters/kafka"
+	"github.com/lorenzoranucci/tor/adapters/postgres"
 	redis2 "github.com/lorenzoranucci/tor/adapters/redis"
 	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -22,6 +32,25 @@ type KafkaTopic struct {
 	NumPartitions       int32
 	ReplicationFactor   int16
 	AggregateTypeRegexp string
+	ColumnRegexps       []KafkaColumnRegexp
+}
+
+type KafkaColumnRegexp struct {
+	ColumnName string
+	Regexp     string
+}
+
+// OutboxTable is an outbox table with its column mapping and, optionally, its own Kafka routing.
+type OutboxTable struct {
+	Schema                  string
+	Table                   string
+	AggregateIDColumnName   string
+	AggregateTypeColumnName string
+	PayloadColumnName       string
+	KafkaTopics             []KafkaTopic
+	KafkaFirstMatchOnly     bool
+	KafkaUnmatchedPolicy    string
+	KafkaDefaultTopic       *KafkaTopic
 }
 
 type KafkaHeaderMappings struct {
@@ -29,60 +58,254 @@ type KafkaHeaderMappings struct {
 	HeaderName string
 }
 
+type eventDispatcher interface {
+	run.EventDispatcher
+	Close() error
+}
+
+type deadLetterSink interface {
+	run.DeadLetterSink
+	Close() error
+}
+
 // runCmd represents the run command
 var runCmd = &cobra.Command{
 	Use:   "run",
 	Short: "Run the application",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		c, err := canal.NewCanal(getCanalConfig())
+		outboxTables, err := getOutboxTables()
 		if err != nil {
 			return err
 		}
 
-		ed, err := getKafkaEventDispatcher()
+		shutdownTracing, err := setupTracing(cmd.Context())
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err := shutdownTracing(context.Background())
+			if err != nil {
+				logrus.WithError(err).Error("shutting down tracing failed")
+			}
+		}()
+
+		var ed eventDispatcher
+		var stateHandler run.StateHandler
+		if viper.GetString("kafkaTransactionalID") != "" {
+			ted, client, err := getKafkaTransactionalEventDispatcher(outboxTables)
+			if err != nil {
+				return err
+			}
+
+			ed, stateHandler = ted, kafka.NewStateHandler(client, ted, 0)
+		} else {
+			ed, err = getKafkaEventDispatcher(outboxTables)
+			if err != nil {
+				return err
+			}
+
+			stateHandler = getRedisStateHandler()
+		}
+		defer func() {
+			err := ed.Close()
+			if err != nil {
+				logrus.WithError(err).Error("closing kafka event dispatcher failed")
+			}
+		}()
+
+		poisonEventPolicy := run.PoisonEventPolicy{
+			MaxRetries:   viper.GetInt("poisonEventMaxRetries"),
+			RetryBackoff: viper.GetDuration("poisonEventRetryBackoff"),
+		}
+		if viper.GetString("deadLetterSink") != "" {
+			dls, err := getDeadLetterSink()
+			if err != nil {
+				return err
+			}
+			defer func() {
+				err := dls.Close()
+				if err != nil {
+					logrus.WithError(err).Error("closing dead-letter sink failed")
+				}
+			}()
+
+			poisonEventPolicy.DeadLetterSink = dls
+		}
+
+		kafkaClient, err := getKafkaHealthClient()
+		if err != nil {
+			return err
+		}
+		defer kafkaClient.Close()
+
+		h := newHealth(viper.GetDuration("readinessMaxCheckpointAge"), func() error {
+			return kafkaClient.RefreshMetadata()
+		})
+
+		schemaChangePolicy, err := run.ParseSchemaChangePolicy(viper.GetString("schemaChangePolicy"))
 		if err != nil {
 			return err
 		}
 
-		stateHandler := getRedisStateHandler()
 		handler, err := run.NewEventHandler(
 			ed,
 			viper.GetString("dbAggregateIDColumnName"),
 			viper.GetString("dbAggregateTypeColumnName"),
 			viper.GetString("dbPayloadColumnName"),
+			run.EventHandlerOptions{
+				PoisonEventPolicy: poisonEventPolicy,
+				Instrumentation:   instrumentations{newPrometheusInstrumentation(prometheus.DefaultRegisterer), h},
+				Tracing: run.Tracing{
+					TraceParentColumnName: viper.GetString("dbTraceParentColumnName"),
+					TraceStateColumnName:  viper.GetString("dbTraceStateColumnName"),
+				},
+				OutboxTables:       getRunOutboxTables(outboxTables),
+				SchemaChangePolicy: schemaChangePolicy,
+				OutboxMode: run.OutboxMode{
+					Transient:        viper.GetBool("transientOutbox"),
+					RepublishUpdates: viper.GetBool("republishUpdates"),
+				},
+			},
 		)
 		if err != nil {
 			return err
 		}
 
-		runner := run.NewRunner(c, handler, stateHandler, time.Second*5)
+		var leaderElector run.LeaderElector
+		if viper.GetBool("leaderElection") {
+			leaderElector, err = getRedisLeaderElector()
+			if err != nil {
+				return err
+			}
+		}
 
-		return runner.Run()
+		runner, err := getRunner(outboxTables, handler, stateHandler, leaderElector)
+		if err != nil {
+			return err
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if addr := viper.GetString("httpAddr"); addr != "" {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			mux.HandleFunc("/healthz", h.liveness)
+			mux.HandleFunc("/readyz", h.readiness)
+			serveHTTP(ctx, addr, mux)
+		}
+
+		return runner.Run(ctx)
 	},
 }
 
 func init() {
+	viper.MustBindEnv("dbSource", "DB_SOURCE")
 	viper.MustBindEnv("dbHost", "DB_HOST")
 	viper.MustBindEnv("dbPort", "DB_PORT")
 	viper.MustBindEnv("dbUser", "DB_USER")
 	viper.MustBindEnv("dbPassword", "DB_PASSWORD")
+	viper.MustBindEnv("dbFlavor", "DB_FLAVOR")
+	viper.MustBindEnv("dbGTIDMode", "DB_GTID_MODE")
 	viper.MustBindEnv("dbOutboxTableRef", "DB_OUTBOX_TABLE_REF")
 	viper.MustBindEnv("dbAggregateIDColumnName", "DB_AGGREGATE_ID_COLUMN_NAME")
 	viper.MustBindEnv("dbAggregateTypeColumnName", "DB_AGGREGATE_TYPE_COLUMN_NAME")
 	viper.MustBindEnv("dbPayloadColumnName", "DB_PAYLOAD_COLUMN_NAME")
 	viper.MustBindEnv("dbHeadersColumnsNames", "DB_HEADERS_COLUMNS_NAME")
+	viper.MustBindEnv("dbTraceParentColumnName", "DB_TRACE_PARENT_COLUMN_NAME")
+	viper.MustBindEnv("dbTraceStateColumnName", "DB_TRACE_STATE_COLUMN_NAME")
 	viper.MustBindEnv("includeTransactionTimestamp", "INCLUDE_TRANSACTION_TIMESTAMP")
 	viper.SetDefault("includeTransactionTimestamp", true)
+	viper.MustBindEnv("kafkaTransactionMetadataHeaders", "KAFKA_TRANSACTION_METADATA_HEADERS")
 	viper.MustBindEnv("aggregateTypeRegexToPairWithTopics", "AGGREGATE_TYPE_REGEX_TO_PAIR_WITH_TOPICS")
 	viper.MustBindEnv("topicsToPairWithAggregateTypeRegex", "TOPICS_TO_PAIR_WITH_AGGREGATE_TYPE_REGEX")
 
+	viper.MustBindEnv("postgresConnString", "POSTGRES_CONN_STRING")
+	viper.MustBindEnv("postgresSlotName", "POSTGRES_SLOT_NAME")
+	viper.MustBindEnv("postgresPublicationName", "POSTGRES_PUBLICATION_NAME")
+	viper.MustBindEnv("postgresStatusInterval", "POSTGRES_STATUS_INTERVAL")
+
+	viper.MustBindEnv("snapshotMode", "SNAPSHOT_MODE")
+	viper.MustBindEnv("snapshotBatchSize", "SNAPSHOT_BATCH_SIZE")
+
+	viper.MustBindEnv("cleanupMode", "CLEANUP_MODE")
+	viper.MustBindEnv("cleanupAgeColumnName", "CLEANUP_AGE_COLUMN_NAME")
+	viper.MustBindEnv("cleanupRetention", "CLEANUP_RETENTION")
+	viper.MustBindEnv("cleanupBatchSize", "CLEANUP_BATCH_SIZE")
+	viper.MustBindEnv("cleanupInterval", "CLEANUP_INTERVAL")
+
+	viper.MustBindEnv("poisonEventMaxRetries", "POISON_EVENT_MAX_RETRIES")
+	viper.MustBindEnv("poisonEventRetryBackoff", "POISON_EVENT_RETRY_BACKOFF")
+	viper.SetDefault("poisonEventRetryBackoff", 100*time.Millisecond)
+	viper.MustBindEnv("deadLetterSink", "DEAD_LETTER_SINK")
+	viper.MustBindEnv("deadLetterFilePath", "DEAD_LETTER_FILE_PATH")
+	viper.MustBindEnv("schemaChangePolicy", "SCHEMA_CHANGE_POLICY")
+	viper.MustBindEnv("transientOutbox", "TRANSIENT_OUTBOX")
+	viper.MustBindEnv("republishUpdates", "REPUBLISH_UPDATES")
+
+	viper.MustBindEnv("tracingExporter", "TRACING_EXPORTER")
+	viper.MustBindEnv("tracingEndpoint", "TRACING_ENDPOINT")
+	viper.MustBindEnv("tracingInsecure", "TRACING_INSECURE")
+	viper.MustBindEnv("tracingServiceName", "TRACING_SERVICE_NAME")
+	viper.SetDefault("tracingServiceName", "tor")
+	viper.MustBindEnv("tracingSampleRatio", "TRACING_SAMPLE_RATIO")
+	viper.SetDefault("tracingSampleRatio", 1.0)
+
+	viper.MustBindEnv("httpAddr", "HTTP_ADDR")
+	viper.SetDefault("httpAddr", ":9090")
+	viper.MustBindEnv("readinessMaxCheckpointAge", "READINESS_MAX_CHECKPOINT_AGE")
+	viper.SetDefault("readinessMaxCheckpointAge", 30*time.Second)
+
 	viper.MustBindEnv("kafkaBrokers", "KAFKA_BROKERS")
+	viper.MustBindEnv("kafkaFirstMatchOnly", "KAFKA_FIRST_MATCH_ONLY")
+	viper.MustBindEnv("kafkaUnmatchedPolicy", "KAFKA_UNMATCHED_POLICY")
+	viper.MustBindEnv("kafkaTransactionalID", "KAFKA_TRANSACTIONAL_ID")
+	viper.MustBindEnv("kafkaStateKey", "KAFKA_STATE_KEY")
+	viper.SetDefault("kafkaStateKey", "last_log_position_read")
+	viper.MustBindEnv("kafkaAsyncProducer", "KAFKA_ASYNC_PRODUCER")
+	viper.MustBindEnv("kafkaFlushFrequency", "KAFKA_FLUSH_FREQUENCY")
+	viper.SetDefault("kafkaFlushFrequency", 10*time.Millisecond)
+	viper.MustBindEnv("kafkaFlushMessages", "KAFKA_FLUSH_MESSAGES")
+	viper.SetDefault("kafkaFlushMessages", 100)
+
+	viper.MustBindEnv("kafkaEnvelope", "KAFKA_ENVELOPE")
+	viper.MustBindEnv("debeziumRouteByField", "DEBEZIUM_ROUTE_BY_FIELD")
+	viper.MustBindEnv("debeziumRouteTopicReplacement", "DEBEZIUM_ROUTE_TOPIC_REPLACEMENT")
+	viper.MustBindEnv("debeziumTopicNumPartitions", "DEBEZIUM_TOPIC_NUM_PARTITIONS")
+	viper.SetDefault("debeziumTopicNumPartitions", 1)
+	viper.MustBindEnv("debeziumTopicReplicationFactor", "DEBEZIUM_TOPIC_REPLICATION_FACTOR")
+	viper.SetDefault("debeziumTopicReplicationFactor", 1)
+	viper.MustBindEnv("debeziumEventIDField", "DEBEZIUM_EVENT_ID_FIELD")
+	viper.MustBindEnv("debeziumAdditionalPlacement", "DEBEZIUM_ADDITIONAL_PLACEMENT")
+	viper.MustBindEnv("debeziumJSONEnvelope", "DEBEZIUM_JSON_ENVELOPE")
+	viper.MustBindEnv("debeziumExpandJSONPayload", "DEBEZIUM_EXPAND_JSON_PAYLOAD")
+
+	viper.MustBindEnv("cloudEventsMode", "CLOUD_EVENTS_MODE")
+	viper.MustBindEnv("cloudEventsIDColumnName", "CLOUD_EVENTS_ID_COLUMN_NAME")
+	viper.MustBindEnv("cloudEventsSource", "CLOUD_EVENTS_SOURCE")
+	viper.MustBindEnv("cloudEventsSourceColumnName", "CLOUD_EVENTS_SOURCE_COLUMN_NAME")
+	viper.MustBindEnv("cloudEventsTypeColumnName", "CLOUD_EVENTS_TYPE_COLUMN_NAME")
+	viper.MustBindEnv("cloudEventsSubjectColumnName", "CLOUD_EVENTS_SUBJECT_COLUMN_NAME")
+	viper.MustBindEnv("cloudEventsTimeColumnName", "CLOUD_EVENTS_TIME_COLUMN_NAME")
+	viper.MustBindEnv("cloudEventsDataContentType", "CLOUD_EVENTS_DATA_CONTENT_TYPE")
+
+	viper.MustBindEnv("schemaRegistryURL", "SCHEMA_REGISTRY_URL")
+	viper.MustBindEnv("schemaRegistryUsername", "SCHEMA_REGISTRY_USERNAME")
+	viper.MustBindEnv("schemaRegistryPassword", "SCHEMA_REGISTRY_PASSWORD")
+	viper.MustBindEnv("schemaRegistryIncompatiblePolicy", "SCHEMA_REGISTRY_INCOMPATIBLE_POLICY")
 
 	viper.MustBindEnv("redisHost", "REDIS_HOST")
 	viper.MustBindEnv("redisPort", "REDIS_PORT")
 	viper.MustBindEnv("redisDB", "REDIS_DB")
 	viper.MustBindEnv("redisKey", "REDIS_KEY")
 
+	viper.MustBindEnv("leaderElection", "LEADER_ELECTION")
+	viper.MustBindEnv("leaderElectionKey", "LEADER_ELECTION_KEY")
+	viper.SetDefault("leaderElectionKey", "tor_leader")
+	viper.MustBindEnv("leaderElectionTTL", "LEADER_ELECTION_TTL")
+	viper.SetDefault("leaderElectionTTL", 10*time.Second)
+	viper.MustBindEnv("leaderElectionID", "LEADER_ELECTION_ID")
+
 	// Configure logrus for tor/router
 	logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
 	logrus.SetOutput(os.Stdout)
@@ -91,41 +314,440 @@ func init() {
 	rootCmd.AddCommand(runCmd)
 }
 
-func getKafkaEventDispatcher() (*kafka.EventDispatcher, error) {
-	producer, err := getKafkaSyncProducer()
+// getRunner returns the Runner of the source database: the MySQL binlog read by canal, the default, or PostgreSQL
+// logical replication, which supports neither snapshots nor cleanups.
+func getRunner(
+	outboxTables []OutboxTable,
+	handler *run.EventHandler,
+	stateHandler run.StateHandler,
+	leaderElector run.LeaderElector,
+) (*run.Runner, error) {
+	snapshot, err := getSnapshot(outboxTables)
 	if err != nil {
 		return nil, err
 	}
 
+	switch viper.GetString("dbSource") {
+	case "", "mysql":
+		c, err := canal.NewCanal(getCanalConfig(outboxTables))
+		if err != nil {
+			return nil, err
+		}
+
+		cleanup, err := getCleanup(c)
+		if err != nil {
+			return nil, err
+		}
+
+		return run.NewRunner(
+			c,
+			handler,
+			stateHandler,
+			time.Second*5,
+			run.RunnerOptions{
+				GTIDMode:      viper.GetBool("dbGTIDMode"),
+				LeaderElector: leaderElector,
+				Snapshot:      snapshot,
+				Cleanup:       cleanup,
+			},
+		), nil
+	case "postgres":
+		if snapshot.Mode != run.SnapshotNever {
+			return nil, errors.New("snapshots are not supported with the postgres source")
+		}
+
+		cleanupMode, err := run.ParseCleanupMode(viper.GetString("cleanupMode"))
+		if err != nil {
+			return nil, err
+		}
+		if cleanupMode != run.CleanupNone {
+			return nil, errors.New("cleanups are not supported with the postgres source")
+		}
+
+		return run.NewSourceRunner(
+			postgres.NewSource(
+				viper.GetString("postgresConnString"),
+				viper.GetString("postgresSlotName"),
+				viper.GetString("postgresPublicationName"),
+				viper.GetDuration("postgresStatusInterval"),
+			),
+			handler,
+			stateHandler,
+			time.Second*5,
+			leaderElector,
+		), nil
+	default:
+		return nil, fmt.Errorf("unknown db source: %s", viper.GetString("dbSource"))
+	}
+}
+
+func getKafkaEventDispatcher(outboxTables []OutboxTable) (eventDispatcher, error) {
 	admin, err := sarama.NewClusterAdmin(viper.GetStringSlice("kafkaBrokers"), sarama.NewConfig())
 	if err != nil {
 		return nil, err
 	}
 
-	var kafkaTopics []KafkaTopic
-	err = viper.UnmarshalKey("kafkaTopics", &kafkaTopics)
+	routing, kafkaHeaderMappings, err := getKafkaRoutingAndHeaderMappings(outboxTables)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope, err := getKafkaEnvelope()
+	if err != nil {
+		return nil, err
+	}
+
+	serializer, err := getKafkaSchemaRegistrySerializer()
 	if err != nil {
 		return nil, err
 	}
+
+	if viper.GetBool("kafkaAsyncProducer") {
+		producer, err := getKafkaAsyncProducer()
+		if err != nil {
+			return nil, err
+		}
+
+		return kafka.NewAsyncEventDispatcher(
+			producer,
+			admin,
+			routing,
+			kafkaHeaderMappings,
+			envelope,
+			serializer,
+			getKafkaTransactionMetadata(),
+		)
+	}
+
+	producer, err := getKafkaSyncProducer()
+	if err != nil {
+		return nil, err
+	}
+
+	return kafka.NewEventDispatcher(
+		producer,
+		admin,
+		routing,
+		kafkaHeaderMappings,
+		envelope,
+		serializer,
+		getKafkaTransactionMetadata(),
+	)
+}
+
+func getKafkaTransactionalEventDispatcher(outboxTables []OutboxTable) (*kafka.TransactionalEventDispatcher, sarama.Client, error) {
+	client, err := sarama.NewClient(
+		viper.GetStringSlice("kafkaBrokers"),
+		kafka.NewTransactionalProducerConfig(viper.GetString("kafkaTransactionalID")),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// closing the admin closes the client
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	producer, err := sarama.NewAsyncProducerFromClient(client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	routing, kafkaHeaderMappings, err := getKafkaRoutingAndHeaderMappings(outboxTables)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	envelope, err := getKafkaEnvelope()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serializer, err := getKafkaSchemaRegistrySerializer()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var stateTopic KafkaTopic
+	err = viper.UnmarshalKey("kafkaStateTopic", &stateTopic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ted, err := kafka.NewTransactionalEventDispatcher(
+		producer,
+		admin,
+		routing,
+		kafkaHeaderMappings,
+		envelope,
+		serializer,
+		getKafkaTransactionMetadata(),
+		kafka.Topic{
+			Name: stateTopic.Name,
+			TopicDetail: &sarama.TopicDetail{
+				ReplicationFactor: stateTopic.ReplicationFactor,
+			},
+		},
+		viper.GetString("kafkaStateKey"),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ted, client, nil
+}
+
+func getKafkaRoutingAndHeaderMappings(outboxTables []OutboxTable) (kafka.Routing, []kafka.HeaderMapping, error) {
+	var kafkaTopics []KafkaTopic
+	err := viper.UnmarshalKey("kafkaTopics", &kafkaTopics)
+	if err != nil {
+		return kafka.Routing{}, nil, err
+	}
 	topics := make([]kafka.Topic, 0, len(kafkaTopics))
 	for _, topic := range kafkaTopics {
-		topics = append(topics, kafka.Topic{
-			Name: topic.Name,
-			TopicDetail: &sarama.TopicDetail{
-				NumPartitions:     topic.NumPartitions,
-				ReplicationFactor: topic.ReplicationFactor,
+		topics = append(topics, getKafkaTopic(topic))
+	}
+
+	unmatchedPolicy, err := kafka.ParseUnmatchedPolicy(viper.GetString("kafkaUnmatchedPolicy"))
+	if err != nil {
+		return kafka.Routing{}, nil, err
+	}
+
+	// without topics, the Debezium envelope routes like the Debezium outbox event router
+	if len(topics) == 0 && viper.GetString("kafkaEnvelope") == "debezium" {
+		topics = kafka.DebeziumRouting(
+			viper.GetString("debeziumRouteByField"),
+			viper.GetString("debeziumRouteTopicReplacement"),
+			&sarama.TopicDetail{
+				NumPartitions:     viper.GetInt32("debeziumTopicNumPartitions"),
+				ReplicationFactor: int16(viper.GetInt("debeziumTopicReplicationFactor")),
 			},
-			AggregateType: regexp.MustCompile(topic.AggregateTypeRegexp),
-		})
+		).Topics
+	}
+
+	routing := kafka.Routing{
+		Topics:          topics,
+		FirstMatchOnly:  viper.GetBool("kafkaFirstMatchOnly"),
+		UnmatchedPolicy: unmatchedPolicy,
+	}
+
+	if viper.IsSet("kafkaDefaultTopic") {
+		var defaultTopic KafkaTopic
+		err = viper.UnmarshalKey("kafkaDefaultTopic", &defaultTopic)
+		if err != nil {
+			return kafka.Routing{}, nil, err
+		}
+
+		t := getKafkaTopic(defaultTopic)
+		routing.DefaultTopic = &t
+	}
+
+	if viper.IsSet("kafkaDeadLetterTopic") {
+		var deadLetterTopic KafkaTopic
+		err = viper.UnmarshalKey("kafkaDeadLetterTopic", &deadLetterTopic)
+		if err != nil {
+			return kafka.Routing{}, nil, err
+		}
+
+		t := getKafkaTopic(deadLetterTopic)
+		routing.DeadLetterTopic = &t
+	}
+
+	for _, ot := range outboxTables {
+		if len(ot.KafkaTopics) == 0 && ot.KafkaDefaultTopic == nil {
+			continue
+		}
+
+		tableRouting, err := getKafkaTableRouting(ot, routing.DeadLetterTopic)
+		if err != nil {
+			return kafka.Routing{}, nil, err
+		}
+		routing.Tables = append(routing.Tables, tableRouting)
 	}
 
 	var kafkaHeaderMappings []kafka.HeaderMapping
 	err = viper.UnmarshalKey("kafkaHeaderMappings", &kafkaHeaderMappings)
+	if err != nil {
+		return kafka.Routing{}, nil, err
+	}
+
+	return routing, kafkaHeaderMappings, nil
+}
+
+func getKafkaEnvelope() (kafka.Envelope, error) {
+	switch viper.GetString("kafkaEnvelope") {
+	case "":
+		return nil, nil
+	case "debezium":
+		additionalFields, err := kafka.ParseAdditionalFields(viper.GetString("debeziumAdditionalPlacement"))
+		if err != nil {
+			return nil, err
+		}
+
+		return kafka.NewDebeziumEnvelope(
+			viper.GetString("debeziumEventIDField"),
+			additionalFields,
+			viper.GetBool("debeziumJSONEnvelope"),
+			viper.GetBool("debeziumExpandJSONPayload"),
+		)
+	case "cloudevents":
+		mode, err := run.ParseCloudEventsMode(viper.GetString("cloudEventsMode"))
+		if err != nil {
+			return nil, err
+		}
+
+		encoder, err := run.NewCloudEventsEncoder(run.CloudEvents{
+			Mode:              mode,
+			IDColumnName:      viper.GetString("cloudEventsIDColumnName"),
+			Source:            viper.GetString("cloudEventsSource"),
+			SourceColumnName:  viper.GetString("cloudEventsSourceColumnName"),
+			TypeColumnName:    viper.GetString("cloudEventsTypeColumnName"),
+			SubjectColumnName: viper.GetString("cloudEventsSubjectColumnName"),
+			TimeColumnName:    viper.GetString("cloudEventsTimeColumnName"),
+			DataContentType:   viper.GetString("cloudEventsDataContentType"),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return kafka.NewCloudEventsEnvelope(encoder), nil
+	default:
+		return nil, fmt.Errorf("unknown kafka envelope: %s", viper.GetString("kafkaEnvelope"))
+	}
+}
+
+func getKafkaTransactionMetadata() kafka.TransactionMetadata {
+	return kafka.TransactionMetadata{
+		Headers:   viper.GetBool("kafkaTransactionMetadataHeaders"),
+		Timestamp: viper.GetBool("includeTransactionTimestamp"),
+	}
+}
+
+func getKafkaSchemaRegistrySerializer() (*kafka.SchemaRegistrySerializer, error) {
+	if viper.GetString("schemaRegistryURL") == "" {
+		return nil, nil
+	}
+
+	incompatiblePolicy, err := kafka.ParseIncompatiblePolicy(viper.GetString("schemaRegistryIncompatiblePolicy"))
 	if err != nil {
 		return nil, err
 	}
 
-	return kafka.NewEventDispatcher(producer, admin, topics, kafkaHeaderMappings)
+	return kafka.NewSchemaRegistrySerializer(
+		kafka.NewSchemaRegistryClient(
+			viper.GetString("schemaRegistryURL"),
+			nil,
+			viper.GetString("schemaRegistryUsername"),
+			viper.GetString("schemaRegistryPassword"),
+		),
+		viper.GetStringMapString("schemaRegistrySubjects"),
+		incompatiblePolicy,
+	)
+}
+
+func getKafkaTableRouting(outboxTable OutboxTable, deadLetterTopic *kafka.Topic) (kafka.TableRouting, error) {
+	topics := make([]kafka.Topic, 0, len(outboxTable.KafkaTopics))
+	for _, topic := range outboxTable.KafkaTopics {
+		topics = append(topics, getKafkaTopic(topic))
+	}
+
+	unmatchedPolicy, err := kafka.ParseUnmatchedPolicy(outboxTable.KafkaUnmatchedPolicy)
+	if err != nil {
+		return kafka.TableRouting{}, err
+	}
+
+	tableRouting := kafka.TableRouting{
+		Schema: outboxTable.Schema,
+		Table:  outboxTable.Table,
+		Routing: kafka.Routing{
+			Topics:          topics,
+			FirstMatchOnly:  outboxTable.KafkaFirstMatchOnly,
+			UnmatchedPolicy: unmatchedPolicy,
+			DeadLetterTopic: deadLetterTopic,
+		},
+	}
+
+	if outboxTable.KafkaDefaultTopic != nil {
+		t := getKafkaTopic(*outboxTable.KafkaDefaultTopic)
+		tableRouting.DefaultTopic = &t
+	}
+
+	return tableRouting, nil
+}
+
+func getDeadLetterSink() (deadLetterSink, error) {
+	switch viper.GetString("deadLetterSink") {
+	case "file":
+		return file.NewDeadLetterSink(viper.GetString("deadLetterFilePath"))
+	case "kafka":
+		if !viper.IsSet("kafkaDeadLetterTopic") {
+			return nil, errors.New("kafka dead-letter sink requires kafkaDeadLetterTopic")
+		}
+
+		var deadLetterTopic KafkaTopic
+		err := viper.UnmarshalKey("kafkaDeadLetterTopic", &deadLetterTopic)
+		if err != nil {
+			return nil, err
+		}
+
+		admin, err := sarama.NewClusterAdmin(viper.GetStringSlice("kafkaBrokers"), sarama.NewConfig())
+		if err != nil {
+			return nil, err
+		}
+		defer admin.Close()
+
+		// a dedicated producer, since the one of the dispatcher may be transactional
+		producer, err := getKafkaSyncProducer()
+		if err != nil {
+			return nil, err
+		}
+
+		return kafka.NewDeadLetterSink(producer, admin, getKafkaTopic(deadLetterTopic))
+	default:
+		return nil, fmt.Errorf("unknown dead-letter sink: %s", viper.GetString("deadLetterSink"))
+	}
+}
+
+// getKafkaHealthClient returns a client failing fast, to check that brokers are reachable.
+func getKafkaHealthClient() (sarama.Client, error) {
+	config := sarama.NewConfig()
+	config.Net.DialTimeout = 2 * time.Second
+	config.Metadata.Retry.Max = 0
+
+	return sarama.NewClient(viper.GetStringSlice("kafkaBrokers"), config)
+}
+
+func getKafkaTopic(topic KafkaTopic) kafka.Topic {
+	t := kafka.Topic{
+		Name: topic.Name,
+		TopicDetail: &sarama.TopicDetail{
+			NumPartitions:     topic.NumPartitions,
+			ReplicationFactor: topic.ReplicationFactor,
+		},
+	}
+
+	if topic.AggregateTypeRegexp != "" {
+		t.AggregateType = regexp.MustCompile(topic.AggregateTypeRegexp)
+	}
+
+	for _, cr := range topic.ColumnRegexps {
+		t.Columns = append(t.Columns, kafka.ColumnMatcher{
+			ColumnName: cr.ColumnName,
+			Regexp:     regexp.MustCompile(cr.Regexp),
+		})
+	}
+
+	return t
+}
+
+func getKafkaAsyncProducer() (sarama.AsyncProducer, error) {
+	config := kafka.NewAsyncProducerConfig()
+	config.Producer.Flush.Frequency = viper.GetDuration("kafkaFlushFrequency")
+	config.Producer.Flush.Messages = viper.GetInt("kafkaFlushMessages")
+
+	return sarama.NewAsyncProducer(viper.GetStringSlice("kafkaBrokers"), config)
 }
 
 func getKafkaSyncProducer() (sarama.SyncProducer, error) {
@@ -144,24 +766,114 @@ func getKafkaSyncProducer() (sarama.SyncProducer, error) {
 }
 
 func getRedisStateHandler() *redis2.StateHandler {
-	return redis2.NewStateHandler(
-		redis.NewClient(&redis.Options{
-			Addr: fmt.Sprintf("%s:%s", viper.GetString("redisHost"), viper.GetString("redisPort")),
-			DB:   viper.GetInt("redisDB"),
-		}),
-		viper.GetString("redisKey"),
+	return redis2.NewStateHandler(getRedisClient(), viper.GetString("redisKey"))
+}
+
+func getRedisLeaderElector() (*redis2.LeaderElector, error) {
+	return redis2.NewLeaderElector(
+		getRedisClient(),
+		viper.GetString("leaderElectionKey"),
+		viper.GetDuration("leaderElectionTTL"),
+		viper.GetString("leaderElectionID"),
 	)
 }
 
-func getCanalConfig() *canal.Config {
+func getRedisClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("%s:%s", viper.GetString("redisHost"), viper.GetString("redisPort")),
+		DB:   viper.GetInt("redisDB"),
+	})
+}
+
+func getOutboxTables() ([]OutboxTable, error) {
+	var outboxTables []OutboxTable
+	err := viper.UnmarshalKey("dbOutboxTables", &outboxTables)
+	if err != nil {
+		return nil, err
+	}
+
+	return outboxTables, nil
+}
+
+func getSnapshot(outboxTables []OutboxTable) (run.Snapshot, error) {
+	mode, err := run.ParseSnapshotMode(viper.GetString("snapshotMode"))
+	if err != nil {
+		return run.Snapshot{}, err
+	}
+
+	snapshot := run.Snapshot{
+		Mode:      mode,
+		BatchSize: viper.GetInt("snapshotBatchSize"),
+		Connect: func() (run.SnapshotConn, error) {
+			return client.Connect(getDBAddr(), viper.GetString("dbUser"), viper.GetString("dbPassword"), "")
+		},
+	}
+	if len(outboxTables) == 0 {
+		snapshot.Tables = []string{viper.GetString("dbOutboxTableRef")}
+	}
+
+	return snapshot, nil
+}
+
+func getCleanup(executor run.Executor) (run.Cleanup, error) {
+	mode, err := run.ParseCleanupMode(viper.GetString("cleanupMode"))
+	if err != nil {
+		return run.Cleanup{}, err
+	}
+
+	return run.Cleanup{
+		Mode:          mode,
+		Executor:      executor,
+		AgeColumnName: viper.GetString("cleanupAgeColumnName"),
+		Retention:     viper.GetDuration("cleanupRetention"),
+		BatchSize:     viper.GetInt("cleanupBatchSize"),
+		Interval:      viper.GetDuration("cleanupInterval"),
+	}, nil
+}
+
+func getRunOutboxTables(outboxTables []OutboxTable) []run.OutboxTable {
+	r := make([]run.OutboxTable, 0, len(outboxTables))
+	for _, t := range outboxTables {
+		r = append(r, run.OutboxTable{
+			Schema:                  t.Schema,
+			Table:                   t.Table,
+			AggregateIDColumnName:   t.AggregateIDColumnName,
+			AggregateTypeColumnName: t.AggregateTypeColumnName,
+			PayloadColumnName:       t.PayloadColumnName,
+		})
+	}
+
+	return r
+}
+
+func getDBAddr() string {
+	return fmt.Sprintf("%s:%s", viper.GetString("dbHost"), viper.GetString("dbPort"))
+}
+
+func getCanalConfig(outboxTables []OutboxTable) *canal.Config {
 	cfg := canal.NewDefaultConfig()
 
-	cfg.Addr = fmt.Sprintf("%s:%s", viper.GetString("dbHost"), viper.GetString("dbPort"))
+	cfg.Addr = getDBAddr()
 	cfg.User = viper.GetString("dbUser")
 	cfg.Password = viper.GetString("dbPassword")
+	if flavor := viper.GetString("dbFlavor"); flavor != "" {
+		cfg.Flavor = flavor
+	}
 	cfg.Dump.ExecutionPath = ""
 	cfg.IncludeTableRegex = []string{fmt.Sprintf("^%s$", viper.Get("dbOutboxTableRef"))}
+	if len(outboxTables) > 0 {
+		cfg.IncludeTableRegex = make([]string, 0, len(outboxTables))
+		for _, t := range outboxTables {
+			cfg.IncludeTableRegex = append(
+				cfg.IncludeTableRegex,
+				fmt.Sprintf("^%s\\.%s$", regexp.QuoteMeta(t.Schema), regexp.QuoteMeta(t.Table)),
+			)
+		}
+	}
 	cfg.MaxReconnectAttempts = 10
+	// exact decimals and UTC timestamps, so that column values are encoded canonically
+	cfg.UseDecimal = true
+	cfg.TimestampStringLocation = time.UTC
 
 	return cfg
 }
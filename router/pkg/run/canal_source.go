@@ -0,0 +1,275 @@
+package run
+
+import (
+	"fmt"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/sirupsen/logrus"
+)
+
+type Canal interface {
+	RunFrom(mysql.Position) error
+	StartFromGTID(mysql.GTIDSet) error
+	GetMasterGTIDSet() (mysql.GTIDSet, error)
+	SetEventHandler(handler canal.EventHandler)
+	Close()
+}
+
+// canalSource is the Source reading the binlog with a Canal, whose events are converted by the canalEventHandler
+// set as its canal.EventHandler.
+type canalSource struct {
+	canal    Canal
+	handler  *canalEventHandler
+	gtidMode bool
+}
+
+// Start starts canal from the stored GTID set when there is one, otherwise from the stored binlog file
+// and offset. In GTID mode, an empty state makes canal start from the GTID set executed by the server,
+// so that GTIDs are tracked from the very first run.
+func (s *canalSource) Start(p Position, _ SourceHandler) error {
+	// canal does not notify the fake rotate event sent by the server when the replication starts, so the rows read
+	// before the first rotation or transaction are in the stored binlog file
+	s.handler.binlogName = p.File
+	if err := s.handler.resetSchemas(); err != nil {
+		return err
+	}
+
+	if p.HasGTIDSet() {
+		gs, err := mysql.ParseGTIDSet(p.GTIDFlavor, p.GTIDSet)
+		if err != nil {
+			return fmt.Errorf("invalid GTID set: %w", err)
+		}
+
+		logrus.WithField("gtidSet", p.GTIDSet).
+			Info("starting from GTID set")
+		return s.canal.StartFromGTID(gs)
+	}
+
+	if s.gtidMode && p.File == "" {
+		gs, err := s.canal.GetMasterGTIDSet()
+		if err != nil {
+			return err
+		}
+
+		logrus.WithField("gtidSet", gs.String()).
+			Info("no state found, starting from server GTID set")
+		return s.canal.StartFromGTID(gs)
+	}
+
+	if s.gtidMode {
+		logrus.WithField("position", p).
+			Warn("GTID mode enabled but no GTID set stored, starting from binlog position: GTIDs will not be tracked")
+	}
+
+	return s.canal.RunFrom(mysql.Position{Name: p.File, Pos: p.Offset})
+}
+
+func (s *canalSource) Close() {
+	s.canal.Close()
+}
+
+// canalEventHandler converts the binlog events of a Canal to the changes handled by the EventHandler.
+type canalEventHandler struct {
+	canal.DummyEventHandler
+
+	handler *EventHandler
+	// tableGetter is set when the canal can reload the schema of the tables changed by DDL statements.
+	tableGetter   TableGetter
+	changedTables []changedTable
+	// schemas are the schemas of the tables at the position of the binlog.
+	schemas *schemaHistory
+	// ddlPosition is the position of the last DDL query applied to the schemas, reloadSchemas reports whether its
+	// changes could not be tracked.
+	ddlPosition   mysql.Position
+	reloadSchemas bool
+	// tables are the tables converted so far, by tracked schema.
+	tables map[*schema.Table]*Table
+
+	binlogName string
+	gtid       string
+}
+
+func newCanalEventHandler(handler *EventHandler) *canalEventHandler {
+	return &canalEventHandler{handler: handler, schemas: newSchemaHistory(), tables: map[*schema.Table]*Table{}}
+}
+
+func (h *canalEventHandler) OnRotate(e *replication.RotateEvent) error {
+	h.binlogName = string(e.NextLogName)
+	return nil
+}
+
+func (h *canalEventHandler) OnGTID(g mysql.GTIDSet) error {
+	h.gtid = g.String()
+	return nil
+}
+
+func (h *canalEventHandler) OnRow(e *canal.RowsEvent) error {
+	re := RowsEvent{
+		Action: e.Action,
+		Rows:   e.Rows,
+		GTID:   h.gtid,
+	}
+	if e.Table != nil {
+		// canal reads the rows with the current schema of the database
+		t := h.schemas.table(e.Table)
+		convertUnsigned(e.Rows, e.Table, t)
+		re.Table = h.table(t)
+	}
+	if e.Header != nil {
+		re.Timestamp = e.Header.Timestamp
+		re.Position = Position{File: h.binlogName, Offset: e.Header.LogPos}
+		re.ServerID = e.Header.ServerID
+	}
+
+	return h.handler.OnRows(re)
+}
+
+// OnXID keeps the binlog file of the next rows, since the fake rotate event the server sends when the replication
+// starts is not notified, e.g. when the stored binlog file was purged or canal starts from a GTID set.
+func (h *canalEventHandler) OnXID(p mysql.Position) error {
+	h.binlogName = p.Name
+	return nil
+}
+
+func (h *canalEventHandler) OnPosSynced(p mysql.Position, g mysql.GTIDSet, _ bool) error {
+	return h.handler.OnPosition(newBinlogPosition(p, g))
+}
+
+func (h *canalEventHandler) String() string {
+	return "EventHandler"
+}
+
+// table returns the Table of a tracked schema, converting it once.
+func (h *canalEventHandler) table(t *schema.Table) *Table {
+	if r, ok := h.tables[t]; ok {
+		return r
+	}
+
+	r := newTable(t)
+	h.tables[t] = r
+
+	return r
+}
+
+func newTable(t *schema.Table) *Table {
+	r := &Table{
+		Schema:    t.Schema,
+		Name:      t.Name,
+		Columns:   make([]TableColumn, 0, len(t.Columns)),
+		PKColumns: t.PKColumns,
+	}
+	for _, c := range t.Columns {
+		r.Columns = append(r.Columns, TableColumn{
+			Name:       c.Name,
+			Type:       ColumnType(c.Type),
+			RawType:    c.RawType,
+			IsUnsigned: c.IsUnsigned,
+			EnumValues: c.EnumValues,
+			SetValues:  c.SetValues,
+		})
+	}
+
+	return r
+}
+
+// convertUnsigned converts the integers of the columns that are unsigned in one of the schemas only, as canal
+// converts the values of the unsigned columns of the schema it reads the rows with.
+func convertUnsigned(rows [][]interface{}, from *schema.Table, to *schema.Table) {
+	if from == to {
+		return
+	}
+
+	for i, c := range to.Columns {
+		converted := i < len(from.Columns) && from.Columns[i].IsUnsigned
+		if converted == c.IsUnsigned {
+			continue
+		}
+
+		for _, row := range rows {
+			if i >= len(row) {
+				continue
+			}
+			if c.IsUnsigned {
+				row[i] = unsignedValue(row[i], c.Type == schema.TYPE_MEDIUM_INT)
+			} else {
+				row[i] = signedValue(row[i], c.Type == schema.TYPE_MEDIUM_INT)
+			}
+		}
+	}
+}
+
+// unsignedValue returns the unsigned integer of the binlog value of an unsigned column, which is read as signed.
+func unsignedValue(v interface{}, mediumInt bool) interface{} {
+	switch v := v.(type) {
+	case int8:
+		return uint8(v)
+	case int16:
+		return uint16(v)
+	case int32:
+		if mediumInt && v < 0 {
+			return uint32(v + 1<<24)
+		}
+		return uint32(v)
+	case int64:
+		return uint64(v)
+	case int:
+		return uint(v)
+	default:
+		return v
+	}
+}
+
+// signedValue reverts unsignedValue.
+func signedValue(v interface{}, mediumInt bool) interface{} {
+	switch v := v.(type) {
+	case uint8:
+		return int8(v)
+	case uint16:
+		return int16(v)
+	case uint32:
+		if mediumInt && v >= 1<<23 {
+			return int32(v) - 1<<24
+		}
+		return int32(v)
+	case uint64:
+		return int64(v)
+	case uint:
+		return int(v)
+	default:
+		return v
+	}
+}
+
+// newBinlogPosition returns the Position of a binlog position, with the GTID set when not empty.
+func newBinlogPosition(p mysql.Position, gs mysql.GTIDSet) Position {
+	r := Position{File: p.Name, Offset: p.Pos}
+	if gs == nil || gs.String() == "" {
+		return r
+	}
+
+	switch gs.(type) {
+	case *mysql.MysqlGTIDSet:
+		r.GTIDFlavor = mysql.MySQLFlavor
+	case *mysql.MariadbGTIDSet:
+		r.GTIDFlavor = mysql.MariaDBFlavor
+	}
+	r.GTIDSet = gs.String()
+
+	return r
+}
+
+// binlogBefore reports whether the binlog position p precedes q, comparing their GTID sets when both have one.
+func binlogBefore(p, q Position) bool {
+	if p.HasGTIDSet() && q.HasGTIDSet() {
+		pgs, perr := mysql.ParseGTIDSet(p.GTIDFlavor, p.GTIDSet)
+		qgs, qerr := mysql.ParseGTIDSet(q.GTIDFlavor, q.GTIDSet)
+		if perr == nil && qerr == nil {
+			return qgs.Contain(pgs) && !pgs.Equal(qgs)
+		}
+	}
+
+	return mysql.Position{Name: p.File, Pos: p.Offset}.Compare(mysql.Position{Name: q.File, Pos: q.Offset}) < 0
+}
@@ -0,0 +1,144 @@
+package run
+
+import (
+	"sync"
+)
+
+// checkpointer tracks the positions synced by canal together with the outbox events handed to the
+// EventDispatcher before each of them.
+// A synced position becomes the checkpoint, i.e. it is eligible to be persisted by the StateHandler,
+// only once every event dispatched before it has been acknowledged.
+// After a failed dispatch the checkpoint never advances again, so the failed event is read again on restart.
+type checkpointer struct {
+	mu sync.Mutex
+	// acknowledged is signaled on every acknowledgement.
+	acknowledged *sync.Cond
+
+	// nextSeq is the sequence number assigned to the next dispatched event.
+	nextSeq uint64
+	// acked is the number of events acknowledged without gaps: every event with a lower sequence number
+	// has been acknowledged.
+	acked uint64
+	// ackedAhead holds the events acknowledged before some of their predecessors.
+	ackedAhead map[uint64]struct{}
+
+	pending    []pendingPosition
+	checkpoint Position
+	// checkpointDispatched is the number of events dispatched before the checkpoint.
+	checkpointDispatched uint64
+	err                  error
+}
+
+type pendingPosition struct {
+	position Position
+	// dispatched is the number of events dispatched before the position was synced.
+	dispatched uint64
+}
+
+func newCheckpointer() *checkpointer {
+	c := &checkpointer{ackedAhead: map[uint64]struct{}{}}
+	c.acknowledged = sync.NewCond(&c.mu)
+
+	return c
+}
+
+// reset sets the checkpoint the router starts from.
+func (c *checkpointer) reset(p Position) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checkpoint = p
+}
+
+// dispatching returns the sequence number of an event that is going to be dispatched.
+func (c *checkpointer) dispatching() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seq := c.nextSeq
+	c.nextSeq++
+
+	return seq
+}
+
+// acknowledge marks the event with the given sequence number as confirmed by the EventDispatcher,
+// or as failed when err is not nil.
+func (c *checkpointer) acknowledge(seq uint64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.acknowledged.Broadcast()
+
+	if err != nil {
+		if c.err == nil {
+			c.err = err
+		}
+
+		return
+	}
+
+	if seq != c.acked {
+		c.ackedAhead[seq] = struct{}{}
+		return
+	}
+
+	c.acked++
+	for {
+		if _, ok := c.ackedAhead[c.acked]; !ok {
+			break
+		}
+
+		delete(c.ackedAhead, c.acked)
+		c.acked++
+	}
+
+	c.release()
+}
+
+// synced records a position synced by canal: it follows every event dispatched so far.
+func (c *checkpointer) synced(p Position) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending = append(c.pending, pendingPosition{position: p, dispatched: c.nextSeq})
+	c.release()
+}
+
+// wait blocks until every dispatched event has been acknowledged or a dispatch failed.
+func (c *checkpointer) wait() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.acked < c.nextSeq && c.err == nil {
+		c.acknowledged.Wait()
+	}
+}
+
+// last returns the last checkpoint and the error of the first failed dispatch, if any.
+func (c *checkpointer) last() (Position, error) {
+	p, _, err := c.lastDispatched()
+
+	return p, err
+}
+
+// lastDispatched returns the last checkpoint with the number of events dispatched before it, and the error of
+// the first failed dispatch, if any.
+func (c *checkpointer) lastDispatched() (Position, uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.checkpoint, c.checkpointDispatched, c.err
+}
+
+func (c *checkpointer) release() {
+	if c.err != nil {
+		return
+	}
+
+	i := 0
+	for ; i < len(c.pending) && c.pending[i].dispatched <= c.acked; i++ {
+		c.checkpoint = c.pending[i].position
+		c.checkpointDispatched = c.pending[i].dispatched
+	}
+
+	c.pending = c.pending[i:]
+}
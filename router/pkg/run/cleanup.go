@@ -0,0 +1,378 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCleanupBatchSize = 500
+	defaultCleanupInterval  = 100 * time.Millisecond
+)
+
+type CleanupMode string
+
+const (
+	// CleanupNone never deletes the outbox rows.
+	CleanupNone CleanupMode = "none"
+	// CleanupByPrimaryKey deletes the rows of the dispatched events by primary key.
+	CleanupByPrimaryKey CleanupMode = "primary_key"
+	// CleanupByAge deletes the rows older than the retention, up to the primary key of the last persisted event.
+	CleanupByAge CleanupMode = "age"
+)
+
+func ParseCleanupMode(s string) (CleanupMode, error) {
+	switch m := CleanupMode(s); m {
+	case "":
+		return CleanupNone, nil
+	case CleanupNone, CleanupByPrimaryKey, CleanupByAge:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown cleanup mode: %s", s)
+	}
+}
+
+// Executor executes statements on the database, as canal.Canal does.
+type Executor interface {
+	Execute(cmd string, args ...interface{}) (*mysql.Result, error)
+}
+
+var _ Executor = (*canal.Canal)(nil)
+
+// Cleanup defines the deletion of the outbox rows whose events have been dispatched and whose position has been
+// persisted by the StateHandler, so that the rows not read yet are never deleted.
+// Rows are deleted in batches while the Runner is running, a failed delete is retried at the next persisted position.
+type Cleanup struct {
+	Mode     CleanupMode
+	Executor Executor
+	// AgeColumnName is the DATETIME or TIMESTAMP column holding the creation time of the rows, required by
+	// CleanupByAge. DATETIME values are taken as UTC. Rows are deleted when it is older than Retention and their
+	// primary key, an integer following the insertion order as AUTO_INCREMENT ones do, is not greater than the one of
+	// the last persisted event.
+	AgeColumnName string
+	Retention     time.Duration
+	// BatchSize is the maximum number of rows deleted by each statement, 500 by default.
+	BatchSize int
+	// Interval is the minimum delay between two statements, 100ms by default.
+	Interval time.Duration
+}
+
+func (c Cleanup) enabled() bool {
+	return c.Mode != "" && c.Mode != CleanupNone
+}
+
+func (c Cleanup) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+
+	if _, err := ParseCleanupMode(string(c.Mode)); err != nil {
+		return err
+	}
+
+	if c.Executor == nil {
+		return errors.New("cleanup requires an executor")
+	}
+
+	if c.Mode == CleanupByAge && c.AgeColumnName == "" {
+		return errors.New("cleanup by age requires the age column name")
+	}
+
+	return nil
+}
+
+// cleaner tracks the rows of the dispatched events and deletes them once their position is persisted.
+type cleaner struct {
+	cleanup Cleanup
+	notify  chan struct{}
+
+	mu sync.Mutex
+	// dispatched are the rows dispatched after the last persisted position, in dispatch order.
+	dispatched []dispatchedRow
+	// deletable are the primary keys of the rows to delete by table reference, in CleanupByPrimaryKey mode.
+	deletable map[string][][]interface{}
+	// watermarks are the greatest primary keys of the persisted rows by table reference, in CleanupByAge mode.
+	watermarks map[string]*big.Int
+	tables     map[string]*Table
+	// warned are the tables whose rows cannot be deleted by age, logged once.
+	warned map[string]bool
+}
+
+type dispatchedRow struct {
+	seq   uint64
+	table *Table
+	pk    []interface{}
+}
+
+func newCleaner(cleanup Cleanup) *cleaner {
+	if cleanup.BatchSize <= 0 {
+		cleanup.BatchSize = defaultCleanupBatchSize
+	}
+	if cleanup.Interval <= 0 {
+		cleanup.Interval = defaultCleanupInterval
+	}
+
+	return &cleaner{
+		cleanup:    cleanup,
+		notify:     make(chan struct{}, 1),
+		deletable:  map[string][][]interface{}{},
+		watermarks: map[string]*big.Int{},
+		tables:     map[string]*Table{},
+		warned:     map[string]bool{},
+	}
+}
+
+// dispatching records the row of the event with the given sequence number.
+func (c *cleaner) dispatching(seq uint64, e *RowsEvent, row []interface{}) {
+	if e.Table == nil || len(e.Table.PKColumns) == 0 {
+		return
+	}
+
+	r := dispatchedRow{seq: seq, table: e.Table}
+	for i, pk := range e.Table.PKColumns {
+		v := row[pk]
+		// unsigned values above the signed range are read as negative when the column is not known to be unsigned
+		if col := e.Table.PKColumn(i); col.IsUnsigned {
+			v = unsignedValue(v, col.Type == TypeMediumInt)
+		}
+		r.pk = append(r.pk, v)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.dispatched = append(c.dispatched, r)
+}
+
+// persisted makes the rows of the first dispatched events deletable, once their position has been persisted.
+func (c *cleaner) persisted(dispatched uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := 0
+	for ; i < len(c.dispatched) && c.dispatched[i].seq < dispatched; i++ {
+		r := c.dispatched[i]
+		ref := tableRef(r.table.Schema, r.table.Name)
+		c.tables[ref] = r.table
+		if c.cleanup.Mode == CleanupByPrimaryKey {
+			c.deletable[ref] = append(c.deletable[ref], r.pk)
+			continue
+		}
+
+		pk, err := integerPK(r.pk)
+		if err != nil {
+			if !c.warned[ref] {
+				logrus.WithError(err).
+					WithField("table", ref).
+					Warn("outbox rows cannot be deleted by age")
+				c.warned[ref] = true
+			}
+			continue
+		}
+		if w := c.watermarks[ref]; w == nil || pk.Cmp(w) > 0 {
+			c.watermarks[ref] = pk
+		}
+	}
+	if i == 0 {
+		return
+	}
+	c.dispatched = c.dispatched[i:]
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run deletes the deletable rows until ctx is canceled.
+func (c *cleaner) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.notify:
+		}
+
+		for _, ref := range c.tableRefs() {
+			var err error
+			if c.cleanup.Mode == CleanupByPrimaryKey {
+				err = c.deleteByPrimaryKey(ctx, ref)
+			} else {
+				err = c.deleteByAge(ctx, ref)
+			}
+			if err != nil && ctx.Err() == nil {
+				logrus.WithError(err).
+					WithField("table", ref).
+					Warn("outbox cleanup failed, retrying at the next persisted position")
+			}
+		}
+	}
+}
+
+func (c *cleaner) tableRefs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	refs := make([]string, 0, len(c.tables))
+	for ref := range c.tables {
+		refs = append(refs, ref)
+	}
+
+	return refs
+}
+
+func (c *cleaner) deleteByPrimaryKey(ctx context.Context, ref string) error {
+	for {
+		c.mu.Lock()
+		t := c.tables[ref]
+		pks := c.deletable[ref]
+		if len(pks) > c.cleanup.BatchSize {
+			pks = pks[:c.cleanup.BatchSize]
+		}
+		c.mu.Unlock()
+
+		if len(pks) == 0 {
+			return nil
+		}
+
+		query, args := deleteByPrimaryKeyQuery(t, pks)
+		rr, err := c.execute(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		c.deletable[ref] = c.deletable[ref][len(pks):]
+		c.mu.Unlock()
+
+		logrus.WithField("table", ref).
+			WithField("rows", rr.AffectedRows).
+			Debug("outbox rows deleted")
+	}
+}
+
+func (c *cleaner) deleteByAge(ctx context.Context, ref string) error {
+	c.mu.Lock()
+	t := c.tables[ref]
+	watermark := c.watermarks[ref]
+	c.mu.Unlock()
+
+	if watermark == nil {
+		return nil
+	}
+
+	query, args, err := deleteByAgeQuery(t, c.cleanup.AgeColumnName, watermark, time.Now().Add(-c.cleanup.Retention))
+	if err != nil {
+		return err
+	}
+	query = fmt.Sprintf("%s LIMIT %d", query, c.cleanup.BatchSize)
+
+	for {
+		rr, err := c.execute(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+
+		logrus.WithField("table", ref).
+			WithField("rows", rr.AffectedRows).
+			Debug("outbox rows deleted")
+
+		if rr.AffectedRows < uint64(c.cleanup.BatchSize) {
+			return nil
+		}
+	}
+}
+
+// execute executes the statement after waiting for the interval, to limit the load on the database.
+func (c *cleaner) execute(ctx context.Context, query string, args ...interface{}) (*mysql.Result, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(c.cleanup.Interval):
+	}
+
+	return c.cleanup.Executor.Execute(query, args...)
+}
+
+func deleteByPrimaryKeyQuery(t *Table, pks [][]interface{}) (string, []interface{}) {
+	pk := make([]string, 0, len(t.PKColumns))
+	for i := range t.PKColumns {
+		pk = append(pk, quoteIdentifier(t.PKColumn(i).Name))
+	}
+
+	tuple := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(pk)), ", ") + ")"
+	tuples := make([]string, 0, len(pks))
+	args := make([]interface{}, 0, len(pks)*len(pk))
+	for _, v := range pks {
+		tuples = append(tuples, tuple)
+		args = append(args, v...)
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s.%s WHERE (%s) IN (%s)",
+		quoteIdentifier(t.Schema), quoteIdentifier(t.Name), strings.Join(pk, ", "), strings.Join(tuples, ", "))
+
+	return query, args
+}
+
+// deleteByAgeQuery returns the statement deleting the rows older than before, up to the watermark primary key.
+// The time is compared in UTC whatever the time zone of the session: DATETIME values are taken as UTC, TIMESTAMP ones
+// are compared as Unix timestamps.
+func deleteByAgeQuery(
+	t *Table,
+	ageColumnName string,
+	watermark *big.Int,
+	before time.Time,
+) (string, []interface{}, error) {
+	i := t.FindColumn(ageColumnName)
+	if i < 0 {
+		return "", nil, fmt.Errorf("missing age column %s", ageColumnName)
+	}
+
+	var age string
+	var cutoff interface{}
+	switch t.Columns[i].Type {
+	case TypeDatetime:
+		age = quoteIdentifier(ageColumnName)
+		cutoff = before.UTC().Format("2006-01-02 15:04:05")
+	case TypeTimestamp:
+		age = fmt.Sprintf("UNIX_TIMESTAMP(%s)", quoteIdentifier(ageColumnName))
+		cutoff = before.Unix()
+	default:
+		return "", nil, fmt.Errorf("age column %s is neither DATETIME nor TIMESTAMP", ageColumnName)
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s.%s WHERE %s <= ? AND %s < ?",
+		quoteIdentifier(t.Schema), quoteIdentifier(t.Name), quoteIdentifier(t.PKColumn(0).Name), age)
+
+	// the primary key is compared as an integer, not as the double a string would be converted to
+	var pk interface{} = watermark.Uint64()
+	if watermark.IsInt64() {
+		pk = watermark.Int64()
+	}
+
+	return query, []interface{}{pk, cutoff}, nil
+}
+
+// integerPK returns the value of a single-column integer primary key.
+func integerPK(pk []interface{}) (*big.Int, error) {
+	if len(pk) != 1 {
+		return nil, errors.New("the primary key has several columns, an integer one is required")
+	}
+
+	switch pk[0].(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		r, _ := new(big.Int).SetString(fmt.Sprint(pk[0]), 10)
+		return r, nil
+	default:
+		return nil, fmt.Errorf("the primary key is a %T, an integer one is required", pk[0])
+	}
+}
@@ -0,0 +1,276 @@
+package run
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+)
+
+const (
+	cloudEventsSpecVersion         = "1.0"
+	cloudEventsStructuredMediaType = "application/cloudevents+json"
+
+	defaultCloudEventsIDColumnName    = "id"
+	defaultCloudEventsDataContentType = "application/json"
+
+	mysqlDateTimeLayout = "2006-01-02 15:04:05.999999"
+)
+
+type CloudEventsMode string
+
+const (
+	// CloudEventsBinary sends the context attributes as metadata, e.g. ce_* Kafka headers, and the payload as data.
+	CloudEventsBinary CloudEventsMode = "binary"
+	// CloudEventsStructured sends the whole event as a JSON object.
+	CloudEventsStructured CloudEventsMode = "structured"
+)
+
+func ParseCloudEventsMode(s string) (CloudEventsMode, error) {
+	switch m := CloudEventsMode(s); m {
+	case "":
+		return CloudEventsBinary, nil
+	case CloudEventsBinary, CloudEventsStructured:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown cloudevents mode: %s", s)
+	}
+}
+
+// CloudEvents defines how outbox events are encoded as CloudEvents 1.0.
+// Empty column names select the defaults of each attribute.
+type CloudEvents struct {
+	Mode CloudEventsMode
+	// IDColumnName is the column of the id attribute, "id" by default.
+	IDColumnName string
+	// Source is the source attribute, "/schema/table" of the outbox table by default.
+	// SourceColumnName takes precedence over it.
+	Source           string
+	SourceColumnName string
+	// TypeColumnName is the column of the type attribute, the aggregate type by default.
+	TypeColumnName string
+	// SubjectColumnName is the column of the subject attribute, the aggregate ID by default.
+	SubjectColumnName string
+	// TimeColumnName is the column of the time attribute, the binlog timestamp of the event by default.
+	// Its value can be a DATETIME or an RFC3339 time, DATETIME values are in UTC.
+	TimeColumnName string
+	// DataContentType is the media type of the payload, "application/json" by default.
+	DataContentType string
+}
+
+// CloudEvent is an encoded CloudEvent, ready to be sent by an EventDispatcher.
+type CloudEvent struct {
+	// Attributes are the context attributes to send as metadata, only in binary mode.
+	// Names are unprefixed, the protocol binding adds its prefix, e.g. ce_ for Kafka.
+	Attributes []CloudEventAttribute
+	// ContentType is the content type of Data.
+	ContentType string
+	Data        []byte
+}
+
+type CloudEventAttribute struct {
+	Name  string
+	Value string
+}
+
+type CloudEventsEncoder struct {
+	cloudEvents CloudEvents
+}
+
+func NewCloudEventsEncoder(cloudEvents CloudEvents) (*CloudEventsEncoder, error) {
+	mode, err := ParseCloudEventsMode(string(cloudEvents.Mode))
+	if err != nil {
+		return nil, err
+	}
+	cloudEvents.Mode = mode
+
+	if cloudEvents.IDColumnName == "" {
+		cloudEvents.IDColumnName = defaultCloudEventsIDColumnName
+	}
+	if cloudEvents.DataContentType == "" {
+		cloudEvents.DataContentType = defaultCloudEventsDataContentType
+	}
+
+	return &CloudEventsEncoder{cloudEvents: cloudEvents}, nil
+}
+
+func (c *CloudEventsEncoder) Encode(event OutboxEvent) (CloudEvent, error) {
+	a, err := c.attributes(event)
+	if err != nil {
+		return CloudEvent{}, err
+	}
+
+	if c.cloudEvents.Mode == CloudEventsBinary {
+		return CloudEvent{
+			Attributes:  a.list(),
+			ContentType: a.dataContentType,
+			Data:        event.Payload,
+		}, nil
+	}
+
+	se := structuredCloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              a.id,
+		Source:          a.source,
+		Type:            a.eventType,
+		Subject:         a.subject,
+		Time:            a.time,
+		DataContentType: a.dataContentType,
+	}
+	if event.Payload != nil {
+		if isJSONMediaType(a.dataContentType) && json.Valid(event.Payload) {
+			se.Data = event.Payload
+		} else {
+			se.DataBase64 = event.Payload
+		}
+	}
+
+	data, err := json.Marshal(se)
+	if err != nil {
+		return CloudEvent{}, err
+	}
+
+	return CloudEvent{
+		ContentType: cloudEventsStructuredMediaType,
+		Data:        data,
+	}, nil
+}
+
+type cloudEventAttributes struct {
+	id              string
+	source          string
+	eventType       string
+	subject         string
+	time            string
+	dataContentType string
+}
+
+func (a cloudEventAttributes) list() []CloudEventAttribute {
+	r := []CloudEventAttribute{
+		{Name: "specversion", Value: cloudEventsSpecVersion},
+		{Name: "id", Value: a.id},
+		{Name: "source", Value: a.source},
+		{Name: "type", Value: a.eventType},
+	}
+	if a.subject != "" {
+		r = append(r, CloudEventAttribute{Name: "subject", Value: a.subject})
+	}
+	if a.time != "" {
+		r = append(r, CloudEventAttribute{Name: "time", Value: a.time})
+	}
+
+	return r
+}
+
+type structuredCloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      []byte          `json:"data_base64,omitempty"`
+}
+
+func (c *CloudEventsEncoder) attributes(event OutboxEvent) (cloudEventAttributes, error) {
+	a := cloudEventAttributes{dataContentType: c.cloudEvents.DataContentType}
+
+	id, err := requiredColumnValue(event.Columns, c.cloudEvents.IDColumnName, "id")
+	if err != nil {
+		return cloudEventAttributes{}, err
+	}
+	a.id = string(id)
+
+	switch {
+	case c.cloudEvents.SourceColumnName != "":
+		source, err := requiredColumnValue(event.Columns, c.cloudEvents.SourceColumnName, "source")
+		if err != nil {
+			return cloudEventAttributes{}, err
+		}
+		a.source = string(source)
+	case c.cloudEvents.Source != "":
+		a.source = c.cloudEvents.Source
+	default:
+		a.source = "/" + event.Schema + "/" + event.Table
+	}
+
+	a.eventType = string(event.AggregateType)
+	if c.cloudEvents.TypeColumnName != "" {
+		eventType, err := requiredColumnValue(event.Columns, c.cloudEvents.TypeColumnName, "type")
+		if err != nil {
+			return cloudEventAttributes{}, err
+		}
+		a.eventType = string(eventType)
+	}
+
+	a.subject = string(event.AggregateID)
+	if c.cloudEvents.SubjectColumnName != "" {
+		subject, ok := eventColumnValue(event.Columns, c.cloudEvents.SubjectColumnName)
+		if !ok {
+			return cloudEventAttributes{}, fmt.Errorf(
+				"column not found for cloudevents subject. Column: %s", c.cloudEvents.SubjectColumnName)
+		}
+		a.subject = string(subject)
+	}
+
+	if c.cloudEvents.TimeColumnName == "" {
+		if event.EventTimestampFromDatabase != 0 {
+			a.time = time.Unix(int64(event.EventTimestampFromDatabase), 0).UTC().Format(time.RFC3339)
+		}
+
+		return a, nil
+	}
+
+	v, err := requiredColumnValue(event.Columns, c.cloudEvents.TimeColumnName, "time")
+	if err != nil {
+		return cloudEventAttributes{}, err
+	}
+	t, err := parseColumnTime(string(v))
+	if err != nil {
+		return cloudEventAttributes{}, fmt.Errorf("invalid cloudevents time. Column: %s: %w",
+			c.cloudEvents.TimeColumnName, err)
+	}
+	a.time = t.Format(time.RFC3339Nano)
+
+	return a, nil
+}
+
+func requiredColumnValue(columns []Column, name string, attribute string) ([]byte, error) {
+	v, ok := eventColumnValue(columns, name)
+	if !ok || v == nil {
+		return nil, fmt.Errorf("column not found for cloudevents %s. Column: %s", attribute, name)
+	}
+
+	return v, nil
+}
+
+func eventColumnValue(columns []Column, name string) ([]byte, bool) {
+	for _, c := range columns {
+		if string(c.Name) == name {
+			return c.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+func parseColumnTime(v string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err == nil {
+		return t, nil
+	}
+
+	return time.ParseInLocation(mysqlDateTimeLayout, v, time.UTC)
+}
+
+func isJSONMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,165 @@
+package run_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloudEventsEncoder_Encode(t *testing.T) {
+	event := run.OutboxEvent{
+		Schema:        "sales",
+		Table:         "outbox",
+		AggregateID:   []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c"),
+		AggregateType: []byte("order"),
+		Payload:       []byte(`{"name": "new order"}`),
+		Columns: []run.Column{
+			{Name: []byte("id"), Value: []byte("5c0e9be6-ea69-452d-9824-7f55b544f2e3")},
+			{Name: []byte("event_type"), Value: []byte("com.example.order.created")},
+			{Name: []byte("origin"), Value: []byte("/orders")},
+			{Name: []byte("customer"), Value: []byte("acme")},
+			{Name: []byte("created_at"), Value: []byte("2022-11-20 10:30:00.5")},
+			{Name: []byte("occurred_at"), Value: []byte("2022-11-20T11:30:00+01:00")},
+			{Name: []byte("deleted_at"), Value: nil},
+		},
+		EventTimestampFromDatabase: 1668940200,
+	}
+
+	tests := []struct {
+		name        string
+		cloudEvents run.CloudEvents
+		event       *run.OutboxEvent
+		want        run.CloudEvent
+		wantErr     error
+	}{
+		{
+			name: "when mode is binary then attributes default to the outbox event and data is the payload",
+			want: run.CloudEvent{
+				Attributes: []run.CloudEventAttribute{
+					{Name: "specversion", Value: "1.0"},
+					{Name: "id", Value: "5c0e9be6-ea69-452d-9824-7f55b544f2e3"},
+					{Name: "source", Value: "/sales/outbox"},
+					{Name: "type", Value: "order"},
+					{Name: "subject", Value: "c44ade3e-9394-4e6e-8d2d-20707d61061c"},
+					{Name: "time", Value: "2022-11-20T10:30:00Z"},
+				},
+				ContentType: "application/json",
+				Data:        []byte(`{"name": "new order"}`),
+			},
+		},
+		{
+			name: "when columns are configured then attributes are read from them",
+			cloudEvents: run.CloudEvents{
+				Mode:              run.CloudEventsBinary,
+				SourceColumnName:  "origin",
+				Source:            "/ignored",
+				TypeColumnName:    "event_type",
+				SubjectColumnName: "customer",
+				TimeColumnName:    "created_at",
+			},
+			want: run.CloudEvent{
+				Attributes: []run.CloudEventAttribute{
+					{Name: "specversion", Value: "1.0"},
+					{Name: "id", Value: "5c0e9be6-ea69-452d-9824-7f55b544f2e3"},
+					{Name: "source", Value: "/orders"},
+					{Name: "type", Value: "com.example.order.created"},
+					{Name: "subject", Value: "acme"},
+					{Name: "time", Value: "2022-11-20T10:30:00.5Z"},
+				},
+				ContentType: "application/json",
+				Data:        []byte(`{"name": "new order"}`),
+			},
+		},
+		{
+			name: "when mode is structured then the event is a JSON object with the payload as data",
+			cloudEvents: run.CloudEvents{
+				Mode:              run.CloudEventsStructured,
+				Source:            "https://example.com/orders",
+				SubjectColumnName: "deleted_at",
+				TimeColumnName:    "occurred_at",
+			},
+			want: run.CloudEvent{
+				ContentType: "application/cloudevents+json",
+				Data: []byte(`{"specversion":"1.0","id":"5c0e9be6-ea69-452d-9824-7f55b544f2e3",` +
+					`"source":"https://example.com/orders","type":"order","time":"2022-11-20T11:30:00+01:00",` +
+					`"datacontenttype":"application/json","data":{"name":"new order"}}`),
+			},
+		},
+		{
+			name: "when mode is structured and payload is not JSON then data is base64 encoded",
+			cloudEvents: run.CloudEvents{
+				Mode:            run.CloudEventsStructured,
+				DataContentType: "text/plain",
+			},
+			event: &run.OutboxEvent{
+				Schema:        "sales",
+				Table:         "outbox",
+				AggregateID:   []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c"),
+				AggregateType: []byte("order"),
+				Payload:       []byte("new order"),
+				Columns:       []run.Column{{Name: []byte("id"), Value: []byte("1")}},
+			},
+			want: run.CloudEvent{
+				ContentType: "application/cloudevents+json",
+				Data: []byte(`{"specversion":"1.0","id":"1","source":"/sales/outbox","type":"order",` +
+					`"subject":"c44ade3e-9394-4e6e-8d2d-20707d61061c","datacontenttype":"text/plain",` +
+					`"data_base64":"bmV3IG9yZGVy"}`),
+			},
+		},
+		{
+			name:        "when id column is missing then error",
+			cloudEvents: run.CloudEvents{IDColumnName: "event_id"},
+			wantErr:     errors.New("column not found for cloudevents id. Column: event_id"),
+		},
+		{
+			name:        "when type column is null then error",
+			cloudEvents: run.CloudEvents{TypeColumnName: "deleted_at"},
+			wantErr:     errors.New("column not found for cloudevents type. Column: deleted_at"),
+		},
+		{
+			name:        "when time column is not a time then error",
+			cloudEvents: run.CloudEvents{TimeColumnName: "customer"},
+			wantErr: errors.New("invalid cloudevents time. Column: customer: " +
+				"parsing time \"acme\" as \"2006-01-02 15:04:05.999999\": cannot parse \"acme\" as \"2006\""),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := run.NewCloudEventsEncoder(tt.cloudEvents)
+			require.NoError(t, err)
+
+			oe := event
+			if tt.event != nil {
+				oe = *tt.event
+			}
+
+			got, err := e.Encode(oe)
+			if tt.wantErr != nil {
+				assert.EqualError(t, err, tt.wantErr.Error())
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want.Attributes, got.Attributes)
+			assert.Equal(t, tt.want.ContentType, got.ContentType)
+			assert.Equal(t, string(tt.want.Data), string(got.Data))
+		})
+	}
+}
+
+func TestParseCloudEventsMode(t *testing.T) {
+	m, err := run.ParseCloudEventsMode("")
+	require.NoError(t, err)
+	assert.Equal(t, run.CloudEventsBinary, m)
+
+	m, err = run.ParseCloudEventsMode("structured")
+	require.NoError(t, err)
+	assert.Equal(t, run.CloudEventsStructured, m)
+
+	_, err = run.ParseCloudEventsMode("batched")
+	assert.Error(t, err)
+}
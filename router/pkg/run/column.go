@@ -0,0 +1,148 @@
+package run
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxMediumIntUnsigned = 1<<24 - 1
+
+// columnValue returns the canonical encoding of the value of a column of the given type:
+//   - integers in base 10, unsigned when the column is unsigned
+//   - floats in their shortest exact representation, decimals as exact numbers when the canal uses decimals
+//   - DATETIME and TIMESTAMP as RFC3339 times, in UTC as they are read from the binlog without a location
+//   - JSON as JSON text
+//   - ENUM and SET as their values, BIT as an unsigned integer
+//   - strings and binaries as they are
+//
+// Values that cannot be decoded, e.g. zero dates, are encoded as they are.
+func columnValue(c TableColumn, v interface{}) []byte {
+	if v == nil {
+		return nil
+	}
+
+	switch c.Type {
+	case TypeNumber, TypeMediumInt:
+		if c.IsUnsigned {
+			if u, ok := unsigned(c, v); ok {
+				return []byte(strconv.FormatUint(u, 10))
+			}
+		}
+	case TypeEnum:
+		if i, ok := integer(v); ok {
+			if i < 1 || int(i) > len(c.EnumValues) {
+				return []byte{}
+			}
+			return []byte(c.EnumValues[i-1])
+		}
+	case TypeSet:
+		if i, ok := integer(v); ok {
+			values := make([]string, 0, len(c.SetValues))
+			for b, s := range c.SetValues {
+				if i&(1<<b) != 0 {
+					values = append(values, s)
+				}
+			}
+			return []byte(strings.Join(values, ","))
+		}
+	case TypeBit:
+		switch b := v.(type) {
+		case []byte:
+			// BIT values read by queries are big-endian bytes
+			padded := make([]byte, 8)
+			if len(b) <= 8 {
+				copy(padded[8-len(b):], b)
+				return []byte(strconv.FormatUint(binary.BigEndian.Uint64(padded), 10))
+			}
+		default:
+			if i, ok := integer(v); ok {
+				return []byte(strconv.FormatUint(uint64(i), 10))
+			}
+		}
+	case TypeDatetime, TypeTimestamp:
+		if s, ok := stringValue(v); ok {
+			t, err := time.ParseInLocation(mysqlDateTimeLayout, s, time.UTC)
+			if err != nil {
+				return []byte(s)
+			}
+			return []byte(t.Format(time.RFC3339Nano))
+		}
+	}
+
+	switch cv := v.(type) {
+	case []byte:
+		return cv
+	case string:
+		return []byte(cv)
+	case float32:
+		return []byte(strconv.FormatFloat(float64(cv), 'f', -1, 32))
+	case float64:
+		return []byte(strconv.FormatFloat(cv, 'f', -1, 64))
+	case time.Time:
+		return []byte(cv.Format(time.RFC3339Nano))
+	case fmt.Stringer:
+		// decimal.Decimal, when the canal uses decimals
+		return []byte(cv.String())
+	default:
+		return []byte(fmt.Sprintf("%v", cv))
+	}
+}
+
+func unsigned(c TableColumn, v interface{}) (uint64, bool) {
+	switch i := v.(type) {
+	case int8:
+		return uint64(uint8(i)), true
+	case int16:
+		return uint64(uint16(i)), true
+	case int32:
+		if i < 0 && c.Type == TypeMediumInt {
+			return uint64(maxMediumIntUnsigned + int64(i) + 1), true
+		}
+		return uint64(uint32(i)), true
+	case int64:
+		return uint64(i), true
+	case int:
+		return uint64(i), true
+	default:
+		return 0, false
+	}
+}
+
+func integer(v interface{}) (int64, bool) {
+	switch i := v.(type) {
+	case int8:
+		return int64(i), true
+	case int16:
+		return int64(i), true
+	case int32:
+		return int64(i), true
+	case int64:
+		return i, true
+	case int:
+		return int64(i), true
+	case uint8:
+		return int64(i), true
+	case uint16:
+		return int64(i), true
+	case uint32:
+		return int64(i), true
+	case uint64:
+		return int64(i), true
+	default:
+		return 0, false
+	}
+}
+
+func stringValue(v interface{}) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case []byte:
+		return string(s), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,92 @@
+package run
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// PoisonEventPolicy defines how the EventHandler deals with the rows that cannot be mapped to an event
+// and with the events whose dispatch fails.
+// The zero value stops the router at the first failure.
+// With an AsyncEventDispatcher, the events of an aggregate wait for the retries of its former events, so that
+// retries do not reorder them.
+type PoisonEventPolicy struct {
+	// MaxRetries is the number of times a failed dispatch is retried. Mapping failures are never retried, nor are the
+	// events of a TransactionalEventDispatcher, with which NewEventHandler rejects retries.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubled at every following one.
+	RetryBackoff time.Duration
+	// DeadLetterSink, when set, receives the rows still failing after the retries, and the router continues
+	// with the following ones. Otherwise the failure stops the router.
+	DeadLetterSink DeadLetterSink
+}
+
+func (p PoisonEventPolicy) enabled() bool {
+	return p.MaxRetries > 0 || p.DeadLetterSink != nil
+}
+
+func (p PoisonEventPolicy) backoff(attempt int) time.Duration {
+	return p.RetryBackoff << (attempt - 1)
+}
+
+type DeadLetterSink interface {
+	Send(deadLetter DeadLetter) error
+}
+
+// DeadLetter is a row of the outbox table that could not be mapped or dispatched.
+type DeadLetter struct {
+	Schema string
+	Table  string
+	// Position is the position of the end of the row-event in the stream of the Source.
+	Position  Position
+	Timestamp uint32
+	Columns   []Column
+	// Event is nil when the row could not be mapped.
+	Event *OutboxEvent
+	// Err is the last error returned by the mapping or the dispatch.
+	Err error
+	// Attempts is the number of dispatches tried, zero when the row could not be mapped.
+	Attempts int
+}
+
+type deadLetterJSON struct {
+	Schema    string             `json:"schema"`
+	Table     string             `json:"table"`
+	File      string             `json:"binlog_file"`
+	Pos       uint32             `json:"binlog_pos"`
+	LSN       uint64             `json:"lsn,omitempty"`
+	Timestamp uint32             `json:"timestamp"`
+	Error     string             `json:"error"`
+	Attempts  int                `json:"attempts"`
+	Columns   map[string]*string `json:"columns"`
+}
+
+// MarshalJSON encodes the dead letter with the raw column values as strings, null when NULL.
+func (d DeadLetter) MarshalJSON() ([]byte, error) {
+	j := deadLetterJSON{
+		Schema:    d.Schema,
+		Table:     d.Table,
+		File:      d.Position.File,
+		Pos:       d.Position.Offset,
+		LSN:       d.Position.LSN,
+		Timestamp: d.Timestamp,
+		Attempts:  d.Attempts,
+		Columns:   make(map[string]*string, len(d.Columns)),
+	}
+
+	if d.Err != nil {
+		j.Error = d.Err.Error()
+	}
+
+	for _, c := range d.Columns {
+		if c.Value == nil {
+			j.Columns[string(c.Name)] = nil
+			continue
+		}
+
+		v := string(c.Value)
+		j.Columns[string(c.Name)] = &v
+	}
+
+	return json.Marshal(j)
+}
@@ -1,12 +1,17 @@
 package run
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/go-mysql-org/go-mysql/canal"
-	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -15,38 +20,84 @@ const (
 	defaultPayloadColumnName       = "payload"
 )
 
-type StateHandler interface {
-	GetLastPosition() (mysql.Position, error)
-	SetLastPosition(position mysql.Position) error
-}
-
 type OutboxEvent struct {
+	// Schema and Table are the outbox table the event was read from.
+	Schema                     string
+	Table                      string
 	AggregateID                []byte
 	AggregateType              []byte
 	Payload                    []byte
 	Columns                    []Column
 	EventTimestampFromDatabase uint32
+	Binlog                     BinlogMetadata
+	// SpanContext is the context of the dispatch span, to be propagated with the event.
+	SpanContext trace.SpanContext
+}
+
+// BinlogMetadata locates the row of an event in the stream of the Source, e.g. the binlog.
+type BinlogMetadata struct {
+	// Position is the end of the row-event, the zero Position for the events read by a snapshot.
+	Position Position
+	// Row is the index of the row in the row-event, where the before and after images of an update count as one row.
+	Row int
+	// GTID is the GTID of the transaction, empty when the server has GTIDs disabled.
+	GTID     string
+	ServerID uint32
 }
 
 type Column struct {
-	Name  []byte
+	Name []byte
+	// Value is the canonical encoding of the value, nil when NULL: integers in base 10, exact decimals,
+	// RFC3339 times and JSON text.
 	Value []byte
+	// Type is the type of the column and RawType its definition, e.g. decimal(10,2) unsigned.
+	Type    ColumnType
+	RawType string
 }
 
 type EventDispatcher interface {
 	Dispatch(event OutboxEvent) error
 }
 
+// AsyncEventDispatcher is an EventDispatcher that can dispatch events without waiting for their delivery.
+// When DispatchAsync returns nil, ack must be called exactly once, with a nil error when the delivery is confirmed
+// or with the delivery error otherwise.
+// Acknowledgements may be out of order, the Runner persists a position only when all the events before it are
+// acknowledged.
+type AsyncEventDispatcher interface {
+	EventDispatcher
+	DispatchAsync(event OutboxEvent, ack func(err error)) error
+}
+
+// TransactionalEventDispatcher is an EventDispatcher delivering the events of each binlog transaction atomically.
+// Commit is called with every position synced after the dispatched events, i.e. at the end of each binlog
+// transaction, and it must make the events dispatched so far visible together with the position.
+type TransactionalEventDispatcher interface {
+	EventDispatcher
+	Commit(position Position) error
+}
+
 type AggregateTypeTopicPair struct {
 	AggregateTypeRegexp *regexp.Regexp
 	Topic               string
 }
 
+// EventHandlerOptions are the optional settings of an EventHandler, their zero values are the defaults.
+type EventHandlerOptions struct {
+	PoisonEventPolicy  PoisonEventPolicy
+	Instrumentation    Instrumentation
+	Tracing            Tracing
+	OutboxTables       []OutboxTable
+	SchemaChangePolicy SchemaChangePolicy
+	OutboxMode         OutboxMode
+}
+
 func NewEventHandler(
 	eventDispatcher EventDispatcher,
 	aggregateIDColumnName string,
 	aggregateTypeColumnName string,
 	payloadColumnName string,
+	options EventHandlerOptions,
 ) (*EventHandler, error) {
 	actualAggregateIDColumnName := defaultAggregateIDColumnName
 	if aggregateIDColumnName != "" {
@@ -63,38 +114,103 @@ func NewEventHandler(
 		actualPayloadColumnName = payloadColumnName
 	}
 
+	eventMapper := &EventMapper{
+		aggregateIDColumnName:   actualAggregateIDColumnName,
+		aggregateTypeColumnName: actualAggregateTypeColumnName,
+		payloadColumnName:       actualPayloadColumnName,
+	}
+
+	// the retries would be written outside the transaction of the binlog position of their events
+	if _, ok := eventDispatcher.(TransactionalEventDispatcher); ok && options.PoisonEventPolicy.MaxRetries > 0 {
+		return nil, errors.New("poison-event retries are not supported by a TransactionalEventDispatcher")
+	}
+
+	tableEventMappers, err := newTableEventMappers(options.OutboxTables, eventMapper)
+	if err != nil {
+		return nil, err
+	}
+
+	var actualInstrumentation Instrumentation = noopInstrumentation{}
+	if options.Instrumentation != nil {
+		actualInstrumentation = options.Instrumentation
+	}
+
 	return &EventHandler{
-		eventMapper: &EventMapper{
-			aggregateIDColumnName:   actualAggregateIDColumnName,
-			aggregateTypeColumnName: actualAggregateTypeColumnName,
-			payloadColumnName:       actualPayloadColumnName,
-		},
-		eventDispatcher: eventDispatcher,
+		eventMapper:        eventMapper,
+		tableEventMappers:  tableEventMappers,
+		outboxTables:       options.OutboxTables,
+		eventDispatcher:    eventDispatcher,
+		poisonEventPolicy:  options.PoisonEventPolicy,
+		instrumentation:    actualInstrumentation,
+		tracer:             newTracer(options.Tracing),
+		checkpointer:       newCheckpointer(),
+		retrying:           newRetryingKeys(),
+		schemaChangePolicy: options.SchemaChangePolicy,
+		outboxMode:         options.OutboxMode,
 	}, nil
 }
 
 type EventHandler struct {
-	canal.DummyEventHandler
+	eventMapper       *EventMapper
+	tableEventMappers map[string]*EventMapper
+	outboxTables      []OutboxTable
+	eventDispatcher   EventDispatcher
+	poisonEventPolicy PoisonEventPolicy
+	outboxMode        OutboxMode
+	instrumentation   Instrumentation
+	tracer            *tracer
+	checkpointer      *checkpointer
+	retrying          *retryingKeys
+	// cleaner is set by the Runner when the cleanup is enabled.
+	cleaner            *cleaner
+	schemaChangePolicy SchemaChangePolicy
+
+	deadLetters uint64
+}
 
-	eventMapper     *EventMapper
-	eventDispatcher EventDispatcher
-	positionChan    chan mysql.Position
+// DeadLetters returns the number of rows sent to the dead-letter sink, whose positions were skipped.
+func (h *EventHandler) DeadLetters() uint64 {
+	return atomic.LoadUint64(&h.deadLetters)
 }
 
-func (h *EventHandler) OnRow(e *canal.RowsEvent) error {
+func (h *EventHandler) OnRows(e RowsEvent) error {
 	logrus.Debug("reading row-event")
 
-	oes, err := h.eventMapper.Map(e)
-	if err != nil && errors.Is(err, notInsertError) {
-		logrus.Info("skipping row-event that is not an insert")
-		return nil
-	}
-	if err != nil {
+	// an asynchronous dispatch failed, stop reading
+	if _, err := h.checkpointer.last(); err != nil {
 		return err
 	}
 
-	for _, oe := range oes {
-		err = h.eventDispatcher.Dispatch(oe)
+	published := h.outboxMode.publishedRows(&e)
+	if len(published) == 0 {
+		h.skip(&e)
+		return nil
+	}
+
+	for _, i := range published {
+		row := e.Rows[i]
+		ctx := h.tracer.extract(&e, row)
+		_, span := h.tracer.startMap(ctx, &e)
+		oe, err := h.mapRow(&e, row)
+		endSpan(span, err)
+		if err != nil {
+			h.instrumentation.EventFailed(err)
+			err = h.deadLetter(&e, row, nil, err, 0)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+		oe.Binlog = BinlogMetadata{
+			Position: e.Position,
+			Row:      rowIndex(&e, i),
+			GTID:     e.GTID,
+			ServerID: e.ServerID,
+		}
+		h.instrumentation.EventMapped(oe)
+
+		err = h.dispatch(ctx, &e, row, oe)
 		if err != nil {
 			return err
 		}
@@ -102,14 +218,276 @@ func (h *EventHandler) OnRow(e *canal.RowsEvent) error {
 			Debug("event dispatched")
 	}
 
+	return nil
+}
+
+func (h *EventHandler) skip(e *RowsEvent) {
+	switch {
+	case h.outboxMode.Transient:
+		logrus.WithField("action", e.Action).Debug("skipping row-event of transient outbox")
+	case e.Action == DeleteAction:
+		// the rows are deleted by the cleanup, or by the application once they are published
+		logrus.Debug("skipping row-event of deleted rows")
+	default:
+		logrus.Info("skipping row-event that is not an insert")
+	}
+
+	reason := h.outboxMode.skipReason(e)
+	for i := 0; i < rowCount(e); i++ {
+		h.instrumentation.EventSkipped(reason)
+	}
+}
+
+// mapRow maps the row with the column mapping of its outbox table, or with the default one when no outbox table
+// is defined.
+func (h *EventHandler) mapRow(e *RowsEvent, row []interface{}) (OutboxEvent, error) {
+	if h.tableEventMappers == nil {
+		return h.eventMapper.mapRow(e, row)
+	}
+
+	em, ok := h.tableEventMappers[tableRef(e.Table.Schema, e.Table.Name)]
+	if !ok {
+		return OutboxEvent{}, fmt.Errorf("%w: %s.%s", ErrUnknownOutboxTable, e.Table.Schema, e.Table.Name)
+	}
+
+	return em.mapRow(e, row)
+}
+
+func (h *EventHandler) dispatch(ctx context.Context, e *RowsEvent, row []interface{}, oe OutboxEvent) error {
+	ad, async := h.eventDispatcher.(AsyncEventDispatcher)
+
+	// the retries of a failed asynchronous dispatch run while the following events are dispatched, so the events of
+	// an aggregate wait for its retries not to be reordered. The events in flight are kept in order by the dispatcher,
+	// e.g. the idempotent Kafka producer, and their positions by the checkpointer.
+	key := string(oe.AggregateID)
+	retried := async && h.poisonEventPolicy.enabled()
+	if retried {
+		h.retrying.wait(key)
+
+		// the former event of the aggregate may have failed
+		if _, err := h.checkpointer.last(); err != nil {
+			return err
+		}
+	}
+	// the retries may run after the row-event is handled
+	ev := *e
+
+	seq := h.checkpointer.dispatching()
+	if h.cleaner != nil {
+		h.cleaner.dispatching(seq, e, row)
+	}
+	start := time.Now()
+
+	_, span := h.tracer.startDispatch(ctx, oe)
+	oe.SpanContext = span.SpanContext()
+	done := func(err error) {
+		endSpan(span, err)
+		h.checkpointer.acknowledge(seq, err)
+	}
+
+	if async {
+		err := ad.DispatchAsync(oe, func(err error) {
+			if err == nil {
+				h.instrumentation.EventDispatched(oe, time.Since(start))
+				done(nil)
+				return
+			}
+
+			if !h.poisonEventPolicy.enabled() {
+				h.instrumentation.EventFailed(err)
+				done(err)
+				return
+			}
+
+			// retries must not block the dispatcher calling ack, they run in the order of the failures
+			turn := h.retrying.enqueue(key)
+			go func() {
+				h.retrying.take(key, turn)
+				defer h.retrying.release(key)
+				done(h.handleDispatchFailure(&ev, row, oe, err, start, span))
+			}()
+		})
+		if err != nil {
+			if retried {
+				h.retrying.take(key, h.retrying.enqueue(key))
+				defer h.retrying.release(key)
+			}
+			err = h.handleDispatchFailure(e, row, oe, err, start, span)
+			done(err)
+		}
+
+		return err
+	}
+
+	err := h.eventDispatcher.Dispatch(oe)
+	if err != nil {
+		err = h.handleDispatchFailure(e, row, oe, err, start, span)
+	} else {
+		h.instrumentation.EventDispatched(oe, time.Since(start))
+	}
+	done(err)
+
 	return err
 }
 
-func (h *EventHandler) OnPosSynced(p mysql.Position, g mysql.GTIDSet, f bool) error {
-	h.positionChan <- p
+// handleDispatchFailure retries the dispatch of the event according to the poison-event policy,
+// then sends it to the dead-letter sink.
+func (h *EventHandler) handleDispatchFailure(
+	e *RowsEvent,
+	row []interface{},
+	oe OutboxEvent,
+	err error,
+	start time.Time,
+	span trace.Span,
+) error {
+	h.instrumentation.EventFailed(err)
+
+	attempts := 1
+	for ; attempts <= h.poisonEventPolicy.MaxRetries; attempts++ {
+		logrus.WithError(err).
+			WithField("attempt", attempts).
+			Warn("retrying event dispatch")
+		span.AddEvent("retry", trace.WithAttributes(
+			attribute.Int("attempt", attempts),
+			attribute.String("error", err.Error()),
+		))
+
+		time.Sleep(h.poisonEventPolicy.backoff(attempts))
+
+		err = h.eventDispatcher.Dispatch(oe)
+		if err == nil {
+			h.instrumentation.EventDispatched(oe, time.Since(start))
+			return nil
+		}
+		h.instrumentation.EventFailed(err)
+	}
+
+	if h.poisonEventPolicy.DeadLetterSink != nil {
+		span.AddEvent("dead-letter", trace.WithAttributes(attribute.String("error", err.Error())))
+	}
+
+	return h.deadLetter(e, row, &oe, err, attempts)
+}
+
+func (h *EventHandler) deadLetter(
+	e *RowsEvent,
+	row []interface{},
+	oe *OutboxEvent,
+	err error,
+	attempts int,
+) error {
+	if h.poisonEventPolicy.DeadLetterSink == nil {
+		return err
+	}
+
+	dl := DeadLetter{
+		Position:  e.Position,
+		Timestamp: e.Timestamp,
+		Event:     oe,
+		Err:       err,
+		Attempts:  attempts,
+	}
+	if e.Table != nil {
+		dl.Schema = e.Table.Schema
+		dl.Table = e.Table.Name
+		dl.Columns = getColumns(e.Table.Columns, row)
+	}
+
+	sendErr := h.poisonEventPolicy.DeadLetterSink.Send(dl)
+	if sendErr != nil {
+		return fmt.Errorf("dead-letter sink failed: %v, after: %w", sendErr, err)
+	}
+
+	atomic.AddUint64(&h.deadLetters, 1)
+	h.instrumentation.EventSkipped(SkipDeadLetter)
+	logrus.WithError(err).
+		WithField("position", dl.Position).
+		WithField("attempts", attempts).
+		Warn("row sent to dead-letter sink, skipping it")
+
 	return nil
 }
 
-func (h *EventHandler) String() string {
-	return "EventHandler"
+// retryingKeys are the aggregate IDs of the events being retried or dead-lettered, with the queue of their retries.
+type retryingKeys struct {
+	mu       sync.Mutex
+	released *sync.Cond
+	keys     map[string]*retryQueue
+}
+
+// retryQueue hands out turns to the retries of a key in the order they are enqueued.
+type retryQueue struct {
+	next uint64
+	turn uint64
+}
+
+func newRetryingKeys() *retryingKeys {
+	k := &retryingKeys{keys: map[string]*retryQueue{}}
+	k.released = sync.NewCond(&k.mu)
+
+	return k
+}
+
+// enqueue returns the turn of a retry of the key, without waiting.
+func (k *retryingKeys) enqueue(key string) uint64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	q, ok := k.keys[key]
+	if !ok {
+		q = &retryQueue{}
+		k.keys[key] = q
+	}
+	q.next++
+
+	return q.next - 1
+}
+
+// take waits for the turn of a retry of the key.
+func (k *retryingKeys) take(key string, turn uint64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for k.keys[key].turn != turn {
+		k.released.Wait()
+	}
+}
+
+// release ends the current retry of the key.
+func (k *retryingKeys) release(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	defer k.released.Broadcast()
+
+	q := k.keys[key]
+	q.turn++
+	if q.turn == q.next {
+		delete(k.keys, key)
+	}
+}
+
+// wait waits until no event with the key is being retried.
+func (k *retryingKeys) wait(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for {
+		if _, ok := k.keys[key]; !ok {
+			return
+		}
+		k.released.Wait()
+	}
+}
+
+func (h *EventHandler) OnPosition(p Position) error {
+	if td, ok := h.eventDispatcher.(TransactionalEventDispatcher); ok {
+		err := td.Commit(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	h.checkpointer.synced(p)
+	h.instrumentation.PositionSynced(p)
+	return nil
 }
@@ -1,18 +1,26 @@
 package run_test
 
 import (
+	"encoding/json"
 	"errors"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/go-mysql-org/go-mysql/replication"
 	"github.com/go-mysql-org/go-mysql/schema"
 	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
-func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
+func TestEventHandler_OnRows_HappyPaths(t *testing.T) {
 	type fields struct {
 		eventDispatcher         *eventDispatcherMock
 		aggregateIdColumnName   string
@@ -20,7 +28,7 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 		payloadColumnName       string
 	}
 	type args struct {
-		e *canal.RowsEvent
+		e run.RowsEvent
 	}
 
 	orderAggregateID := []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c")
@@ -38,11 +46,11 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 		{
 			name: "when row-event action is not insert then row-event is skipped",
 			args: args{
-				e: &canal.RowsEvent{
-					Table: &schema.Table{
+				e: run.RowsEvent{
+					Table: &run.Table{
 						Schema: "my_schema",
 						Name:   "outbox",
-						Columns: []schema.TableColumn{
+						Columns: []run.TableColumn{
 							{
 								Name: "aggregate_id",
 							},
@@ -54,7 +62,7 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 							},
 						},
 					},
-					Action: canal.DeleteAction,
+					Action: run.DeleteAction,
 					Rows: [][]interface{}{
 						{
 							"c44ade3e-9394-4e6e-8d2d-20707d61061c",
@@ -62,7 +70,6 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 							`{"name": "new order"}`,
 						},
 					},
-					Header: &replication.EventHeader{},
 				},
 			},
 			fields: fields{
@@ -72,11 +79,11 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 		{
 			name: "single row-events, with default column names",
 			args: args{
-				e: &canal.RowsEvent{
-					Table: &schema.Table{
+				e: run.RowsEvent{
+					Table: &run.Table{
 						Schema: "my_schema",
 						Name:   "outbox",
-						Columns: []schema.TableColumn{
+						Columns: []run.TableColumn{
 							{
 								Name: "aggregate_id",
 							},
@@ -91,7 +98,7 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 							},
 						},
 					},
-					Action: canal.InsertAction,
+					Action: run.InsertAction,
 					Rows: [][]interface{}{
 						{
 							"c44ade3e-9394-4e6e-8d2d-20707d61061c",
@@ -100,9 +107,7 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 							orderOtherColumnValue,
 						},
 					},
-					Header: &replication.EventHeader{
-						Timestamp: timestamp,
-					},
+					Timestamp: timestamp,
 				},
 			},
 			fields: fields{
@@ -110,6 +115,8 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 			},
 			wantDispatches: []run.OutboxEvent{
 				{
+					Schema:        "my_schema",
+					Table:         "outbox",
 					AggregateID:   orderAggregateID,
 					AggregateType: orderAggregateType,
 					Payload:       orderPayload,
@@ -138,11 +145,11 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 		{
 			name: "single row-event with custom column names and order",
 			args: args{
-				e: &canal.RowsEvent{
-					Table: &schema.Table{
+				e: run.RowsEvent{
+					Table: &run.Table{
 						Schema: "my_schema",
 						Name:   "outbox",
-						Columns: []schema.TableColumn{
+						Columns: []run.TableColumn{
 							{
 								Name: "aggregateType",
 							},
@@ -157,7 +164,7 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 							},
 						},
 					},
-					Action: canal.InsertAction,
+					Action: run.InsertAction,
 					Rows: [][]interface{}{
 						{
 							"order",
@@ -166,9 +173,7 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 							orderOtherColumnValue,
 						},
 					},
-					Header: &replication.EventHeader{
-						Timestamp: timestamp,
-					},
+					Timestamp: timestamp,
 				},
 			},
 			fields: fields{
@@ -179,6 +184,8 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 			},
 			wantDispatches: []run.OutboxEvent{
 				{
+					Schema:        "my_schema",
+					Table:         "outbox",
 					AggregateID:   orderAggregateID,
 					AggregateType: orderAggregateType,
 					Payload:       orderPayload,
@@ -207,11 +214,11 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 		{
 			name: "multiple row-events, with default column names",
 			args: args{
-				e: &canal.RowsEvent{
-					Table: &schema.Table{
+				e: run.RowsEvent{
+					Table: &run.Table{
 						Schema: "my_schema",
 						Name:   "outbox",
-						Columns: []schema.TableColumn{
+						Columns: []run.TableColumn{
 							{
 								Name: "aggregate_id",
 							},
@@ -226,7 +233,7 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 							},
 						},
 					},
-					Action: canal.InsertAction,
+					Action: run.InsertAction,
 					Rows: [][]interface{}{
 						{
 							"c44ade3e-9394-4e6e-8d2d-20707d61061c",
@@ -241,9 +248,7 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 							nil,
 						},
 					},
-					Header: &replication.EventHeader{
-						Timestamp: timestamp,
-					},
+					Timestamp: timestamp,
 				},
 			},
 			fields: fields{
@@ -251,6 +256,8 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 			},
 			wantDispatches: []run.OutboxEvent{
 				{
+					Schema:        "my_schema",
+					Table:         "outbox",
 					AggregateID:   orderAggregateID,
 					AggregateType: orderAggregateType,
 					Payload:       orderPayload,
@@ -275,6 +282,8 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 					EventTimestampFromDatabase: timestamp,
 				},
 				{
+					Schema:        "my_schema",
+					Table:         "outbox",
 					AggregateID:   []byte("c38a5d13-788c-4878-8bdc-c012cbad5b82"),
 					AggregateType: []byte("invoice"),
 					Payload:       []byte(`{"name": "new invoice"}`),
@@ -297,17 +306,18 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 						},
 					},
 					EventTimestampFromDatabase: timestamp,
+					Binlog:                     run.BinlogMetadata{Row: 1},
 				},
 			},
 		},
 		{
 			name: "multiple row-events, with custom column names",
 			args: args{
-				e: &canal.RowsEvent{
-					Table: &schema.Table{
+				e: run.RowsEvent{
+					Table: &run.Table{
 						Schema: "my_schema",
 						Name:   "outbox",
-						Columns: []schema.TableColumn{
+						Columns: []run.TableColumn{
 							{
 								Name: "aggregateId",
 							},
@@ -322,7 +332,7 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 							},
 						},
 					},
-					Action: canal.InsertAction,
+					Action: run.InsertAction,
 					Rows: [][]interface{}{
 						{
 							"c44ade3e-9394-4e6e-8d2d-20707d61061c",
@@ -337,9 +347,7 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 							nil,
 						},
 					},
-					Header: &replication.EventHeader{
-						Timestamp: timestamp,
-					},
+					Timestamp: timestamp,
 				},
 			},
 			fields: fields{
@@ -350,6 +358,8 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 			},
 			wantDispatches: []run.OutboxEvent{
 				{
+					Schema:        "my_schema",
+					Table:         "outbox",
 					AggregateID:   orderAggregateID,
 					AggregateType: orderAggregateType,
 					Payload:       orderPayload,
@@ -374,6 +384,8 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 					EventTimestampFromDatabase: timestamp,
 				},
 				{
+					Schema:        "my_schema",
+					Table:         "outbox",
 					AggregateID:   []byte("c38a5d13-788c-4878-8bdc-c012cbad5b82"),
 					AggregateType: []byte("invoice"),
 					Payload:       []byte(`{"name": "new invoice"}`),
@@ -396,6 +408,7 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 						},
 					},
 					EventTimestampFromDatabase: timestamp,
+					Binlog:                     run.BinlogMetadata{Row: 1},
 				},
 			},
 		},
@@ -408,10 +421,11 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 				tt.fields.aggregateIdColumnName,
 				tt.fields.aggregateTypeColumnName,
 				tt.fields.payloadColumnName,
+				run.EventHandlerOptions{},
 			)
 			require.NoError(t, err)
 
-			if err := h.OnRow(tt.args.e); (err != nil) != false {
+			if err := h.OnRows(tt.args.e); (err != nil) != false {
 				t.Errorf("OnRow() error = %v, wantErr false", err)
 			}
 
@@ -420,7 +434,7 @@ func TestEventHandler_OnRow_HappyPaths(t *testing.T) {
 	}
 }
 
-func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
+func TestEventHandler_OnRows_UnhappyPaths(t *testing.T) {
 	type fields struct {
 		eventDispatcher         *eventDispatcherMock
 		aggregateIdColumnName   string
@@ -428,7 +442,7 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 		payloadColumnName       string
 	}
 	type args struct {
-		e *canal.RowsEvent
+		e run.RowsEvent
 	}
 	tests := []struct {
 		name               string
@@ -439,11 +453,11 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 		{
 			name: "when dispatcher fails then error",
 			args: args{
-				e: &canal.RowsEvent{
-					Table: &schema.Table{
+				e: run.RowsEvent{
+					Table: &run.Table{
 						Schema: "my_schema",
 						Name:   "outbox",
-						Columns: []schema.TableColumn{
+						Columns: []run.TableColumn{
 							{
 								Name: "aggregate_id",
 							},
@@ -455,7 +469,7 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 							},
 						},
 					},
-					Action: canal.InsertAction,
+					Action: run.InsertAction,
 					Rows: [][]interface{}{
 						{
 							"c44ade3e-9394-4e6e-8d2d-20707d61061c",
@@ -463,7 +477,6 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 							`{"name": "new order"}`,
 						},
 					},
-					Header: &replication.EventHeader{},
 				},
 			},
 			fields: fields{
@@ -475,11 +488,11 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 		{
 			name: "when a Column value is missing compared to table structure then error",
 			args: args{
-				e: &canal.RowsEvent{
-					Table: &schema.Table{
+				e: run.RowsEvent{
+					Table: &run.Table{
 						Schema: "my_schema",
 						Name:   "outbox",
-						Columns: []schema.TableColumn{
+						Columns: []run.TableColumn{
 							{
 								Name: "aggregate_id",
 							},
@@ -491,14 +504,13 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 							},
 						},
 					},
-					Action: canal.InsertAction,
+					Action: run.InsertAction,
 					Rows: [][]interface{}{
 						{
 							"c44ade3e-9394-4e6e-8d2d-20707d61061c",
 							"order",
 						},
 					},
-					Header: &replication.EventHeader{},
 				},
 			},
 			fields: fields{
@@ -508,11 +520,11 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 		{
 			name: "when aggregate-id Column is missing then error",
 			args: args{
-				e: &canal.RowsEvent{
-					Table: &schema.Table{
+				e: run.RowsEvent{
+					Table: &run.Table{
 						Schema: "my_schema",
 						Name:   "outbox",
-						Columns: []schema.TableColumn{
+						Columns: []run.TableColumn{
 							{
 								Name: "aggregateId",
 							},
@@ -524,7 +536,7 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 							},
 						},
 					},
-					Action: canal.InsertAction,
+					Action: run.InsertAction,
 					Rows: [][]interface{}{
 						{
 							"c44ade3e-9394-4e6e-8d2d-20707d61061c",
@@ -532,7 +544,6 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 							`{"name": "new order"}`,
 						},
 					},
-					Header: &replication.EventHeader{},
 				},
 			},
 			fields: fields{
@@ -542,11 +553,11 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 		{
 			name: "when aggregate-type Column is missing then error",
 			args: args{
-				e: &canal.RowsEvent{
-					Table: &schema.Table{
+				e: run.RowsEvent{
+					Table: &run.Table{
 						Schema: "my_schema",
 						Name:   "outbox",
-						Columns: []schema.TableColumn{
+						Columns: []run.TableColumn{
 							{
 								Name: "aggregate_id",
 							},
@@ -558,7 +569,7 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 							},
 						},
 					},
-					Action: canal.InsertAction,
+					Action: run.InsertAction,
 					Rows: [][]interface{}{
 						{
 							"c44ade3e-9394-4e6e-8d2d-20707d61061c",
@@ -566,7 +577,6 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 							`{"name": "new order"}`,
 						},
 					},
-					Header: &replication.EventHeader{},
 				},
 			},
 			fields: fields{
@@ -576,11 +586,11 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 		{
 			name: "when payload Column is missing then error",
 			args: args{
-				e: &canal.RowsEvent{
-					Table: &schema.Table{
+				e: run.RowsEvent{
+					Table: &run.Table{
 						Schema: "my_schema",
 						Name:   "outbox",
-						Columns: []schema.TableColumn{
+						Columns: []run.TableColumn{
 							{
 								Name: "aggregate_id",
 							},
@@ -592,7 +602,7 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 							},
 						},
 					},
-					Action: canal.InsertAction,
+					Action: run.InsertAction,
 					Rows: [][]interface{}{
 						{
 							"c44ade3e-9394-4e6e-8d2d-20707d61061c",
@@ -600,7 +610,6 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 							`{"name": "new order"}`,
 						},
 					},
-					Header: &replication.EventHeader{},
 				},
 			},
 			fields: fields{
@@ -616,6 +625,7 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 				tt.fields.aggregateIdColumnName,
 				tt.fields.aggregateTypeColumnName,
 				tt.fields.payloadColumnName,
+				run.EventHandlerOptions{},
 			)
 			if (err != nil) != tt.wantErrOnConstruct {
 				t.Errorf("NewEventHandler() error = %v, wantErr %v", err, tt.wantErrOnConstruct)
@@ -625,20 +635,1257 @@ func TestEventHandler_OnRow_UnhappyPaths(t *testing.T) {
 				return
 			}
 
-			if err := h.OnRow(tt.args.e); (err != nil) != true {
+			if err := h.OnRows(tt.args.e); (err != nil) != true {
 				t.Errorf("OnRow() error = %v, wantErr true", err)
 			}
 		})
 	}
 }
 
+func TestEventHandler_OnRows_OutboxTables(t *testing.T) {
+	rowsEvent := func(schemaName, tableName string, columnNames ...string) run.RowsEvent {
+		columns := make([]run.TableColumn, 0, len(columnNames))
+		for _, n := range columnNames {
+			columns = append(columns, run.TableColumn{Name: n})
+		}
+
+		return run.RowsEvent{
+			Table:  &run.Table{Schema: schemaName, Name: tableName, Columns: columns},
+			Action: run.InsertAction,
+			Rows:   [][]interface{}{{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"name": "new order"}`}},
+		}
+	}
+
+	outboxTables := []run.OutboxTable{
+		{Schema: "orders", Table: "outbox"},
+		{
+			Schema:                  "invoices",
+			Table:                   "outbox_events",
+			AggregateIDColumnName:   "id",
+			AggregateTypeColumnName: "type",
+			PayloadColumnName:       "body",
+		},
+	}
+
+	tests := []struct {
+		name               string
+		outboxTables       []run.OutboxTable
+		event              run.RowsEvent
+		wantErr            error
+		wantErrOnConstruct bool
+		wantSchema         string
+		wantTable          string
+	}{
+		{
+			name:         "when table has default column mapping then event is mapped with default column names",
+			outboxTables: outboxTables,
+			event:        rowsEvent("orders", "outbox", "aggregate_id", "aggregate_type", "payload"),
+			wantSchema:   "orders",
+			wantTable:    "outbox",
+		},
+		{
+			name:         "when table has its own column mapping then event is mapped with its column names",
+			outboxTables: outboxTables,
+			event:        rowsEvent("invoices", "outbox_events", "id", "type", "body"),
+			wantSchema:   "invoices",
+			wantTable:    "outbox_events",
+		},
+		{
+			name:         "when table has its own column mapping then default column names are not used",
+			outboxTables: outboxTables,
+			event:        rowsEvent("invoices", "outbox_events", "aggregate_id", "aggregate_type", "payload"),
+			wantErr:      errors.New("id Column not found"),
+		},
+		{
+			name:         "when table is not an outbox table then error",
+			outboxTables: outboxTables,
+			event:        rowsEvent("orders", "other", "aggregate_id", "aggregate_type", "payload"),
+			wantErr:      run.ErrUnknownOutboxTable,
+		},
+		{
+			name:       "when there are no outbox tables then any table is mapped with default column names",
+			event:      rowsEvent("any", "table", "aggregate_id", "aggregate_type", "payload"),
+			wantSchema: "any",
+			wantTable:  "table",
+		},
+		{
+			name:               "when outbox table is duplicated then error on construct",
+			outboxTables:       []run.OutboxTable{{Schema: "orders", Table: "outbox"}, {Schema: "orders", Table: "outbox"}},
+			wantErrOnConstruct: true,
+		},
+		{
+			name:               "when outbox table has no schema then error on construct",
+			outboxTables:       []run.OutboxTable{{Table: "outbox"}},
+			wantErrOnConstruct: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ed := &eventDispatcherMock{}
+			h, err := run.NewEventHandler(ed, "", "", "", run.EventHandlerOptions{OutboxTables: tt.outboxTables})
+			if tt.wantErrOnConstruct {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			err = h.OnRows(tt.event)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					assert.EqualError(t, err, tt.wantErr.Error())
+				}
+				return
+			}
+			require.NoError(t, err)
+
+			require.Len(t, ed.dispatches, 1)
+			assert.Equal(t, tt.wantSchema, ed.dispatches[0].Schema)
+			assert.Equal(t, tt.wantTable, ed.dispatches[0].Table)
+			assert.Equal(t, []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c"), ed.dispatches[0].AggregateID)
+			assert.Equal(t, []byte("order"), ed.dispatches[0].AggregateType)
+			assert.Equal(t, []byte(`{"name": "new order"}`), ed.dispatches[0].Payload)
+		})
+	}
+}
+
+func TestEventHandler_OnRows_PoisonEvents(t *testing.T) {
+	dispatchErr := errors.New("message too large")
+	sinkErr := errors.New("sink unavailable")
+
+	rowsEvent := func(rows ...[]interface{}) run.RowsEvent {
+		return run.RowsEvent{
+			Table: &run.Table{
+				Schema: "my_schema",
+				Name:   "outbox",
+				Columns: []run.TableColumn{
+					{Name: "aggregate_id"},
+					{Name: "aggregate_type"},
+					{Name: "payload"},
+				},
+			},
+			Action:    run.InsertAction,
+			Rows:      rows,
+			Timestamp: 1600000000,
+			Position:  run.Position{File: "mysql-bin.000001", Offset: 400},
+		}
+	}
+	validRow := []interface{}{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"name": "new order"}`}
+	missingPayloadRow := []interface{}{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", nil}
+
+	tests := []struct {
+		name            string
+		eventDispatcher *eventDispatcherMock
+		withSink        bool
+		sinkErr         error
+		maxRetries      int
+		e               run.RowsEvent
+		wantErr         bool
+		wantDispatches  int
+		wantDeadLetters []run.DeadLetter
+	}{
+		{
+			name:            "when a row cannot be mapped then it is sent to the sink and the next rows are dispatched",
+			eventDispatcher: &eventDispatcherMock{},
+			withSink:        true,
+			maxRetries:      2,
+			e:               rowsEvent(missingPayloadRow, validRow),
+			wantDispatches:  1,
+			wantDeadLetters: []run.DeadLetter{
+				{
+					Schema:    "my_schema",
+					Table:     "outbox",
+					Position:  run.Position{File: "mysql-bin.000001", Offset: 400},
+					Timestamp: 1600000000,
+					Columns: []run.Column{
+						{Name: []byte("aggregate_id"), Value: []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c")},
+						{Name: []byte("aggregate_type"), Value: []byte("order")},
+						{Name: []byte("payload"), Value: nil},
+					},
+					Err: errors.New("payload Column not found"),
+				},
+			},
+		},
+		{
+			name:            "when a row is shorter than the table then its columns are sent to the sink",
+			eventDispatcher: &eventDispatcherMock{},
+			withSink:        true,
+			e:               rowsEvent([]interface{}{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order"}),
+			wantDeadLetters: []run.DeadLetter{
+				{
+					Schema:    "my_schema",
+					Table:     "outbox",
+					Position:  run.Position{File: "mysql-bin.000001", Offset: 400},
+					Timestamp: 1600000000,
+					Columns: []run.Column{
+						{Name: []byte("aggregate_id"), Value: []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c")},
+						{Name: []byte("aggregate_type"), Value: []byte("order")},
+					},
+					Err: errors.New(
+						"unexpected row length: 2 columns in the row, 3 in the schema of my_schema.outbox, " +
+							"was the table altered?",
+					),
+				},
+			},
+		},
+		{
+			name:            "when a row cannot be mapped and there is no sink then error",
+			eventDispatcher: &eventDispatcherMock{},
+			maxRetries:      2,
+			e:               rowsEvent(missingPayloadRow, validRow),
+			wantErr:         true,
+		},
+		{
+			name:            "when dispatch fails less times than retries then event is dispatched",
+			eventDispatcher: &eventDispatcherMock{err: dispatchErr, failures: 2},
+			withSink:        true,
+			maxRetries:      2,
+			e:               rowsEvent(validRow),
+			wantDispatches:  3,
+		},
+		{
+			name:            "when dispatch keeps failing then event is sent to the sink after retries",
+			eventDispatcher: &eventDispatcherMock{err: dispatchErr},
+			withSink:        true,
+			maxRetries:      2,
+			e:               rowsEvent(validRow),
+			wantDispatches:  3,
+			wantDeadLetters: []run.DeadLetter{
+				{
+					Schema:    "my_schema",
+					Table:     "outbox",
+					Position:  run.Position{File: "mysql-bin.000001", Offset: 400},
+					Timestamp: 1600000000,
+					Columns: []run.Column{
+						{Name: []byte("aggregate_id"), Value: []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c")},
+						{Name: []byte("aggregate_type"), Value: []byte("order")},
+						{Name: []byte("payload"), Value: []byte(`{"name": "new order"}`)},
+					},
+					Event: &run.OutboxEvent{
+						Schema:        "my_schema",
+						Table:         "outbox",
+						AggregateID:   []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c"),
+						AggregateType: []byte("order"),
+						Payload:       []byte(`{"name": "new order"}`),
+						Columns: []run.Column{
+							{Name: []byte("aggregate_id"), Value: []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c")},
+							{Name: []byte("aggregate_type"), Value: []byte("order")},
+							{Name: []byte("payload"), Value: []byte(`{"name": "new order"}`)},
+						},
+						EventTimestampFromDatabase: 1600000000,
+						Binlog: run.BinlogMetadata{
+							Position: run.Position{File: "mysql-bin.000001", Offset: 400},
+						},
+					},
+					Err:      dispatchErr,
+					Attempts: 3,
+				},
+			},
+		},
+		{
+			name:            "when dispatch keeps failing and there is no sink then error after retries",
+			eventDispatcher: &eventDispatcherMock{err: dispatchErr},
+			maxRetries:      2,
+			e:               rowsEvent(validRow),
+			wantErr:         true,
+			wantDispatches:  3,
+		},
+		{
+			name:            "when the sink fails then error",
+			eventDispatcher: &eventDispatcherMock{err: dispatchErr},
+			withSink:        true,
+			sinkErr:         sinkErr,
+			e:               rowsEvent(validRow),
+			wantErr:         true,
+			wantDispatches:  1,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			policy := run.PoisonEventPolicy{MaxRetries: tt.maxRetries, RetryBackoff: time.Millisecond}
+			sink := &deadLetterSinkMock{err: tt.sinkErr}
+			if tt.withSink {
+				policy.DeadLetterSink = sink
+			}
+
+			h, err := run.NewEventHandler(tt.eventDispatcher, "", "", "", run.EventHandlerOptions{PoisonEventPolicy: policy})
+			require.NoError(t, err)
+
+			err = h.OnRows(tt.e)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Len(t, tt.eventDispatcher.dispatches, tt.wantDispatches)
+			if tt.sinkErr == nil {
+				assert.Equal(t, tt.wantDeadLetters, sink.deadLetters)
+				assert.Equal(t, uint64(len(tt.wantDeadLetters)), h.DeadLetters())
+			}
+		})
+	}
+}
+
+func TestEventHandler_OnRows_BinlogMetadata(t *testing.T) {
+	d := &eventDispatcherMock{}
+	h, err := run.NewEventHandler(d, "", "", "", run.EventHandlerOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, h.OnRows(run.RowsEvent{
+		Table: &run.Table{
+			Schema: "my_schema",
+			Name:   "outbox",
+			Columns: []run.TableColumn{
+				{Name: "aggregate_id"},
+				{Name: "aggregate_type"},
+				{Name: "payload"},
+			},
+		},
+		Action: run.InsertAction,
+		Rows: [][]interface{}{
+			{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"name": "new order"}`},
+			{"c38a5d13-788c-4878-8bdc-c012cbad5b82", "invoice", `{"name": "new invoice"}`},
+		},
+		Timestamp: 1600000000,
+		Position:  run.Position{File: "mysql-bin.000002", Offset: 400},
+		GTID:      "3e11fa47-71ca-11e1-9e33-c80aa9429562:23",
+		ServerID:  7,
+	}))
+
+	require.Len(t, d.dispatches, 2)
+	for i, oe := range d.dispatches {
+		assert.Equal(t, run.BinlogMetadata{
+			Position: run.Position{File: "mysql-bin.000002", Offset: 400},
+			Row:      i,
+			GTID:     "3e11fa47-71ca-11e1-9e33-c80aa9429562:23",
+			ServerID: 7,
+		}, oe.Binlog)
+	}
+}
+
+func TestEventHandler_OnRows_ColumnTypes(t *testing.T) {
+	tests := []struct {
+		name   string
+		column run.TableColumn
+		value  interface{}
+		want   []byte
+	}{
+		{
+			name:   "when column is unsigned then negative values are converted",
+			column: run.TableColumn{Type: run.TypeNumber, IsUnsigned: true},
+			value:  int64(-1),
+			want:   []byte("18446744073709551615"),
+		},
+		{
+			name:   "when column is an unsigned mediumint then 24 bits values are converted",
+			column: run.TableColumn{Type: run.TypeMediumInt, IsUnsigned: true},
+			value:  int32(-1),
+			want:   []byte("16777215"),
+		},
+		{
+			name:   "when column is signed then values are in base 10",
+			column: run.TableColumn{Type: run.TypeNumber},
+			value:  int8(-5),
+			want:   []byte("-5"),
+		},
+		{
+			name:   "when column is a float then value is the shortest representation",
+			column: run.TableColumn{Type: run.TypeFloat},
+			value:  float32(0.1),
+			want:   []byte("0.1"),
+		},
+		{
+			name:   "when column is a decimal then value is exact",
+			column: run.TableColumn{Type: run.TypeDecimal},
+			value:  decimal.RequireFromString("12345678901234567890.123456789"),
+			want:   []byte("12345678901234567890.123456789"),
+		},
+		{
+			name:   "when column is a datetime then value is RFC3339",
+			column: run.TableColumn{Type: run.TypeDatetime},
+			value:  "2022-11-20 10:30:00.250000",
+			want:   []byte("2022-11-20T10:30:00.25Z"),
+		},
+		{
+			name:   "when column is a timestamp read by a query then value is RFC3339",
+			column: run.TableColumn{Type: run.TypeTimestamp},
+			value:  []byte("2022-11-20 10:30:00"),
+			want:   []byte("2022-11-20T10:30:00Z"),
+		},
+		{
+			name:   "when column is a zero datetime then value is unchanged",
+			column: run.TableColumn{Type: run.TypeDatetime},
+			value:  "0000-00-00 00:00:00",
+			want:   []byte("0000-00-00 00:00:00"),
+		},
+		{
+			name:   "when value is a time then value is RFC3339",
+			column: run.TableColumn{Type: run.TypeTimestamp},
+			value:  time.Date(2022, 11, 20, 10, 30, 0, 0, time.FixedZone("CET", 3600)),
+			want:   []byte("2022-11-20T10:30:00+01:00"),
+		},
+		{
+			name:   "when column is json then value is json text",
+			column: run.TableColumn{Type: run.TypeJSON},
+			value:  []byte(`{"a":1}`),
+			want:   []byte(`{"a":1}`),
+		},
+		{
+			name:   "when column is an enum then value is the enum value",
+			column: run.TableColumn{Type: run.TypeEnum, EnumValues: []string{"created", "paid"}},
+			value:  int64(2),
+			want:   []byte("paid"),
+		},
+		{
+			name:   "when column is a set then value is the list of set values",
+			column: run.TableColumn{Type: run.TypeSet, SetValues: []string{"a", "b", "c"}},
+			value:  int64(5),
+			want:   []byte("a,c"),
+		},
+		{
+			name:   "when column is a bit then value is an unsigned integer",
+			column: run.TableColumn{Type: run.TypeBit},
+			value:  int64(5),
+			want:   []byte("5"),
+		},
+		{
+			name:   "when column is a bit read by a query then value is an unsigned integer",
+			column: run.TableColumn{Type: run.TypeBit},
+			value:  []byte{0x01, 0x00},
+			want:   []byte("256"),
+		},
+		{
+			name:   "when value is null then value is nil",
+			column: run.TableColumn{Type: run.TypeDatetime},
+			value:  nil,
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			d := &eventDispatcherMock{}
+			h, err := run.NewEventHandler(d, "", "", "", run.EventHandlerOptions{})
+			require.NoError(t, err)
+
+			column := tt.column
+			column.Name = "typed"
+			column.RawType = "raw"
+			err = h.OnRows(run.RowsEvent{
+				Table: &run.Table{
+					Schema: "my_schema",
+					Name:   "outbox",
+					Columns: []run.TableColumn{
+						{Name: "aggregate_id"},
+						{Name: "aggregate_type"},
+						{Name: "payload"},
+						column,
+					},
+				},
+				Action: run.InsertAction,
+				Rows: [][]interface{}{
+					{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"name": "new order"}`, tt.value},
+				},
+			})
+			require.NoError(t, err)
+
+			require.Len(t, d.dispatches, 1)
+			assert.Equal(t, run.Column{
+				Name:    []byte("typed"),
+				Value:   tt.want,
+				Type:    tt.column.Type,
+				RawType: "raw",
+			}, d.dispatches[0].Columns[3])
+		})
+	}
+}
+
+func TestDeadLetter_MarshalJSON(t *testing.T) {
+	dl := run.DeadLetter{
+		Schema:    "my_schema",
+		Table:     "outbox",
+		Position:  run.Position{File: "mysql-bin.000001", Offset: 400},
+		Timestamp: 1600000000,
+		Columns: []run.Column{
+			{Name: []byte("aggregate_id"), Value: []byte("c44ade3e-9394-4e6e-8d2d-20707d61061c")},
+			{Name: []byte("payload"), Value: nil},
+		},
+		Err: errors.New("payload Column not found"),
+	}
+
+	b, err := json.Marshal(dl)
+	require.NoError(t, err)
+
+	assert.JSONEq(
+		t,
+		`{
+			"schema": "my_schema",
+			"table": "outbox",
+			"binlog_file": "mysql-bin.000001",
+			"binlog_pos": 400,
+			"timestamp": 1600000000,
+			"error": "payload Column not found",
+			"attempts": 0,
+			"columns": {"aggregate_id": "c44ade3e-9394-4e6e-8d2d-20707d61061c", "payload": null}
+		}`,
+		string(b),
+	)
+}
+
+func TestEventHandler_OnRows_Instrumentation(t *testing.T) {
+	rowsEvent := func(action string, rows ...[]interface{}) run.RowsEvent {
+		return run.RowsEvent{
+			Table: &run.Table{
+				Schema: "my_schema",
+				Name:   "outbox",
+				Columns: []run.TableColumn{
+					{Name: "aggregate_id"},
+					{Name: "aggregate_type"},
+					{Name: "payload"},
+				},
+			},
+			Action: action,
+			Rows:   rows,
+		}
+	}
+	validRow := []interface{}{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"name": "new order"}`}
+	missingPayloadRow := []interface{}{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", nil}
+
+	tests := []struct {
+		name            string
+		eventDispatcher *eventDispatcherMock
+		policy          run.PoisonEventPolicy
+		e               run.RowsEvent
+		wantMapped      int
+		wantDispatched  int
+		wantFailed      int
+		wantSkipped     map[run.SkipReason]int
+	}{
+		{
+			name:            "when rows are dispatched then they are mapped and dispatched",
+			eventDispatcher: &eventDispatcherMock{},
+			e:               rowsEvent(run.InsertAction, validRow, validRow),
+			wantMapped:      2,
+			wantDispatched:  2,
+		},
+		{
+			name:            "when row-event is not an insert then its rows are skipped, once per update",
+			eventDispatcher: &eventDispatcherMock{},
+			e:               rowsEvent(run.UpdateAction, validRow, validRow),
+			wantSkipped:     map[run.SkipReason]int{run.SkipNotInsert: 1},
+		},
+		{
+			name:            "when rows are deleted, e.g. by the cleanup, then they are skipped",
+			eventDispatcher: &eventDispatcherMock{},
+			e:               rowsEvent(run.DeleteAction, validRow, validRow),
+			wantSkipped:     map[run.SkipReason]int{run.SkipNotInsert: 2},
+		},
+		{
+			name:            "when row cannot be mapped and is dead-lettered then it fails and is skipped",
+			eventDispatcher: &eventDispatcherMock{},
+			policy:          run.PoisonEventPolicy{DeadLetterSink: &deadLetterSinkMock{}},
+			e:               rowsEvent(run.InsertAction, missingPayloadRow, validRow),
+			wantMapped:      1,
+			wantDispatched:  1,
+			wantFailed:      1,
+			wantSkipped:     map[run.SkipReason]int{run.SkipDeadLetter: 1},
+		},
+		{
+			name:            "when dispatch fails then every attempt fails",
+			eventDispatcher: &eventDispatcherMock{err: errors.New("a")},
+			policy:          run.PoisonEventPolicy{MaxRetries: 2, RetryBackoff: time.Millisecond},
+			e:               rowsEvent(run.InsertAction, validRow),
+			wantMapped:      1,
+			wantFailed:      3,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			i := &instrumentationMock{}
+			h, err := run.NewEventHandler(
+				tt.eventDispatcher,
+				"",
+				"",
+				"",
+				run.EventHandlerOptions{
+					PoisonEventPolicy: tt.policy,
+					Instrumentation:   i,
+				},
+			)
+			require.NoError(t, err)
+
+			_ = h.OnRows(tt.e)
+
+			assert.Equal(t, tt.wantMapped, i.mapped)
+			assert.Equal(t, tt.wantDispatched, i.dispatched)
+			assert.Equal(t, tt.wantFailed, i.failed)
+			assert.Equal(t, tt.wantSkipped, i.skipped)
+		})
+	}
+}
+
+func TestEventHandler_OnRows_Tracing(t *testing.T) {
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	rowsEvent := func(traceParent interface{}) run.RowsEvent {
+		return run.RowsEvent{
+			Table: &run.Table{
+				Schema: "my_schema",
+				Name:   "outbox",
+				Columns: []run.TableColumn{
+					{Name: "aggregate_id"},
+					{Name: "aggregate_type"},
+					{Name: "payload"},
+					{Name: "traceparent"},
+				},
+			},
+			Action: run.InsertAction,
+			Rows: [][]interface{}{
+				{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"name": "new order"}`, traceParent},
+			},
+		}
+	}
+
+	tests := []struct {
+		name            string
+		eventDispatcher *eventDispatcherMock
+		e               run.RowsEvent
+		wantTraceID     string
+		wantParentSpan  string
+		wantErr         bool
+	}{
+		{
+			name:            "when row holds a trace context then spans continue its trace",
+			eventDispatcher: &eventDispatcherMock{},
+			e:               rowsEvent(traceParent),
+			wantTraceID:     "4bf92f3577b34da6a3ce929d0e0e4736",
+			wantParentSpan:  "00f067aa0ba902b7",
+		},
+		{
+			name:            "when row holds no trace context then spans start a new trace",
+			eventDispatcher: &eventDispatcherMock{},
+			e:               rowsEvent(nil),
+		},
+		{
+			name:            "when dispatch fails then dispatch span has error status",
+			eventDispatcher: &eventDispatcherMock{err: errors.New("a")},
+			e:               rowsEvent(traceParent),
+			wantTraceID:     "4bf92f3577b34da6a3ce929d0e0e4736",
+			wantParentSpan:  "00f067aa0ba902b7",
+			wantErr:         true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			sr := tracetest.NewSpanRecorder()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+			h, err := run.NewEventHandler(
+				tt.eventDispatcher,
+				"",
+				"",
+				"",
+				run.EventHandlerOptions{Tracing: run.Tracing{TracerProvider: tp, TraceParentColumnName: "traceparent"}},
+			)
+			require.NoError(t, err)
+
+			err = h.OnRows(tt.e)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			spans := sr.Ended()
+			require.Len(t, spans, 2)
+			assert.Equal(t, "tor.map", spans[0].Name())
+			assert.Equal(t, "tor.dispatch", spans[1].Name())
+
+			for _, s := range spans {
+				if tt.wantTraceID != "" {
+					assert.Equal(t, tt.wantTraceID, s.SpanContext().TraceID().String())
+					assert.Equal(t, tt.wantParentSpan, s.Parent().SpanID().String())
+				} else {
+					assert.False(t, s.Parent().IsValid())
+				}
+			}
+
+			if tt.wantErr {
+				assert.Equal(t, codes.Error, spans[1].Status().Code)
+			}
+
+			require.Len(t, tt.eventDispatcher.dispatches, 1)
+			assert.Equal(t, spans[1].SpanContext(), tt.eventDispatcher.dispatches[0].SpanContext)
+		})
+	}
+}
+
+func TestEventHandler_OnRows_OutboxMode(t *testing.T) {
+	rowsEvent := func(action string, rows ...[]interface{}) run.RowsEvent {
+		return run.RowsEvent{
+			Table: &run.Table{
+				Schema:  "my_schema",
+				Name:    "outbox",
+				Columns: []run.TableColumn{{Name: "aggregate_id"}, {Name: "aggregate_type"}, {Name: "payload"}},
+			},
+			Action: action,
+			Rows:   rows,
+		}
+	}
+	created := []interface{}{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"status": "created"}`}
+	paid := []interface{}{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"status": "paid"}`}
+
+	tests := []struct {
+		name         string
+		outboxMode   run.OutboxMode
+		events       []run.RowsEvent
+		wantPayloads []string
+		wantRows     []int
+		wantSkipped  map[run.SkipReason]int
+	}{
+		{
+			name:         "when mode is default then deletes are skipped as not inserts",
+			events:       []run.RowsEvent{rowsEvent(run.InsertAction, created), rowsEvent(run.DeleteAction, created)},
+			wantPayloads: []string{`{"status": "created"}`},
+			wantRows:     []int{0},
+			wantSkipped:  map[run.SkipReason]int{run.SkipNotInsert: 1},
+		},
+		{
+			name:       "when mode is transient then inserts deleted in the same transaction are published",
+			outboxMode: run.OutboxMode{Transient: true},
+			events: []run.RowsEvent{
+				rowsEvent(run.InsertAction, created),
+				rowsEvent(run.DeleteAction, created),
+				rowsEvent(run.UpdateAction, created, paid),
+			},
+			wantPayloads: []string{`{"status": "created"}`},
+			wantRows:     []int{0},
+			wantSkipped:  map[run.SkipReason]int{run.SkipTransientDelete: 1, run.SkipTransientUpdate: 1},
+		},
+		{
+			name:       "when updates are republished then rows after the update are published",
+			outboxMode: run.OutboxMode{Transient: true, RepublishUpdates: true},
+			events: []run.RowsEvent{
+				rowsEvent(run.InsertAction, created),
+				rowsEvent(run.UpdateAction, created, paid),
+				rowsEvent(run.DeleteAction, paid),
+			},
+			wantPayloads: []string{`{"status": "created"}`, `{"status": "paid"}`},
+			wantRows:     []int{0, 0},
+			wantSkipped:  map[run.SkipReason]int{run.SkipTransientDelete: 1},
+		},
+		{
+			name:       "when update row-events have many rows then every pair of images counts as one row",
+			outboxMode: run.OutboxMode{Transient: true, RepublishUpdates: true},
+			events: []run.RowsEvent{
+				rowsEvent(run.UpdateAction, created, paid, created, paid),
+				rowsEvent(run.UpdateAction, created, paid, created, paid),
+			},
+			wantPayloads: []string{
+				`{"status": "paid"}`, `{"status": "paid"}`, `{"status": "paid"}`, `{"status": "paid"}`,
+			},
+			wantRows: []int{0, 1, 0, 1},
+		},
+		{
+			name:       "when update row-events with many rows are skipped then every pair of images counts as one row",
+			outboxMode: run.OutboxMode{Transient: true},
+			events: []run.RowsEvent{
+				rowsEvent(run.UpdateAction, created, paid, created, paid),
+			},
+			wantSkipped: map[run.SkipReason]int{run.SkipTransientUpdate: 2},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			d := &eventDispatcherMock{}
+			i := &instrumentationMock{}
+			h, err := run.NewEventHandler(d, "", "", "", run.EventHandlerOptions{Instrumentation: i, OutboxMode: tt.outboxMode})
+			require.NoError(t, err)
+
+			for _, e := range tt.events {
+				require.NoError(t, h.OnRows(e))
+			}
+
+			var payloads []string
+			var rows []int
+			for _, oe := range d.dispatches {
+				payloads = append(payloads, string(oe.Payload))
+				rows = append(rows, oe.Binlog.Row)
+			}
+			assert.Equal(t, tt.wantPayloads, payloads)
+			assert.Equal(t, tt.wantRows, rows)
+			assert.Equal(t, tt.wantSkipped, i.skipped)
+		})
+	}
+}
+
+func TestEventHandler_OnDDL(t *testing.T) {
+	columns := func(names ...string) []schema.TableColumn {
+		r := make([]schema.TableColumn, 0, len(names))
+		for _, n := range names {
+			r = append(r, schema.TableColumn{Name: n})
+		}
+		return r
+	}
+
+	tests := []struct {
+		name               string
+		query              string
+		table              string
+		columns            []schema.TableColumn
+		requiredColumns    []string
+		schemaChangePolicy run.SchemaChangePolicy
+		wantErr            error
+		wantErrContains    string
+	}{
+		{
+			name:    "when a column is added then the change is compatible",
+			query:   "ALTER TABLE outbox ADD COLUMN created_at DATETIME",
+			table:   "outbox",
+			columns: columns("aggregate_id", "aggregate_type", "payload", "created_at"),
+		},
+		{
+			name:            "when the payload column is renamed then the change is incompatible",
+			query:           "ALTER TABLE outbox RENAME COLUMN payload TO body",
+			table:           "outbox",
+			columns:         columns("aggregate_id", "aggregate_type", "body"),
+			wantErr:         run.ErrIncompatibleSchemaChange,
+			wantErrContains: `table my_schema.outbox at mysql-bin.000001:1234 after "ALTER TABLE outbox RENAME COLUMN payload TO body": missing required columns: payload`,
+		},
+		{
+			name:               "when the payload column is renamed and policy is continue then no error",
+			query:              "ALTER TABLE outbox RENAME COLUMN payload TO body",
+			table:              "outbox",
+			columns:            columns("aggregate_id", "aggregate_type", "body"),
+			schemaChangePolicy: run.ContinueOnIncompatibleSchemaChange,
+		},
+		{
+			name:            "when a column mapped to a header is dropped then the change is incompatible",
+			query:           "ALTER TABLE outbox DROP COLUMN traceparent",
+			table:           "outbox",
+			columns:         columns("aggregate_id", "aggregate_type", "payload"),
+			requiredColumns: []string{"traceparent"},
+			wantErr:         run.ErrIncompatibleSchemaChange,
+			wantErrContains: "missing required columns: traceparent",
+		},
+		{
+			name:            "when the outbox table is dropped then the change is incompatible",
+			query:           "DROP TABLE outbox",
+			table:           "outbox",
+			wantErr:         run.ErrIncompatibleSchemaChange,
+			wantErrContains: "table does not exist",
+		},
+		{
+			name:  "when another table is changed then it is ignored",
+			query: "ALTER TABLE orders DROP COLUMN payload",
+			table: "orders",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var ed run.EventDispatcher = &eventDispatcherMock{}
+			if tt.requiredColumns != nil {
+				ed = &columnsRequirerMock{requiredColumns: tt.requiredColumns}
+			}
+
+			h, err := run.NewEventHandler(
+				ed,
+				"",
+				"",
+				"",
+				run.EventHandlerOptions{SchemaChangePolicy: tt.schemaChangePolicy},
+			)
+			require.NoError(t, err)
+
+			cm := &tableGetterCanalMock{tables: map[string]*schema.Table{}}
+			if tt.columns != nil {
+				cm.tables[tt.table] = &schema.Table{Schema: "my_schema", Name: tt.table, Columns: tt.columns}
+			}
+			run.NewRunner(cm, h, &stateHandlerMock{}, time.Hour, run.RunnerOptions{})
+
+			require.NoError(t, cm.handler.OnTableChanged("my_schema", tt.table))
+			err = cm.handler.OnDDL(
+				mysql.Position{Name: "mysql-bin.000001", Pos: 1234},
+				&replication.QueryEvent{Schema: []byte("my_schema"), Query: []byte(tt.query)},
+			)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+				return
+			}
+			require.NoError(t, err)
+
+			if tt.table != "outbox" || tt.schemaChangePolicy == run.ContinueOnIncompatibleSchemaChange {
+				return
+			}
+
+			// rows written after the change are mapped with the new schema
+			e := &canal.RowsEvent{
+				Table:  cm.tables["outbox"],
+				Action: canal.InsertAction,
+				Rows: [][]interface{}{
+					{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"name": "new order"}`, "2022-01-01 00:00:00"},
+				},
+			}
+			require.NoError(t, cm.handler.OnRow(e))
+			require.Len(t, ed.(*eventDispatcherMock).dispatches, 1)
+			assert.Equal(t, `{"name": "new order"}`, string(ed.(*eventDispatcherMock).dispatches[0].Payload))
+		})
+	}
+}
+
+func TestEventHandler_OnDDLTracksSchema(t *testing.T) {
+	columns := func(names ...string) []schema.TableColumn {
+		r := make([]schema.TableColumn, 0, len(names))
+		for _, n := range names {
+			r = append(r, schema.TableColumn{Name: n})
+		}
+		return r
+	}
+	// the current schema of the database is ahead of the binlog, since the router lags behind further changes
+	current := columns("created_at", "aggregate_id", "aggregate_type", "payload", "updated_at")
+
+	tests := []struct {
+		name               string
+		query              string
+		schemaChangePolicy run.SchemaChangePolicy
+		row                []interface{}
+		wantErr            error
+		wantErrContains    string
+	}{
+		{
+			name:  "when a column is added then rows are mapped with the schema at their position",
+			query: "ALTER TABLE outbox ADD COLUMN created_at DATETIME FIRST",
+			row:   []interface{}{"2022-01-01 00:00:00", "c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"name": "new order"}`},
+		},
+		{
+			name:  "when a column is moved then rows are mapped with the schema at their position",
+			query: "ALTER TABLE outbox CHANGE COLUMN payload payload JSON AFTER aggregate_id",
+			row:   []interface{}{"c44ade3e-9394-4e6e-8d2d-20707d61061c", `{"name": "new order"}`, "order"},
+		},
+		{
+			name: "when the outbox table is swapped with an altered copy then rows are mapped with the copy schema",
+			query: "CREATE TABLE _outbox_new LIKE outbox; " +
+				"ALTER TABLE _outbox_new ADD COLUMN created_at DATETIME FIRST; " +
+				"RENAME TABLE outbox TO _outbox_old, _outbox_new TO outbox",
+			row: []interface{}{"2022-01-01 00:00:00", "c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"name": "new order"}`},
+		},
+		{
+			name:            "when the payload column is renamed then the change is incompatible whatever the current schema",
+			query:           "ALTER TABLE outbox RENAME COLUMN payload TO body",
+			wantErr:         run.ErrIncompatibleSchemaChange,
+			wantErrContains: "missing required columns: payload",
+		},
+		{
+			name:            "when the outbox table is renamed then the change is incompatible whatever the current schema",
+			query:           "RENAME TABLE outbox TO outbox_old",
+			wantErr:         run.ErrIncompatibleSchemaChange,
+			wantErrContains: "table does not exist",
+		},
+		{
+			name:            "when the change cannot be tracked then the router halts",
+			query:           "ALTER TABLE outbox DROP COLUMN unknown",
+			wantErr:         run.ErrIncompatibleSchemaChange,
+			wantErrContains: `at mysql-bin.000001:1234 after "ALTER TABLE outbox DROP COLUMN unknown": schema change cannot be tracked: my_schema.outbox: unknown column unknown`,
+		},
+		{
+			name:               "when the change cannot be tracked and policy is continue then the current schema is used",
+			query:              "ALTER TABLE outbox DROP COLUMN unknown",
+			schemaChangePolicy: run.ContinueOnIncompatibleSchemaChange,
+			row: []interface{}{
+				"2022-01-01 00:00:00",
+				"c44ade3e-9394-4e6e-8d2d-20707d61061c",
+				"order",
+				`{"name": "new order"}`,
+				"2022-01-01 00:00:00",
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ed := &eventDispatcherMock{}
+			h, err := run.NewEventHandler(
+				ed,
+				"",
+				"",
+				"",
+				run.EventHandlerOptions{SchemaChangePolicy: tt.schemaChangePolicy},
+			)
+			require.NoError(t, err)
+
+			cm := &tableGetterCanalMock{tables: map[string]*schema.Table{
+				"outbox": {Schema: "my_schema", Name: "outbox", Columns: current},
+			}}
+			run.NewRunner(cm, h, &stateHandlerMock{}, time.Hour, run.RunnerOptions{})
+
+			// the schema is tracked from the rows read before the change
+			require.NoError(t, cm.handler.OnRow(&canal.RowsEvent{
+				Table: &schema.Table{
+					Schema:  "my_schema",
+					Name:    "outbox",
+					Columns: columns("aggregate_id", "aggregate_type", "payload"),
+				},
+				Action: canal.InsertAction,
+				Rows:   [][]interface{}{{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"name": "old order"}`}},
+			}))
+
+			require.NoError(t, cm.handler.OnTableChanged("my_schema", "outbox"))
+			err = cm.handler.OnDDL(
+				mysql.Position{Name: "mysql-bin.000001", Pos: 1234},
+				&replication.QueryEvent{Schema: []byte("my_schema"), Query: []byte(tt.query)},
+			)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Contains(t, err.Error(), tt.wantErrContains)
+				return
+			}
+			require.NoError(t, err)
+
+			// canal reads the rows with the current schema
+			require.NoError(t, cm.handler.OnRow(&canal.RowsEvent{
+				Table:  cm.tables["outbox"],
+				Action: canal.InsertAction,
+				Rows:   [][]interface{}{tt.row},
+			}))
+			require.Len(t, ed.dispatches, 2)
+			assert.Equal(t, "c44ade3e-9394-4e6e-8d2d-20707d61061c", string(ed.dispatches[1].AggregateID))
+			assert.Equal(t, "order", string(ed.dispatches[1].AggregateType))
+			assert.Equal(t, `{"name": "new order"}`, string(ed.dispatches[1].Payload))
+		})
+	}
+}
+
+func TestEventHandler_OnDDLOnOtherTables(t *testing.T) {
+	columns := func(names ...string) []schema.TableColumn {
+		r := make([]schema.TableColumn, 0, len(names))
+		for _, n := range names {
+			r = append(r, schema.TableColumn{Name: n})
+		}
+		return r
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		// statements are the tables changed by each statement of the query, canal notifies them in turn
+		statements [][]string
+		row        []interface{}
+	}{
+		{
+			name:       "when another table is created then it is ignored",
+			query:      "CREATE TABLE audit_log (id BIGINT PRIMARY KEY, message TEXT)",
+			statements: [][]string{{"audit_log"}},
+		},
+		{
+			name:       "when another table is altered then it is ignored",
+			query:      "ALTER TABLE audit_log ADD COLUMN created_at DATETIME",
+			statements: [][]string{{"audit_log"}},
+		},
+		{
+			name:       "when another table is dropped then it is ignored",
+			query:      "DROP TABLE audit_log",
+			statements: [][]string{{"audit_log"}},
+		},
+		{
+			name:       "when another table is renamed then it is ignored",
+			query:      "RENAME TABLE audit_log TO audit_log_old",
+			statements: [][]string{{"audit_log", "audit_log_old"}},
+		},
+		{
+			name:       "when a query changes the outbox table and another table then the outbox table is changed once",
+			query:      "ALTER TABLE outbox ADD COLUMN created_at DATETIME FIRST; DROP TABLE audit_log",
+			statements: [][]string{{"outbox"}, {"audit_log"}},
+			row:        []interface{}{"2022-01-01 00:00:00", "c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"name": "new order"}`},
+		},
+	}
+	for _, mode := range []struct {
+		name         string
+		outboxTables []run.OutboxTable
+	}{
+		{name: "single outbox table"},
+		{name: "outbox tables", outboxTables: []run.OutboxTable{{Schema: "my_schema", Table: "outbox"}}},
+	} {
+		mode := mode
+		for _, tt := range tests {
+			tt := tt
+			t.Run(mode.name+": "+tt.name, func(t *testing.T) {
+				ed := &eventDispatcherMock{}
+				h, err := run.NewEventHandler(ed, "", "", "", run.EventHandlerOptions{OutboxTables: mode.outboxTables})
+				require.NoError(t, err)
+
+				cm := &tableGetterCanalMock{tables: map[string]*schema.Table{
+					"outbox": {Schema: "my_schema", Name: "outbox", Columns: columns("aggregate_id", "aggregate_type", "payload")},
+				}}
+				run.NewRunner(cm, h, &stateHandlerMock{}, time.Hour, run.RunnerOptions{})
+
+				// the schema is tracked from the rows read before the change
+				require.NoError(t, cm.handler.OnRow(&canal.RowsEvent{
+					Table:  cm.tables["outbox"],
+					Action: canal.InsertAction,
+					Rows:   [][]interface{}{{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"name": "old order"}`}},
+				}))
+
+				for _, tables := range tt.statements {
+					for _, table := range tables {
+						require.NoError(t, cm.handler.OnTableChanged("my_schema", table))
+					}
+					require.NoError(t, cm.handler.OnDDL(
+						mysql.Position{Name: "mysql-bin.000001", Pos: 1234},
+						&replication.QueryEvent{Schema: []byte("my_schema"), Query: []byte(tt.query)},
+					))
+				}
+
+				row := tt.row
+				if row == nil {
+					row = []interface{}{"c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"name": "new order"}`}
+				}
+				require.NoError(t, cm.handler.OnRow(&canal.RowsEvent{
+					Table:  cm.tables["outbox"],
+					Action: canal.InsertAction,
+					Rows:   [][]interface{}{row},
+				}))
+				require.Len(t, ed.dispatches, 2)
+				assert.Equal(t, "c44ade3e-9394-4e6e-8d2d-20707d61061c", string(ed.dispatches[1].AggregateID))
+				assert.Equal(t, `{"name": "new order"}`, string(ed.dispatches[1].Payload))
+			})
+		}
+	}
+}
+
+type instrumentationMock struct {
+	mu           sync.Mutex
+	mapped       int
+	dispatched   int
+	skipped      map[run.SkipReason]int
+	failed       int
+	synced       []run.Position
+	checkpointed []run.Position
+	canalStarted bool
+	canalStopped bool
+}
+
+func (i *instrumentationMock) EventMapped(run.OutboxEvent) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.mapped++
+}
+
+func (i *instrumentationMock) EventDispatched(run.OutboxEvent, time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.dispatched++
+}
+
+func (i *instrumentationMock) EventSkipped(reason run.SkipReason) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.skipped == nil {
+		i.skipped = map[run.SkipReason]int{}
+	}
+	i.skipped[reason]++
+}
+
+func (i *instrumentationMock) EventFailed(error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.failed++
+}
+
+func (i *instrumentationMock) PositionSynced(p run.Position) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.synced = append(i.synced, p)
+}
+
+func (i *instrumentationMock) CheckpointFailed(error) {}
+
+func (i *instrumentationMock) CanalStarted() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.canalStarted = true
+}
+
+func (i *instrumentationMock) CanalStopped(error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.canalStopped = true
+}
+
+func (i *instrumentationMock) PositionCheckpointed(p run.Position) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.checkpointed = append(i.checkpointed, p)
+}
+
+type deadLetterSinkMock struct {
+	deadLetters []run.DeadLetter
+	err         error
+}
+
+func (s *deadLetterSinkMock) Send(dl run.DeadLetter) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	s.deadLetters = append(s.deadLetters, dl)
+	return nil
+}
+
 type eventDispatcherMock struct {
-	dispatches []run.OutboxEvent
-	err        error
+	dispatches         []run.OutboxEvent
+	err                error
+	errByAggregateType map[string]error
+	// failures, when set, limits err to the first dispatches
+	failures int
 }
 
 func (e *eventDispatcherMock) Dispatch(oe run.OutboxEvent) error {
 	e.dispatches = append(e.dispatches, oe)
 
+	if e.failures > 0 && len(e.dispatches) > e.failures {
+		return nil
+	}
+
+	if err, ok := e.errByAggregateType[string(oe.AggregateType)]; ok {
+		return err
+	}
+
 	return e.err
 }
+
+// columnsRequirerMock is a dispatcher requiring columns of the outbox table, e.g. to map headers.
+type columnsRequirerMock struct {
+	eventDispatcherMock
+	requiredColumns []string
+}
+
+func (e *columnsRequirerMock) RequiredColumns() []string {
+	return e.requiredColumns
+}
+
+// tableGetterCanalMock returns the tables of my_schema, as canal.Canal reloads them after a DDL statement, when it
+// reads my_schema.outbox only.
+type tableGetterCanalMock struct {
+	canalMock
+	tables map[string]*schema.Table
+}
+
+func (c *tableGetterCanalMock) GetTable(db string, table string) (*schema.Table, error) {
+	if db != "my_schema" || table != "outbox" {
+		return nil, canal.ErrExcludedTable
+	}
+
+	t, ok := c.tables[table]
+	if !ok {
+		return nil, schema.ErrTableNotExist
+	}
+
+	return t, nil
+}
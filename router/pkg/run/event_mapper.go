@@ -1,12 +1,6 @@
 package run
 
-import (
-	"errors"
-	"fmt"
-
-	"github.com/go-mysql-org/go-mysql/canal"
-	"github.com/go-mysql-org/go-mysql/schema"
-)
+import "fmt"
 
 type EventMapper struct {
 	aggregateIDColumnName   string
@@ -14,72 +8,50 @@ type EventMapper struct {
 	payloadColumnName       string
 }
 
-var notInsertError = errors.New("row-event is not an insert")
-
-func (e *EventMapper) Map(event *canal.RowsEvent) ([]OutboxEvent, error) {
-	if event.Action != canal.InsertAction {
-		return nil, notInsertError
-	}
-
-	err := assertRowsSizesAreValid(event)
-	if err != nil {
-		return nil, err
-	}
-
-	oes := make([]OutboxEvent, 0, len(event.Rows))
-	for _, row := range event.Rows {
-		c := getColumns(event.Table.Columns, row)
-
-		aggregateID, aggregateType, payload, err := e.getMainColumnsValue(c)
-		if err != nil {
-			return nil, err
-		}
-
-		oes = append(oes, OutboxEvent{
-			AggregateID:                aggregateID,
-			AggregateType:              aggregateType,
-			Payload:                    payload,
-			Columns:                    c,
-			EventTimestampFromDatabase: event.Header.Timestamp,
-		})
+func (e *EventMapper) mapRow(event *RowsEvent, row []interface{}) (OutboxEvent, error) {
+	if len(event.Table.Columns) != len(row) {
+		return OutboxEvent{}, fmt.Errorf(
+			"unexpected row length: %d columns in the row, %d in the schema of %s.%s, was the table altered?",
+			len(row), len(event.Table.Columns), event.Table.Schema, event.Table.Name,
+		)
 	}
 
-	return oes, nil
-}
+	c := getColumns(event.Table.Columns, row)
 
-func assertRowsSizesAreValid(event *canal.RowsEvent) error {
-	for _, row := range event.Rows {
-		if len(event.Table.Columns) != len(row) {
-			return errors.New("unexpected row length")
-		}
+	aggregateID, aggregateType, payload, err := e.getMainColumnsValue(c)
+	if err != nil {
+		return OutboxEvent{}, err
 	}
 
-	return nil
+	return OutboxEvent{
+		Schema:                     event.Table.Schema,
+		Table:                      event.Table.Name,
+		AggregateID:                aggregateID,
+		AggregateType:              aggregateType,
+		Payload:                    payload,
+		Columns:                    c,
+		EventTimestampFromDatabase: event.Timestamp,
+	}, nil
 }
 
+// getColumns returns the columns of the row, up to the shorter of the table and the row, e.g. when the schema of the
+// table changed.
 func getColumns(
-	tableColumns []schema.TableColumn,
+	tableColumns []TableColumn,
 	rowColumns []interface{},
 ) []Column {
-	r := make([]Column, 0, len(tableColumns))
-	for i, etc := range tableColumns {
-		if rowColumns[i] == nil {
-			r = append(r, Column{
-				Name:  []byte(etc.Name),
-				Value: nil,
-			})
-
-			continue
-		}
-
-		cv, ok := rowColumns[i].([]byte)
-		if !ok {
-			cv = []byte(fmt.Sprintf("%v", rowColumns[i]))
-		}
+	n := len(tableColumns)
+	if len(rowColumns) < n {
+		n = len(rowColumns)
+	}
 
+	r := make([]Column, 0, n)
+	for i, etc := range tableColumns[:n] {
 		r = append(r, Column{
-			Name:  []byte(etc.Name),
-			Value: cv,
+			Name:    []byte(etc.Name),
+			Value:   columnValue(etc, rowColumns[i]),
+			Type:    etc.Type,
+			RawType: etc.RawType,
 		})
 	}
 
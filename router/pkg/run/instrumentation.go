@@ -0,0 +1,51 @@
+package run
+
+import "time"
+
+type SkipReason string
+
+const (
+	// SkipNotInsert is the reason of the rows of update and delete row-events.
+	SkipNotInsert SkipReason = "not_insert"
+	// SkipTransientDelete and SkipTransientUpdate are the reasons of the rows of delete and update row-events
+	// in the transient OutboxMode.
+	SkipTransientDelete SkipReason = "transient_delete"
+	SkipTransientUpdate SkipReason = "transient_update"
+	// SkipDeadLetter is the reason of the rows sent to the dead-letter sink.
+	SkipDeadLetter SkipReason = "dead_letter"
+)
+
+// Instrumentation is notified by the EventHandler and the Runner of what happens while routing, e.g. to expose
+// metrics. Methods may be called concurrently and must not block.
+type Instrumentation interface {
+	// EventMapped is called for every row mapped to an event.
+	EventMapped(event OutboxEvent)
+	// EventDispatched is called when the delivery of an event is confirmed, with the time elapsed since its
+	// dispatch started.
+	EventDispatched(event OutboxEvent, duration time.Duration)
+	// EventSkipped is called for every row that is not routed.
+	EventSkipped(reason SkipReason)
+	// EventFailed is called for every failed mapping or dispatch attempt.
+	EventFailed(err error)
+	// PositionSynced is called at the end of every binlog transaction, with the position following it.
+	PositionSynced(position Position)
+	// PositionCheckpointed is called when a position is persisted by the StateHandler.
+	PositionCheckpointed(position Position)
+	// CheckpointFailed is called when the StateHandler fails to persist a position.
+	CheckpointFailed(err error)
+	// CanalStarted is called when the Runner starts reading the binlog, and CanalStopped when it stops.
+	CanalStarted()
+	CanalStopped(err error)
+}
+
+type noopInstrumentation struct{}
+
+func (noopInstrumentation) EventMapped(OutboxEvent)                    {}
+func (noopInstrumentation) EventDispatched(OutboxEvent, time.Duration) {}
+func (noopInstrumentation) EventSkipped(SkipReason)                    {}
+func (noopInstrumentation) EventFailed(error)                          {}
+func (noopInstrumentation) PositionSynced(Position)                    {}
+func (noopInstrumentation) PositionCheckpointed(Position)              {}
+func (noopInstrumentation) CheckpointFailed(error)                     {}
+func (noopInstrumentation) CanalStarted()                              {}
+func (noopInstrumentation) CanalStopped(error)                         {}
@@ -0,0 +1,32 @@
+package run
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrLeadershipLost is returned by the Runner when its lease expires while routing.
+var ErrLeadershipLost = errors.New("leadership lost")
+
+// LeaderElector grants to a single Runner among the replicas sharing a StateHandler the right to read the binlog.
+type LeaderElector interface {
+	// Campaign blocks until the leadership is acquired or ctx is done.
+	Campaign(ctx context.Context) (Lease, error)
+}
+
+// Lease is the leadership granted by a LeaderElector.
+type Lease interface {
+	// Done is closed when the lease is lost, e.g. because it could not be renewed in time.
+	Done() <-chan struct{}
+	// FencingToken increases at every acquisition of the leadership.
+	FencingToken() uint64
+	// Release gives up the leadership.
+	Release() error
+}
+
+// FencedStateHandler is a StateHandler rejecting the positions set with a fencing token older than the last
+// one it has seen, so that a former leader cannot overwrite the position of the current one.
+type FencedStateHandler interface {
+	StateHandler
+	SetFencingToken(token uint64)
+}
@@ -0,0 +1,57 @@
+package run
+
+// OutboxMode defines which row-events of the outbox tables are published.
+// By default only inserts are published, and the other row-events are logged as unexpected.
+type OutboxMode struct {
+	// Transient supports the outbox tables whose rows are deleted right after the insert, usually in the same
+	// transaction, to keep them empty: the inserts are published regardless of the deletes, and the delete and
+	// update row-events are skipped quietly.
+	Transient bool
+	// RepublishUpdates publishes the rows of update row-events again, with their values after the update.
+	RepublishUpdates bool
+}
+
+// publishedRows returns the indexes in the row-event of the rows to publish.
+// The rows of update row-events are pairs of values before and after the update.
+func (m OutboxMode) publishedRows(e *RowsEvent) []int {
+	var r []int
+	switch {
+	case e.Action == InsertAction:
+		for i := range e.Rows {
+			r = append(r, i)
+		}
+	case e.Action == UpdateAction && m.RepublishUpdates:
+		for i := 1; i < len(e.Rows); i += 2 {
+			r = append(r, i)
+		}
+	}
+
+	return r
+}
+
+// rowIndex returns the ordinal of the row at index i of the row-event, counting the pairs of update row-events once.
+func rowIndex(e *RowsEvent, i int) int {
+	if e.Action == UpdateAction {
+		return i / 2
+	}
+
+	return i
+}
+
+// rowCount returns the number of rows of the row-event, counting the pairs of update row-events once.
+func rowCount(e *RowsEvent) int {
+	return rowIndex(e, len(e.Rows))
+}
+
+// skipReason returns the reason of the rows of a row-event that is not published.
+func (m OutboxMode) skipReason(e *RowsEvent) SkipReason {
+	if !m.Transient {
+		return SkipNotInsert
+	}
+
+	if e.Action == UpdateAction {
+		return SkipTransientUpdate
+	}
+
+	return SkipTransientDelete
+}
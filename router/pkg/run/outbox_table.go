@@ -0,0 +1,61 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnknownOutboxTable is returned when a row is read from a table that is not one of the outbox tables.
+var ErrUnknownOutboxTable = errors.New("table is not an outbox table")
+
+// OutboxTable is an outbox table read by the router, with its own column mapping.
+// Empty column names default to the ones given to NewEventHandler.
+type OutboxTable struct {
+	Schema                  string
+	Table                   string
+	AggregateIDColumnName   string
+	AggregateTypeColumnName string
+	PayloadColumnName       string
+}
+
+// Ref returns the reference to the table, as schema.table.
+func (t OutboxTable) Ref() string {
+	return tableRef(t.Schema, t.Table)
+}
+
+func tableRef(schema, table string) string {
+	return fmt.Sprintf("%s.%s", schema, table)
+}
+
+// newTableEventMappers returns the event mappers by table reference, nil when there are no outbox tables.
+func newTableEventMappers(outboxTables []OutboxTable, defaultEventMapper *EventMapper) (map[string]*EventMapper, error) {
+	if len(outboxTables) == 0 {
+		return nil, nil
+	}
+
+	r := make(map[string]*EventMapper, len(outboxTables))
+	for _, t := range outboxTables {
+		if t.Schema == "" || t.Table == "" {
+			return nil, fmt.Errorf("outbox table requires schema and table. Table: %s", t.Ref())
+		}
+
+		if _, ok := r[t.Ref()]; ok {
+			return nil, fmt.Errorf("duplicated outbox table. Table: %s", t.Ref())
+		}
+
+		em := *defaultEventMapper
+		if t.AggregateIDColumnName != "" {
+			em.aggregateIDColumnName = t.AggregateIDColumnName
+		}
+		if t.AggregateTypeColumnName != "" {
+			em.aggregateTypeColumnName = t.AggregateTypeColumnName
+		}
+		if t.PayloadColumnName != "" {
+			em.payloadColumnName = t.PayloadColumnName
+		}
+
+		r[t.Ref()] = &em
+	}
+
+	return r, nil
+}
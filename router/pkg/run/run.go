@@ -4,79 +4,239 @@ import (
 	"context"
 	"time"
 
-	"github.com/go-mysql-org/go-mysql/canal"
-	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/sirupsen/logrus"
 )
 
+// RunnerOptions are the optional settings of a Runner, their zero values are the defaults.
+type RunnerOptions struct {
+	// GTIDMode makes the Runner track GTID sets and resume from them when stored.
+	GTIDMode      bool
+	LeaderElector LeaderElector
+	Snapshot      Snapshot
+	Cleanup       Cleanup
+}
+
 func NewRunner(
 	canal Canal,
 	handler *EventHandler,
 	stateHandler StateHandler,
 	stateUpdateFrequency time.Duration,
+	options RunnerOptions,
 ) *Runner {
-	p := make(chan mysql.Position)
-	handler.positionChan = p
+	ceh := newCanalEventHandler(handler)
+	if tg, ok := canal.(TableGetter); ok {
+		ceh.tableGetter = tg
+	}
+	canal.SetEventHandler(ceh)
 
-	canal.SetEventHandler(handler)
+	var c *cleaner
+	if options.Cleanup.enabled() {
+		c = newCleaner(options.Cleanup)
+		handler.cleaner = c
+	}
+
+	return &Runner{
+		source:               &canalSource{canal: canal, handler: ceh, gtidMode: options.GTIDMode},
+		canal:                canal,
+		handler:              handler,
+		stateHandler:         stateHandler,
+		checkpointer:         handler.checkpointer,
+		instrumentation:      handler.instrumentation,
+		stateUpdateFrequency: stateUpdateFrequency,
+		gtidMode:             options.GTIDMode,
+		leaderElector:        options.LeaderElector,
+		snapshot:             options.Snapshot,
+		cleanup:              options.Cleanup,
+		cleaner:              c,
+	}
+}
 
-	return &Runner{canal: canal, stateHandler: stateHandler, positionChan: p, stateUpdateFrequency: stateUpdateFrequency}
+// NewSourceRunner returns a Runner streaming the changes of a Source other than a Canal, without snapshots and
+// cleanups.
+func NewSourceRunner(
+	source Source,
+	handler *EventHandler,
+	stateHandler StateHandler,
+	stateUpdateFrequency time.Duration,
+	leaderElector LeaderElector,
+) *Runner {
+	return &Runner{
+		source:               source,
+		handler:              handler,
+		stateHandler:         stateHandler,
+		checkpointer:         handler.checkpointer,
+		instrumentation:      handler.instrumentation,
+		stateUpdateFrequency: stateUpdateFrequency,
+		leaderElector:        leaderElector,
+	}
 }
 
 type Runner struct {
+	// canal is nil unless the source reads the binlog.
 	canal                Canal
+	source               Source
+	handler              *EventHandler
 	stateHandler         StateHandler
-	positionChan         chan mysql.Position
+	checkpointer         *checkpointer
+	instrumentation      Instrumentation
 	stateUpdateFrequency time.Duration
+	gtidMode             bool
+	leaderElector        LeaderElector
+	snapshot             Snapshot
+	cleanup              Cleanup
+	cleaner              *cleaner
 }
 
-type Canal interface {
-	RunFrom(mysql.Position) error
-	SetEventHandler(handler canal.EventHandler)
-	Close()
-}
+// Run reads the binlog, or the Source, and dispatches outbox events until it fails or ctx is canceled.
+// Periodically, it persists the last checkpoint: the last position whose preceding events have all been
+// acknowledged by the EventDispatcher.
+// On cancellation, it stops reading, waits for the in-flight dispatches to complete, persists the last
+// checkpoint and returns nil.
+// With a LeaderElector, it first waits to be the leader, reading the last position only then, and it returns
+// ErrLeadershipLost without persisting the checkpoint when the lease is lost.
+// When the Snapshot requires it, the rows already in the outbox tables are dispatched before reading the binlog.
+// With the Cleanup enabled, the rows of the dispatched events are deleted while running, once persisted.
+func (r *Runner) Run(ctx context.Context) error {
+	err := r.cleanup.validate()
+	if err != nil {
+		return err
+	}
+
+	var leaseLost <-chan struct{}
+	if r.leaderElector != nil {
+		logrus.Info("campaigning for leadership")
+		lease, err := r.leaderElector.Campaign(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		defer func() {
+			err := lease.Release()
+			if err != nil {
+				logrus.WithError(err).Warn("releasing leadership failed")
+			}
+		}()
+
+		logrus.WithField("fencingToken", lease.FencingToken()).
+			Info("leadership acquired")
+		if fsh, ok := r.stateHandler.(FencedStateHandler); ok {
+			fsh.SetFencingToken(lease.FencingToken())
+		}
+		leaseLost = lease.Done()
+	}
 
-func (r *Runner) Run() error {
-	lastPosition, err := r.stateHandler.GetLastPosition()
+	lastPosition, err := r.lastPosition()
 	if err != nil {
 		return err
 	}
+	r.checkpointer.reset(lastPosition)
 
-	errCh := make(chan error, 2)
+	if r.snapshot.required(lastPosition) {
+		lastPosition, err = r.runSnapshot(ctx, leaseLost)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
 
+	// started after the snapshot, which may run its transaction on the same connection
+	if r.cleaner != nil {
+		cleanerCtx, cancel := context.WithCancel(ctx)
+		cleanerDone := make(chan struct{})
+		go func() {
+			defer close(cleanerDone)
+			r.cleaner.run(cleanerCtx)
+		}()
+		defer func() {
+			cancel()
+			<-cleanerDone
+		}()
+	}
+
+	canalErrCh := make(chan error, 1)
+	r.instrumentation.CanalStarted()
 	go func() {
-		errCh <- r.canal.RunFrom(lastPosition)
+		err := r.source.Start(lastPosition, r.handler)
+		r.instrumentation.CanalStopped(err)
+		canalErrCh <- err
 	}()
 
-	ctx, cf := context.WithCancel(context.Background())
 	ticker := time.NewTicker(r.stateUpdateFrequency)
-	go func() {
-		for {
-			select {
-			case lastPosition = <-r.positionChan:
-			case <-ticker.C:
-				err := r.setLastPosition(lastPosition)
-				if err != nil {
-					errCh <- err
-				}
-			case <-ctx.Done():
-				_ = r.setLastPosition(lastPosition)
-				return
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			checkpoint, dispatched, err := r.checkpointer.lastDispatched()
+			if err == nil {
+				err = r.setLastPosition(checkpoint, dispatched)
+			}
+			if err != nil {
+				r.stop(canalErrCh, true)
+				return err
 			}
+		case err := <-canalErrCh:
+			r.stop(canalErrCh, false)
+			checkpoint, dispatched, _ := r.checkpointer.lastDispatched()
+			_ = r.setLastPosition(checkpoint, dispatched)
+			return err
+		case <-leaseLost:
+			logrus.Warn("leadership lost, stopping runner")
+			r.stop(canalErrCh, true)
+			return ErrLeadershipLost
+		case <-ctx.Done():
+			logrus.Info("stopping runner")
+			r.stop(canalErrCh, true)
+			checkpoint, dispatched, _ := r.checkpointer.lastDispatched()
+			return r.setLastPosition(checkpoint, dispatched)
 		}
-	}()
+	}
+}
 
-	err = <-errCh
-	r.canal.Close()
-	cf()
-	return err
+// stop closes the source, waits for it to return and for the dispatched events to be acknowledged.
+func (r *Runner) stop(canalErrCh <-chan error, canalRunning bool) {
+	r.source.Close()
+	if canalRunning {
+		<-canalErrCh
+	}
+
+	r.checkpointer.wait()
 }
 
-func (r *Runner) setLastPosition(p mysql.Position) error {
-	err := r.stateHandler.SetLastPosition(p)
+// lastPosition returns the position of the last persisted checkpoint.
+func (r *Runner) lastPosition() (Position, error) {
+	c, err := r.stateHandler.GetLastCheckpoint()
 	if err != nil {
+		return Position{}, err
+	}
+
+	return DecodeCheckpoint(c)
+}
+
+// setLastPosition persists the checkpoint p, preceded by the given number of dispatched events.
+func (r *Runner) setLastPosition(p Position, dispatched uint64) error {
+	c, err := EncodeCheckpoint(p)
+	if err == nil {
+		err = r.stateHandler.SetLastCheckpoint(c)
+	}
+	if err != nil {
+		r.instrumentation.CheckpointFailed(err)
 		return err
 	}
+	r.instrumentation.PositionCheckpointed(p)
+	if cs, ok := r.source.(CheckpointedSource); ok {
+		err = cs.Checkpointed(p)
+		if err != nil {
+			logrus.WithError(err).Warn("notifying the checkpoint to the source failed")
+		}
+	}
+	if r.cleaner != nil {
+		r.cleaner.persisted(dispatched)
+	}
 	logrus.WithField("lastPosition", p).
 		Debug("last position set")
 
@@ -1,12 +1,18 @@
 package run_test
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-mysql-org/go-mysql/canal"
 	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
 	"github.com/lorenzoranucci/tor/router/pkg/run"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -21,9 +27,10 @@ func TestRunner_RunWhenCanalRunFail(t *testing.T) {
 		handler,
 		&stateHandlerMock{},
 		1*time.Millisecond,
+		run.RunnerOptions{},
 	)
 
-	err := r.Run()
+	err := r.Run(context.Background())
 	assert.Equal(t, err, expectedErr)
 }
 
@@ -36,9 +43,10 @@ func TestRunner_RunWhenStateHandlerSetFail(t *testing.T) {
 		handler,
 		&stateHandlerMock{setLastPositionErr: expectedErr},
 		1*time.Millisecond,
+		run.RunnerOptions{},
 	)
 
-	err := r.Run()
+	err := r.Run(context.Background())
 	assert.Equal(t, err, expectedErr)
 }
 
@@ -51,9 +59,10 @@ func TestRunner_RunWhenStateHandlerGetFail(t *testing.T) {
 		handler,
 		&stateHandlerMock{getLastPositionErr: expectedErr},
 		1*time.Millisecond,
+		run.RunnerOptions{},
 	)
 
-	err := r.Run()
+	err := r.Run(context.Background())
 	assert.Equal(t, err, expectedErr)
 }
 
@@ -65,45 +74,1342 @@ func TestRunner_RunWhenNoError(t *testing.T) {
 		handler,
 		&stateHandlerMock{},
 		1*time.Millisecond,
+		run.RunnerOptions{},
 	)
 
-	err := r.Run()
+	err := r.Run(context.Background())
 	assert.NoError(t, err)
 }
 
+func TestRunner_RunFromStoredGTIDSet(t *testing.T) {
+	handler := buildEventHandler(t)
+
+	gs, err := mysql.ParseMysqlGTIDSet("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5")
+	require.NoError(t, err)
+
+	c := &canalMock{}
+	r := run.NewRunner(
+		c,
+		handler,
+		&stateHandlerMock{lastPosition: run.Position{
+			File:       "mysql-bin.000001",
+			Offset:     4,
+			GTIDSet:    gs.String(),
+			GTIDFlavor: mysql.MySQLFlavor,
+		}},
+		1*time.Millisecond,
+		run.RunnerOptions{},
+	)
+
+	err = r.Run(context.Background())
+	require.NoError(t, err)
+	assert.Nil(t, c.runFromPosition)
+	assert.Equal(t, gs, c.startFromGTIDSet)
+}
+
+func TestRunner_RunFromStoredPosition(t *testing.T) {
+	handler := buildEventHandler(t)
+
+	p := mysql.Position{Name: "mysql-bin.000001", Pos: 4}
+
+	c := &canalMock{}
+	r := run.NewRunner(
+		c,
+		handler,
+		&stateHandlerMock{lastPosition: binlogPosition(p)},
+		1*time.Millisecond,
+		run.RunnerOptions{GTIDMode: true},
+	)
+
+	err := r.Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &p, c.runFromPosition)
+	assert.Nil(t, c.startFromGTIDSet)
+}
+
+func TestRunner_RunInGTIDModeWithoutState(t *testing.T) {
+	handler := buildEventHandler(t)
+
+	gs, err := mysql.ParseMysqlGTIDSet("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5")
+	require.NoError(t, err)
+
+	c := &canalMock{masterGTIDSet: gs}
+	r := run.NewRunner(
+		c,
+		handler,
+		&stateHandlerMock{},
+		1*time.Millisecond,
+		run.RunnerOptions{GTIDMode: true},
+	)
+
+	err = r.Run(context.Background())
+	require.NoError(t, err)
+	assert.Nil(t, c.runFromPosition)
+	assert.Equal(t, gs, c.startFromGTIDSet)
+}
+
+func TestRunner_RunWhenContextCanceled(t *testing.T) {
+	handler := buildEventHandler(t)
+
+	p := mysql.Position{Name: "mysql-bin.000002", Pos: 120}
+	sh := &stateHandlerMock{}
+	r := run.NewRunner(
+		&canalMock{closePosition: p},
+		handler,
+		sh,
+		time.Hour,
+		run.RunnerOptions{},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := r.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []run.Position{binlogPosition(p)}, sh.setPositions)
+}
+
+func TestRunner_RunWhenContextCanceledAndStateHandlerSetFail(t *testing.T) {
+	handler := buildEventHandler(t)
+
+	expectedErr := errors.New("a")
+	r := run.NewRunner(
+		&canalMock{},
+		handler,
+		&stateHandlerMock{setLastPositionErr: expectedErr},
+		time.Hour,
+		run.RunnerOptions{},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := r.Run(ctx)
+	assert.Equal(t, expectedErr, err)
+}
+
+func TestRunner_RunPersistsOnlyAcknowledgedPositions(t *testing.T) {
+	initial := mysql.Position{Name: "mysql-bin.000001", Pos: 4}
+	committed := mysql.Position{Name: "mysql-bin.000001", Pos: 200}
+	afterFailure := mysql.Position{Name: "mysql-bin.000001", Pos: 400}
+
+	tests := []struct {
+		name   string
+		script func(h canal.EventHandler) error
+	}{
+		{
+			name: "when dispatch fails between a rows-event and the following XID-event",
+			script: func(h canal.EventHandler) error {
+				require.NoError(t, h.OnRow(buildInsertRowsEvent("order")))
+				require.NoError(t, h.OnXID(committed))
+				require.NoError(t, h.OnPosSynced(committed, nil, false))
+
+				err := h.OnRow(buildInsertRowsEvent("invoice"))
+				require.Error(t, err)
+
+				require.NoError(t, h.OnXID(afterFailure))
+				require.NoError(t, h.OnPosSynced(afterFailure, nil, false))
+				return err
+			},
+		},
+		{
+			name: "when dispatch fails after a successful rows-event of the same transaction",
+			script: func(h canal.EventHandler) error {
+				require.NoError(t, h.OnRow(buildInsertRowsEvent("order")))
+				require.NoError(t, h.OnXID(committed))
+				require.NoError(t, h.OnPosSynced(committed, nil, false))
+
+				require.NoError(t, h.OnRow(buildInsertRowsEvent("order")))
+				err := h.OnRow(buildInsertRowsEvent("invoice"))
+				require.Error(t, err)
+
+				require.NoError(t, h.OnPosSynced(afterFailure, nil, true))
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ed := &eventDispatcherMock{errByAggregateType: map[string]error{"invoice": errors.New("a")}}
+			sh := &stateHandlerMock{lastPosition: binlogPosition(initial)}
+			r := run.NewRunner(
+				&canalMock{script: tt.script, closePosition: afterFailure},
+				buildEventHandlerWithDispatcher(t, ed),
+				sh,
+				time.Hour,
+				run.RunnerOptions{},
+			)
+
+			err := r.Run(context.Background())
+			require.Error(t, err)
+			require.NotEmpty(t, sh.setPositions)
+			for _, p := range sh.setPositions {
+				assert.NotEqual(t, binlogPosition(afterFailure), p)
+			}
+			assert.Equal(t, binlogPosition(committed), sh.setPositions[len(sh.setPositions)-1])
+		})
+	}
+}
+
+func TestRunner_RunPersistsPositionAfterAcknowledgedEvents(t *testing.T) {
+	committed := mysql.Position{Name: "mysql-bin.000001", Pos: 200}
+
+	ed := &eventDispatcherMock{}
+	sh := &stateHandlerMock{}
+	r := run.NewRunner(
+		&canalMock{
+			script: func(h canal.EventHandler) error {
+				require.NoError(t, h.OnRow(buildInsertRowsEvent("order")))
+				require.NoError(t, h.OnXID(committed))
+				return h.OnPosSynced(committed, nil, false)
+			},
+			closePosition: committed,
+		},
+		buildEventHandlerWithDispatcher(t, ed),
+		sh,
+		time.Millisecond,
+		run.RunnerOptions{},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := r.Run(ctx)
+	require.NoError(t, err)
+	assert.Len(t, ed.dispatches, 1)
+	assert.Equal(t, binlogPosition(committed), sh.setPositions[len(sh.setPositions)-1])
+}
+
+func TestRunner_RunConvertsBinlogEvents(t *testing.T) {
+	gtid, err := mysql.ParseMysqlGTIDSet("3e11fa47-71ca-11e1-9e33-c80aa9429562:23")
+	require.NoError(t, err)
+
+	ed := &eventDispatcherMock{}
+	r := run.NewRunner(
+		&canalMock{
+			script: func(h canal.EventHandler) error {
+				require.NoError(t, h.OnRotate(&replication.RotateEvent{NextLogName: []byte("mysql-bin.000002")}))
+				require.NoError(t, h.OnGTID(gtid))
+				e := buildInsertRowsEvent("order")
+				e.Header = &replication.EventHeader{Timestamp: 1600000000, LogPos: 400, ServerID: 7}
+				return h.OnRow(e)
+			},
+		},
+		buildEventHandlerWithDispatcher(t, ed),
+		&stateHandlerMock{},
+		time.Hour,
+		run.RunnerOptions{},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	require.NoError(t, r.Run(ctx))
+	require.Len(t, ed.dispatches, 1)
+	assert.Equal(t, "my_schema", ed.dispatches[0].Schema)
+	assert.Equal(t, "outbox", ed.dispatches[0].Table)
+	assert.Equal(t, uint32(1600000000), ed.dispatches[0].EventTimestampFromDatabase)
+	assert.Equal(t, run.BinlogMetadata{
+		Position: run.Position{File: "mysql-bin.000002", Offset: 400},
+		GTID:     "3e11fa47-71ca-11e1-9e33-c80aa9429562:23",
+		ServerID: 7,
+	}, ed.dispatches[0].Binlog)
+}
+
+func TestRunner_RunFromStoredPositionTracksBinlogFile(t *testing.T) {
+	ed := &eventDispatcherMock{}
+	r := run.NewRunner(
+		&canalMock{
+			// canal drops the fake rotate event sent when the replication starts
+			script: func(h canal.EventHandler) error {
+				e := buildInsertRowsEvent("order")
+				e.Header = &replication.EventHeader{LogPos: 400}
+				require.NoError(t, h.OnRow(e))
+				require.NoError(t, h.OnXID(mysql.Position{Name: "mysql-bin.000003", Pos: 500}))
+
+				e = buildInsertRowsEvent("order")
+				e.Header = &replication.EventHeader{LogPos: 600}
+				return h.OnRow(e)
+			},
+		},
+		buildEventHandlerWithDispatcher(t, ed),
+		&stateHandlerMock{lastPosition: run.Position{File: "mysql-bin.000002", Offset: 4}},
+		time.Hour,
+		run.RunnerOptions{},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	require.NoError(t, r.Run(ctx))
+	require.Len(t, ed.dispatches, 2)
+	assert.Equal(t, run.Position{File: "mysql-bin.000002", Offset: 400}, ed.dispatches[0].Binlog.Position)
+	assert.Equal(t, run.Position{File: "mysql-bin.000003", Offset: 600}, ed.dispatches[1].Binlog.Position)
+}
+
+func TestRunner_RunWithAsyncEventDispatcher(t *testing.T) {
+	committed := mysql.Position{Name: "mysql-bin.000001", Pos: 200}
+	notCommitted := mysql.Position{Name: "mysql-bin.000001", Pos: 400}
+
+	tests := []struct {
+		name             string
+		ackOrder         []int
+		ackErrs          []error
+		wantErr          bool
+		wantLastPosition mysql.Position
+	}{
+		{
+			name:             "when acknowledgements are out of order then position is persisted once all are received",
+			ackOrder:         []int{2, 1, 0},
+			ackErrs:          []error{nil, nil, nil},
+			wantLastPosition: notCommitted,
+		},
+		{
+			name:             "when an event delivery fails then following positions are not persisted",
+			ackOrder:         []int{0, 2, 1},
+			ackErrs:          []error{nil, nil, errors.New("a")},
+			wantErr:          true,
+			wantLastPosition: committed,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ed := &asyncEventDispatcherMock{}
+			sh := &stateHandlerMock{}
+			r := run.NewRunner(
+				&canalMock{
+					script: func(h canal.EventHandler) error {
+						require.NoError(t, h.OnRow(buildInsertRowsEvent("order")))
+						require.NoError(t, h.OnPosSynced(committed, nil, false))
+						require.NoError(t, h.OnRow(buildInsertRowsEvent("order")))
+						require.NoError(t, h.OnRow(buildInsertRowsEvent("order")))
+						require.NoError(t, h.OnPosSynced(notCommitted, nil, false))
+
+						acks := ed.acks
+						go func() {
+							for _, i := range tt.ackOrder {
+								time.Sleep(10 * time.Millisecond)
+								acks[i](tt.ackErrs[i])
+							}
+						}()
+
+						return nil
+					},
+					closePosition: notCommitted,
+				},
+				buildEventHandlerWithDispatcher(t, ed),
+				sh,
+				time.Millisecond,
+				run.RunnerOptions{},
+			)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			err := r.Run(ctx)
+			if tt.wantErr {
+				require.Error(t, err)
+				for _, p := range sh.setPositions {
+					assert.NotEqual(t, binlogPosition(notCommitted), p)
+				}
+			} else {
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, binlogPosition(tt.wantLastPosition), sh.setPositions[len(sh.setPositions)-1])
+		})
+	}
+}
+
+func TestRunner_RunWithAsyncEventDispatcherAndDeadLetterSink(t *testing.T) {
+	committed := mysql.Position{Name: "mysql-bin.000001", Pos: 200}
+
+	ed := &asyncEventDispatcherMock{eventDispatcherMock: eventDispatcherMock{err: errors.New("a")}}
+	sink := &deadLetterSinkMock{}
+	eh, err := run.NewEventHandler(
+		ed,
+		"",
+		"",
+		"",
+		run.EventHandlerOptions{
+			PoisonEventPolicy: run.PoisonEventPolicy{MaxRetries: 1, RetryBackoff: time.Millisecond, DeadLetterSink: sink},
+		},
+	)
+	require.NoError(t, err)
+
+	sh := &stateHandlerMock{}
+	r := run.NewRunner(
+		&canalMock{
+			script: func(h canal.EventHandler) error {
+				require.NoError(t, h.OnRow(buildInsertRowsEvent("order")))
+				require.NoError(t, h.OnPosSynced(committed, nil, false))
+
+				ed.acks[0](errors.New("a"))
+
+				return nil
+			},
+			closePosition: committed,
+		},
+		eh,
+		sh,
+		time.Millisecond,
+		run.RunnerOptions{},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	require.NoError(t, r.Run(ctx))
+
+	assert.Equal(t, binlogPosition(committed), sh.setPositions[len(sh.setPositions)-1])
+	require.Len(t, sink.deadLetters, 1)
+	assert.Equal(t, 2, sink.deadLetters[0].Attempts)
+	assert.Equal(t, uint64(1), eh.DeadLetters())
+}
+
+func TestRunner_RunWithAsyncEventDispatcherRetriesInAggregateOrder(t *testing.T) {
+	committed := mysql.Position{Name: "mysql-bin.000001", Pos: 200}
+
+	// the first asynchronous dispatch fails, its retry succeeds
+	ed := &asyncEventDispatcherMock{eventDispatcherMock: eventDispatcherMock{err: errors.New("a"), failures: 1}}
+	eh, err := run.NewEventHandler(
+		ed,
+		"",
+		"",
+		"",
+		run.EventHandlerOptions{
+			PoisonEventPolicy: run.PoisonEventPolicy{MaxRetries: 1, RetryBackoff: 20 * time.Millisecond},
+		},
+	)
+	require.NoError(t, err)
+
+	sh := &stateHandlerMock{}
+	r := run.NewRunner(
+		&canalMock{
+			script: func(h canal.EventHandler) error {
+				require.NoError(t, h.OnRow(buildInsertRowsEvent("first")))
+				ed.acks[0](errors.New("a"))
+
+				// the event of the same aggregate waits for the retry of the former one
+				require.NoError(t, h.OnRow(buildInsertRowsEvent("second")))
+				ed.acks[1](nil)
+
+				return h.OnPosSynced(committed, nil, false)
+			},
+			closePosition: committed,
+		},
+		eh,
+		sh,
+		time.Millisecond,
+		run.RunnerOptions{},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	require.NoError(t, r.Run(ctx))
+
+	var aggregateTypes []string
+	for _, d := range ed.dispatches {
+		aggregateTypes = append(aggregateTypes, string(d.AggregateType))
+	}
+	assert.Equal(t, []string{"first", "first", "second"}, aggregateTypes)
+	assert.Equal(t, binlogPosition(committed), sh.setPositions[len(sh.setPositions)-1])
+}
+
+func TestRunner_RunWithAsyncEventDispatcherKeepsAggregateEventsInFlight(t *testing.T) {
+	committed := mysql.Position{Name: "mysql-bin.000001", Pos: 200}
+
+	ed := &asyncEventDispatcherMock{}
+	eh, err := run.NewEventHandler(
+		ed,
+		"",
+		"",
+		"",
+		run.EventHandlerOptions{
+			PoisonEventPolicy: run.PoisonEventPolicy{MaxRetries: 1, RetryBackoff: time.Millisecond},
+		},
+	)
+	require.NoError(t, err)
+
+	sh := &stateHandlerMock{}
+	r := run.NewRunner(
+		&canalMock{
+			script: func(h canal.EventHandler) error {
+				// the events of an aggregate are dispatched without waiting for the acknowledgement of the former ones
+				require.NoError(t, h.OnRow(buildInsertRowsEvent("first")))
+				require.NoError(t, h.OnRow(buildInsertRowsEvent("second")))
+				require.Len(t, ed.dispatches, 2)
+
+				ed.acks[0](nil)
+				ed.acks[1](nil)
+
+				return h.OnPosSynced(committed, nil, false)
+			},
+			closePosition: committed,
+		},
+		eh,
+		sh,
+		time.Millisecond,
+		run.RunnerOptions{},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	require.NoError(t, r.Run(ctx))
+
+	assert.Equal(t, binlogPosition(committed), sh.setPositions[len(sh.setPositions)-1])
+}
+
+func TestRunner_RunNotifiesInstrumentation(t *testing.T) {
+	committed := mysql.Position{Name: "mysql-bin.000001", Pos: 200}
+
+	i := &instrumentationMock{}
+	eh, err := run.NewEventHandler(&eventDispatcherMock{}, "", "", "", run.EventHandlerOptions{Instrumentation: i})
+	require.NoError(t, err)
+
+	r := run.NewRunner(
+		&canalMock{
+			script: func(h canal.EventHandler) error {
+				require.NoError(t, h.OnRow(buildInsertRowsEvent("order")))
+				require.NoError(t, h.OnPosSynced(committed, nil, false))
+
+				return nil
+			},
+			closePosition: committed,
+		},
+		eh,
+		&stateHandlerMock{},
+		time.Millisecond,
+		run.RunnerOptions{},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	require.NoError(t, r.Run(ctx))
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	assert.True(t, i.canalStarted)
+	assert.True(t, i.canalStopped)
+	require.NotEmpty(t, i.synced)
+	assert.Equal(t, binlogPosition(committed), i.synced[0])
+	require.NotEmpty(t, i.checkpointed)
+	assert.Equal(t, binlogPosition(committed), i.checkpointed[len(i.checkpointed)-1])
+}
+
+func TestRunner_RunWithLeaderElector(t *testing.T) {
+	stored := mysql.Position{Name: "mysql-bin.000001", Pos: 200}
+
+	tests := []struct {
+		name              string
+		leaderElector     *leaderElectorMock
+		loseLease         bool
+		wantErr           error
+		wantStarted       bool
+		wantReleased      bool
+		wantFencingTokens []uint64
+	}{
+		{
+			name:              "when leadership is acquired then canal runs from the stored position",
+			leaderElector:     &leaderElectorMock{lease: &leaseMock{done: make(chan struct{}), token: 7}},
+			wantStarted:       true,
+			wantReleased:      true,
+			wantFencingTokens: []uint64{7},
+		},
+		{
+			name:              "when the lease is lost then runner stops with an error",
+			leaderElector:     &leaderElectorMock{lease: &leaseMock{done: make(chan struct{}), token: 7}},
+			loseLease:         true,
+			wantErr:           run.ErrLeadershipLost,
+			wantStarted:       true,
+			wantReleased:      true,
+			wantFencingTokens: []uint64{7},
+		},
+		{
+			name:          "when context is canceled while campaigning then canal is not started",
+			leaderElector: &leaderElectorMock{blocked: true},
+		},
+		{
+			name:          "when campaign fails then error",
+			leaderElector: &leaderElectorMock{campaignErr: errors.New("a")},
+			wantErr:       errors.New("a"),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			cm := &canalMock{
+				script: func(h canal.EventHandler) error {
+					if tt.loseLease {
+						close(tt.leaderElector.lease.done)
+					}
+					return nil
+				},
+			}
+			sh := &fencedStateHandlerMock{stateHandlerMock: stateHandlerMock{lastPosition: binlogPosition(stored)}}
+			r := run.NewRunner(
+				cm,
+				buildEventHandler(t),
+				sh,
+				time.Millisecond,
+				run.RunnerOptions{LeaderElector: tt.leaderElector},
+			)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			err := r.Run(ctx)
+			assert.Equal(t, tt.wantErr, err)
+
+			if tt.wantStarted {
+				assert.Equal(t, &stored, cm.runFromPosition)
+			} else {
+				assert.Nil(t, cm.runFromPosition)
+			}
+			if tt.leaderElector.lease != nil {
+				assert.Equal(t, tt.wantReleased, tt.leaderElector.lease.released)
+			}
+			assert.Equal(t, tt.wantFencingTokens, sh.fencingTokens)
+		})
+	}
+}
+
+func TestRunner_RunWithTransactionalEventDispatcher(t *testing.T) {
+	initial := mysql.Position{Name: "mysql-bin.000001", Pos: 4}
+	committed := mysql.Position{Name: "mysql-bin.000001", Pos: 200}
+
+	tests := []struct {
+		name             string
+		commitErr        error
+		wantErr          bool
+		wantLastPosition mysql.Position
+	}{
+		{
+			name:             "when commit succeeds then position is persisted",
+			wantLastPosition: committed,
+		},
+		{
+			name:             "when commit fails then position is not persisted",
+			commitErr:        errors.New("a"),
+			wantErr:          true,
+			wantLastPosition: initial,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ed := &transactionalEventDispatcherMock{commitErr: tt.commitErr}
+			sh := &stateHandlerMock{lastPosition: binlogPosition(initial)}
+			r := run.NewRunner(
+				&canalMock{
+					script: func(h canal.EventHandler) error {
+						require.NoError(t, h.OnRow(buildInsertRowsEvent("order")))
+						require.NoError(t, h.OnRow(buildInsertRowsEvent("order")))
+						require.NoError(t, h.OnXID(committed))
+						return h.OnPosSynced(committed, nil, false)
+					},
+					closePosition: committed,
+				},
+				buildEventHandlerWithDispatcher(t, ed),
+				sh,
+				time.Hour,
+				run.RunnerOptions{},
+			)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			err := r.Run(ctx)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, binlogPosition(committed), ed.commits[0])
+			assert.Equal(t, binlogPosition(tt.wantLastPosition), sh.setPositions[len(sh.setPositions)-1])
+		})
+	}
+}
+
+func TestNewEventHandler_WithTransactionalEventDispatcher(t *testing.T) {
+	ed := &transactionalEventDispatcherMock{}
+
+	_, err := run.NewEventHandler(ed, "", "", "", run.EventHandlerOptions{
+		PoisonEventPolicy: run.PoisonEventPolicy{MaxRetries: 1},
+	})
+	assert.Error(t, err, "retries are rejected")
+
+	_, err = run.NewEventHandler(ed, "", "", "", run.EventHandlerOptions{
+		PoisonEventPolicy: run.PoisonEventPolicy{DeadLetterSink: &deadLetterSinkMock{}},
+	})
+	assert.NoError(t, err, "dead-letter sinks are accepted")
+}
+
+func TestRunner_RunWithSnapshot(t *testing.T) {
+	stored := mysql.Position{Name: "mysql-bin.000001", Pos: 200}
+	head := mysql.Position{Name: "mysql-bin.000003", Pos: 400}
+	rows := [][]interface{}{
+		{1, "c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{"id": 1}`},
+		{2, "5c0e9be6-ea69-452d-9824-7f55b544f2e3", "order", `{"id": 2}`},
+		{3, "29fd8c5b-6b44-48b6-98a3-c1c601eaae26", "invoice", `{"id": 3}`},
+	}
+
+	tests := []struct {
+		name             string
+		snapshot         run.Snapshot
+		lastPosition     mysql.Position
+		positions        []mysql.Position
+		connErr          error
+		wantErr          bool
+		wantPayloads     []string
+		wantQueries      []string
+		wantRunFrom      mysql.Position
+		wantSetPositions []mysql.Position
+	}{
+		{
+			name:         "when mode is initial and there is no stored position then rows are dispatched before streaming",
+			snapshot:     run.Snapshot{Mode: run.SnapshotInitial, Tables: []string{"my_schema.outbox"}, BatchSize: 2},
+			wantPayloads: []string{`{"id": 1}`, `{"id": 2}`, `{"id": 3}`},
+			wantQueries: []string{
+				"SHOW MASTER STATUS",
+				"SET TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+				"START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY",
+				"SHOW MASTER STATUS",
+				"SELECT `id`, `aggregate_id`, `aggregate_type`, `payload` FROM `my_schema`.`outbox` ORDER BY `id` LIMIT ?",
+				"SELECT `id`, `aggregate_id`, `aggregate_type`, `payload` FROM `my_schema`.`outbox` WHERE (`id`) > (?) ORDER BY `id` LIMIT ?",
+				"COMMIT",
+			},
+			wantRunFrom:      head,
+			wantSetPositions: []mysql.Position{head, head},
+		},
+		{
+			name:             "when mode is initial and there is a stored position then no snapshot is taken",
+			snapshot:         run.Snapshot{Mode: run.SnapshotInitial, Tables: []string{"my_schema.outbox"}},
+			lastPosition:     stored,
+			wantRunFrom:      stored,
+			wantSetPositions: []mysql.Position{stored},
+		},
+		{
+			name:         "when mode is always then rows are dispatched even with a stored position",
+			snapshot:     run.Snapshot{Mode: run.SnapshotAlways, Tables: []string{"my_schema.outbox"}},
+			lastPosition: stored,
+			wantPayloads: []string{`{"id": 1}`, `{"id": 2}`, `{"id": 3}`},
+			wantQueries: []string{
+				"SHOW MASTER STATUS",
+				"SET TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+				"START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY",
+				"SHOW MASTER STATUS",
+				"SELECT `id`, `aggregate_id`, `aggregate_type`, `payload` FROM `my_schema`.`outbox` ORDER BY `id` LIMIT ?",
+				"COMMIT",
+			},
+			wantRunFrom:      head,
+			wantSetPositions: []mysql.Position{head, head},
+		},
+		{
+			name:         "when a transaction commits while the snapshot starts then the snapshot is started again",
+			snapshot:     run.Snapshot{Mode: run.SnapshotInitial, Tables: []string{"my_schema.outbox"}},
+			positions:    []mysql.Position{{Name: "mysql-bin.000003", Pos: 300}, head},
+			wantPayloads: []string{`{"id": 1}`, `{"id": 2}`, `{"id": 3}`},
+			wantQueries: []string{
+				"SHOW MASTER STATUS",
+				"SET TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+				"START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY",
+				"SHOW MASTER STATUS",
+				"ROLLBACK",
+				"SHOW MASTER STATUS",
+				"SET TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+				"START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY",
+				"SHOW MASTER STATUS",
+				"SELECT `id`, `aggregate_id`, `aggregate_type`, `payload` FROM `my_schema`.`outbox` ORDER BY `id` LIMIT ?",
+				"COMMIT",
+			},
+			wantRunFrom:      head,
+			wantSetPositions: []mysql.Position{head, head},
+		},
+		{
+			name:     "when the connection drops then the snapshot fails",
+			snapshot: run.Snapshot{Mode: run.SnapshotInitial, Tables: []string{"my_schema.outbox"}},
+			connErr:  errors.New("connection was bad"),
+			wantErr:  true,
+		},
+		{
+			name:             "when mode is never then no snapshot is taken",
+			snapshot:         run.Snapshot{Mode: run.SnapshotNever, Tables: []string{"my_schema.outbox"}},
+			wantRunFrom:      mysql.Position{},
+			wantSetPositions: []mysql.Position{{}},
+		},
+		{
+			name:     "when there are no tables to read then error",
+			snapshot: run.Snapshot{Mode: run.SnapshotInitial},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			cm := &tableGetterCanalMock{tables: map[string]*schema.Table{
+				"outbox": {
+					Schema: "my_schema",
+					Name:   "outbox",
+					Columns: []schema.TableColumn{
+						{Name: "id"},
+						{Name: "aggregate_id"},
+						{Name: "aggregate_type"},
+						{Name: "payload"},
+					},
+					PKColumns: []int{0},
+				},
+			}}
+			cm.closePosition = tt.wantRunFrom
+			conn := &snapshotConnMock{
+				columns:   []string{"id", "aggregate_id", "aggregate_type", "payload"},
+				rows:      rows,
+				positions: tt.positions,
+				err:       tt.connErr,
+			}
+			if conn.positions == nil {
+				conn.positions = []mysql.Position{head}
+			}
+			tt.snapshot.Connect = func() (run.SnapshotConn, error) {
+				return conn, nil
+			}
+			ed := &eventDispatcherMock{}
+			sh := &stateHandlerMock{lastPosition: binlogPosition(tt.lastPosition)}
+			r := run.NewRunner(
+				cm,
+				buildEventHandlerWithDispatcher(t, ed),
+				sh,
+				time.Hour,
+				run.RunnerOptions{Snapshot: tt.snapshot},
+			)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			err := r.Run(ctx)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Nil(t, cm.runFromPosition)
+				return
+			}
+			require.NoError(t, err)
+
+			var payloads []string
+			for _, oe := range ed.dispatches {
+				payloads = append(payloads, string(oe.Payload))
+			}
+			assert.Equal(t, tt.wantPayloads, payloads)
+			assert.Equal(t, tt.wantQueries, conn.queries)
+			assert.Equal(t, tt.wantQueries != nil, conn.closed)
+			assert.Equal(t, &tt.wantRunFrom, cm.runFromPosition)
+
+			var setPositions []mysql.Position
+			for _, p := range sh.setPositions {
+				setPositions = append(setPositions, mysql.Position{Name: p.File, Pos: p.Offset})
+			}
+			assert.Equal(t, tt.wantSetPositions, setPositions)
+		})
+	}
+}
+
+func TestRunner_RunWithCleanup(t *testing.T) {
+	persisted := mysql.Position{Name: "mysql-bin.000001", Pos: 300}
+	notPersisted := mysql.Position{Name: "mysql-bin.000001", Pos: 400}
+	rowsEvent := func(ids ...interface{}) *canal.RowsEvent {
+		e := &canal.RowsEvent{
+			Table: &schema.Table{
+				Schema: "my_schema",
+				Name:   "outbox",
+				Columns: []schema.TableColumn{
+					{Name: "id", Type: schema.TYPE_NUMBER, IsUnsigned: true},
+					{Name: "aggregate_id"},
+					{Name: "aggregate_type"},
+					{Name: "payload"},
+					{Name: "created_at", Type: schema.TYPE_DATETIME},
+				},
+				PKColumns: []int{0},
+			},
+			Action: canal.InsertAction,
+			Header: &replication.EventHeader{Timestamp: 1600000000},
+		}
+		for _, id := range ids {
+			e.Rows = append(e.Rows, []interface{}{
+				id, "c44ade3e-9394-4e6e-8d2d-20707d61061c", "order", `{}`, "2020-09-13 12:26:40",
+			})
+		}
+
+		return e
+	}
+
+	tests := []struct {
+		name        string
+		cleanup     run.Cleanup
+		ids         []interface{}
+		wantQueries []string
+		wantArgs    [][]interface{}
+		wantErr     bool
+	}{
+		{
+			name:    "when cleanup is by primary key then only the rows before the persisted position are deleted",
+			cleanup: run.Cleanup{Mode: run.CleanupByPrimaryKey, BatchSize: 2, Interval: time.Millisecond},
+			ids:     []interface{}{int64(1), int64(2), int64(3)},
+			wantQueries: []string{
+				"DELETE FROM `my_schema`.`outbox` WHERE (`id`) IN ((?), (?))",
+				"DELETE FROM `my_schema`.`outbox` WHERE (`id`) IN ((?))",
+			},
+			wantArgs: [][]interface{}{{uint64(1), uint64(2)}, {uint64(3)}},
+		},
+		{
+			name:    "when the primary key is unsigned then the values read as negative are converted",
+			cleanup: run.Cleanup{Mode: run.CleanupByPrimaryKey, Interval: time.Millisecond},
+			ids:     []interface{}{int64(-1)},
+			wantQueries: []string{
+				"DELETE FROM `my_schema`.`outbox` WHERE (`id`) IN ((?))",
+			},
+			wantArgs: [][]interface{}{{uint64(18446744073709551615)}},
+		},
+		{
+			name: "when cleanup is by age then rows older than the retention are deleted up to the persisted primary key",
+			cleanup: run.Cleanup{
+				Mode:          run.CleanupByAge,
+				AgeColumnName: "created_at",
+				Retention:     time.Hour,
+				BatchSize:     10,
+				Interval:      time.Millisecond,
+			},
+			ids: []interface{}{int64(1), int64(3), int64(2)},
+			wantQueries: []string{
+				"DELETE FROM `my_schema`.`outbox` WHERE `id` <= ? AND `created_at` < ? LIMIT 10",
+			},
+			wantArgs: [][]interface{}{{int64(3), "cutoff"}},
+		},
+		{
+			name:    "when cleanup by age has no age column then error",
+			cleanup: run.Cleanup{Mode: run.CleanupByAge},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			em := &executorMock{}
+			tt.cleanup.Executor = em
+
+			cm := &canalMock{
+				closePosition: notPersisted,
+				script: func(h canal.EventHandler) error {
+					require.NoError(t, h.OnRow(rowsEvent(tt.ids...)))
+					require.NoError(t, h.OnPosSynced(persisted, nil, false))
+					require.NoError(t, h.OnRow(rowsEvent(int64(4))))
+					return nil
+				},
+			}
+			sh := &stateHandlerMock{setLastPositionErr: errors.New("a"), setLastPositionErrOn: &notPersisted}
+			r := run.NewRunner(
+				cm,
+				buildEventHandlerWithDispatcher(t, &eventDispatcherMock{}),
+				sh,
+				time.Millisecond,
+				run.RunnerOptions{Cleanup: tt.cleanup},
+			)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			err := r.Run(ctx)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Nil(t, cm.runFromPosition)
+				return
+			}
+			// the position following the last row is never persisted
+			assert.Error(t, err)
+
+			em.mu.Lock()
+			defer em.mu.Unlock()
+			assert.Equal(t, tt.wantQueries, em.queries)
+			if tt.cleanup.Mode == run.CleanupByAge && len(em.args) == 1 {
+				// the cutoff is the current time in UTC less the retention
+				cutoff, err := time.ParseInLocation("2006-01-02 15:04:05", em.args[0][1].(string), time.UTC)
+				require.NoError(t, err)
+				assert.WithinDuration(t, time.Now().Add(-tt.cleanup.Retention), cutoff, time.Minute)
+				em.args[0][1] = "cutoff"
+			}
+			assert.Equal(t, tt.wantArgs, em.args)
+		})
+	}
+}
+
+func TestRunner_RunWithSource(t *testing.T) {
+	ed := &eventDispatcherMock{}
+	s := &sourceMock{
+		closed: make(chan struct{}),
+		script: func(h run.SourceHandler) error {
+			err := h.OnRows(run.RowsEvent{
+				Table: &run.Table{
+					Schema:  "my_schema",
+					Name:    "outbox",
+					Columns: []run.TableColumn{{Name: "aggregate_id"}, {Name: "aggregate_type"}, {Name: "payload"}},
+				},
+				Action:    run.InsertAction,
+				Rows:      buildInsertRowsEvent("order").Rows,
+				Timestamp: 1672531200,
+			})
+			if err != nil {
+				return err
+			}
+
+			return h.OnPosition(run.Position{LSN: 200})
+		},
+	}
+	sh := &stateHandlerMock{lastPosition: run.Position{LSN: 100}}
+	r := run.NewSourceRunner(s, buildEventHandlerWithDispatcher(t, ed), sh, time.Hour, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := r.Run(ctx)
+	require.NoError(t, err)
+
+	assert.Equal(t, run.Position{LSN: 100}, s.from)
+	require.Len(t, ed.dispatches, 1)
+	assert.Equal(t, uint32(1672531200), ed.dispatches[0].EventTimestampFromDatabase)
+	assert.Equal(t, []run.Position{{LSN: 200}}, sh.setPositions)
+	assert.Equal(t, []run.Position{{LSN: 200}}, s.checkpointed)
+}
+
 type canalMock struct {
-	runFromErr error
+	runFromErr       error
+	masterGTIDSet    mysql.GTIDSet
+	closePosition    mysql.Position
+	runFromPosition  *mysql.Position
+	startFromGTIDSet mysql.GTIDSet
+	// script simulates the events read from the binlog.
+	script func(h canal.EventHandler) error
+
+	handler   canal.EventHandler
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Close mimics canal.Canal, which syncs its current position on close.
+func (c *canalMock) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		_ = c.handler.OnPosSynced(c.closePosition, nil, true)
+	})
+}
+
+func (c *canalMock) RunFrom(p mysql.Position) error {
+	c.runFromPosition = &p
+	return c.listen()
+}
+
+func (c *canalMock) StartFromGTID(gs mysql.GTIDSet) error {
+	c.startFromGTIDSet = gs
+	return c.listen()
+}
+
+// listen simulates listening time.
+func (c *canalMock) listen() error {
+	if c.script != nil {
+		err := c.script(c.handler)
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case <-time.After(time.Second * 1):
+		return c.runFromErr
+	case <-c.closed:
+		return nil
+	}
+}
+
+func (c *canalMock) GetMasterGTIDSet() (mysql.GTIDSet, error) {
+	return c.masterGTIDSet, nil
+}
+
+func (c *canalMock) SetEventHandler(h canal.EventHandler) {
+	c.handler = h
+	c.closed = make(chan struct{})
 }
 
-func (c *canalMock) Close() {}
+// snapshotConnMock returns the binlog positions in turn, the last one once the others are returned, and the rows
+// following the id given as argument, as many as the last argument.
+type snapshotConnMock struct {
+	columns   []string
+	rows      [][]interface{}
+	positions []mysql.Position
+	// err, when set, is returned when selecting rows, as when the connection drops
+	err error
+
+	queries []string
+	closed  bool
+}
+
+func (c *snapshotConnMock) Execute(cmd string, args ...interface{}) (*mysql.Result, error) {
+	c.queries = append(c.queries, cmd)
+
+	var names []string
+	var values [][]interface{}
+	switch {
+	case cmd == "SHOW MASTER STATUS":
+		p := c.positions[0]
+		if len(c.positions) > 1 {
+			c.positions = c.positions[1:]
+		}
 
-func (c *canalMock) RunFrom(mysql.Position) error {
-	time.Sleep(time.Second * 1) // simulate listening time
-	return c.runFromErr
+		names = []string{"File", "Position", "Binlog_Do_DB", "Binlog_Ignore_DB", "Executed_Gtid_Set"}
+		values = [][]interface{}{{p.Name, p.Pos, "", "", ""}}
+	case strings.HasPrefix(cmd, "SELECT"):
+		if c.err != nil {
+			return nil, c.err
+		}
+
+		limit := args[len(args)-1].(int)
+		for _, row := range c.rows {
+			if len(args) > 1 && fmt.Sprint(row[0]) <= fmt.Sprint(args[0]) {
+				continue
+			}
+			if len(values) == limit {
+				break
+			}
+			values = append(values, row)
+		}
+		names = c.columns
+	default:
+		return &mysql.Result{}, nil
+	}
+
+	rs, err := mysql.BuildSimpleTextResultset(names, values)
+	if err != nil {
+		return nil, err
+	}
+
+	// the client parses the rows, the helper does not
+	for _, rd := range rs.RowDatas {
+		v, err := rd.Parse(rs.Fields, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		rs.Values = append(rs.Values, v)
+	}
+
+	return &mysql.Result{Resultset: rs}, nil
 }
 
-func (c *canalMock) SetEventHandler(canal.EventHandler) {}
+func (c *snapshotConnMock) Close() error {
+	c.closed = true
+	return nil
+}
 
 type stateHandlerMock struct {
+	lastPosition       run.Position
 	setLastPositionErr error
-	getLastPositionErr error
+	// setLastPositionErrOn, when set, limits setLastPositionErr to the given position
+	setLastPositionErrOn *mysql.Position
+	getLastPositionErr   error
+	setPositions         []run.Position
 }
 
-func (s *stateHandlerMock) GetLastPosition() (mysql.Position, error) {
-	return mysql.Position{}, s.getLastPositionErr
+func (s *stateHandlerMock) GetLastCheckpoint() (run.Checkpoint, error) {
+	if s.getLastPositionErr != nil {
+		return nil, s.getLastPositionErr
+	}
+
+	return run.EncodeCheckpoint(s.lastPosition)
 }
 
-func (s *stateHandlerMock) SetLastPosition(mysql.Position) error {
+func (s *stateHandlerMock) SetLastCheckpoint(c run.Checkpoint) error {
+	p, err := run.DecodeCheckpoint(c)
+	if err != nil {
+		return err
+	}
+
+	s.setPositions = append(s.setPositions, p)
+	if s.setLastPositionErrOn != nil && p != binlogPosition(*s.setLastPositionErrOn) {
+		return nil
+	}
+
 	return s.setLastPositionErr
 }
 
+type executorMock struct {
+	mu      sync.Mutex
+	queries []string
+	args    [][]interface{}
+}
+
+func (e *executorMock) Execute(cmd string, args ...interface{}) (*mysql.Result, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.queries = append(e.queries, cmd)
+	e.args = append(e.args, args)
+
+	return &mysql.Result{AffectedRows: uint64(len(args))}, nil
+}
+
+type fencedStateHandlerMock struct {
+	stateHandlerMock
+	fencingTokens []uint64
+}
+
+func (s *fencedStateHandlerMock) SetFencingToken(token uint64) {
+	s.fencingTokens = append(s.fencingTokens, token)
+}
+
+type leaderElectorMock struct {
+	lease       *leaseMock
+	campaignErr error
+	// blocked makes Campaign wait for ctx
+	blocked bool
+}
+
+func (l *leaderElectorMock) Campaign(ctx context.Context) (run.Lease, error) {
+	if l.blocked {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	if l.campaignErr != nil {
+		return nil, l.campaignErr
+	}
+
+	return l.lease, nil
+}
+
+type leaseMock struct {
+	done     chan struct{}
+	token    uint64
+	released bool
+}
+
+func (l *leaseMock) Done() <-chan struct{} {
+	return l.done
+}
+
+func (l *leaseMock) FencingToken() uint64 {
+	return l.token
+}
+
+func (l *leaseMock) Release() error {
+	l.released = true
+	return nil
+}
+
 func buildEventHandler(t *testing.T) *run.EventHandler {
+	return buildEventHandlerWithDispatcher(t, nil)
+}
+
+func buildEventHandlerWithDispatcher(t *testing.T, ed run.EventDispatcher) *run.EventHandler {
 	eh, err := run.NewEventHandler(
-		nil,
+		ed,
 		"",
 		"",
 		"",
+		run.EventHandlerOptions{},
 	)
 	require.NoError(t, err)
 	return eh
 }
+
+func buildInsertRowsEvent(aggregateType string) *canal.RowsEvent {
+	return &canal.RowsEvent{
+		Table: &schema.Table{
+			Schema: "my_schema",
+			Name:   "outbox",
+			Columns: []schema.TableColumn{
+				{Name: "aggregate_id"},
+				{Name: "aggregate_type"},
+				{Name: "payload"},
+			},
+		},
+		Action: canal.InsertAction,
+		Rows: [][]interface{}{
+			{"c44ade3e-9394-4e6e-8d2d-20707d61061c", aggregateType, `{}`},
+		},
+		Header: &replication.EventHeader{},
+	}
+}
+
+// binlogPosition returns the run.Position of a position of canal.
+func binlogPosition(p mysql.Position) run.Position {
+	return run.Position{File: p.Name, Offset: p.Pos}
+}
+
+type asyncEventDispatcherMock struct {
+	eventDispatcherMock
+	acks []func(error)
+}
+
+func (e *asyncEventDispatcherMock) DispatchAsync(oe run.OutboxEvent, ack func(error)) error {
+	e.dispatches = append(e.dispatches, oe)
+	e.acks = append(e.acks, ack)
+
+	return nil
+}
+
+type transactionalEventDispatcherMock struct {
+	asyncEventDispatcherMock
+	commitErr error
+	commits   []run.Position
+	mu        sync.Mutex
+}
+
+// Commit may be called concurrently by canal on close.
+func (e *transactionalEventDispatcherMock) Commit(p run.Position) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.commits = append(e.commits, p)
+
+	for _, ack := range e.acks {
+		ack(e.commitErr)
+	}
+	e.acks = nil
+
+	return e.commitErr
+}
+
+// sourceMock is a CheckpointedSource running script, then waiting to be closed.
+type sourceMock struct {
+	script func(h run.SourceHandler) error
+
+	from         run.Position
+	checkpointed []run.Position
+	closeOnce    sync.Once
+	closed       chan struct{}
+}
+
+func (s *sourceMock) Start(from run.Position, h run.SourceHandler) error {
+	s.from = from
+	if s.script != nil {
+		err := s.script(h)
+		if err != nil {
+			return err
+		}
+	}
+
+	<-s.closed
+	return nil
+}
+
+func (s *sourceMock) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+}
+
+func (s *sourceMock) Checkpointed(p run.Position) error {
+	s.checkpointed = append(s.checkpointed, p)
+	return nil
+}
@@ -0,0 +1,83 @@
+// Package runtest provides utilities to test the implementations of the interfaces of run.
+package runtest
+
+import (
+	"testing"
+
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// StateHandlerSuite tests the semantics every run.StateHandler must have: the checkpoint of an empty state is the
+// zero position, the checkpoints are returned as they were set, and setting one overwrites the former.
+// newStateHandler is called by every test and must return a handler on an empty state.
+// As the Runner does, the handlers are asked for the last checkpoint before setting one.
+func StateHandlerSuite(t *testing.T, newStateHandler func(t *testing.T) run.StateHandler) {
+	t.Helper()
+
+	t.Run("missing checkpoint", func(t *testing.T) {
+		s := newStateHandler(t)
+
+		p := getLastPosition(t, s)
+		assert.Equal(t, run.Position{}, p)
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		for _, p := range positions() {
+			s := newStateHandler(t)
+			getLastPosition(t, s)
+
+			c, err := run.EncodeCheckpoint(p)
+			require.NoError(t, err)
+			require.NoError(t, s.SetLastCheckpoint(c))
+
+			actual, err := s.GetLastCheckpoint()
+			require.NoError(t, err)
+			assert.Equal(t, c, actual)
+			assert.Equal(t, p, getLastPosition(t, s))
+		}
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		s := newStateHandler(t)
+		getLastPosition(t, s)
+
+		// the longest checkpoint first, so that leftovers of the former one would be noticed
+		ps := positions()
+		for i := len(ps) - 1; i >= 0; i-- {
+			c, err := run.EncodeCheckpoint(ps[i])
+			require.NoError(t, err)
+			require.NoError(t, s.SetLastCheckpoint(c))
+
+			assert.Equal(t, ps[i], getLastPosition(t, s))
+		}
+	})
+}
+
+// positions returns positions of every kind, from the shortest encoded to the longest.
+func positions() []run.Position {
+	return []run.Position{
+		{LSN: 0x16B374D848},
+		{File: "mysql-bin.000001", Offset: 4},
+		{File: "mysql-bin.000003", Offset: 1234, GTIDSet: "0-1-100", GTIDFlavor: "mariadb"},
+		{
+			File:       "mysql-bin.000002",
+			Offset:     5678,
+			GTIDSet:    "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5,5ad9cb8e-2092-11e2-a0d1-a0b3cc8f2fb1:1-23",
+			GTIDFlavor: "mysql",
+		},
+	}
+}
+
+func getLastPosition(t *testing.T, s run.StateHandler) run.Position {
+	t.Helper()
+
+	c, err := s.GetLastCheckpoint()
+	require.NoError(t, err)
+
+	p, err := run.DecodeCheckpoint(c)
+	require.NoError(t, err)
+
+	return p
+}
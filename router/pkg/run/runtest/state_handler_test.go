@@ -0,0 +1,27 @@
+package runtest_test
+
+import (
+	"testing"
+
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/lorenzoranucci/tor/router/pkg/run/runtest"
+)
+
+func TestStateHandlerSuite(t *testing.T) {
+	runtest.StateHandlerSuite(t, func(t *testing.T) run.StateHandler {
+		return &stateHandlerMock{}
+	})
+}
+
+type stateHandlerMock struct {
+	checkpoint run.Checkpoint
+}
+
+func (s *stateHandlerMock) GetLastCheckpoint() (run.Checkpoint, error) {
+	return s.checkpoint, nil
+}
+
+func (s *stateHandlerMock) SetLastCheckpoint(c run.Checkpoint) error {
+	s.checkpoint = append(run.Checkpoint(nil), c...)
+	return nil
+}
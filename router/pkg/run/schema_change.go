@@ -0,0 +1,244 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrIncompatibleSchemaChange is returned when a DDL statement leaves an outbox table without the required columns.
+var ErrIncompatibleSchemaChange = errors.New("outbox table schema change is incompatible")
+
+type SchemaChangePolicy string
+
+const (
+	// HaltOnIncompatibleSchemaChange stops the router when an outbox table loses a required column.
+	HaltOnIncompatibleSchemaChange SchemaChangePolicy = "halt"
+	// ContinueOnIncompatibleSchemaChange logs the incompatible changes and keeps reading, the rows that cannot be
+	// mapped are then handled by the PoisonEventPolicy.
+	ContinueOnIncompatibleSchemaChange SchemaChangePolicy = "continue"
+)
+
+func ParseSchemaChangePolicy(s string) (SchemaChangePolicy, error) {
+	switch p := SchemaChangePolicy(s); p {
+	case "":
+		return HaltOnIncompatibleSchemaChange, nil
+	case HaltOnIncompatibleSchemaChange, ContinueOnIncompatibleSchemaChange:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown schema change policy: %s", s)
+	}
+}
+
+// TableGetter returns the schema of a table, as canal.Canal does.
+// It returns canal.ErrExcludedTable for the tables that are not read and schema.ErrTableNotExist for the
+// missing ones.
+type TableGetter interface {
+	GetTable(db string, table string) (*schema.Table, error)
+}
+
+var _ TableGetter = (*canal.Canal)(nil)
+
+// ColumnsRequirer is implemented by the EventDispatchers that read columns of the outbox tables other than the
+// ones of the event mapping, e.g. to map headers. The columns are validated when an outbox table changes.
+type ColumnsRequirer interface {
+	RequiredColumns() []string
+}
+
+// changedTable is a table changed by a DDL statement, the changes are validated by OnDDL.
+type changedTable struct {
+	schema string
+	table  string
+}
+
+func (h *canalEventHandler) OnTableChanged(schemaName string, table string) error {
+	h.changedTables = append(h.changedTables, changedTable{schema: schemaName, table: table})
+
+	// the schema of the table changes
+	for t := range h.tables {
+		if t.Schema == schemaName && t.Name == table {
+			delete(h.tables, t)
+		}
+	}
+
+	return nil
+}
+
+// OnDDL applies the statement to the tracked schemas and validates the outbox tables it changed.
+// When the changes cannot be tracked, the halt policy stops the router, while the continue policy reloads the
+// current schema of the database, which is ahead of the statement when the router lags behind further changes.
+func (h *canalEventHandler) OnDDL(nextPos mysql.Position, queryEvent *replication.QueryEvent) error {
+	changed := h.changedTables
+	h.changedTables = nil
+
+	query := string(queryEvent.Query)
+	// canal notifies a query once per statement changing tables, all the statements are applied at the first time
+	if nextPos != h.ddlPosition {
+		h.ddlPosition = nextPos
+		h.reloadSchemas = false
+
+		err := h.schemas.apply(string(queryEvent.Schema), query, h.isOutboxTable)
+		if err != nil {
+			err = fmt.Errorf("%w: at %s:%d after %q: %s",
+				ErrIncompatibleSchemaChange, nextPos.Name, nextPos.Pos, query, err)
+			if h.handler.schemaChangePolicy != ContinueOnIncompatibleSchemaChange {
+				return err
+			}
+
+			logrus.WithError(err).
+				Error("outbox table schema cannot be tracked, reloading the current schema of the database")
+			h.reloadSchemas = true
+		}
+	}
+
+	for _, t := range changed {
+		err := h.validateTable(t.schema, t.table, h.reloadSchemas)
+		if err == nil {
+			continue
+		}
+
+		err = fmt.Errorf("%w: table %s at %s:%d after %q: %s",
+			ErrIncompatibleSchemaChange, tableRef(t.schema, t.table), nextPos.Name, nextPos.Pos, query, err)
+		if h.handler.schemaChangePolicy == ContinueOnIncompatibleSchemaChange {
+			logrus.WithError(err).
+				Error("outbox table schema changed, rows that cannot be mapped are handled as poison events")
+			continue
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// validateTable validates the tracked schema of an outbox table, reloading it when asked or not tracked.
+func (h *canalEventHandler) validateTable(schemaName string, tableName string, reload bool) error {
+	if !h.isOutboxTable(schemaName, tableName) {
+		return nil
+	}
+
+	t, ok := h.schemas.tracked(schemaName, tableName)
+	if !ok || reload {
+		var err error
+		t, err = h.reloadTable(schemaName, tableName)
+		if err != nil || t == nil {
+			return err
+		}
+	}
+	if t == nil {
+		return errors.New("table does not exist")
+	}
+
+	return h.handler.validateTable(newTable(t))
+}
+
+// reloadTable tracks the current schema of a table in the database, nil when it cannot be reloaded or is excluded.
+func (h *canalEventHandler) reloadTable(schemaName string, tableName string) (*schema.Table, error) {
+	if h.tableGetter == nil {
+		return nil, nil
+	}
+
+	t, err := h.tableGetter.GetTable(schemaName, tableName)
+	if errors.Is(err, canal.ErrExcludedTable) {
+		return nil, nil
+	}
+	if errors.Is(err, schema.ErrTableNotExist) {
+		return nil, errors.New("table does not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.WithField("table", tableRef(schemaName, tableName)).
+		Warn("outbox table schema not tracked, using the current schema of the database")
+	h.schemas.track(t)
+
+	return t, nil
+}
+
+// resetSchemas tracks the outbox tables from their current schema when the binlog is read from a new position.
+// It is the schema at the position unless the router lags behind further changes, whose rows then have a length
+// other than the one of the schema and are handled by the PoisonEventPolicy.
+func (h *canalEventHandler) resetSchemas() error {
+	h.schemas = newSchemaHistory()
+	h.ddlPosition = mysql.Position{}
+	if h.tableGetter == nil {
+		return nil
+	}
+
+	for _, ot := range h.handler.outboxTables {
+		t, err := h.tableGetter.GetTable(ot.Schema, ot.Table)
+		if errors.Is(err, canal.ErrExcludedTable) || errors.Is(err, schema.ErrTableNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("loading the schema of %s: %w", ot.Ref(), err)
+		}
+
+		h.schemas.track(t)
+	}
+
+	return nil
+}
+
+// isOutboxTable reports whether the table is an outbox table of the EventHandler or, when it defines none, a table
+// read by canal. DDL statements on the other tables are not tracked.
+func (h *canalEventHandler) isOutboxTable(schemaName string, tableName string) bool {
+	if h.handler.tableEventMappers != nil || h.tableGetter == nil {
+		return h.handler.isOutboxTable(schemaName, tableName)
+	}
+
+	_, err := h.tableGetter.GetTable(schemaName, tableName)
+
+	return !errors.Is(err, canal.ErrExcludedTable)
+}
+
+// isOutboxTable reports whether the table is read by the EventHandler: any table when no outbox table is defined.
+func (h *EventHandler) isOutboxTable(schemaName string, tableName string) bool {
+	if h.tableEventMappers == nil {
+		return true
+	}
+
+	_, ok := h.tableEventMappers[tableRef(schemaName, tableName)]
+
+	return ok
+}
+
+// validateTable checks that the outbox table still has the required columns.
+func (h *EventHandler) validateTable(t *Table) error {
+	em := h.eventMapper
+	if h.tableEventMappers != nil {
+		em = h.tableEventMappers[tableRef(t.Schema, t.Name)]
+	}
+
+	required := []string{em.aggregateIDColumnName, em.aggregateTypeColumnName, em.payloadColumnName}
+	if cr, ok := h.eventDispatcher.(ColumnsRequirer); ok {
+		required = append(required, cr.RequiredColumns()...)
+	}
+
+	var missing []string
+	for _, c := range required {
+		if t.FindColumn(c) < 0 {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required columns: %s", strings.Join(missing, ", "))
+	}
+
+	columns := make([]string, 0, len(t.Columns))
+	for _, c := range t.Columns {
+		columns = append(columns, c.Name)
+	}
+	logrus.WithField("table", tableRef(t.Schema, t.Name)).
+		WithField("columns", columns).
+		Info("outbox table schema changed")
+
+	return nil
+}
@@ -0,0 +1,346 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	// the parser requires a driver for the values of the statements, as canal, which does not import one
+	_ "github.com/pingcap/parser/test_driver"
+)
+
+// errUntrackedSchemaChange is returned for the DDL statements whose changes to the columns cannot be tracked.
+var errUntrackedSchemaChange = errors.New("schema change cannot be tracked")
+
+// schemaHistory tracks the schema of the tables through the DDL statements of the binlog, so that rows are read
+// with the schema of their position. canal reloads the current schema of the database instead, which is ahead of
+// the binlog when the router lags behind further schema changes.
+type schemaHistory struct {
+	parser *parser.Parser
+	// tables are the tracked schemas by table reference, nil for the dropped tables.
+	tables map[string]*schema.Table
+}
+
+func newSchemaHistory() *schemaHistory {
+	return &schemaHistory{parser: parser.New(), tables: map[string]*schema.Table{}}
+}
+
+// table returns the tracked schema of the table of a row, starting to track t when the table is not tracked.
+func (s *schemaHistory) table(t *schema.Table) *schema.Table {
+	if r := s.tables[tableRef(t.Schema, t.Name)]; r != nil {
+		return r
+	}
+
+	s.track(t)
+
+	return t
+}
+
+func (s *schemaHistory) track(t *schema.Table) {
+	s.tables[tableRef(t.Schema, t.Name)] = t
+}
+
+// tracked returns the tracked schema of the table, nil when it was dropped.
+func (s *schemaHistory) tracked(schemaName string, tableName string) (*schema.Table, bool) {
+	t, ok := s.tables[tableRef(schemaName, tableName)]
+	return t, ok
+}
+
+// apply applies a DDL statement to the tracked tables, the tables it creates are tracked when include reports so.
+func (s *schemaHistory) apply(defaultSchema string, query string, include func(string, string) bool) error {
+	stmts, _, err := s.parser.Parse(query, "", "")
+	if err != nil {
+		return fmt.Errorf("%w: %s", errUntrackedSchemaChange, err)
+	}
+
+	for _, stmt := range stmts {
+		if err := s.applyStmt(defaultSchema, stmt, include); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *schemaHistory) applyStmt(defaultSchema string, stmt ast.StmtNode, include func(string, string) bool) error {
+	switch stmt := stmt.(type) {
+	case *ast.CreateTableStmt:
+		schemaName, tableName := qualifiedName(defaultSchema, stmt.Table)
+		if stmt.IsTemporary {
+			return nil
+		}
+		if stmt.ReferTable != nil {
+			// copies of the outbox tables are tracked, as online schema change tools rename them to the outbox tables
+			like, ok := s.tracked(qualifiedName(defaultSchema, stmt.ReferTable))
+			if ok && like != nil {
+				t := newTrackedTable(like)
+				t.table.Schema, t.table.Name = schemaName, tableName
+				s.track(t.build())
+
+				return nil
+			}
+		}
+		if !include(schemaName, tableName) {
+			return nil
+		}
+		if stmt.ReferTable != nil || stmt.Select != nil {
+			return fmt.Errorf("%w: the columns of %s are not in the statement",
+				errUntrackedSchemaChange, tableRef(schemaName, tableName))
+		}
+
+		t := &trackedTable{table: &schema.Table{Schema: schemaName, Name: tableName}}
+		for _, c := range stmt.Cols {
+			if err := t.addColumn(c, nil); err != nil {
+				return err
+			}
+		}
+		for _, c := range stmt.Constraints {
+			t.addConstraint(c)
+		}
+		s.track(t.build())
+	case *ast.AlterTableStmt:
+		schemaName, tableName := qualifiedName(defaultSchema, stmt.Table)
+		current, ok := s.tracked(schemaName, tableName)
+		if !ok || current == nil {
+			return nil
+		}
+
+		t := newTrackedTable(current)
+		for _, spec := range stmt.Specs {
+			if err := t.alter(spec); err != nil {
+				return fmt.Errorf("%w: %s: %s", errUntrackedSchemaChange, tableRef(schemaName, tableName), err)
+			}
+		}
+
+		if t.rename != nil {
+			s.tables[tableRef(schemaName, tableName)] = nil
+			schemaName, tableName = qualifiedName(defaultSchema, t.rename)
+			t.table.Schema, t.table.Name = schemaName, tableName
+			if !include(schemaName, tableName) {
+				return nil
+			}
+		}
+		s.track(t.build())
+	case *ast.RenameTableStmt:
+		for _, tt := range stmt.TableToTables {
+			oldSchema, oldTable := qualifiedName(defaultSchema, tt.OldTable)
+			newSchema, newTable := qualifiedName(defaultSchema, tt.NewTable)
+
+			current, ok := s.tracked(oldSchema, oldTable)
+			if ok {
+				s.tables[tableRef(oldSchema, oldTable)] = nil
+			}
+			if !include(newSchema, newTable) {
+				continue
+			}
+			if current == nil {
+				return fmt.Errorf("%w: %s is renamed from %s, which is not tracked",
+					errUntrackedSchemaChange, tableRef(newSchema, newTable), tableRef(oldSchema, oldTable))
+			}
+
+			t := newTrackedTable(current)
+			t.table.Schema, t.table.Name = newSchema, newTable
+			s.track(t.build())
+		}
+	case *ast.DropTableStmt:
+		if stmt.IsView {
+			return nil
+		}
+		for _, tn := range stmt.Tables {
+			schemaName, tableName := qualifiedName(defaultSchema, tn)
+			if _, ok := s.tracked(schemaName, tableName); ok || include(schemaName, tableName) {
+				s.tables[tableRef(schemaName, tableName)] = nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// qualifiedName returns the schema and the name of a table of a statement run in the default schema.
+func qualifiedName(defaultSchema string, tn *ast.TableName) (string, string) {
+	if tn.Schema.O == "" {
+		return defaultSchema, tn.Name.O
+	}
+
+	return tn.Schema.O, tn.Name.O
+}
+
+// trackedTable is a copy of a tracked schema changed by a statement, with the primary key by column names.
+type trackedTable struct {
+	table  *schema.Table
+	pk     []string
+	rename *ast.TableName
+}
+
+func newTrackedTable(t *schema.Table) *trackedTable {
+	c := *t
+	c.Columns = append([]schema.TableColumn(nil), t.Columns...)
+	c.Indexes = nil
+
+	r := &trackedTable{table: &c}
+	for _, i := range t.PKColumns {
+		r.pk = append(r.pk, t.Columns[i].Name)
+	}
+
+	return r
+}
+
+func (t *trackedTable) alter(spec *ast.AlterTableSpec) error {
+	switch spec.Tp {
+	case ast.AlterTableAddColumns:
+		for _, c := range spec.NewColumns {
+			if err := t.addColumn(c, spec.Position); err != nil {
+				return err
+			}
+		}
+	case ast.AlterTableDropColumn:
+		i, err := t.findColumn(spec.OldColumnName.Name.O)
+		if err != nil {
+			return err
+		}
+		t.table.Columns = append(t.table.Columns[:i], t.table.Columns[i+1:]...)
+		t.dropPK(spec.OldColumnName.Name.O)
+	case ast.AlterTableModifyColumn:
+		return t.changeColumn(spec.NewColumns[0].Name.Name.O, spec.NewColumns[0], spec.Position)
+	case ast.AlterTableChangeColumn:
+		return t.changeColumn(spec.OldColumnName.Name.O, spec.NewColumns[0], spec.Position)
+	case ast.AlterTableRenameColumn:
+		i, err := t.findColumn(spec.OldColumnName.Name.O)
+		if err != nil {
+			return err
+		}
+		t.renameColumn(i, spec.NewColumnName.Name.O)
+	case ast.AlterTableAddConstraint:
+		t.addConstraint(spec.Constraint)
+	case ast.AlterTableDropPrimaryKey:
+		t.pk = nil
+	case ast.AlterTableRenameTable:
+		t.rename = spec.NewTable
+	}
+
+	// indexes, options, defaults and partitions do not change the columns of the rows
+	return nil
+}
+
+func (t *trackedTable) addColumn(def *ast.ColumnDef, position *ast.ColumnPosition) error {
+	c := newTableColumn(def)
+
+	i := len(t.table.Columns)
+	if position != nil {
+		switch position.Tp {
+		case ast.ColumnPositionFirst:
+			i = 0
+		case ast.ColumnPositionAfter:
+			after, err := t.findColumn(position.RelativeColumn.Name.O)
+			if err != nil {
+				return err
+			}
+			i = after + 1
+		}
+	}
+
+	t.table.Columns = append(t.table.Columns[:i], append([]schema.TableColumn{c}, t.table.Columns[i:]...)...)
+	for _, o := range def.Options {
+		if o.Tp == ast.ColumnOptionPrimaryKey {
+			t.pk = []string{c.Name}
+		}
+	}
+
+	return nil
+}
+
+// changeColumn replaces a column, moving it when the position is given.
+func (t *trackedTable) changeColumn(name string, def *ast.ColumnDef, position *ast.ColumnPosition) error {
+	i, err := t.findColumn(name)
+	if err != nil {
+		return err
+	}
+
+	if position == nil || position.Tp == ast.ColumnPositionNone {
+		c := newTableColumn(def)
+		t.renameColumn(i, c.Name)
+		t.table.Columns[i] = c
+
+		return nil
+	}
+
+	t.table.Columns = append(t.table.Columns[:i], t.table.Columns[i+1:]...)
+	isPK := t.dropPK(name)
+	if err := t.addColumn(def, position); err != nil {
+		return err
+	}
+	if isPK {
+		t.pk = append(t.pk, def.Name.Name.O)
+	}
+
+	return nil
+}
+
+func (t *trackedTable) renameColumn(i int, name string) {
+	for j, pk := range t.pk {
+		if strings.EqualFold(pk, t.table.Columns[i].Name) {
+			t.pk[j] = name
+		}
+	}
+	t.table.Columns[i].Name = name
+}
+
+func (t *trackedTable) addConstraint(c *ast.Constraint) {
+	if c.Tp != ast.ConstraintPrimaryKey {
+		return
+	}
+
+	t.pk = nil
+	for _, k := range c.Keys {
+		if k.Column != nil {
+			t.pk = append(t.pk, k.Column.Name.O)
+		}
+	}
+}
+
+// dropPK removes the column from the primary key, reporting whether it was part of it.
+func (t *trackedTable) dropPK(name string) bool {
+	for i, pk := range t.pk {
+		if strings.EqualFold(pk, name) {
+			t.pk = append(t.pk[:i], t.pk[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *trackedTable) findColumn(name string) (int, error) {
+	for i, c := range t.table.Columns {
+		if strings.EqualFold(c.Name, name) {
+			return i, nil
+		}
+	}
+
+	return -1, fmt.Errorf("unknown column %s", name)
+}
+
+// build returns the tracked schema, with the indexes of the primary key columns.
+func (t *trackedTable) build() *schema.Table {
+	t.table.PKColumns = nil
+	for _, pk := range t.pk {
+		if i, err := t.findColumn(pk); err == nil {
+			t.table.PKColumns = append(t.table.PKColumns, i)
+		}
+	}
+
+	return t.table
+}
+
+// newTableColumn returns the column of a definition, typed from its type as reported by information_schema, as
+// canal types the columns it loads.
+func newTableColumn(def *ast.ColumnDef) schema.TableColumn {
+	t := &schema.Table{}
+	t.AddColumn(def.Name.Name.O, def.Tp.InfoSchemaStr(), "", "")
+
+	return t.Columns[0]
+}
@@ -0,0 +1,364 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/client"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSnapshotBatchSize = 1000
+	// snapshotBeginAttempts is the number of times the snapshot transaction is started to match the binlog position.
+	snapshotBeginAttempts = 3
+)
+
+type SnapshotMode string
+
+const (
+	// SnapshotNever starts streaming from the stored position, or from the binlog head when there is none.
+	SnapshotNever SnapshotMode = "never"
+	// SnapshotInitial publishes the rows already in the outbox tables when there is no stored position.
+	SnapshotInitial SnapshotMode = "initial"
+	// SnapshotAlways publishes the rows already in the outbox tables on every start, ignoring the stored position.
+	SnapshotAlways SnapshotMode = "always"
+)
+
+func ParseSnapshotMode(s string) (SnapshotMode, error) {
+	switch m := SnapshotMode(s); m {
+	case "":
+		return SnapshotNever, nil
+	case SnapshotNever, SnapshotInitial, SnapshotAlways:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown snapshot mode: %s", s)
+	}
+}
+
+// Snapshot defines whether the Runner publishes the rows already in the outbox tables before streaming the binlog.
+// The rows are read in primary key order with a consistent read, the streaming starts from the binlog position of
+// its snapshot. When transactions keep committing while the read starts, the position may precede the snapshot and
+// the rows committed between the two are published twice.
+type Snapshot struct {
+	Mode SnapshotMode
+	// Tables are the tables to read, as schema.table. They default to the outbox tables of the EventHandler.
+	Tables []string
+	// BatchSize is the number of rows read by each query, 1000 by default.
+	BatchSize int
+	// Connect opens the connection the rows are read with, closed once they are read.
+	Connect func() (SnapshotConn, error)
+}
+
+func (s Snapshot) required(lastPosition Position) bool {
+	switch s.Mode {
+	case SnapshotAlways:
+		return true
+	case SnapshotInitial:
+		return lastPosition.File == "" && !lastPosition.HasGTIDSet()
+	default:
+		return false
+	}
+}
+
+// SnapshotConn is the connection a snapshot reads the rows with, as client.Conn is. It must not reconnect, so that
+// a dropped connection fails the snapshot instead of reading the remaining rows out of its transaction.
+type SnapshotConn interface {
+	Execute(command string, args ...interface{}) (*mysql.Result, error)
+	Close() error
+}
+
+var _ SnapshotConn = (*client.Conn)(nil)
+
+// runSnapshot dispatches the rows of the outbox tables, then persists the position of their snapshot and returns it.
+func (r *Runner) runSnapshot(ctx context.Context, leaseLost <-chan struct{}) (Position, error) {
+	tg, ok := r.canal.(TableGetter)
+	if !ok {
+		return Position{}, errors.New("snapshot requires a canal able to get the schema of the tables")
+	}
+	if r.snapshot.Connect == nil {
+		return Position{}, errors.New("snapshot requires a connection")
+	}
+
+	tables := r.snapshot.Tables
+	if len(tables) == 0 {
+		for _, t := range r.handler.outboxTables {
+			tables = append(tables, t.Ref())
+		}
+	}
+	if len(tables) == 0 {
+		return Position{}, errors.New("snapshot requires the tables to read")
+	}
+
+	conn, err := r.snapshot.Connect()
+	if err != nil {
+		return Position{}, fmt.Errorf("connecting for the snapshot: %w", err)
+	}
+	defer conn.Close()
+
+	batchSize := defaultSnapshotBatchSize
+	if r.snapshot.BatchSize > 0 {
+		batchSize = r.snapshot.BatchSize
+	}
+
+	sr := &snapshotReader{
+		conn:        conn,
+		tableGetter: tg,
+		gtidMode:    r.gtidMode,
+		batchSize:   batchSize,
+		timestamp:   uint32(time.Now().Unix()),
+	}
+	p, err := sr.begin()
+	if err != nil {
+		return Position{}, err
+	}
+	logrus.WithField("position", p).
+		WithField("tables", tables).
+		Info("starting snapshot")
+
+	err = sr.read(ctx, tables, func(e RowsEvent) error {
+		select {
+		case <-leaseLost:
+			return ErrLeadershipLost
+		default:
+		}
+
+		return r.handler.OnRows(e)
+	})
+	if err == nil {
+		err = r.handler.OnPosition(p)
+	}
+	r.checkpointer.wait()
+	if err != nil {
+		return Position{}, err
+	}
+
+	checkpoint, dispatched, err := r.checkpointer.lastDispatched()
+	if err != nil {
+		return Position{}, err
+	}
+
+	err = r.setLastPosition(checkpoint, dispatched)
+	if err != nil {
+		return Position{}, err
+	}
+	logrus.WithField("position", checkpoint).
+		Info("snapshot completed")
+
+	return checkpoint, nil
+}
+
+type snapshotReader struct {
+	conn        SnapshotConn
+	tableGetter TableGetter
+	gtidMode    bool
+	batchSize   int
+	// timestamp is the time of the snapshot, used as the timestamp of the events.
+	timestamp uint32
+}
+
+// begin starts the consistent-read transaction and returns the binlog position of its snapshot.
+// The position is read before and right after starting the transaction, which is started again until both match,
+// so that no transaction committed in between. After the last attempt the position before is returned.
+func (s *snapshotReader) begin() (Position, error) {
+	for attempt := 1; ; attempt++ {
+		before, err := s.position()
+		if err != nil {
+			return Position{}, err
+		}
+
+		_, err = s.conn.Execute("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ")
+		if err != nil {
+			return Position{}, err
+		}
+
+		_, err = s.conn.Execute("START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY")
+		if err != nil {
+			return Position{}, err
+		}
+
+		after, err := s.position()
+		if err != nil {
+			return Position{}, err
+		}
+		if after == before {
+			return after, nil
+		}
+
+		if attempt == snapshotBeginAttempts {
+			logrus.WithField("position", before).
+				Warn("transactions committed while starting the snapshot, their rows may be published twice")
+			return before, nil
+		}
+
+		_, err = s.conn.Execute("ROLLBACK")
+		if err != nil {
+			return Position{}, err
+		}
+	}
+}
+
+// position returns the current position of the binlog, with the executed GTID set in GTID mode.
+func (s *snapshotReader) position() (Position, error) {
+	rr, err := s.conn.Execute("SHOW MASTER STATUS")
+	if err != nil {
+		return Position{}, err
+	}
+	if rr.Resultset == nil || rr.RowNumber() == 0 {
+		return Position{}, errors.New("binary log is disabled")
+	}
+
+	name, err := rr.GetString(0, 0)
+	if err != nil {
+		return Position{}, err
+	}
+	pos, err := rr.GetUint(0, 1)
+	if err != nil {
+		return Position{}, err
+	}
+	p := mysql.Position{Name: name, Pos: uint32(pos)}
+	if !s.gtidMode {
+		return newBinlogPosition(p, nil), nil
+	}
+
+	// MariaDB does not report the GTID set with the binlog position
+	if _, ok := rr.FieldNames["Executed_Gtid_Set"]; ok {
+		gtidSet, err := rr.GetStringByName(0, "Executed_Gtid_Set")
+		if err != nil {
+			return Position{}, err
+		}
+		gs, err := mysql.ParseGTIDSet(mysql.MySQLFlavor, gtidSet)
+		if err != nil {
+			return Position{}, err
+		}
+
+		return newBinlogPosition(p, gs), nil
+	}
+
+	rr, err = s.conn.Execute("SELECT @@GLOBAL.gtid_binlog_pos")
+	if err != nil {
+		return Position{}, err
+	}
+	gtidSet, err := rr.GetString(0, 0)
+	if err != nil {
+		return Position{}, err
+	}
+	gs, err := mysql.ParseGTIDSet(mysql.MariaDBFlavor, gtidSet)
+	if err != nil {
+		return Position{}, err
+	}
+
+	return newBinlogPosition(p, gs), nil
+}
+
+// read reads the tables in the transaction started by begin, calling fn with each batch of rows.
+func (s *snapshotReader) read(ctx context.Context, tables []string, fn func(e RowsEvent) error) error {
+	for _, ref := range tables {
+		err := s.readTable(ctx, ref, fn)
+		if err != nil {
+			_, _ = s.conn.Execute("ROLLBACK")
+			return err
+		}
+	}
+
+	_, err := s.conn.Execute("COMMIT")
+
+	return err
+}
+
+func (s *snapshotReader) readTable(ctx context.Context, ref string, fn func(e RowsEvent) error) error {
+	schemaName, tableName, ok := strings.Cut(ref, ".")
+	if !ok {
+		return fmt.Errorf("invalid table reference, schema.table expected: %s", ref)
+	}
+
+	st, err := s.tableGetter.GetTable(schemaName, tableName)
+	if err != nil {
+		return err
+	}
+	t := newTable(st)
+
+	if len(t.PKColumns) == 0 {
+		return fmt.Errorf("snapshot requires a primary key. Table: %s", ref)
+	}
+
+	var after []interface{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		query, args := selectBatchQuery(t, after, s.batchSize)
+		rr, err := s.conn.Execute(query, args...)
+		if err != nil {
+			return err
+		}
+
+		if rr.Resultset == nil || rr.RowNumber() == 0 {
+			return nil
+		}
+
+		rows := make([][]interface{}, 0, rr.RowNumber())
+		for i := range rr.Values {
+			row := make([]interface{}, 0, len(rr.Values[i]))
+			for j := range rr.Values[i] {
+				row = append(row, rr.Values[i][j].Value())
+			}
+			rows = append(rows, row)
+		}
+
+		err = fn(RowsEvent{
+			Table:     t,
+			Action:    InsertAction,
+			Rows:      rows,
+			Timestamp: s.timestamp,
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(rows) < s.batchSize {
+			return nil
+		}
+
+		last := rows[len(rows)-1]
+		after = make([]interface{}, 0, len(t.PKColumns))
+		for _, i := range t.PKColumns {
+			after = append(after, last[i])
+		}
+	}
+}
+
+// selectBatchQuery returns the query selecting the rows following after, in primary key order.
+// The batch size is an argument too, so that every batch is read with a prepared statement and its values have the
+// types of the binary protocol.
+func selectBatchQuery(t *Table, after []interface{}, batchSize int) (string, []interface{}) {
+	columns := make([]string, 0, len(t.Columns))
+	for _, c := range t.Columns {
+		columns = append(columns, quoteIdentifier(c.Name))
+	}
+
+	pk := make([]string, 0, len(t.PKColumns))
+	for i := range t.PKColumns {
+		pk = append(pk, quoteIdentifier(t.PKColumn(i).Name))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "SELECT %s FROM %s.%s",
+		strings.Join(columns, ", "), quoteIdentifier(t.Schema), quoteIdentifier(t.Name))
+	if after != nil {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(after)), ", ")
+		fmt.Fprintf(&b, " WHERE (%s) > (%s)", strings.Join(pk, ", "), placeholders)
+	}
+	fmt.Fprintf(&b, " ORDER BY %s LIMIT ?", strings.Join(pk, ", "))
+
+	return b.String(), append(after, batchSize)
+}
+
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
@@ -0,0 +1,152 @@
+package run
+
+import "fmt"
+
+// Source streams the row changes of the outbox tables to a SourceHandler.
+// The MySQL binlog read by a Canal is the default Source, the other databases are supported by the Sources of the
+// adapters, e.g. PostgreSQL logical replication.
+type Source interface {
+	// Start streams the changes following the position to the handler until Close is called, when it returns nil.
+	// With the zero Position, it starts from the position of the database.
+	Start(from Position, handler SourceHandler) error
+	Close()
+}
+
+// CheckpointedSource is a Source notified of the persisted checkpoints, e.g. to let the database discard the
+// changes before them.
+type CheckpointedSource interface {
+	Source
+	Checkpointed(p Position) error
+}
+
+// SourceHandler handles the changes streamed by a Source, as EventHandler does.
+type SourceHandler interface {
+	// OnRows is called with the rows changed by a statement.
+	OnRows(e RowsEvent) error
+	// OnPosition is called with the position following every transaction.
+	OnPosition(p Position) error
+}
+
+// Position is a point of the stream of a Source.
+// For the MySQL binlog, GTIDSet is empty unless the server has GTIDs enabled, and when present it takes precedence
+// over the binlog file and offset.
+type Position struct {
+	// File and Offset locate the position in the MySQL binlog.
+	File   string
+	Offset uint32
+	// GTIDSet is the set of the GTIDs executed by a MySQL server, in the format of its GTIDFlavor: mysql or mariadb.
+	GTIDSet    string
+	GTIDFlavor string
+	// LSN is the log sequence number of a PostgreSQL source, zero for the MySQL binlog.
+	LSN uint64
+}
+
+func (p Position) HasGTIDSet() bool {
+	return p.GTIDSet != ""
+}
+
+// IsZero reports whether p is the zero Position, i.e. the position of the database.
+func (p Position) IsZero() bool {
+	return p == Position{}
+}
+
+// Before reports whether p precedes q in the stream of the same Source.
+func (p Position) Before(q Position) bool {
+	if p.LSN != 0 || q.LSN != 0 {
+		return p.LSN < q.LSN
+	}
+
+	return binlogBefore(p, q)
+}
+
+func (p Position) String() string {
+	switch {
+	case p.LSN != 0:
+		return fmt.Sprintf("%X/%X", uint32(p.LSN>>32), uint32(p.LSN))
+	case p.HasGTIDSet():
+		return fmt.Sprintf("(%s, %d, %s)", p.File, p.Offset, p.GTIDSet)
+	default:
+		return fmt.Sprintf("(%s, %d)", p.File, p.Offset)
+	}
+}
+
+// The actions of a RowsEvent.
+const (
+	InsertAction = "insert"
+	UpdateAction = "update"
+	DeleteAction = "delete"
+)
+
+// RowsEvent is a change of rows of a table streamed by a Source.
+type RowsEvent struct {
+	// Table describes the columns of the rows, with the ColumnType closest to the types of the database.
+	Table *Table
+	// Action is InsertAction, UpdateAction or DeleteAction.
+	// The rows of updates are pairs of values before and after the update.
+	Action string
+	Rows   [][]interface{}
+	// Timestamp is the commit time of the transaction, in seconds.
+	Timestamp uint32
+	// Position is the position of the end of the change, the zero Position for the rows read by a snapshot.
+	Position Position
+	// GTID is the GTID of the transaction, empty unless the source is a MySQL server with GTIDs enabled.
+	GTID     string
+	ServerID uint32
+}
+
+// Table is the schema of a table streamed by a Source.
+type Table struct {
+	Schema  string
+	Name    string
+	Columns []TableColumn
+	// PKColumns are the indexes in Columns of the primary key columns.
+	PKColumns []int
+}
+
+// FindColumn returns the index of the column with the given name, -1 when missing.
+func (t *Table) FindColumn(name string) int {
+	for i, c := range t.Columns {
+		if c.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// PKColumn returns the i-th column of the primary key.
+func (t *Table) PKColumn(i int) *TableColumn {
+	return &t.Columns[t.PKColumns[i]]
+}
+
+type TableColumn struct {
+	Name string
+	Type ColumnType
+	// RawType is the definition of the type in the database, e.g. decimal(10,2) unsigned.
+	RawType    string
+	IsUnsigned bool
+	EnumValues []string
+	SetValues  []string
+}
+
+// ColumnType is the type of a column, the types of the databases are mapped to the closest one.
+// The values are the ones of the go-mysql schema.TYPE_* constants.
+type ColumnType int
+
+const (
+	TypeNumber ColumnType = iota + 1
+	TypeFloat
+	TypeEnum
+	TypeSet
+	TypeString
+	TypeDatetime
+	TypeTimestamp
+	TypeDate
+	TypeTime
+	TypeBit
+	TypeJSON
+	TypeDecimal
+	TypeMediumInt
+	TypeBinary
+	TypePoint
+)
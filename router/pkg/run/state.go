@@ -0,0 +1,99 @@
+package run
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// StateHandler persists the last checkpoint, it does not need to know the Source it comes from.
+// GetLastCheckpoint returns an empty Checkpoint when none was set.
+type StateHandler interface {
+	GetLastCheckpoint() (Checkpoint, error)
+	SetLastCheckpoint(checkpoint Checkpoint) error
+}
+
+// Checkpoint is the opaque encoding of a Position persisted by a StateHandler: a version byte followed by the
+// data of the version. An empty Checkpoint is the zero Position.
+type Checkpoint []byte
+
+// CheckpointV1 is the version encoding the Position as a JSON object with the name, pos, gtid_set, gtid_flavor
+// and lsn fields. It is the format of the JSON MySQL positions stored before checkpoints were versioned.
+const CheckpointV1 byte = 1
+
+var ErrUnknownCheckpointVersion = errors.New("unknown checkpoint version")
+
+// NewCheckpoint returns the Checkpoint of the given version with the given data.
+func NewCheckpoint(version byte, data []byte) Checkpoint {
+	c := make(Checkpoint, 0, len(data)+1)
+	c = append(c, version)
+
+	return append(c, data...)
+}
+
+// Version returns the version of the Checkpoint, zero when it is empty.
+func (c Checkpoint) Version() byte {
+	if len(c) == 0 {
+		return 0
+	}
+
+	return c[0]
+}
+
+// Data returns the data of the Checkpoint, without its version.
+func (c Checkpoint) Data() []byte {
+	if len(c) == 0 {
+		return nil
+	}
+
+	return c[1:]
+}
+
+type checkpointV1 struct {
+	Name       string `json:"name,omitempty"`
+	Pos        uint32 `json:"pos,omitempty"`
+	GTIDSet    string `json:"gtid_set,omitempty"`
+	GTIDFlavor string `json:"gtid_flavor,omitempty"`
+	LSN        uint64 `json:"lsn,omitempty"`
+}
+
+// EncodeCheckpoint encodes the Position with the latest version.
+func EncodeCheckpoint(p Position) (Checkpoint, error) {
+	data, err := json.Marshal(checkpointV1{
+		Name:       p.File,
+		Pos:        p.Offset,
+		GTIDSet:    p.GTIDSet,
+		GTIDFlavor: p.GTIDFlavor,
+		LSN:        p.LSN,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCheckpoint(CheckpointV1, data), nil
+}
+
+// DecodeCheckpoint decodes the Position of a Checkpoint of any known version.
+func DecodeCheckpoint(c Checkpoint) (Position, error) {
+	if len(c) == 0 {
+		return Position{}, nil
+	}
+
+	if c.Version() != CheckpointV1 {
+		return Position{}, fmt.Errorf("%w: %d", ErrUnknownCheckpointVersion, c.Version())
+	}
+
+	var cp checkpointV1
+	err := json.Unmarshal(c.Data(), &cp)
+	if err != nil {
+		return Position{}, fmt.Errorf("invalid checkpoint: %w", err)
+	}
+
+	return Position{
+		File:       cp.Name,
+		Offset:     cp.Pos,
+		GTIDSet:    cp.GTIDSet,
+		GTIDFlavor: cp.GTIDFlavor,
+		LSN:        cp.LSN,
+	}, nil
+}
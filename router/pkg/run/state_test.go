@@ -0,0 +1,78 @@
+package run_test
+
+import (
+	"testing"
+
+	"github.com/lorenzoranucci/tor/router/pkg/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint_EncodeDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		position run.Position
+		wantData string
+	}{
+		{
+			name:     "when position is zero then data is an empty object",
+			wantData: `{}`,
+		},
+		{
+			name:     "when position is a binlog position then it is encoded",
+			position: run.Position{File: "mysql-bin.000001", Offset: 4},
+			wantData: `{"name":"mysql-bin.000001","pos":4}`,
+		},
+		{
+			name: "when position has a MySQL GTID set then it is encoded with its flavor",
+			position: run.Position{
+				File:       "mysql-bin.000001",
+				Offset:     4,
+				GTIDSet:    "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5",
+				GTIDFlavor: "mysql",
+			},
+			wantData: `{"name":"mysql-bin.000001","pos":4,` +
+				`"gtid_set":"3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5","gtid_flavor":"mysql"}`,
+		},
+		{
+			name:     "when position has a MariaDB GTID set then it is encoded with its flavor",
+			position: run.Position{GTIDSet: "0-1-100", GTIDFlavor: "mariadb"},
+			wantData: `{"gtid_set":"0-1-100","gtid_flavor":"mariadb"}`,
+		},
+		{
+			name:     "when position is an LSN then it is encoded",
+			position: run.Position{LSN: 97628473416},
+			wantData: `{"lsn":97628473416}`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := run.EncodeCheckpoint(tt.position)
+			require.NoError(t, err)
+			assert.Equal(t, run.CheckpointV1, c.Version())
+			assert.JSONEq(t, tt.wantData, string(c.Data()))
+
+			p, err := run.DecodeCheckpoint(c)
+			require.NoError(t, err)
+			assert.Equal(t, tt.position, p)
+		})
+	}
+}
+
+func TestDecodeCheckpoint(t *testing.T) {
+	p, err := run.DecodeCheckpoint(nil)
+	require.NoError(t, err)
+	assert.Equal(t, run.Position{}, p)
+
+	// the JSON MySQL positions stored before checkpoints were versioned are the data of version 1
+	p, err = run.DecodeCheckpoint(run.NewCheckpoint(run.CheckpointV1, []byte(`{"name":"mysql-bin.000002","pos":120}`)))
+	require.NoError(t, err)
+	assert.Equal(t, run.Position{File: "mysql-bin.000002", Offset: 120}, p)
+
+	_, err = run.DecodeCheckpoint(run.NewCheckpoint(2, []byte(`{}`)))
+	assert.ErrorIs(t, err, run.ErrUnknownCheckpointVersion)
+
+	_, err = run.DecodeCheckpoint(run.NewCheckpoint(run.CheckpointV1, []byte(`{`)))
+	assert.Error(t, err)
+}
@@ -0,0 +1,106 @@
+package run
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/lorenzoranucci/tor/router/pkg/run"
+
+// Tracing configures the spans created by the EventHandler for the map and dispatch stages of every row.
+// The zero value uses the global TracerProvider and starts a new trace for every row.
+type Tracing struct {
+	TracerProvider trace.TracerProvider
+	// TraceParentColumnName, when set, is the outbox column holding the W3C traceparent of the trace to continue.
+	TraceParentColumnName string
+	// TraceStateColumnName, when set, is the outbox column holding the W3C tracestate of the trace to continue.
+	TraceStateColumnName string
+}
+
+type tracer struct {
+	trace.Tracer
+	traceParentColumnName string
+	traceStateColumnName  string
+}
+
+func newTracer(t Tracing) *tracer {
+	tp := t.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+
+	return &tracer{
+		Tracer:                tp.Tracer(tracerName),
+		traceParentColumnName: t.TraceParentColumnName,
+		traceStateColumnName:  t.TraceStateColumnName,
+	}
+}
+
+// extract returns a context holding the trace context read from the row, if any.
+func (t *tracer) extract(e *RowsEvent, row []interface{}) context.Context {
+	ctx := context.Background()
+	if t.traceParentColumnName == "" {
+		return ctx
+	}
+
+	carrier := propagation.MapCarrier{}
+	if v := rowValue(e, row, t.traceParentColumnName); v != nil {
+		carrier.Set("traceparent", string(v))
+	}
+	if t.traceStateColumnName != "" {
+		if v := rowValue(e, row, t.traceStateColumnName); v != nil {
+			carrier.Set("tracestate", string(v))
+		}
+	}
+
+	return propagation.TraceContext{}.Extract(ctx, carrier)
+}
+
+func (t *tracer) startMap(ctx context.Context, e *RowsEvent) (context.Context, trace.Span) {
+	return t.Start(
+		ctx,
+		"tor.map",
+		trace.WithAttributes(
+			attribute.String("db.name", e.Table.Schema),
+			attribute.String("db.sql.table", e.Table.Name),
+		),
+	)
+}
+
+func (t *tracer) startDispatch(ctx context.Context, oe OutboxEvent) (context.Context, trace.Span) {
+	return t.Start(
+		ctx,
+		"tor.dispatch",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("tor.aggregate_type", string(oe.AggregateType)),
+			attribute.String("tor.aggregate_id", string(oe.AggregateID)),
+		),
+	)
+}
+
+// endSpan ends the span, recording the error when not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func rowValue(e *RowsEvent, row []interface{}, columnName string) []byte {
+	for i, c := range e.Table.Columns {
+		if c.Name != columnName || i >= len(row) {
+			continue
+		}
+
+		return columnValue(c, row[i])
+	}
+
+	return nil
+}